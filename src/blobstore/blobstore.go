@@ -0,0 +1,102 @@
+// Package blobstore keeps payloads in a local directory, each in a file named by the SHA-256 of its content.
+package blobstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var refRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Store is a content-addressed blob directory, equal payloads are stored once.
+type Store struct {
+	dir string
+}
+
+// New returns the store kept in dir, creating the directory if needed.
+func New(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Ref returns the reference of a payload, the hex SHA-256 of its content.
+func Ref(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// Put stores a payload and returns its reference.
+// The file is written to a temporary name and renamed, so a blob is never seen half written.
+func (s *Store) Put(data string) (string, error) {
+	ref := Ref(data)
+	path := filepath.Join(s.dir, ref)
+	if _, err := os.Stat(path); err == nil {
+		return ref, nil
+	}
+
+	f, err := os.CreateTemp(s.dir, ref+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return ref, nil
+}
+
+// Get returns the payload stored under a reference.
+func (s *Store) Get(ref string) (string, error) {
+	if !refRegex.MatchString(ref) {
+		return "", fmt.Errorf("invalid blob reference %q", ref)
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, ref))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Delete removes the payload stored under a reference, a missing blob is not an error.
+func (s *Store) Delete(ref string) error {
+	if !refRegex.MatchString(ref) {
+		return fmt.Errorf("invalid blob reference %q", ref)
+	}
+	err := os.Remove(filepath.Join(s.dir, ref))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Refs returns the references of the stored payloads.
+func (s *Store) Refs() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var refs []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && refRegex.MatchString(entry.Name()) {
+			refs = append(refs, entry.Name())
+		}
+	}
+	return refs, nil
+}
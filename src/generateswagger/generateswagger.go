@@ -47,9 +47,17 @@ func main() {
 
 	comments := getComments(serverDefinition)
 
+	paths := swagger["paths"].(map[string]any)
 	for _, comment := range comments {
 		path, pathItem := parseComment(comment)
-		swagger["paths"].(map[string]any)[path] = pathItem
+		// several handlers may document different methods of the same path
+		if existing, ok := paths[path].(map[string]any); ok {
+			for method, operation := range pathItem {
+				existing[method] = operation
+			}
+		} else {
+			paths[path] = pathItem
+		}
 	}
 
 	swaggerBytes, err := json.MarshalIndent(swagger, "", "  ")
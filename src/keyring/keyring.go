@@ -0,0 +1,115 @@
+// Package keyring encrypts payloads at rest with AES-GCM under keys identified by key ids.
+package keyring
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrUnknownKey is returned when decrypting a payload encrypted with a key missing from the keyring.
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// Keyring holds the keys payloads are encrypted with.
+// The current key encrypts new payloads, the other keys only decrypt payloads encrypted before a rotation.
+type Keyring struct {
+	keys    map[string]cipher.AEAD
+	current string
+}
+
+// Load reads a key file, see Parse.
+func Load(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(string(data))
+}
+
+// Parse reads keys, one per line as a key id and a base64 encoded AES key of 16, 24 or 32 bytes
+// separated by white space. Empty lines and lines starting with # are skipped.
+// The last key is the current key: rotate keys by appending a new key and keep the old keys
+// as long as payloads encrypted with them may be left.
+func Parse(data string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a key id and a key", line)
+		}
+		id, encoded := fields[0], fields[1]
+		if _, ok := k.keys[id]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key id %q", line, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid key: %w", line, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		k.keys[id] = aead
+		k.current = id
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if k.current == "" {
+		return nil, errors.New("no keys found")
+	}
+	return k, nil
+}
+
+// Current returns the id of the key new payloads are encrypted with.
+func (k *Keyring) Current() string {
+	return k.current
+}
+
+// Encrypt encrypts a payload with the current key, returning the base64 encoded nonce and ciphertext
+// and the id of the key. The key id is authenticated with the payload.
+func (k *Keyring) Encrypt(plaintext string) (string, string, error) {
+	aead := k.keys[k.current]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(k.current))
+	return base64.StdEncoding.EncodeToString(sealed), k.current, nil
+}
+
+// Decrypt decrypts a payload encrypted by Encrypt with the key with the given id.
+func (k *Keyring) Decrypt(ciphertext, keyId string) (string, error) {
+	aead, ok := k.keys[keyId]
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownKey, keyId)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted payload too short")
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, []byte(keyId))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
@@ -11,6 +11,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/jnsoft/jnq/src/keyring"
 	"github.com/jnsoft/jnq/src/mempqueue"
 	"github.com/jnsoft/jnq/src/priorityqueue"
 	"github.com/jnsoft/jnq/src/server"
@@ -20,6 +21,8 @@ import (
 const (
 	MAX_PARALLELISM             = 10
 	RESERVATION_TIMEOUT_SECONDS = 30
+	HEARTBEAT_TIMEOUT_SECONDS   = 15
+	BLOB_THRESHOLD_BYTES        = 64 * 1024
 )
 
 func main() {
@@ -31,6 +34,11 @@ func main() {
 	verbose := flag.Bool("v", false, "Enable verbose logging")
 	port := flag.Int("p", 8080, "Port of the server")
 	apiKey := flag.String("key", "", "API key for authentication")
+	retention := flag.Duration("retention", priorityqueue.DEFAULT_STATUS_RETENTION, "How long the status of completed and deleted items is kept")
+	heartbeatTimeout := flag.Duration("heartbeat", HEARTBEAT_TIMEOUT_SECONDS*time.Second, "How long a registered consumer may miss heartbeats before its reservations are requeued")
+	blobDir := flag.String("blobs", "", "Directory payloads of the in-memory queue above -blob-threshold bytes are offloaded to")
+	blobThreshold := flag.Int("blob-threshold", BLOB_THRESHOLD_BYTES, "Size in bytes above which payloads are offloaded to the -blobs directory")
+	keyFile := flag.String("keys", "", "Key file of the channels encrypting payloads at rest, one key id and base64 AES key per line, the last key encrypts")
 	flag.Parse()
 
 	log.SetFlags(0)
@@ -44,12 +52,22 @@ func main() {
 		log.Fatal("API key is required (use -key or set API_KEY environment variable)")
 	}
 
+	var keys *keyring.Keyring
+	if *keyFile != "" {
+		var err error
+		if keys, err = keyring.Load(*keyFile); err != nil {
+			log.Fatalf("Cannot load key file %s: %v", *keyFile, err)
+		}
+		log.Printf("Encrypting payloads with key %s\n", keys.Current())
+	}
+
 	var pq priorityqueue.IPriorityQueue
 
 	if mem_queue {
+		var mpq *mempqueue.MemPQueue
 		if *persistantFile == "" {
 			log.Println("Using in-memory queue without persistence")
-			pq = mempqueue.NewMemPQueue(true)
+			mpq = mempqueue.NewMemPQueue(true)
 		} else {
 			walPath := *persistantFile + ".wal"
 			savPath := *persistantFile + ".sav"
@@ -67,14 +85,26 @@ func main() {
 			}
 			sav.Close()
 
-			pq = mempqueue.NewMemPQueuePersistent(true, *persistantFile+".sav", *persistantFile+".wal")
+			mpq = mempqueue.NewMemPQueuePersistent(true, *persistantFile+".sav", *persistantFile+".wal")
 		}
+		mpq.SetStatusRetention(*retention)
+		mpq.SetKeyring(keys)
+		if *blobDir != "" {
+			log.Printf("Offloading payloads above %d bytes to %s\n", *blobThreshold, *blobDir)
+			if err := mpq.SetBlobStore(*blobDir, *blobThreshold); err != nil {
+				log.Fatalf("Cannot use blob directory %s: %v", *blobDir, err)
+			}
+		}
+		pq = mpq
 	} else {
 		if dbFile == nil || *dbFile == "" {
 			log.Fatal("Database file is required (use -db)")
 		}
 		log.Printf("Using SQLite queue with database file: %s and table name: %s\n", *dbFile, *tableName)
-		pq = sqlpqueue.NewSqLitePQueue(*dbFile, *tableName, true)
+		spq := sqlpqueue.NewSqLitePQueue(*dbFile, *tableName, true)
+		spq.SetStatusRetention(*retention)
+		spq.SetKeyring(keys)
+		pq = spq
 	}
 
 	// Set up server
@@ -94,6 +124,9 @@ func main() {
 
 	reservationTimeout := RESERVATION_TIMEOUT_SECONDS * time.Second
 	srv.StartRequeueTask(reservationTimeout)
+	if *heartbeatTimeout > 0 {
+		srv.StartConsumerTask(*heartbeatTimeout)
+	}
 
 	// Wait for SIGINT or SIGTERM
 	sigChan := make(chan os.Signal, 1)
@@ -7,12 +7,14 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/jnsoft/jnq/src/httphelper"
 	"github.com/jnsoft/jnq/src/mempqueue"
+	"github.com/jnsoft/jnq/src/priorityqueue"
 	"github.com/jnsoft/jnq/src/server"
 	"github.com/jnsoft/jnq/src/sqlpqueue"
 	. "github.com/jnsoft/jnq/src/testhelper"
@@ -168,6 +170,295 @@ func TestJnqEndToEnd(t *testing.T) {
 		AssertNoError(t, err)
 	})
 
+	t.Run("End to end test results", func(t *testing.T) {
+
+		pq := mempqueue.NewMemPQueue(true)
+
+		srv := server.NewServer(pq, API_KEY, false)
+		ready := make(chan struct{})
+		go func() {
+			err := srv.Start(":"+strconv.Itoa(PORT+3), ready)
+			if err != nil && err != http.ErrServerClosed {
+				fmt.Printf("Failed to start server: %v\n", err)
+			}
+		}()
+
+		<-ready
+		time.Sleep(1 * time.Second)
+
+		baseURL := fmt.Sprintf("%s:%d", API_BASE_URL, PORT+3)
+		apiKey := [2]string{server.API_KEY_HEADER, API_KEY}
+
+		// Enqueue an item and read its id
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s%s?channel=%d", baseURL, ENQUEUE_ENDPOINT, CHANNEL), strings.NewReader(getItem(1)))
+		AssertNoError(t, err)
+		req.Header.Set(apiKey[0], apiKey[1])
+		resp, err := http.DefaultClient.Do(req)
+		AssertNoError(t, err)
+		resp.Body.Close()
+		AssertEqual(t, resp.StatusCode, http.StatusOK)
+		itemId := resp.Header.Get(server.ITEM_ID_HEADER)
+		AssertNotEqual(t, itemId, "")
+
+		// No result yet
+		_, code, err := httphelper.GetString(fmt.Sprintf("%s/items/%s/result", baseURL, itemId), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusNoContent)
+
+		// Reserve and confirm with a result while a producer waits for it
+		reserved, code, err := httphelper.GetJSON[map[string]any](fmt.Sprintf("%s/reserve?channel=%d", baseURL, CHANNEL), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+
+		go func() {
+			time.Sleep(300 * time.Millisecond)
+			httphelper.PostString(fmt.Sprintf("%s/confirm/%s", baseURL, reserved["reservation_id"]), `{"status":"done"}`, apiKey)
+		}()
+
+		result, code, err := httphelper.GetString(fmt.Sprintf("%s/items/%s/result?wait=5", baseURL, itemId), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		AssertEqual(t, result, `{"status":"done"}`)
+
+		// The item is reported as completed
+		status, code, err := httphelper.GetJSON[server.ItemStatusResponse](fmt.Sprintf("%s/items/%s/status", baseURL, itemId), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		AssertEqual(t, status.Status, "completed")
+		AssertEqual(t, status.Attempts, 1)
+
+		// Errors map to a status code and a JSON body
+		body, code, err := httphelper.PostString(fmt.Sprintf("%s/confirm/%s", baseURL, reserved["reservation_id"]), "", apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusNotFound)
+		var errResp server.ErrorResponse
+		AssertNoError(t, json.Unmarshal([]byte(body), &errResp))
+		AssertEqual(t, errResp.Code, "reservation_not_found")
+
+		// Only the consumer holding a reservation may confirm it
+		req, err = http.NewRequest(http.MethodPost, fmt.Sprintf("%s%s?channel=%d", baseURL, ENQUEUE_ENDPOINT, CHANNEL), strings.NewReader(getItem(2)))
+		AssertNoError(t, err)
+		req.Header.Set(apiKey[0], apiKey[1])
+		resp, err = http.DefaultClient.Do(req)
+		AssertNoError(t, err)
+		resp.Body.Close()
+		reserved, code, err = httphelper.GetJSON[map[string]any](fmt.Sprintf("%s/reserve?channel=%d&consumer=worker-1", baseURL, CHANNEL), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		_, code, err = httphelper.PostString(fmt.Sprintf("%s/confirm/%s?consumer=worker-2", baseURL, reserved["reservation_id"]), "", apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusConflict)
+		reservations, code, err := httphelper.GetJSON[map[string][]priorityqueue.Reservation](fmt.Sprintf("%s/reservations", baseURL), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		AssertEqual(t, len(reservations["worker-1"]), 1)
+		_, code, err = httphelper.PostString(fmt.Sprintf("%s/confirm/%s?consumer=worker-1", baseURL, reserved["reservation_id"]), "", apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+
+		// Consumers that miss their heartbeats lose their reservations
+		srv.StartConsumerTask(200 * time.Millisecond)
+		_, code, err = httphelper.PostString(fmt.Sprintf("%s/consumers?consumer=worker-3&channel=%d", baseURL, CHANNEL), "", apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		_, code, err = httphelper.PostString(fmt.Sprintf("%s/heartbeat?consumer=worker-3", baseURL), "", apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		stats, _, err := httphelper.GetJSON[map[int]priorityqueue.ChannelStats](fmt.Sprintf("%s/stats", baseURL), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, stats[CHANNEL].Consumers, 1)
+		req, err = http.NewRequest(http.MethodPost, fmt.Sprintf("%s%s?channel=%d", baseURL, ENQUEUE_ENDPOINT, CHANNEL), strings.NewReader(getItem(3)))
+		AssertNoError(t, err)
+		req.Header.Set(apiKey[0], apiKey[1])
+		resp, err = http.DefaultClient.Do(req)
+		AssertNoError(t, err)
+		resp.Body.Close()
+		_, code, err = httphelper.GetJSON[map[string]any](fmt.Sprintf("%s/reserve?channel=%d&consumer=worker-3", baseURL, CHANNEL), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		time.Sleep(500 * time.Millisecond)
+		consumers, _, err := httphelper.GetJSON[[]server.ConsumerInfo](fmt.Sprintf("%s/consumers", baseURL), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, len(consumers), 0)
+		reservations, _, err = httphelper.GetJSON[map[string][]priorityqueue.Reservation](fmt.Sprintf("%s/reservations", baseURL), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, len(reservations), 0)
+		_, code, err = httphelper.PostString(fmt.Sprintf("%s/heartbeat?consumer=worker-3", baseURL), "", apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusNotFound)
+
+		// Reservations carry a fencing token, a stale token is rejected
+		fenced, _, err := httphelper.GetJSON[map[string]any](fmt.Sprintf("%s/reserve?channel=%d", baseURL, CHANNEL), apiKey)
+		AssertNoError(t, err)
+		token := int64(fenced["token"].(float64))
+		AssertTrue(t, token > 0)
+		_, code, err = httphelper.PostString(fmt.Sprintf("%s/confirm/%s?token=%d", baseURL, fenced["reservation_id"], token-1), "", apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusConflict)
+		_, code, err = httphelper.PostString(fmt.Sprintf("%s/confirm/%s?token=%d", baseURL, fenced["reservation_id"], token), "", apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+
+		// Items can be reserved and confirmed in batches
+		for i := 0; i < 2; i++ {
+			_, code, err = httphelper.PostString(fmt.Sprintf("%s%s?channel=%d", baseURL, ENQUEUE_ENDPOINT, CHANNEL), getItem(i), apiKey)
+			AssertNoError(t, err)
+			AssertEqual(t, code, http.StatusOK)
+		}
+		batch, _, err := httphelper.GetJSON[[]server.ReservedItemResponse](fmt.Sprintf("%s/reserve_batch?channel=%d&n=10", baseURL, CHANNEL), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, len(batch), 2)
+		batchIds := []string{batch[0].ReservationId, batch[1].ReservationId, "unknown"}
+		body, code, err = httphelper.PostJSON(fmt.Sprintf("%s/confirm_batch", baseURL), batchIds, apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		var confirmed []server.ConfirmBatchResult
+		AssertNoError(t, json.Unmarshal([]byte(body), &confirmed))
+		AssertTrue(t, confirmed[0].Confirmed)
+		AssertTrue(t, confirmed[1].Confirmed)
+		AssertFalse(t, confirmed[2].Confirmed)
+		AssertEqual(t, confirmed[2].Code, "reservation_not_found")
+
+		// Ready items are counted by tenant
+		_, code, err = httphelper.PostString(fmt.Sprintf("%s%s?channel=%d&tenant=acme", baseURL, ENQUEUE_ENDPOINT, CHANNEL), getItem(0), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		stats, _, err = httphelper.GetJSON[map[int]priorityqueue.ChannelStats](fmt.Sprintf("%s/stats", baseURL), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, stats[CHANNEL].Tenants["acme"], 1)
+		_, code, err = httphelper.GetString(fmt.Sprintf("%s/dequeue?channel=%d", baseURL, CHANNEL), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+
+		// Routing rules send matching items to another channel
+		routed := CHANNEL + 4
+		_, code, err = httphelper.PostJSON(fmt.Sprintf("%s/routes", baseURL), priorityqueue.RoutingRule{Name: "invoices", Conditions: []string{"$.type=invoice"}, Channel: routed}, apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		rules, _, err := httphelper.GetJSON[[]priorityqueue.RoutingRule](fmt.Sprintf("%s/routes", baseURL), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, len(rules), 1)
+		req, err = http.NewRequest(http.MethodPost, fmt.Sprintf("%s%s?channel=%d", baseURL, ENQUEUE_ENDPOINT, CHANNEL), strings.NewReader(`{"type":"invoice"}`))
+		AssertNoError(t, err)
+		req.Header.Set(apiKey[0], apiKey[1])
+		resp, err = http.DefaultClient.Do(req)
+		AssertNoError(t, err)
+		resp.Body.Close()
+		AssertEqual(t, resp.StatusCode, http.StatusOK)
+		AssertEqual(t, resp.Header.Get(server.ROUTE_HEADER), "invoices")
+		body, code, err = httphelper.GetString(fmt.Sprintf("%s/dequeue?channel=%d", baseURL, routed), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		AssertEqual(t, body, `{"type":"invoice"}`)
+		req, err = http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/routes?name=invoices", baseURL), nil)
+		AssertNoError(t, err)
+		req.Header.Set(apiKey[0], apiKey[1])
+		resp, err = http.DefaultClient.Do(req)
+		AssertNoError(t, err)
+		resp.Body.Close()
+		AssertEqual(t, resp.StatusCode, http.StatusOK)
+
+		// A channel schema rejects non-conforming payloads with the violations
+		validated := CHANNEL + 5
+		body, code, err = httphelper.PostString(fmt.Sprintf("%s/schemas?channel=%d", baseURL, validated), `{"type":"object","required":["id"],"properties":{"id":{"type":"integer","minimum":1}}}`, apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		AssertEqual(t, strings.TrimSpace(body), `{"version":1}`)
+		_, code, err = httphelper.PostString(fmt.Sprintf("%s/schemas?channel=%d", baseURL, validated), `{"type":"object","pattern":"x"}`, apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusBadRequest)
+		body, code, err = httphelper.PostString(fmt.Sprintf("%s%s?channel=%d", baseURL, ENQUEUE_ENDPOINT, validated), `{"id":0}`, apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusBadRequest)
+		var violation server.ErrorResponse
+		AssertNoError(t, json.Unmarshal([]byte(body), &violation))
+		AssertEqual(t, violation.Code, "schema_violation")
+		AssertEqual(t, len(violation.Violations), 1)
+		AssertEqual(t, violation.Violations[0], "$.id: must be at least 1")
+		body, code, err = httphelper.PostString(baseURL+"/tx", fmt.Sprintf(`[{"op":"enqueue","channel":%d,"item":{"id":1}},{"op":"enqueue","channel":%d,"item":{"id":0}}]`, validated, validated), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusBadRequest)
+		violation = server.ErrorResponse{}
+		AssertNoError(t, json.Unmarshal([]byte(body), &violation))
+		AssertEqual(t, violation.Code, "schema_violation")
+		AssertEqual(t, len(violation.Violations), 1)
+		AssertEqual(t, violation.Violations[0], "$.id: must be at least 1")
+		_, code, err = httphelper.PostString(fmt.Sprintf("%s%s?channel=%d", baseURL, ENQUEUE_ENDPOINT, validated), `{"id":1}`, apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		_, code, err = httphelper.GetString(fmt.Sprintf("%s/dequeue?channel=%d", baseURL, validated), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		versions, _, err := httphelper.GetJSON[[]priorityqueue.SchemaVersion](fmt.Sprintf("%s/schemas?channel=%d", baseURL, validated), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, len(versions), 1)
+		req, err = http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/schemas?channel=%d", baseURL, validated), nil)
+		AssertNoError(t, err)
+		req.Header.Set(apiKey[0], apiKey[1])
+		resp, err = http.DefaultClient.Do(req)
+		AssertNoError(t, err)
+		resp.Body.Close()
+		AssertEqual(t, resp.StatusCode, http.StatusOK)
+
+		// A partitioned channel serves each partition key from a single partition
+		partitioned := CHANNEL + 6
+		_, code, err = httphelper.PostString(fmt.Sprintf("%s/repartition?channel=%d&partitions=2", baseURL, partitioned), "", apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusBadRequest) // the channel must be paused
+		_, code, err = httphelper.PostString(fmt.Sprintf("%s/pause?channel=%d", baseURL, partitioned), "", apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		_, code, err = httphelper.PostString(fmt.Sprintf("%s/repartition?channel=%d&partitions=2", baseURL, partitioned), "", apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		_, code, err = httphelper.PostString(fmt.Sprintf("%s/resume?channel=%d", baseURL, partitioned), "", apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		_, code, err = httphelper.PostString(fmt.Sprintf("%s%s?channel=%d&partition_key=order-7", baseURL, ENQUEUE_ENDPOINT, partitioned), "shipped", apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		partition := priorityqueue.ChannelConfig{Partitions: 2}.Partition(priorityqueue.PartitionHash("order-7"))
+		_, code, err = httphelper.GetString(fmt.Sprintf("%s/reserve?channel=%d&partition=%d", baseURL, partitioned, 1-partition), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusNoContent)
+		_, code, err = httphelper.GetString(fmt.Sprintf("%s/reserve?channel=%d&partition=2", baseURL, partitioned), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusBadRequest)
+		reserved, code, err = httphelper.GetJSON[map[string]any](fmt.Sprintf("%s/reserve?channel=%d&partition=%d", baseURL, partitioned, partition), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		AssertEqual(t, reserved["value"], "shipped")
+		_, code, err = httphelper.PostString(fmt.Sprintf("%s/confirm/%s", baseURL, reserved["reservation_id"]), "", apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+
+		// Channels past the last are rejected alike by every endpoint
+		for _, path := range []string{"/dequeue", "/reserve", "/reserve_batch", "/stats", "/size"} {
+			body, code, err = httphelper.GetString(fmt.Sprintf("%s%s?channel=%d", baseURL, path, mempqueue.MAX_CHANNEL), apiKey)
+			AssertNoError(t, err)
+			AssertEqual(t, code, http.StatusBadRequest)
+			AssertTrue(t, strings.Contains(body, "Must be between 0 and 99."))
+		}
+
+		// Channels can be switched to earliest-deadline-first, an overdue channel requires it
+		overdue := CHANNEL + 1
+		_, code, err = httphelper.PostJSON(fmt.Sprintf("%s/channels?channel=%d", baseURL, CHANNEL), priorityqueue.ChannelConfig{EDF: true}, apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		configs, code, err := httphelper.GetJSON[map[int]priorityqueue.ChannelConfig](fmt.Sprintf("%s/channels", baseURL), apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusOK)
+		AssertTrue(t, configs[CHANNEL].EDF)
+		_, code, err = httphelper.PostJSON(fmt.Sprintf("%s/channels?channel=%d", baseURL, CHANNEL), priorityqueue.ChannelConfig{OverdueChannel: &overdue}, apiKey)
+		AssertNoError(t, err)
+		AssertEqual(t, code, http.StatusBadRequest)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+		err = srv.Shutdown(ctx)
+		AssertNoError(t, err)
+	})
+
 	t.Run("Performance test", func(t *testing.T) {
 		const NO_OF_ITEMS = 500
 		const MAX_PARALLELISM = 1
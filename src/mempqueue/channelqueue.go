@@ -0,0 +1,321 @@
+package mempqueue
+
+import (
+	"container/heap"
+	"slices"
+
+	"github.com/jnsoft/jnq/src/priorityqueue"
+)
+
+// itemHeap is a binary min-heap with removal by id in O(log n).
+// Items with an empty id are kept but not indexed, they are removed by Dequeue or RemoveFunc.
+type itemHeap[T any] struct {
+	items []T
+	pos   map[string]int // index in items by id
+	id    func(T) string
+	less  func(i, j T) bool
+}
+
+func newItemHeap[T any](id func(T) string, less func(i, j T) bool) *itemHeap[T] {
+	return &itemHeap[T]{pos: make(map[string]int), id: id, less: less}
+}
+
+func (h *itemHeap[T]) IsEmpty() bool {
+	return len(h.items) == 0
+}
+
+func (h *itemHeap[T]) Size() int {
+	return len(h.items)
+}
+
+func (h *itemHeap[T]) Peek() (T, error) {
+	if len(h.items) == 0 {
+		return *new(T), priorityqueue.ErrEmpty
+	}
+	return h.items[0], nil
+}
+
+// Enqueue adds an item, replacing the item with the same id, if any.
+func (h *itemHeap[T]) Enqueue(x T) {
+	if i, ok := h.pos[h.id(x)]; ok {
+		h.items[i] = x
+		h.fix(i)
+		return
+	}
+	h.items = append(h.items, x)
+	h.index(len(h.items) - 1)
+	h.up(len(h.items) - 1)
+}
+
+func (h *itemHeap[T]) Dequeue() (T, error) {
+	if len(h.items) == 0 {
+		return *new(T), priorityqueue.ErrEmpty
+	}
+	return h.removeAt(0), nil
+}
+
+// Remove removes and returns the item with the given id.
+func (h *itemHeap[T]) Remove(id string) (T, bool) {
+	i, ok := h.pos[id]
+	if !ok {
+		return *new(T), false
+	}
+	return h.removeAt(i), true
+}
+
+// RemoveFunc removes and returns the first item found accepted by match, scanning all items.
+func (h *itemHeap[T]) RemoveFunc(match func(T) bool) (T, bool) {
+	for i, x := range h.items {
+		if match(x) {
+			return h.removeAt(i), true
+		}
+	}
+	return *new(T), false
+}
+
+func (h *itemHeap[T]) Get(id string) (T, bool) {
+	i, ok := h.pos[id]
+	if !ok {
+		return *new(T), false
+	}
+	return h.items[i], true
+}
+
+// Items returns a copy of the items, in no particular order.
+func (h *itemHeap[T]) Items() []T {
+	return append([]T(nil), h.items...)
+}
+
+// Reorder rebuilds the heap with a new ordering.
+func (h *itemHeap[T]) Reorder(less func(i, j T) bool) {
+	h.less = less
+	for i := len(h.items)/2 - 1; i >= 0; i-- {
+		h.down(i)
+	}
+}
+
+// Matching returns up to n items accepted by match, in order. The items are visited in order, walking
+// the heap from the root and only descending below visited items, so the cost depends on the number
+// of items visited before the n-th match rather than on the size of the heap.
+func (h *itemHeap[T]) Matching(match func(T) bool, n int) []T {
+	var found []T
+	if len(h.items) == 0 || n <= 0 {
+		return found
+	}
+	f := &frontier[T]{h: h, idx: []int{0}}
+	for f.Len() > 0 && len(found) < n {
+		i := heap.Pop(f).(int)
+		if match(h.items[i]) {
+			found = append(found, h.items[i])
+		}
+		for _, child := range []int{2*i + 1, 2*i + 2} {
+			if child < len(h.items) {
+				heap.Push(f, child)
+			}
+		}
+	}
+	return found
+}
+
+func (h *itemHeap[T]) removeAt(i int) T {
+	last := len(h.items) - 1
+	if i != last {
+		h.swap(i, last)
+	}
+	x := h.items[last]
+	h.items[last] = *new(T) // no loitering
+	h.items = h.items[:last]
+	if id := h.id(x); id != "" {
+		delete(h.pos, id)
+	}
+	if i != last {
+		h.fix(i)
+	}
+	return x
+}
+
+func (h *itemHeap[T]) fix(i int) {
+	if !h.down(i) {
+		h.up(i)
+	}
+}
+
+func (h *itemHeap[T]) up(i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if !h.less(h.items[i], h.items[parent]) {
+			break
+		}
+		h.swap(i, parent)
+		i = parent
+	}
+}
+
+// down moves an item towards the leaves, reporting whether it moved.
+func (h *itemHeap[T]) down(i int) bool {
+	start := i
+	for {
+		child := 2*i + 1
+		if child >= len(h.items) {
+			break
+		}
+		if right := child + 1; right < len(h.items) && h.less(h.items[right], h.items[child]) {
+			child = right
+		}
+		if !h.less(h.items[child], h.items[i]) {
+			break
+		}
+		h.swap(i, child)
+		i = child
+	}
+	return i > start
+}
+
+func (h *itemHeap[T]) swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.index(i)
+	h.index(j)
+}
+
+func (h *itemHeap[T]) index(i int) {
+	if id := h.id(h.items[i]); id != "" {
+		h.pos[id] = i
+	}
+}
+
+// frontier holds the heap positions next in line during Matching, ordered by their items.
+type frontier[T any] struct {
+	h   *itemHeap[T]
+	idx []int
+}
+
+func (f *frontier[T]) Len() int           { return len(f.idx) }
+func (f *frontier[T]) Less(i, j int) bool { return f.h.less(f.h.items[f.idx[i]], f.h.items[f.idx[j]]) }
+func (f *frontier[T]) Swap(i, j int)      { f.idx[i], f.idx[j] = f.idx[j], f.idx[i] }
+func (f *frontier[T]) Push(x any)         { f.idx = append(f.idx, x.(int)) }
+func (f *frontier[T]) Pop() any {
+	i := f.idx[len(f.idx)-1]
+	f.idx = f.idx[:len(f.idx)-1]
+	return i
+}
+
+func itemId(item pqItem) string {
+	return item.Id
+}
+
+// channelQueue holds the ready items of a channel in the order of the channel.
+// Fair channels also keep the items of each tenant in a heap of their own,
+// with the tenants holding items sorted in a ring the round-robin cursor moves along.
+type channelQueue struct {
+	*itemHeap[pqItem]
+	tenants map[string]*itemHeap[pqItem] // nil unless the channel is fair
+	ring    []string                     // keys of tenants, sorted
+}
+
+func newChannelQueue(less func(i, j pqItem) bool, fair bool) *channelQueue {
+	q := &channelQueue{itemHeap: newItemHeap(itemId, less)}
+	q.reorder(less, fair)
+	return q
+}
+
+func (q *channelQueue) Enqueue(item pqItem) {
+	if q.tenants != nil {
+		if old, ok := q.itemHeap.Get(item.Id); ok {
+			q.untenant(old)
+		}
+		q.tenant(item)
+	}
+	q.itemHeap.Enqueue(item)
+}
+
+func (q *channelQueue) Dequeue() (pqItem, error) {
+	item, err := q.itemHeap.Dequeue()
+	if err == nil {
+		q.untenant(item)
+	}
+	return item, err
+}
+
+func (q *channelQueue) Remove(id string) (pqItem, bool) {
+	item, ok := q.itemHeap.Remove(id)
+	if ok {
+		q.untenant(item)
+	}
+	return item, ok
+}
+
+func (q *channelQueue) RemoveFunc(match func(pqItem) bool) (pqItem, bool) {
+	item, ok := q.itemHeap.RemoveFunc(match)
+	if ok {
+		q.untenant(item)
+	}
+	return item, ok
+}
+
+// removeItem removes an item by id or, for items logged before ids existed, by value.
+func (q *channelQueue) removeItem(item pqItem) (pqItem, bool) {
+	if item.Id != "" {
+		return q.Remove(item.Id)
+	}
+	return q.RemoveFunc(func(other pqItem) bool { return sameItem(other, item) })
+}
+
+// reorder rebuilds the queue with a new ordering, keeping the items of each tenant apart if fair is set.
+func (q *channelQueue) reorder(less func(i, j pqItem) bool, fair bool) {
+	q.itemHeap.Reorder(less)
+	q.tenants, q.ring = nil, nil
+	if fair {
+		q.tenants = make(map[string]*itemHeap[pqItem])
+		for _, item := range q.items {
+			q.tenant(item)
+		}
+	}
+}
+
+// nextTenant returns the first item accepted by match of the first tenant after cursor in the ring,
+// wrapping around to the first tenant. Every tenant is taken to follow a missing cursor.
+func (q *channelQueue) nextTenant(cursor string, hasCursor bool, match func(pqItem) bool) (pqItem, bool) {
+	start := 0
+	if hasCursor {
+		var found bool
+		if start, found = slices.BinarySearch(q.ring, cursor); found {
+			start++
+		}
+	}
+	for i := range q.ring {
+		tenant := q.ring[(start+i)%len(q.ring)]
+		if items := q.tenants[tenant].Matching(match, 1); len(items) > 0 {
+			return items[0], true
+		}
+	}
+	return pqItem{}, false
+}
+
+func (q *channelQueue) tenant(item pqItem) {
+	h, ok := q.tenants[item.Tenant]
+	if !ok {
+		h = newItemHeap(itemId, q.less)
+		q.tenants[item.Tenant] = h
+		i, _ := slices.BinarySearch(q.ring, item.Tenant)
+		q.ring = slices.Insert(q.ring, i, item.Tenant)
+	}
+	h.Enqueue(item)
+}
+
+func (q *channelQueue) untenant(item pqItem) {
+	h, ok := q.tenants[item.Tenant]
+	if !ok {
+		return
+	}
+	if item.Id != "" {
+		h.Remove(item.Id)
+	} else {
+		h.RemoveFunc(func(other pqItem) bool { return sameItem(other, item) })
+	}
+	if h.IsEmpty() {
+		delete(q.tenants, item.Tenant)
+		if i, found := slices.BinarySearch(q.ring, item.Tenant); found {
+			q.ring = slices.Delete(q.ring, i, i+1)
+		}
+	}
+}
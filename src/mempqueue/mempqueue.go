@@ -2,32 +2,61 @@ package mempqueue
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/json"
-	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"reflect"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/jnsoft/jngo/pqueue"
+	"github.com/jnsoft/jnq/src/blobstore"
+	"github.com/jnsoft/jnq/src/keyring"
 	"github.com/jnsoft/jnq/src/priorityqueue"
 	"golang.org/x/exp/mmap"
 )
 
 const (
-	MAX_CHANNEL         = 100
+	MAX_CHANNEL = priorityqueue.MAX_CHANNEL
+	// Deprecated: match priorityqueue.ErrInvalidChannel with errors.Is instead.
 	INVALID_CHANNEL_MSG = "invalid channel"
-	CHECKPOINT_COUNT    = 10_000
-	DELETEME_SUFFIX     = ".deleteme"
-	TRY_RESET_INTERVAL  = 10 * time.Minute
+	// Deprecated: match priorityqueue.ErrReservationNotFound with errors.Is instead.
+	INVALID_RES_ID_MSG = "invalid or expired reservation ID"
+	// Deprecated: match priorityqueue.ErrItemNotFound with errors.Is instead.
+	ITEM_NOT_FOUND_MSG = "item not found"
+	CHECKPOINT_COUNT   = 10_000
+	DELETEME_SUFFIX    = ".deleteme"
+	TRY_RESET_INTERVAL = 10 * time.Minute
 )
 
 type pqItem struct {
-	Obj        string
-	Prio       float64
-	Not_before time.Time
+	Id            string
+	Obj           string
+	Prio          float64
+	Not_before    time.Time
+	ReplyTo       *int // channel for the reply on confirm, if any
+	CorrelationId string
+	Attributes    map[string]string
+	Enqueued      time.Time
+	Attempts      int       // number of times the item has been reserved
+	Expired       time.Time // when its last reservation expired, cleared when it is reserved again
+	Deadline      time.Time
+	CoalesceKey   string // cleared when the item is reserved
+	Tenant        string
+	Blob          string // reference of the payload offloaded to the blob store, Obj is empty then
+	KeyId         string // key the payload is encrypted with, if any
+	PartitionHash uint32 // hash of the partition key, or of the id for items without a key
+}
+
+// coalesceKey identifies the pending item an enqueue with a coalesce key replaces
+type coalesceKey struct {
+	Channel int
+	Key     string
 }
 
 type notBeforeItem struct {
@@ -38,7 +67,31 @@ type notBeforeItem struct {
 type reservedItem struct {
 	Item      pqItem
 	Channel   int
-	Timestamp time.Time // Time when the item was reserved
+	Timestamp time.Time // Time when the item was reserved or the reservation was last extended
+	Consumer  string    // owner of the reservation, if any
+	Token     int64     // fencing token of the reservation
+}
+
+type blockedItem struct {
+	Item    pqItem
+	Channel int
+	Parents []string // ids of unfinished items this item waits for
+}
+
+// tombstone keeps the status of a completed or deleted item for the status retention period
+type tombstone struct {
+	Id       string
+	Status   string
+	Channel  int
+	Attempts int
+	Enqueued time.Time
+	Finished time.Time
+}
+
+type storedResult struct {
+	Value   string
+	KeyId   string // key the value is encrypted with, if the item's channel encrypts payloads
+	Expires time.Time
 }
 
 type walOp struct { // Write-Ahead Log
@@ -47,13 +100,44 @@ type walOp struct { // Write-Ahead Log
 	Item      pqItem
 	NotBefore notBeforeItem
 	ResId     string
+	Topic     string
+	Parents   []string
+	Result    storedResult
+	Group     []walOp // operations of a transaction
+	Config    priorityqueue.ChannelConfig
+	To        int    // channel an item is moved to
+	Consumer  string // owner of a reservation
+	Token     int64  // fencing token of a reservation
+	Rule      priorityqueue.RoutingRule
+	Schema    priorityqueue.SchemaVersion
 	Time      time.Time
 }
 
 type MemPQueue struct {
-	pqs            []pqueue.PriorityQueue[pqItem]
-	not_before_pq  pqueue.PriorityQueue[notBeforeItem]
+	pqs            []*channelQueue
+	not_before_pq  *itemHeap[notBeforeItem]
 	reserved       map[string]reservedItem
+	blocked        map[string]blockedItem  // items waiting for their parents, keyed by item id
+	dependents     map[string][]string     // parent item id -> ids of blocked items
+	results        map[string]storedResult // results of confirmed items, keyed by item id
+	paused         map[int]bool            // channels not served by Dequeue and DequeueWithReservation
+	topics         map[string][]int        // topic -> subscribed channels, in ascending order
+	configs        map[int]priorityqueue.ChannelConfig
+	keys           map[coalesceKey]string // ids of pending items with a coalesce key, rebuilt from the items on load
+	cursors        map[int]string         // tenant served last by each fair channel
+	rules          []priorityqueue.RoutingRule
+	schemas        map[int][]priorityqueue.SchemaVersion // versions of the schema of each channel, oldest first
+	counters       []priorityqueue.ChannelCounters
+	fence          int64                // last fencing token handed out, kept by ResetQueue
+	finished       map[string]tombstone // completed and deleted items, keyed by item id
+	finishedOrder  []string             // ids in finished, oldest first
+	blobs          *blobstore.Store     // where payloads above blobThreshold bytes are offloaded, if set
+	blobThreshold  int
+	blobRefs       map[string]int   // number of unfinished items per offloaded payload, rebuilt from the items on load
+	keyring        *keyring.Keyring // encrypts the payloads of channels with Encrypt set
+	retention      time.Duration    // how long finished items are kept
+	observers      priorityqueue.Observers
+	events         []priorityqueue.Event // events of applied operations, notified by flush
 	isMinQueue     bool
 	mu             sync.Mutex
 	snapshotFile   string
@@ -66,19 +150,49 @@ func less(i, j pqItem) bool {
 	return i.Prio < j.Prio
 }
 
+// lessDeadline orders items earliest deadline first, items without a deadline last.
+func lessDeadline(i, j pqItem) bool {
+	if i.Deadline.IsZero() != j.Deadline.IsZero() {
+		return j.Deadline.IsZero()
+	}
+	if !i.Deadline.Equal(j.Deadline) {
+		return i.Deadline.Before(j.Deadline)
+	}
+	return less(i, j)
+}
+
 func less_not_before(i, j notBeforeItem) bool {
 	return i.Item.Not_before.Before(j.Item.Not_before)
 }
 
+// newNotBeforeHeap returns the heap of scheduled items, indexed by item id so that replaying the move
+// of an item to its channel, logged as a plain enqueue, finds it without a scan.
+func newNotBeforeHeap() *itemHeap[notBeforeItem] {
+	return newItemHeap(func(nb notBeforeItem) string { return nb.Item.Id }, less_not_before)
+}
+
 func NewMemPQueue(IsMinQueue bool) *MemPQueue {
-	pqs := make([]pqueue.PriorityQueue[pqItem], MAX_CHANNEL)
+	pqs := make([]*channelQueue, MAX_CHANNEL)
 	for i := 0; i < MAX_CHANNEL; i++ {
-		pqs[i] = *pqueue.NewPriorityQueue(less)
+		pqs[i] = newChannelQueue(less, false)
 	}
 	return &MemPQueue{
 		pqs:           pqs,
-		not_before_pq: *pqueue.NewPriorityQueue(less_not_before),
+		not_before_pq: newNotBeforeHeap(),
 		reserved:      make(map[string]reservedItem),
+		blocked:       make(map[string]blockedItem),
+		dependents:    make(map[string][]string),
+		results:       make(map[string]storedResult),
+		paused:        make(map[int]bool),
+		topics:        make(map[string][]int),
+		configs:       make(map[int]priorityqueue.ChannelConfig),
+		keys:          make(map[coalesceKey]string),
+		cursors:       make(map[int]string),
+		schemas:       make(map[int][]priorityqueue.SchemaVersion),
+		counters:      make([]priorityqueue.ChannelCounters, MAX_CHANNEL),
+		finished:      make(map[string]tombstone),
+		blobRefs:      make(map[string]int),
+		retention:     priorityqueue.DEFAULT_STATUS_RETENTION,
 		isMinQueue:    IsMinQueue,
 	}
 }
@@ -95,9 +209,69 @@ func NewMemPQueuePersistent(IsMinQueue bool, snapshotFile, walFile string) *MemP
 	return pq
 }
 
+// SetStatusRetention sets how long the status of completed and deleted items is kept, 0 keeps none.
+// Statuses already dropped under a shorter retention are not restored.
+func (pq *MemPQueue) SetStatusRetention(retention time.Duration) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	pq.retention = retention
+}
+
+// SetBlobStore offloads the payloads of new items larger than threshold bytes to a content-addressed
+// blob directory, keeping only a reference in the item, the WAL and the snapshot. Payloads are read back
+// when items are peeked, dequeued or reserved, and removed once no unfinished item refers to them.
+// Items offloaded earlier need the same directory to be read back. Blobs no item refers to are removed.
+func (pq *MemPQueue) SetBlobStore(dir string, threshold int) error {
+	if threshold < 0 {
+		return fmt.Errorf("%w: blob threshold cannot be negative", priorityqueue.ErrInvalidArgument)
+	}
+	store, err := blobstore.New(dir)
+	if err != nil {
+		return err
+	}
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	pq.blobs = store
+	pq.blobThreshold = threshold
+
+	refs, err := store.Refs()
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if pq.blobRefs[ref] == 0 {
+			if err := store.Delete(ref); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetKeyring sets the keys payloads of channels with Encrypt set are encrypted with, see priorityqueue.ChannelConfig.
+// Payloads are encrypted before they reach the WAL, the snapshot or the blob store.
+func (pq *MemPQueue) SetKeyring(k *keyring.Keyring) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	pq.keyring = k
+}
+
+// Subscribe adds an observer called with the events of every operation once pq.mu has been released.
+func (pq *MemPQueue) Subscribe(observer func(priorityqueue.Event)) func() {
+	return pq.observers.Subscribe(observer)
+}
+
 // Operations
+// In-memory operations never wait, so the ...Context variants only check the context before starting.
 
 func (pq *MemPQueue) IsEmpty(channel int) (bool, error) {
+	return pq.IsEmptyContext(context.Background(), channel)
+}
+
+func (pq *MemPQueue) IsEmptyContext(ctx context.Context, channel int) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
 	if channel < 0 || channel >= MAX_CHANNEL {
 		return true, nil
 	}
@@ -108,6 +282,13 @@ func (pq *MemPQueue) IsEmpty(channel int) (bool, error) {
 }
 
 func (pq *MemPQueue) Size(channel int) (int, error) {
+	return pq.SizeContext(context.Background(), channel)
+}
+
+func (pq *MemPQueue) SizeContext(ctx context.Context, channel int) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
 	if channel < 0 || channel >= MAX_CHANNEL {
 		return 0, nil
 	}
@@ -118,241 +299,2115 @@ func (pq *MemPQueue) Size(channel int) (int, error) {
 }
 
 func (pq *MemPQueue) Peek(channel int) (string, error) {
+	return pq.PeekContext(context.Background(), channel)
+}
+
+func (pq *MemPQueue) PeekContext(ctx context.Context, channel int) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 	if channel < 0 || channel >= MAX_CHANNEL {
-		return "", errors.New(INVALID_CHANNEL_MSG)
+		return "", priorityqueue.ErrInvalidChannel
 	}
 	pq.processNotBeforeQueue()
 	pq.mu.Lock()
 	defer pq.mu.Unlock()
+	if pq.configs[channel].Fair {
+		item, ok := pq.nextFair(channel, priorityqueue.Filter{}, nil)
+		if !ok {
+			return "", priorityqueue.ErrEmpty
+		}
+		return pq.payload(item)
+	}
 	item, err := pq.pqs[channel].Peek()
 	if err != nil {
-		return "", err
+		return "", priorityqueue.ErrEmpty
 	}
-	return item.Obj, nil
+	return pq.payload(item)
 }
 
 func (pq *MemPQueue) Enqueue(obj string, prio float64, channel int, notBefore time.Time) error {
+	return pq.EnqueueContext(context.Background(), obj, prio, channel, notBefore)
+}
+
+func (pq *MemPQueue) EnqueueContext(ctx context.Context, obj string, prio float64, channel int, notBefore time.Time) error {
+	_, err := pq.EnqueueWithOptionsContext(ctx, obj, prio, channel, notBefore, priorityqueue.EnqueueOptions{})
+	return err
+}
+
+func (pq *MemPQueue) EnqueueWithOptions(obj string, prio float64, channel int, notBefore time.Time, opts priorityqueue.EnqueueOptions) (string, error) {
+	return pq.EnqueueWithOptionsContext(context.Background(), obj, prio, channel, notBefore, opts)
+}
+
+// EnqueueWithOptionsContext enqueues an item and returns its item ID.
+// Items with unfinished dependencies are kept blocked until all parents have completed.
+func (pq *MemPQueue) EnqueueWithOptionsContext(ctx context.Context, obj string, prio float64, channel int, notBefore time.Time, opts priorityqueue.EnqueueOptions) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	defer pq.flush()
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	op, err := pq.enqueueOp(obj, prio, channel, notBefore, opts, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if pq.snapshotFile != "" {
+		err := pq.appendWAL(op)
+		if err != nil {
+			log.Printf("Error appending to WAL: %v", err)
+			pq.discardBlobs(op)
+			return "", err
+		}
+	}
+
+	pq.apply(op)
+	pq.maybeCheckpoint()
+	return op.Item.Id, nil
+}
+
+func (pq *MemPQueue) Dequeue(channel int) (string, error) {
+	return pq.DequeueContext(context.Background(), channel)
+}
+
+func (pq *MemPQueue) DequeueContext(ctx context.Context, channel int) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 	if channel < 0 || channel >= MAX_CHANNEL {
-		return errors.New(INVALID_CHANNEL_MSG)
+		return "", priorityqueue.ErrInvalidChannel
 	}
+
+	pq.processNotBeforeQueue()
+
+	defer pq.flush()
 	pq.mu.Lock()
 	defer pq.mu.Unlock()
 
-	pqItem := pqItem{Obj: obj, Prio: prio, Not_before: notBefore}
+	if pq.paused[channel] {
+		return "", priorityqueue.ErrEmpty
+	}
 
-	if !pq.isMinQueue {
-		pqItem.Prio = -prio
+	cursor, hasCursor := pq.cursors[channel]
+	taken := pq.takeNext(channel, priorityqueue.Filter{}, nil, 1)
+	if len(taken) == 0 {
+		return "", priorityqueue.ErrEmpty
+	}
+	item := taken[0]
+	obj, err := pq.payload(item)
+	if err != nil {
+		pq.untake(channel, taken, cursor, hasCursor)
+		return "", err
 	}
 
-	if !notBefore.IsZero() && time.Now().Before(notBefore) {
-		if pq.snapshotFile != "" {
-			err := pq.appendWAL(walOp{Op: "enqueue_notbefore", Channel: channel, Item: pqItem, Time: time.Now()})
-			if err != nil {
-				log.Printf("Error appending to WAL: %v", err)
-				return err
-			} else {
+	now := time.Now()
+	if pq.snapshotFile != "" {
+		err := pq.appendWAL(walOp{Op: "dequeue", Channel: channel, Item: item, Time: now})
+		if err != nil {
+			log.Printf("Error appending to WAL: %v", err)
+			pq.untake(channel, taken, cursor, hasCursor)
+			return "", err
 
-			}
 		}
+	}
 
-		pq.not_before_pq.Enqueue(notBeforeItem{
-			Item:    pqItem,
-			Channel: channel,
-		})
+	pq.unindex(item, channel)
+	pq.complete(item.Id)
+	pq.finish(item, channel, priorityqueue.STATUS_COMPLETED, now)
+	pq.record(priorityqueue.EVENT_DEQUEUE, channel, item, now)
+	pq.counters[channel].Dequeued++
+	pq.maybeCheckpoint()
 
-		pq.maybeCheckpoint()
+	return obj, nil
+}
 
-	} else {
+func (pq *MemPQueue) Delete(itemId string) (bool, error) {
+	return pq.DeleteContext(context.Background(), itemId)
+}
 
-		if pq.snapshotFile != "" {
-			err := pq.appendWAL(walOp{Op: "enqueue", Channel: channel, Item: pqItem, Time: time.Now()})
-			if err != nil {
-				log.Printf("Error appending to WAL: %v", err)
-				return err
-			}
+// DeleteContext removes an unfinished item, whether it is ready, scheduled, blocked or reserved.
+// Items depending on the deleted item are deleted as well.
+func (pq *MemPQueue) DeleteContext(ctx context.Context, itemId string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	defer pq.flush()
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	if !pq.isUnfinished(itemId) {
+		return false, nil
+	}
+
+	op := walOp{Op: "delete", Item: pqItem{Id: itemId}, Time: time.Now()}
+	if pq.snapshotFile != "" {
+		err := pq.appendWAL(op)
+		if err != nil {
+			log.Printf("Error appending to WAL: %v", err)
+			return false, err
+		}
+	}
+
+	pq.apply(op)
+	pq.maybeCheckpoint()
+	return true, nil
+}
+
+func (pq *MemPQueue) DequeueWithReservation(channel int) (string, string, error) {
+	return pq.DequeueWithReservationContext(context.Background(), channel)
+}
+
+// DequeueWithReservationContext dequeues an item and reserves it with a unique reservation ID.
+// The reservation ID can be used to confirm the reservation later.
+// returns the dequeued item and the reservation ID.
+func (pq *MemPQueue) DequeueWithReservationContext(ctx context.Context, channel int) (string, string, error) {
+	return pq.DequeueWithReservationFilteredContext(ctx, channel, priorityqueue.Filter{})
+}
+
+func (pq *MemPQueue) DequeueWithReservationFiltered(channel int, filter priorityqueue.Filter) (string, string, error) {
+	return pq.DequeueWithReservationFilteredContext(context.Background(), channel, filter)
+}
+
+// DequeueWithReservationFilteredContext reserves the highest-priority item matching the filter.
+// Matching items are found by scanning the channel, non-matching items are left in place.
+func (pq *MemPQueue) DequeueWithReservationFilteredContext(ctx context.Context, channel int, filter priorityqueue.Filter) (string, string, error) {
+	obj, reservation, err := pq.DequeueWithReservationOptionsContext(ctx, channel, priorityqueue.ReserveOptions{Filter: filter})
+	return obj, reservation.ReservationId, err
+}
+
+func (pq *MemPQueue) DequeueWithReservationOptions(channel int, opts priorityqueue.ReserveOptions) (string, priorityqueue.Reservation, error) {
+	return pq.DequeueWithReservationOptionsContext(context.Background(), channel, opts)
+}
+
+// DequeueWithReservationOptionsContext reserves the highest-priority item matching the filter of opts
+// on behalf of the consumer of opts, if any. The reservation gets the next fencing token.
+func (pq *MemPQueue) DequeueWithReservationOptionsContext(ctx context.Context, channel int, opts priorityqueue.ReserveOptions) (string, priorityqueue.Reservation, error) {
+	items, err := pq.DequeueWithReservationBatchContext(ctx, channel, 1, opts)
+	if err != nil {
+		return "", priorityqueue.Reservation{}, err
+	}
+	return items[0].Value, items[0].Reservation, nil
+}
+
+func (pq *MemPQueue) DequeueWithReservationBatch(channel int, n int, opts priorityqueue.ReserveOptions) ([]priorityqueue.ReservedItem, error) {
+	return pq.DequeueWithReservationBatchContext(context.Background(), channel, n, opts)
+}
+
+// DequeueWithReservationBatchContext reserves up to n items matching the filter and partition of opts,
+// highest priority first, logged as a single WAL group. Returns ErrEmpty if no item is available.
+func (pq *MemPQueue) DequeueWithReservationBatchContext(ctx context.Context, channel int, n int, opts priorityqueue.ReserveOptions) ([]priorityqueue.ReservedItem, error) {
+	filter := opts.Filter
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if channel < 0 || channel >= MAX_CHANNEL {
+		return nil, priorityqueue.ErrInvalidChannel
+	}
+	if n <= 0 {
+		return nil, fmt.Errorf("%w: batch size must be positive", priorityqueue.ErrInvalidArgument)
+	}
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	pq.processNotBeforeQueue()
+
+	defer pq.flush()
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	if pq.paused[channel] {
+		return nil, priorityqueue.ErrEmpty
+	}
+	if opts.Partition != nil {
+		if err := pq.configs[channel].ValidatePartition(*opts.Partition); err != nil {
+			return nil, err
+		}
+	}
+
+	cursor, hasCursor := pq.cursors[channel]
+	items := pq.takeNext(channel, filter, opts.Partition, n)
+	if len(items) == 0 {
+		return nil, priorityqueue.ErrEmpty
+	}
+	values := make([]string, len(items))
+	for i, item := range items {
+		value, err := pq.payload(item)
+		if err != nil {
+			pq.untake(channel, items, cursor, hasCursor)
+			return nil, err
+		}
+		values[i] = value
+	}
+
+	now := time.Now()
+	group := make([]walOp, len(items))
+	for i, item := range items {
+		group[i] = walOp{Op: "dequeueWithReservation", Channel: channel, Item: item, ResId: uuid.New().String(), Consumer: opts.Consumer, Token: pq.fence + int64(i) + 1, Time: now}
+	}
+	if pq.snapshotFile != "" {
+		err := pq.appendWAL(walOp{Op: "tx", Group: group, Time: now})
+		if err != nil {
+			log.Printf("Error appending to WAL: %v", err)
+			pq.untake(channel, items, cursor, hasCursor)
+			return nil, err
+		}
+	}
+
+	reserved := make([]priorityqueue.ReservedItem, len(group))
+	for i, op := range group {
+		pq.reserve(op.ResId, op.Item, channel, op.Consumer, op.Token, now)
+		reserved[i] = priorityqueue.ReservedItem{
+			Value: values[i],
+			Reservation: priorityqueue.Reservation{
+				ReservationId: op.ResId,
+				ItemId:        op.Item.Id,
+				Channel:       channel,
+				Consumer:      op.Consumer,
+				ReservedAt:    now,
+				Token:         op.Token,
+			},
+		}
+	}
+	pq.maybeCheckpoint()
+	return reserved, nil
+}
+
+func (pq *MemPQueue) ConfirmReservation(reservationId string) (bool, error) {
+	return pq.ConfirmReservationContext(context.Background(), reservationId)
+}
+
+func (pq *MemPQueue) ConfirmReservationContext(ctx context.Context, reservationId string) (bool, error) {
+	return pq.ConfirmReservationWithResultContext(ctx, reservationId, "", 0)
+}
+
+func (pq *MemPQueue) ConfirmReservationWithResult(reservationId string, result string, ttl time.Duration) (bool, error) {
+	return pq.ConfirmReservationWithResultContext(context.Background(), reservationId, result, ttl)
+}
+
+// ConfirmReservationWithResultContext confirms a reservation and stores a non-empty result
+// against the item id, retrievable with GetResult until the ttl has passed.
+// If the item was enqueued with a reply channel, the result is also enqueued there as a reply.
+func (pq *MemPQueue) ConfirmReservationWithResultContext(ctx context.Context, reservationId string, result string, ttl time.Duration) (bool, error) {
+	return pq.ConfirmReservationAsContext(ctx, reservationId, priorityqueue.ReservationClaim{}, result, ttl)
+}
+
+func (pq *MemPQueue) ConfirmReservationAs(reservationId string, claim priorityqueue.ReservationClaim, result string, ttl time.Duration) (bool, error) {
+	return pq.ConfirmReservationAsContext(context.Background(), reservationId, claim, result, ttl)
+}
+
+// ConfirmReservationAsContext confirms a reservation like ConfirmReservationWithResultContext,
+// returning ErrNotOwner if the reservation is owned by another consumer than the claim's.
+func (pq *MemPQueue) ConfirmReservationAsContext(ctx context.Context, reservationId string, claim priorityqueue.ReservationClaim, result string, ttl time.Duration) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	defer pq.flush()
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	op, err := pq.confirmOp(reservationId, claim, result, ttl)
+	if err != nil {
+		return false, err
+	}
+
+	if pq.snapshotFile != "" {
+		err := pq.appendWAL(op)
+		if err != nil {
+			log.Printf("Error appending to WAL: %v", err)
+			pq.discardBlobs(op)
+			return false, err
+		}
+	}
+
+	pq.apply(op)
+	pq.maybeCheckpoint()
+	return true, nil
+}
+
+func (pq *MemPQueue) ConfirmReservationBatch(reservationIds []string, claim priorityqueue.ReservationClaim) ([]error, error) {
+	return pq.ConfirmReservationBatchContext(context.Background(), reservationIds, claim)
+}
+
+// ConfirmReservationBatchContext confirms many reservations, logged as a single WAL group.
+// The outcome is reported per reservation, nil or the error ConfirmReservationAs would return,
+// the claim applies to every reservation.
+func (pq *MemPQueue) ConfirmReservationBatchContext(ctx context.Context, reservationIds []string, claim priorityqueue.ReservationClaim) ([]error, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer pq.flush()
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	results := make([]error, len(reservationIds))
+	group := make([]walOp, 0, len(reservationIds))
+	used := make(map[string]bool)
+	for i, reservationId := range reservationIds {
+		if used[reservationId] {
+			results[i] = priorityqueue.ErrReservationNotFound
+			continue
+		}
+		op, err := pq.confirmOp(reservationId, claim, "", 0)
+		if err != nil {
+			results[i] = err
+			continue
+		}
+		used[reservationId] = true
+		group = append(group, op)
+	}
+	if len(group) == 0 {
+		return results, nil
+	}
+
+	op := walOp{Op: "tx", Group: group, Time: time.Now()}
+	if pq.snapshotFile != "" {
+		err := pq.appendWAL(op)
+		if err != nil {
+			log.Printf("Error appending to WAL: %v", err)
+			return nil, err
 		}
+	}
+
+	pq.apply(op)
+	pq.maybeCheckpoint()
+	return results, nil
+}
+
+func (pq *MemPQueue) ReleaseReservation(reservationId string) (bool, error) {
+	return pq.ReleaseReservationContext(context.Background(), reservationId)
+}
+
+// ReleaseReservationContext returns a reserved item to its channel without waiting for the reservation to expire.
+func (pq *MemPQueue) ReleaseReservationContext(ctx context.Context, reservationId string) (bool, error) {
+	return pq.ReleaseReservationAsContext(ctx, reservationId, priorityqueue.ReservationClaim{})
+}
+
+func (pq *MemPQueue) ReleaseReservationAs(reservationId string, claim priorityqueue.ReservationClaim) (bool, error) {
+	return pq.ReleaseReservationAsContext(context.Background(), reservationId, claim)
+}
+
+// ReleaseReservationAsContext releases a reservation like ReleaseReservationContext,
+// returning ErrNotOwner if the reservation is owned by another consumer than the claim's.
+func (pq *MemPQueue) ReleaseReservationAsContext(ctx context.Context, reservationId string, claim priorityqueue.ReservationClaim) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	defer pq.flush()
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	op, err := pq.releaseOp(reservationId, claim)
+	if err != nil {
+		return false, err
+	}
+
+	if pq.snapshotFile != "" {
+		err := pq.appendWAL(op)
+		if err != nil {
+			log.Printf("Error appending to WAL: %v", err)
+			return false, err
+		}
+	}
+
+	pq.apply(op)
+	pq.maybeCheckpoint()
+	return true, nil
+}
+
+func (pq *MemPQueue) ExtendReservation(reservationId string, claim priorityqueue.ReservationClaim) (bool, error) {
+	return pq.ExtendReservationContext(context.Background(), reservationId, claim)
+}
+
+// ExtendReservationContext restarts the timeout of a reservation, as if the item was reserved now.
+func (pq *MemPQueue) ExtendReservationContext(ctx context.Context, reservationId string, claim priorityqueue.ReservationClaim) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	reserved, exists := pq.reserved[reservationId]
+	if !exists {
+		return false, priorityqueue.ErrReservationNotFound
+	}
+	if err := claim.Check(reserved.Consumer, reserved.Token); err != nil {
+		return false, err
+	}
+
+	op := walOp{Op: "extend", ResId: reservationId, Time: time.Now()}
+	if pq.snapshotFile != "" {
+		err := pq.appendWAL(op)
+		if err != nil {
+			log.Printf("Error appending to WAL: %v", err)
+			return false, err
+		}
+	}
+
+	pq.apply(op)
+	pq.maybeCheckpoint()
+	return true, nil
+}
+
+func (pq *MemPQueue) Reservations() (map[string][]priorityqueue.Reservation, error) {
+	return pq.ReservationsContext(context.Background())
+}
+
+// ReservationsContext returns the current reservations grouped by consumer, oldest first.
+// Reservations made without a consumer are listed under "".
+func (pq *MemPQueue) ReservationsContext(ctx context.Context) (map[string][]priorityqueue.Reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	reservations := make(map[string][]priorityqueue.Reservation)
+	for reservationId, reserved := range pq.reserved {
+		reservations[reserved.Consumer] = append(reservations[reserved.Consumer], priorityqueue.Reservation{
+			ReservationId: reservationId,
+			ItemId:        reserved.Item.Id,
+			Channel:       reserved.Channel,
+			Consumer:      reserved.Consumer,
+			ReservedAt:    reserved.Timestamp,
+			Token:         reserved.Token,
+		})
+	}
+	for _, list := range reservations {
+		slices.SortFunc(list, func(a, b priorityqueue.Reservation) int { return a.ReservedAt.Compare(b.ReservedAt) })
+	}
+	return reservations, nil
+}
+
+func (pq *MemPQueue) ApplyTransaction(ops []priorityqueue.TxOp) ([]string, error) {
+	return pq.ApplyTransactionContext(context.Background(), ops)
+}
+
+// ApplyTransactionContext applies enqueue, confirm, release and delete operations all-or-nothing.
+// Every operation is validated before any is applied, and the transaction is logged as one WAL record.
+// Returns the ids of the enqueued items, aligned with ops.
+func (pq *MemPQueue) ApplyTransactionContext(ctx context.Context, ops []priorityqueue.TxOp) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer pq.flush()
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	group := make([]walOp, 0, len(ops))
+	itemIds := make([]string, len(ops))
+	used := make(map[string]bool)     // reservations confirmed or released by the transaction
+	finished := make(map[string]bool) // items confirmed or deleted by the transaction
+	enqueued := make(map[string]bool)
+
+	for i, txOp := range ops {
+		var op walOp
+		var err error
+		switch txOp.Op {
+		case priorityqueue.TX_ENQUEUE:
+			if txOp.Options.CoalesceKey != "" {
+				return nil, fmt.Errorf("%w: coalescing is not supported in transactions", priorityqueue.ErrInvalidArgument)
+			}
+			op, err = pq.enqueueOp(txOp.Obj, txOp.Prio, txOp.Channel, txOp.NotBefore, txOp.Options, finished)
+			itemIds[i] = op.Item.Id
+			enqueued[op.Item.Id] = true
+		case priorityqueue.TX_CONFIRM, priorityqueue.TX_RELEASE:
+			if used[txOp.ReservationId] {
+				return nil, priorityqueue.ErrReservationNotFound
+			}
+			used[txOp.ReservationId] = true
+			if txOp.Op == priorityqueue.TX_CONFIRM {
+				op, err = pq.confirmOp(txOp.ReservationId, txOp.Claim, txOp.Result, txOp.ResultTTL)
+				finished[pq.reserved[txOp.ReservationId].Item.Id] = true
+			} else {
+				op, err = pq.releaseOp(txOp.ReservationId, txOp.Claim)
+			}
+		case priorityqueue.TX_DELETE:
+			if finished[txOp.ItemId] || (!enqueued[txOp.ItemId] && !pq.isUnfinished(txOp.ItemId)) {
+				return nil, priorityqueue.ErrItemNotFound
+			}
+			finished[txOp.ItemId] = true
+			op = walOp{Op: "delete", Item: pqItem{Id: txOp.ItemId}, Time: time.Now()}
+		default:
+			err = fmt.Errorf("%w: unknown transaction operation %q", priorityqueue.ErrInvalidArgument, txOp.Op)
+		}
+		if err != nil {
+			pq.discardBlobs(group...)
+			return nil, err
+		}
+		group = append(group, op)
+	}
+
+	op := walOp{Op: "tx", Group: group, Time: time.Now()}
+	if pq.snapshotFile != "" {
+		err := pq.appendWAL(op)
+		if err != nil {
+			log.Printf("Error appending to WAL: %v", err)
+			pq.discardBlobs(op)
+			return nil, err
+		}
+	}
+
+	pq.apply(op)
+	pq.maybeCheckpoint()
+	return itemIds, nil
+}
+
+func (pq *MemPQueue) Publish(topic string, obj string, prio float64, notBefore time.Time, opts priorityqueue.EnqueueOptions) ([]string, error) {
+	return pq.PublishContext(context.Background(), topic, obj, prio, notBefore, opts)
+}
+
+// PublishContext enqueues a copy of the item to every channel subscribed to the topic, all-or-nothing.
+// Returns the ids of the copies, in the order of the subscribed channels.
+func (pq *MemPQueue) PublishContext(ctx context.Context, topic string, obj string, prio float64, notBefore time.Time, opts priorityqueue.EnqueueOptions) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer pq.flush()
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	channels := pq.topics[topic]
+	group := make([]walOp, 0, len(channels))
+	itemIds := make([]string, 0, len(channels))
+	for _, channel := range channels {
+		op, err := pq.enqueueOp(obj, prio, channel, notBefore, opts, nil)
+		if err != nil {
+			pq.discardBlobs(group...)
+			return nil, err
+		}
+		group = append(group, op)
+		itemIds = append(itemIds, op.Item.Id)
+	}
+	if len(group) == 0 {
+		return itemIds, nil
+	}
+
+	op := walOp{Op: "tx", Group: group, Time: time.Now()}
+	if pq.snapshotFile != "" {
+		err := pq.appendWAL(op)
+		if err != nil {
+			log.Printf("Error appending to WAL: %v", err)
+			pq.discardBlobs(op)
+			return nil, err
+		}
+	}
+
+	pq.apply(op)
+	pq.maybeCheckpoint()
+	return itemIds, nil
+}
+
+func (pq *MemPQueue) AddSubscription(topic string, channel int) error {
+	return pq.AddSubscriptionContext(context.Background(), topic, channel)
+}
+
+// AddSubscriptionContext subscribes a channel to a topic.
+func (pq *MemPQueue) AddSubscriptionContext(ctx context.Context, topic string, channel int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return pq.setSubscription(topic, channel, true)
+}
+
+func (pq *MemPQueue) RemoveSubscription(topic string, channel int) error {
+	return pq.RemoveSubscriptionContext(context.Background(), topic, channel)
+}
+
+// RemoveSubscriptionContext unsubscribes a channel from a topic.
+func (pq *MemPQueue) RemoveSubscriptionContext(ctx context.Context, topic string, channel int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return pq.setSubscription(topic, channel, false)
+}
+
+func (pq *MemPQueue) Subscriptions() (map[string][]int, error) {
+	return pq.SubscriptionsContext(context.Background())
+}
+
+// SubscriptionsContext returns the subscribed channels of every topic.
+func (pq *MemPQueue) SubscriptionsContext(ctx context.Context) (map[string][]int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	subscriptions := make(map[string][]int, len(pq.topics))
+	for topic, channels := range pq.topics {
+		subscriptions[topic] = slices.Clone(channels)
+	}
+	return subscriptions, nil
+}
+
+func (pq *MemPQueue) setSubscription(topic string, channel int, subscribed bool) error {
+	if channel < 0 || channel >= MAX_CHANNEL {
+		return priorityqueue.ErrInvalidChannel
+	}
+	if topic == "" {
+		return fmt.Errorf("%w: empty topic", priorityqueue.ErrInvalidArgument)
+	}
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	if slices.Contains(pq.topics[topic], channel) == subscribed {
+		return nil
+	}
+
+	op := walOp{Op: "unsubscribe", Topic: topic, Channel: channel, Time: time.Now()}
+	if subscribed {
+		op.Op = "subscribe"
+	}
+	if pq.snapshotFile != "" {
+		err := pq.appendWAL(op)
+		if err != nil {
+			log.Printf("Error appending to WAL: %v", err)
+			return err
+		}
+	}
+
+	pq.apply(op)
+	pq.maybeCheckpoint()
+	return nil
+}
+
+func (pq *MemPQueue) Stats() (map[int]priorityqueue.ChannelStats, error) {
+	return pq.StatsContext(context.Background())
+}
+
+// StatsContext returns the statistics of every channel holding items or with non-zero counters.
+func (pq *MemPQueue) StatsContext(ctx context.Context) (map[int]priorityqueue.ChannelStats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pq.processNotBeforeQueue()
+
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	now := time.Now()
+	stats := make([]priorityqueue.ChannelStats, MAX_CHANNEL)
+	overdue := func(channel int, item pqItem) {
+		if !item.Deadline.IsZero() && item.Deadline.Before(now) {
+			stats[channel].Overdue++
+		}
+	}
+	for channel := range pq.pqs {
+		stats[channel].ChannelCounters = pq.counters[channel]
+		config := pq.configs[channel]
+		if config.Partitions > 0 && pq.pqs[channel].Size() > 0 {
+			stats[channel].Partitions = make([]int, config.Partitions)
+		}
+		for _, item := range pq.pqs[channel].Items() {
+			overdue(channel, item)
+			stats[channel].Ready++
+			if stats[channel].Partitions != nil {
+				stats[channel].Partitions[config.Partition(item.PartitionHash)]++
+			}
+			if item.Tenant != "" {
+				if stats[channel].Tenants == nil {
+					stats[channel].Tenants = make(map[string]int)
+				}
+				stats[channel].Tenants[item.Tenant]++
+			}
+			readySince := item.Enqueued
+			if item.Not_before.After(readySince) {
+				readySince = item.Not_before
+			}
+			if !readySince.IsZero() {
+				stats[channel].OldestReadyAge = max(stats[channel].OldestReadyAge, now.Sub(readySince).Seconds())
+			}
+		}
+	}
+	for _, item := range pq.not_before_pq.Items() {
+		overdue(item.Channel, item.Item)
+		stats[item.Channel].Scheduled++
+	}
+	for _, blocked := range pq.blocked {
+		overdue(blocked.Channel, blocked.Item)
+		stats[blocked.Channel].Blocked++
+	}
+	for _, reserved := range pq.reserved {
+		overdue(reserved.Channel, reserved.Item)
+		stats[reserved.Channel].Reserved++
+		stats[reserved.Channel].OldestReservationAge = max(stats[reserved.Channel].OldestReservationAge, now.Sub(reserved.Timestamp).Seconds())
+	}
+
+	result := make(map[int]priorityqueue.ChannelStats)
+	for channel, channelStats := range stats {
+		if !reflect.DeepEqual(channelStats, priorityqueue.ChannelStats{}) {
+			result[channel] = channelStats
+		}
+	}
+	return result, nil
+}
+
+func (pq *MemPQueue) GetResult(itemId string) (string, bool, error) {
+	return pq.GetResultContext(context.Background(), itemId)
+}
+
+// GetResultContext returns the result stored for an item, and whether one exists.
+func (pq *MemPQueue) GetResultContext(ctx context.Context, itemId string) (string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	result, ok := pq.results[itemId]
+	if !ok || !time.Now().Before(result.Expires) {
+		return "", false, nil
+	}
+	if result.KeyId == "" {
+		return result.Value, true, nil
+	}
+	if pq.keyring == nil {
+		return "", false, fmt.Errorf("result of item %s is encrypted but no keyring is set", itemId)
+	}
+	value, err := pq.keyring.Decrypt(result.Value, result.KeyId)
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+func (pq *MemPQueue) GetStatus(itemId string) (priorityqueue.ItemStatus, error) {
+	return pq.GetStatusContext(context.Background(), itemId)
+}
+
+// GetStatusContext returns the status of an unfinished item, or of a finished item within the retention period.
+func (pq *MemPQueue) GetStatusContext(ctx context.Context, itemId string) (priorityqueue.ItemStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return priorityqueue.ItemStatus{}, err
+	}
+	pq.processNotBeforeQueue()
+
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	if b, ok := pq.blocked[itemId]; ok {
+		return itemStatus(b.Item, b.Channel, priorityqueue.STATUS_BLOCKED), nil
+	}
+	for _, reserved := range pq.reserved {
+		if reserved.Item.Id == itemId {
+			status := itemStatus(reserved.Item, reserved.Channel, priorityqueue.STATUS_RESERVED)
+			status.ReservedAt = reserved.Timestamp
+			return status, nil
+		}
+	}
+	for _, nb := range pq.not_before_pq.Items() {
+		if nb.Item.Id == itemId {
+			return itemStatus(nb.Item, nb.Channel, priorityqueue.STATUS_SCHEDULED), nil
+		}
+	}
+	for channel := range pq.pqs {
+		for _, item := range pq.pqs[channel].Items() {
+			if item.Id == itemId {
+				if item.Expired.IsZero() {
+					return itemStatus(item, channel, priorityqueue.STATUS_PENDING), nil
+				}
+				return itemStatus(item, channel, priorityqueue.STATUS_EXPIRED), nil
+			}
+		}
+	}
+
+	t, ok := pq.finished[itemId]
+	if !ok || time.Since(t.Finished) >= pq.retention {
+		return priorityqueue.ItemStatus{}, priorityqueue.ErrItemNotFound
+	}
+	return priorityqueue.ItemStatus{
+		Status:     t.Status,
+		Channel:    t.Channel,
+		Attempts:   t.Attempts,
+		EnqueuedAt: t.Enqueued,
+		FinishedAt: t.Finished,
+	}, nil
+}
+
+func (pq *MemPQueue) PauseChannel(channel int) error {
+	return pq.PauseChannelContext(context.Background(), channel)
+}
+
+// PauseChannelContext stops Dequeue and DequeueWithReservation from serving a channel until it is resumed.
+// Enqueue and requeueing of expired reservations are not affected.
+func (pq *MemPQueue) PauseChannelContext(ctx context.Context, channel int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return pq.setPaused(channel, true)
+}
+
+func (pq *MemPQueue) ResumeChannel(channel int) error {
+	return pq.ResumeChannelContext(context.Background(), channel)
+}
+
+// ResumeChannelContext resumes a paused channel.
+func (pq *MemPQueue) ResumeChannelContext(ctx context.Context, channel int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return pq.setPaused(channel, false)
+}
+
+func (pq *MemPQueue) PausedChannels() ([]int, error) {
+	return pq.PausedChannelsContext(context.Background())
+}
+
+// PausedChannelsContext returns the paused channels in ascending order.
+func (pq *MemPQueue) PausedChannelsContext(ctx context.Context) ([]int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	channels := make([]int, 0, len(pq.paused))
+	for channel := range pq.paused {
+		channels = append(channels, channel)
+	}
+	slices.Sort(channels)
+	return channels, nil
+}
+
+func (pq *MemPQueue) setPaused(channel int, paused bool) error {
+	if channel < 0 || channel >= MAX_CHANNEL {
+		return priorityqueue.ErrInvalidChannel
+	}
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	if pq.paused[channel] == paused {
+		return nil
+	}
+
+	op := "resume"
+	if paused {
+		op = "pause"
+	}
+	if pq.snapshotFile != "" {
+		err := pq.appendWAL(walOp{Op: op, Channel: channel, Time: time.Now()})
+		if err != nil {
+			log.Printf("Error appending to WAL: %v", err)
+			return err
+		}
+	}
+
+	if paused {
+		pq.paused[channel] = true
+	} else {
+		delete(pq.paused, channel)
+	}
+	pq.maybeCheckpoint()
+	return nil
+}
+
+func (pq *MemPQueue) SetChannelConfig(channel int, config priorityqueue.ChannelConfig) error {
+	return pq.SetChannelConfigContext(context.Background(), channel, config)
+}
+
+// SetChannelConfigContext sets the config of a channel, the zero config restores the default.
+// Items already in the channel are reordered.
+func (pq *MemPQueue) SetChannelConfigContext(ctx context.Context, channel int, config priorityqueue.ChannelConfig) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	if err := priorityqueue.ValidateChannelConfig(channel, config, pq.configs); err != nil {
+		return err
+	}
+	if config.Encrypt && pq.keyring == nil {
+		return fmt.Errorf("%w: encryption requires a keyring", priorityqueue.ErrInvalidArgument)
+	}
+	if config.OverdueChannel != nil {
+		overdue := *config.OverdueChannel
+		config.OverdueChannel = &overdue
+	}
+	config.Partitions = pq.configs[channel].Partitions
+
+	op := walOp{Op: "config", Channel: channel, Config: config, Time: time.Now()}
+	if pq.snapshotFile != "" {
+		err := pq.appendWAL(op)
+		if err != nil {
+			log.Printf("Error appending to WAL: %v", err)
+			return err
+		}
+	}
+
+	pq.apply(op)
+	pq.maybeCheckpoint()
+	return nil
+}
+
+func (pq *MemPQueue) RepartitionChannel(channel int, partitions int) error {
+	return pq.RepartitionChannelContext(context.Background(), channel, partitions)
+}
+
+// RepartitionChannelContext changes the number of partitions of a channel, 0 removes the partitioning.
+// Items are rebalanced by their partition hash. The channel must be paused and without reservations,
+// so no consumer holds items assigned by the old partitioning while the new one is served.
+func (pq *MemPQueue) RepartitionChannelContext(ctx context.Context, channel int, partitions int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if channel < 0 || channel >= MAX_CHANNEL {
+		return priorityqueue.ErrInvalidChannel
+	}
+	if err := priorityqueue.ValidatePartitions(partitions); err != nil {
+		return err
+	}
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	if !pq.paused[channel] {
+		return fmt.Errorf("%w: pause the channel before repartitioning it", priorityqueue.ErrInvalidArgument)
+	}
+	for _, reserved := range pq.reserved {
+		if reserved.Channel == channel {
+			return fmt.Errorf("%w: the channel has outstanding reservations", priorityqueue.ErrInvalidArgument)
+		}
+	}
+
+	config := pq.configs[channel]
+	config.Partitions = partitions
+	op := walOp{Op: "config", Channel: channel, Config: config, Time: time.Now()}
+	if pq.snapshotFile != "" {
+		err := pq.appendWAL(op)
+		if err != nil {
+			log.Printf("Error appending to WAL: %v", err)
+			return err
+		}
+	}
+
+	pq.apply(op)
+	pq.maybeCheckpoint()
+	return nil
+}
+
+func (pq *MemPQueue) ChannelConfigs() (map[int]priorityqueue.ChannelConfig, error) {
+	return pq.ChannelConfigsContext(context.Background())
+}
+
+// ChannelConfigsContext returns the config of every channel not using the default.
+func (pq *MemPQueue) ChannelConfigsContext(ctx context.Context) (map[int]priorityqueue.ChannelConfig, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	configs := make(map[int]priorityqueue.ChannelConfig, len(pq.configs))
+	for channel, config := range pq.configs {
+		if config.OverdueChannel != nil {
+			overdue := *config.OverdueChannel
+			config.OverdueChannel = &overdue
+		}
+		configs[channel] = config
+	}
+	return configs, nil
+}
+
+func (pq *MemPQueue) SetRoutingRule(rule priorityqueue.RoutingRule) error {
+	return pq.SetRoutingRuleContext(context.Background(), rule)
+}
+
+// SetRoutingRuleContext adds a routing rule after the existing rules, or replaces the rule with the same name in place.
+func (pq *MemPQueue) SetRoutingRuleContext(ctx context.Context, rule priorityqueue.RoutingRule) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	rule.Conditions = slices.Clone(rule.Conditions)
+	if rule.Prio != nil {
+		prio := *rule.Prio
+		rule.Prio = &prio
+	}
+
+	op := walOp{Op: "rule", Rule: rule, Time: time.Now()}
+	if pq.snapshotFile != "" {
+		err := pq.appendWAL(op)
+		if err != nil {
+			log.Printf("Error appending to WAL: %v", err)
+			return err
+		}
+	}
+
+	pq.apply(op)
+	pq.maybeCheckpoint()
+	return nil
+}
+
+func (pq *MemPQueue) DeleteRoutingRule(name string) (bool, error) {
+	return pq.DeleteRoutingRuleContext(context.Background(), name)
+}
+
+// DeleteRoutingRuleContext removes a routing rule, returns false if there is no rule with the name.
+func (pq *MemPQueue) DeleteRoutingRuleContext(ctx context.Context, name string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	if !slices.ContainsFunc(pq.rules, func(rule priorityqueue.RoutingRule) bool { return rule.Name == name }) {
+		return false, nil
+	}
+
+	op := walOp{Op: "delete_rule", Rule: priorityqueue.RoutingRule{Name: name}, Time: time.Now()}
+	if pq.snapshotFile != "" {
+		err := pq.appendWAL(op)
+		if err != nil {
+			log.Printf("Error appending to WAL: %v", err)
+			return false, err
+		}
+	}
+
+	pq.apply(op)
+	pq.maybeCheckpoint()
+	return true, nil
+}
+
+func (pq *MemPQueue) RoutingRules() ([]priorityqueue.RoutingRule, error) {
+	return pq.RoutingRulesContext(context.Background())
+}
+
+// RoutingRulesContext returns the routing rules in the order they are evaluated.
+func (pq *MemPQueue) RoutingRulesContext(ctx context.Context) ([]priorityqueue.RoutingRule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	rules := make([]priorityqueue.RoutingRule, len(pq.rules))
+	for i, rule := range pq.rules {
+		rule.Conditions = slices.Clone(rule.Conditions)
+		if rule.Prio != nil {
+			prio := *rule.Prio
+			rule.Prio = &prio
+		}
+		rules[i] = rule
+	}
+	return rules, nil
+}
+
+func (pq *MemPQueue) SetChannelSchema(channel int, schema priorityqueue.Schema) (int, error) {
+	return pq.SetChannelSchemaContext(context.Background(), channel, schema)
+}
+
+// SetChannelSchemaContext stores a new version of the schema of a channel and returns its version number.
+func (pq *MemPQueue) SetChannelSchemaContext(ctx context.Context, channel int, schema priorityqueue.Schema) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := priorityqueue.ValidateChannel(channel); err != nil {
+		return 0, err
+	}
+	if err := schema.Validate(); err != nil {
+		return 0, err
+	}
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	version := priorityqueue.SchemaVersion{Channel: channel, Version: len(pq.schemas[channel]) + 1, Schema: schema.Clone(), CreatedAt: time.Now().UTC()}
+	op := walOp{Op: "schema", Channel: channel, Schema: version, Time: time.Now()}
+	if pq.snapshotFile != "" {
+		err := pq.appendWAL(op)
+		if err != nil {
+			log.Printf("Error appending to WAL: %v", err)
+			return 0, err
+		}
+	}
+
+	pq.apply(op)
+	pq.maybeCheckpoint()
+	return version.Version, nil
+}
+
+func (pq *MemPQueue) DeleteChannelSchema(channel int) (bool, error) {
+	return pq.DeleteChannelSchemaContext(context.Background(), channel)
+}
+
+// DeleteChannelSchemaContext removes all versions of the schema of a channel, returns false if it has none.
+func (pq *MemPQueue) DeleteChannelSchemaContext(ctx context.Context, channel int) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if err := priorityqueue.ValidateChannel(channel); err != nil {
+		return false, err
+	}
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	if len(pq.schemas[channel]) == 0 {
+		return false, nil
+	}
+
+	op := walOp{Op: "delete_schema", Channel: channel, Time: time.Now()}
+	if pq.snapshotFile != "" {
+		err := pq.appendWAL(op)
+		if err != nil {
+			log.Printf("Error appending to WAL: %v", err)
+			return false, err
+		}
+	}
+
+	pq.apply(op)
+	pq.maybeCheckpoint()
+	return true, nil
+}
+
+func (pq *MemPQueue) ChannelSchemas(channel int) ([]priorityqueue.SchemaVersion, error) {
+	return pq.ChannelSchemasContext(context.Background(), channel)
+}
+
+// ChannelSchemasContext returns the versions of the schema of a channel, oldest first.
+func (pq *MemPQueue) ChannelSchemasContext(ctx context.Context, channel int) ([]priorityqueue.SchemaVersion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := priorityqueue.ValidateChannel(channel); err != nil {
+		return nil, err
+	}
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	versions := make([]priorityqueue.SchemaVersion, len(pq.schemas[channel]))
+	for i, version := range pq.schemas[channel] {
+		version.Schema = version.Schema.Clone()
+		versions[i] = version
+	}
+	return versions, nil
+}
+
+func (pq *MemPQueue) RequeueExpiredReservations(timeout time.Duration) (int, error) {
+	return pq.RequeueExpiredReservationsContext(context.Background(), timeout)
+}
+
+func (pq *MemPQueue) RequeueExpiredReservationsContext(ctx context.Context, timeout time.Duration) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	defer pq.flush()
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	now := time.Now()
+	return pq.expire(func(reserved reservedItem) bool {
+		return now.Sub(reserved.Timestamp) > timeout
+	})
+}
+
+func (pq *MemPQueue) RequeueConsumerReservations(consumer string) (int, error) {
+	return pq.RequeueConsumerReservationsContext(context.Background(), consumer)
+}
+
+// RequeueConsumerReservationsContext expires all reservations of a consumer now, without waiting for their timeout.
+func (pq *MemPQueue) RequeueConsumerReservationsContext(ctx context.Context, consumer string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if consumer == "" {
+		return 0, fmt.Errorf("%w: missing consumer", priorityqueue.ErrInvalidArgument)
+	}
+	defer pq.flush()
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	return pq.expire(func(reserved reservedItem) bool {
+		return reserved.Consumer == consumer
+	})
+}
+
+// expire requeues the matching reservations as expired, callers must hold pq.mu.
+func (pq *MemPQueue) expire(match func(reservedItem) bool) (int, error) {
+	c := 0
+	for reservationId, reserved := range pq.reserved {
+		if match(reserved) {
+			op := walOp{Op: "expire", ResId: reservationId, Time: time.Now()}
+			if pq.snapshotFile != "" {
+				if err := pq.appendWAL(op); err != nil {
+					return c, err
+				}
+			}
+
+			pq.apply(op)
+			c++
+			pq.maybeCheckpoint()
+		}
+	}
+	return c, nil
+}
+
+func (pq *MemPQueue) ResetQueue() error {
+	return pq.ResetQueueContext(context.Background())
+}
+
+func (pq *MemPQueue) ResetQueueContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer pq.flush()
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	pqs := make([]*channelQueue, MAX_CHANNEL)
+	for i := 0; i < MAX_CHANNEL; i++ {
+		pqs[i] = newChannelQueue(less, false)
+	}
+
+	pq.pqs = pqs
+	pq.not_before_pq = newNotBeforeHeap()
+	pq.reserved = make(map[string]reservedItem)
+	pq.blocked = make(map[string]blockedItem)
+	pq.dependents = make(map[string][]string)
+	pq.results = make(map[string]storedResult)
+	pq.paused = make(map[int]bool)
+	pq.topics = make(map[string][]int)
+	pq.configs = make(map[int]priorityqueue.ChannelConfig)
+	pq.keys = make(map[coalesceKey]string)
+	pq.cursors = make(map[int]string)
+	pq.rules = nil
+	pq.schemas = make(map[int][]priorityqueue.SchemaVersion)
+	pq.counters = make([]priorityqueue.ChannelCounters, MAX_CHANNEL)
+	pq.finished = make(map[string]tombstone)
+	pq.finishedOrder = nil
+	refs := pq.blobRefs
+	pq.blobRefs = make(map[string]int)
+	pq.events = append(pq.events, priorityqueue.Event{Type: priorityqueue.EVENT_RESET, Time: time.Now()})
+
+	if pq.snapshotFile != "" {
+		if err := os.Remove(pq.snapshotFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Remove(pq.walFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if pq.blobs != nil {
+		for ref := range refs {
+			if err := pq.blobs.Delete(ref); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (pq *MemPQueue) processNotBeforeQueue() {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	defer pq.moveOverdue() // once the due items have reached their channels
+	for {
+		if pq.not_before_pq.IsEmpty() {
+			return
+		}
+		notBeforeItem, err := pq.not_before_pq.Peek()
+		if err != nil {
+			log.Printf("Error peeking not_before_pq in processNotBefore: %v", err)
+			return
+		}
+		if time.Now().Before(notBeforeItem.Item.Not_before) {
+			return
+
+		}
+		notBeforeItem, err = pq.not_before_pq.Dequeue()
+		if err != nil {
+			log.Printf("Error dequeueing not_before_pq in processNotBefore: %v", err)
+			return
+		}
+
+		if pq.snapshotFile != "" {
+			err := pq.appendWAL(walOp{Op: "enqueue", Channel: notBeforeItem.Channel, Item: notBeforeItem.Item, Time: time.Now()})
+			if err != nil {
+				log.Printf("Error appending to WAL: %v", err)
+				pq.not_before_pq.Enqueue(notBeforeItem)
+				return
+			}
+		}
+		pq.pqs[notBeforeItem.Channel].Enqueue(notBeforeItem.Item)
+		pq.maybeCheckpoint()
+	}
+}
+
+// moveOverdue moves ready items past their deadline from EDF channels to their overdue channels.
+// EDF channels are ordered by deadline, so only the heads need to be checked.
+func (pq *MemPQueue) moveOverdue() {
+	now := time.Now()
+	for channel, config := range pq.configs {
+		if !config.EDF || config.OverdueChannel == nil {
+			continue
+		}
+		for {
+			item, err := pq.pqs[channel].Peek()
+			if err != nil || item.Deadline.IsZero() || !item.Deadline.Before(now) {
+				break
+			}
+			op := walOp{Op: "move", Channel: channel, To: *config.OverdueChannel, Item: item, Time: now}
+			if pq.snapshotFile != "" {
+				if err := pq.appendWAL(op); err != nil {
+					log.Printf("Error appending to WAL: %v", err)
+					return
+				}
+			}
+			pq.apply(op)
+			pq.maybeCheckpoint()
+		}
+	}
+}
+
+// operation builders and apply, callers must hold pq.mu
+
+// enqueueOp builds the operation enqueueing a new item.
+// Parents in done are treated as completed.
+func (pq *MemPQueue) enqueueOp(obj string, prio float64, channel int, notBefore time.Time, opts priorityqueue.EnqueueOptions, done map[string]bool) (walOp, error) {
+	if channel < 0 || channel >= MAX_CHANNEL {
+		return walOp{}, priorityqueue.ErrInvalidChannel
+	}
+	if opts.ReplyTo != nil && (*opts.ReplyTo < 0 || *opts.ReplyTo >= MAX_CHANNEL) {
+		return walOp{}, priorityqueue.ErrInvalidChannel
+	}
+	if err := priorityqueue.ValidateAttributes(opts.Attributes); err != nil {
+		return walOp{}, err
+	}
+	if err := priorityqueue.CheckSchema(pq.schemas[channel], obj); err != nil {
+		return walOp{}, err
+	}
+
+	obj, keyId, err := pq.seal(channel, obj)
+	if err != nil {
+		return walOp{}, err
+	}
+	obj, blob, err := pq.offload(obj)
+	if err != nil {
+		return walOp{}, err
+	}
+
+	now := time.Now()
+	pqItem := pqItem{Id: uuid.New().String(), Obj: obj, Blob: blob, KeyId: keyId, Prio: prio, Not_before: notBefore, Enqueued: now, Deadline: opts.Deadline, Tenant: opts.Tenant}
+	if opts.PartitionKey != "" {
+		pqItem.PartitionHash = priorityqueue.PartitionHash(opts.PartitionKey)
+	} else {
+		pqItem.PartitionHash = priorityqueue.PartitionHash(pqItem.Id)
+	}
+
+	if len(opts.Attributes) > 0 {
+		pqItem.Attributes = make(map[string]string, len(opts.Attributes))
+		for key, value := range opts.Attributes {
+			pqItem.Attributes[key] = value
+		}
+	}
+
+	if !pq.isMinQueue {
+		pqItem.Prio = -prio
+	}
+
+	if opts.CoalesceKey != "" {
+		if id, ok := pq.keys[coalesceKey{channel, opts.CoalesceKey}]; ok {
+			if pending, ok := pq.pending(channel, id); ok {
+				pending.Obj = obj
+				pending.Blob = blob
+				pending.KeyId = keyId
+				if opts.CoalescePrio {
+					pending.Prio = pqItem.Prio
+				}
+				if opts.CoalesceNotBefore {
+					pending.Not_before = notBefore
+				}
+				return walOp{Op: "coalesce", Channel: channel, Item: pending, Time: now}, nil
+			}
+		}
+		pqItem.CoalesceKey = opts.CoalesceKey
+	}
+
+	if opts.ReplyTo != nil {
+		replyTo := *opts.ReplyTo
+		pqItem.ReplyTo = &replyTo
+		pqItem.CorrelationId = opts.CorrelationId
+		if pqItem.CorrelationId == "" {
+			pqItem.CorrelationId = pqItem.Id
+		}
+	}
+
+	var parents []string
+	for _, parent := range pq.unfinished(opts.DependsOn) {
+		if !done[parent] {
+			parents = append(parents, parent)
+		}
+	}
+	if len(parents) > 0 {
+		return walOp{Op: "enqueue_blocked", Channel: channel, Item: pqItem, Parents: parents, Time: now}, nil
+	}
+	if !notBefore.IsZero() && now.Before(notBefore) {
+		return walOp{Op: "enqueue_notbefore", Channel: channel, Item: pqItem, Time: now}, nil
+	}
+	return walOp{Op: "enqueue", Channel: channel, Item: pqItem, Time: now}, nil
+}
+
+// confirmOp builds the operation confirming a reservation, including the reply to enqueue, if any.
+func (pq *MemPQueue) confirmOp(reservationId string, claim priorityqueue.ReservationClaim, result string, ttl time.Duration) (walOp, error) {
+	reserved, exists := pq.reserved[reservationId]
+	if !exists {
+		return walOp{}, priorityqueue.ErrReservationNotFound
+	}
+	if err := claim.Check(reserved.Consumer, reserved.Token); err != nil {
+		return walOp{}, err
+	}
+
+	now := time.Now()
+	op := walOp{Op: "confirm", ResId: reservationId, Time: now}
+	if result != "" {
+		value, keyId, err := pq.seal(reserved.Channel, result)
+		if err != nil {
+			return walOp{}, err
+		}
+		op.Result = storedResult{Value: value, KeyId: keyId, Expires: now.Add(ttl)}
+		if reserved.Item.ReplyTo != nil {
+			reply := priorityqueue.ReplyPayload(reserved.Item.CorrelationId, result)
+			if err := priorityqueue.CheckSchema(pq.schemas[*reserved.Item.ReplyTo], reply); err != nil {
+				return walOp{}, err
+			}
+			obj, keyId, err := pq.seal(*reserved.Item.ReplyTo, reply)
+			if err != nil {
+				return walOp{}, err
+			}
+			obj, blob, err := pq.offload(obj)
+			if err != nil {
+				return walOp{}, err
+			}
+			op.Channel = *reserved.Item.ReplyTo
+			op.Item = pqItem{
+				Id:       uuid.New().String(),
+				Obj:      obj,
+				Blob:     blob,
+				KeyId:    keyId,
+				Prio:     reserved.Item.Prio,
+				Enqueued: now,
+			}
+			op.Item.PartitionHash = priorityqueue.PartitionHash(op.Item.Id)
+		}
+	}
+	return op, nil
+}
+
+func (pq *MemPQueue) releaseOp(reservationId string, claim priorityqueue.ReservationClaim) (walOp, error) {
+	reserved, exists := pq.reserved[reservationId]
+	if !exists {
+		return walOp{}, priorityqueue.ErrReservationNotFound
+	}
+	if err := claim.Check(reserved.Consumer, reserved.Token); err != nil {
+		return walOp{}, err
+	}
+	return walOp{Op: "release", ResId: reservationId, Time: time.Now()}, nil
+}
+
+// apply applies a logged operation, both for live operations and when replaying the WAL.
+func (pq *MemPQueue) apply(op walOp) {
+	op.Item = partitioned(op.Item)
+	switch op.Op {
+	case "enqueue":
+		// An item moved from not_before_pq is logged as a plain enqueue
+		if op.Item.Id == "" {
+			pq.counters[op.Channel].Enqueued++
+		} else if _, moved := pq.deleteNotBefore(op.Item.Id); !moved {
+			pq.retainBlob(op.Item)
+			pq.counters[op.Channel].Enqueued++
+			pq.record(priorityqueue.EVENT_ENQUEUE, op.Channel, op.Item, op.Time)
+		}
+		pq.pqs[op.Channel].Enqueue(op.Item)
+		pq.index(op.Item, op.Channel)
+	case "enqueue_notbefore":
+		pq.not_before_pq.Enqueue(notBeforeItem{
+			Item:    op.Item,
+			Channel: op.Channel,
+		})
+		pq.index(op.Item, op.Channel)
+		pq.retainBlob(op.Item)
+		pq.counters[op.Channel].Enqueued++
+		pq.record(priorityqueue.EVENT_ENQUEUE, op.Channel, op.Item, op.Time)
+	case "enqueue_blocked":
+		pq.block(op.Item, op.Channel, op.Parents)
+		pq.index(op.Item, op.Channel)
+		pq.retainBlob(op.Item)
+		pq.counters[op.Channel].Enqueued++
+		pq.record(priorityqueue.EVENT_ENQUEUE, op.Channel, op.Item, op.Time)
+	case "coalesce":
+		pq.replace(op.Channel, op.Item, op.Time)
+	case "dequeue":
+		// Remove the dequeued item from the queue
+		if op.Item.Id != "" {
+			item, _ := pq.take(op.Channel, op.Item.Id)
+			pq.served(op.Channel, item)
+			pq.unindex(item, op.Channel)
+			pq.complete(op.Item.Id)
+			pq.finish(item, op.Channel, priorityqueue.STATUS_COMPLETED, op.Time)
+			pq.record(priorityqueue.EVENT_DEQUEUE, op.Channel, item, op.Time)
+		} else if item, err := pq.pqs[op.Channel].Dequeue(); err == nil {
+			pq.unindex(item, op.Channel)
+		}
+		pq.counters[op.Channel].Dequeued++
+	case "dequeueWithReservation":
+		// Remove from queue and add to reserved
+		var item pqItem
+		var err error
+		if op.Item.Id != "" {
+			var ok bool
+			if item, ok = pq.take(op.Channel, op.Item.Id); !ok {
+				err = priorityqueue.ErrEmpty
+			}
+		} else {
+			item, err = pq.pqs[op.Channel].Dequeue()
+		}
+		if err == nil {
+			pq.served(op.Channel, item)
+			pq.reserve(op.ResId, item, op.Channel, op.Consumer, op.Token, op.Time)
+		}
+	case "confirm":
+		// Remove reservation, release dependents and enqueue the reply
+		reserved, ok := pq.reserved[op.ResId]
+		if !ok {
+			return
+		}
+		delete(pq.reserved, op.ResId)
+		pq.retainBlob(op.Item) // before finish releases the confirmed item, the reply may share its blob
+		pq.complete(reserved.Item.Id)
+		pq.finish(reserved.Item, reserved.Channel, priorityqueue.STATUS_COMPLETED, op.Time)
+		pq.storeResult(reserved.Item.Id, op.Result, op.Time)
+		pq.counters[reserved.Channel].Confirmed++
+		pq.record(priorityqueue.EVENT_CONFIRM, reserved.Channel, reserved.Item, op.Time)
+		if op.Item.Id != "" {
+			pq.pqs[op.Channel].Enqueue(op.Item)
+			pq.counters[op.Channel].Enqueued++
+			pq.record(priorityqueue.EVENT_ENQUEUE, op.Channel, op.Item, op.Time)
+		}
+	case "release", "expire":
+		// Released and expired reservations, expired reservations were logged as release before item statuses existed
+		if reserved, ok := pq.reserved[op.ResId]; ok {
+			delete(pq.reserved, op.ResId)
+			event := priorityqueue.EVENT_REQUEUE
+			if op.Op == "expire" {
+				reserved.Item.Expired = op.Time
+				event = priorityqueue.EVENT_EXPIRE
+			}
+			pq.pqs[reserved.Channel].Enqueue(reserved.Item)
+			pq.counters[reserved.Channel].Requeued++
+			pq.record(event, reserved.Channel, reserved.Item, op.Time)
+		}
+	case "extend":
+		if reserved, ok := pq.reserved[op.ResId]; ok {
+			reserved.Timestamp = op.Time
+			pq.reserved[op.ResId] = reserved
+		}
+	case "delete":
+		pq.delete(op.Item.Id, op.Time)
+	case "delete_reserved":
+		// Remove reservation by value (reserved item)
+		for id, reserved := range pq.reserved {
+			if sameItem(reserved.Item, op.Item) && reserved.Channel == op.Channel {
+				delete(pq.reserved, id)
+				break
+			}
+		}
+	case "move":
+		if item, ok := pq.take(op.Channel, op.Item.Id); ok {
+			pq.unindex(item, op.Channel)
+			item.CoalesceKey = ""
+			pq.pqs[op.To].Enqueue(item)
+		}
+	case "config":
+		if op.Config == (priorityqueue.ChannelConfig{}) {
+			delete(pq.configs, op.Channel)
+		} else {
+			pq.configs[op.Channel] = op.Config
+		}
+		pq.reorder(op.Channel)
+	case "rule":
+		if i := slices.IndexFunc(pq.rules, func(rule priorityqueue.RoutingRule) bool { return rule.Name == op.Rule.Name }); i >= 0 {
+			pq.rules[i] = op.Rule
+		} else {
+			pq.rules = append(pq.rules, op.Rule)
+		}
+	case "delete_rule":
+		pq.rules = slices.DeleteFunc(pq.rules, func(rule priorityqueue.RoutingRule) bool { return rule.Name == op.Rule.Name })
+	case "schema":
+		pq.schemas[op.Channel] = append(pq.schemas[op.Channel], op.Schema)
+	case "delete_schema":
+		delete(pq.schemas, op.Channel)
+	case "pause":
+		pq.paused[op.Channel] = true
+	case "resume":
+		delete(pq.paused, op.Channel)
+	case "subscribe":
+		if !slices.Contains(pq.topics[op.Topic], op.Channel) {
+			pq.topics[op.Topic] = append(pq.topics[op.Topic], op.Channel)
+			slices.Sort(pq.topics[op.Topic])
+		}
+	case "unsubscribe":
+		pq.topics[op.Topic] = slices.DeleteFunc(pq.topics[op.Topic], func(channel int) bool { return channel == op.Channel })
+		if len(pq.topics[op.Topic]) == 0 {
+			delete(pq.topics, op.Topic)
+		}
+	case "tx":
+		// The payloads of the group are held while it is applied, so blobs shared with items
+		// finished by the group are not removed before the items of the group retain them
+		for _, sub := range op.Group {
+			pq.retainBlob(sub.Item)
+		}
+		for _, sub := range op.Group {
+			pq.apply(sub)
+		}
+		for _, sub := range op.Group {
+			pq.releaseBlob(sub.Item)
+		}
+	}
+}
+
+// dependency helpers, callers must hold pq.mu
+
+// unfinished returns the distinct ids among ids that refer to items not yet completed.
+func (pq *MemPQueue) unfinished(ids []string) []string {
+	var res []string
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		if pq.isUnfinished(id) {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+func (pq *MemPQueue) isUnfinished(id string) bool {
+	if _, ok := pq.blocked[id]; ok {
+		return true
+	}
+	for _, reserved := range pq.reserved {
+		if reserved.Item.Id == id {
+			return true
+		}
+	}
+	if _, ok := pq.not_before_pq.Get(id); ok {
+		return true
+	}
+	for i := range pq.pqs {
+		if _, ok := pq.pqs[i].Get(id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (pq *MemPQueue) block(item pqItem, channel int, parents []string) {
+	pq.blocked[item.Id] = blockedItem{Item: item, Channel: channel, Parents: parents}
+	for _, parent := range parents {
+		pq.dependents[parent] = append(pq.dependents[parent], item.Id)
+	}
+}
+
+// complete releases the dependents of a completed item.
+// Released items with a not-before time go through not_before_pq, which moves them on when due.
+func (pq *MemPQueue) complete(id string) {
+	children, ok := pq.dependents[id]
+	if !ok {
+		return
+	}
+	delete(pq.dependents, id)
+	for _, child := range children {
+		b, ok := pq.blocked[child]
+		if !ok {
+			continue
+		}
+		parents := b.Parents[:0]
+		for _, parent := range b.Parents {
+			if parent != id {
+				parents = append(parents, parent)
+			}
+		}
+		if len(parents) > 0 {
+			b.Parents = parents
+			pq.blocked[child] = b
+			continue
+		}
+		delete(pq.blocked, child)
+		if b.Item.Not_before.IsZero() {
+			pq.pqs[b.Channel].Enqueue(b.Item)
+		} else {
+			pq.not_before_pq.Enqueue(notBeforeItem{Item: b.Item, Channel: b.Channel})
+		}
+	}
+}
+
+// delete removes an unfinished item and, recursively, the items depending on it.
+func (pq *MemPQueue) delete(id string, now time.Time) {
+	var item pqItem
+	var channel int
+	found := true
+	if b, ok := pq.blocked[id]; ok {
+		delete(pq.blocked, id)
+		item, channel = b.Item, b.Channel
+	} else if reserved, ok := pq.deleteReserved(id); ok {
+		item, channel = reserved.Item, reserved.Channel
+	} else if nb, ok := pq.deleteNotBefore(id); ok {
+		item, channel = nb.Item, nb.Channel
+	} else {
+		found = false
+		for i := range pq.pqs {
+			if item, found = pq.take(i, id); found {
+				channel = i
+				break
+			}
+		}
+	}
+	if found {
+		pq.unindex(item, channel)
+		pq.finish(item, channel, priorityqueue.STATUS_DELETED, now)
+		pq.record(priorityqueue.EVENT_DELETE, channel, item, now)
+	}
+
+	children := pq.dependents[id]
+	delete(pq.dependents, id)
+	for _, child := range children {
+		pq.delete(child, now)
+	}
+}
+
+func (pq *MemPQueue) deleteReserved(id string) (reservedItem, bool) {
+	for reservationId, reserved := range pq.reserved {
+		if reserved.Item.Id == id {
+			delete(pq.reserved, reservationId)
+			return reserved, true
+		}
+	}
+	return reservedItem{}, false
+}
+
+func (pq *MemPQueue) deleteNotBefore(id string) (notBeforeItem, bool) {
+	return pq.not_before_pq.Remove(id)
+}
+
+// take removes the item with the given id from a channel.
+func (pq *MemPQueue) take(channel int, id string) (pqItem, bool) {
+	return pq.pqs[channel].Remove(id)
+}
+
+// takeNext removes and returns up to n items served next from a channel among the items matching the filter
+// and, if set, in the given partition. Matching items are looked up in the order of the channel, so payloads
+// of offloaded items after the n-th match are not read.
+func (pq *MemPQueue) takeNext(channel int, filter priorityqueue.Filter, partition *int, n int) []pqItem {
+	var items []pqItem
+	if pq.configs[channel].Fair {
+		for len(items) < n {
+			item, ok := pq.nextFair(channel, filter, partition)
+			if !ok {
+				break
+			}
+			pq.pqs[channel].removeItem(item)
+			pq.served(channel, item)
+			items = append(items, item)
+		}
+		return items
+	}
+	if filter.IsEmpty() && partition == nil {
+		for len(items) < n {
+			item, err := pq.pqs[channel].Dequeue()
+			if err != nil {
+				break
+			}
+			items = append(items, item)
+		}
+		return items
+	}
+	items = pq.pqs[channel].Matching(func(item pqItem) bool {
+		return pq.inPartition(channel, partition, item) && pq.match(filter, item)
+	}, n)
+	for _, item := range items {
+		pq.pqs[channel].removeItem(item)
+	}
+	return items
+}
+
+// untake puts items taken by takeNext back in their channel and moves the round-robin cursor back to where it was.
+func (pq *MemPQueue) untake(channel int, items []pqItem, cursor string, hasCursor bool) {
+	for _, item := range items {
+		pq.pqs[channel].Enqueue(item)
+	}
+	if hasCursor {
+		pq.cursors[channel] = cursor
+	} else {
+		delete(pq.cursors, channel)
+	}
+}
 
-		pq.pqs[channel].Enqueue(pqItem)
+// nextFair returns the first item, in the order of the channel, of the tenant following
+// the tenant served last, wrapping around to the first tenant.
+func (pq *MemPQueue) nextFair(channel int, filter priorityqueue.Filter, partition *int) (pqItem, bool) {
+	cursor, ok := pq.cursors[channel]
+	return pq.pqs[channel].nextTenant(cursor, ok, func(item pqItem) bool {
+		return pq.inPartition(channel, partition, item) && pq.match(filter, item)
+	})
+}
 
-		pq.maybeCheckpoint()
-	}
+// inPartition reports whether an item is in the given partition of a channel, any partition if it is nil.
+func (pq *MemPQueue) inPartition(channel int, partition *int, item pqItem) bool {
+	return partition == nil || pq.configs[channel].Partition(item.PartitionHash) == *partition
+}
 
-	return nil
+// served moves the round-robin cursor of a fair channel past the tenant of an item.
+func (pq *MemPQueue) served(channel int, item pqItem) {
+	if pq.configs[channel].Fair {
+		pq.cursors[channel] = item.Tenant
+	}
 }
 
-func (pq *MemPQueue) Dequeue(channel int) (string, error) {
-	if channel < 0 || channel >= MAX_CHANNEL {
-		return "", errors.New(INVALID_CHANNEL_MSG)
+// lessFor returns the ordering of a channel.
+func (pq *MemPQueue) lessFor(channel int) func(i, j pqItem) bool {
+	if pq.configs[channel].EDF {
+		return lessDeadline
 	}
+	return less
+}
 
-	pq.processNotBeforeQueue()
+// reorder rebuilds the heap of a channel after its ordering or fair mode has changed.
+func (pq *MemPQueue) reorder(channel int) {
+	pq.pqs[channel].reorder(pq.lessFor(channel), pq.configs[channel].Fair)
+}
 
-	pq.mu.Lock()
-	defer pq.mu.Unlock()
+// coalesce key helpers, callers must hold pq.mu
 
-	item, err := pq.pqs[channel].Dequeue()
-	if err != nil {
-		return "", err
+func (pq *MemPQueue) index(item pqItem, channel int) {
+	if item.CoalesceKey != "" {
+		pq.keys[coalesceKey{channel, item.CoalesceKey}] = item.Id
 	}
+}
 
-	if pq.snapshotFile != "" {
-		err := pq.appendWAL(walOp{Op: "dequeue", Channel: channel, Item: item, Time: time.Now()})
-		if err != nil {
-			log.Printf("Error appending to WAL: %v", err)
-			pq.pqs[channel].Enqueue(item)
-			return "", err
-
-		}
-		pq.maybeCheckpoint()
+func (pq *MemPQueue) unindex(item pqItem, channel int) {
+	key := coalesceKey{channel, item.CoalesceKey}
+	if item.CoalesceKey != "" && pq.keys[key] == item.Id {
+		delete(pq.keys, key)
 	}
-
-	return item.Obj, nil
 }
 
-// DequeueWithReservation dequeues an item and reserves it with a unique reservation ID.
-// The reservation ID can be used to confirm the reservation later.
-// returns the dequeued item and the reservation ID.
-func (pq *MemPQueue) DequeueWithReservation(channel int) (string, string, error) {
-	if channel < 0 || channel >= MAX_CHANNEL {
-		return "", "", errors.New(INVALID_CHANNEL_MSG)
+// pending returns an item that is blocked, scheduled or ready in a channel.
+func (pq *MemPQueue) pending(channel int, id string) (pqItem, bool) {
+	if b, ok := pq.blocked[id]; ok {
+		return b.Item, true
 	}
-	pq.processNotBeforeQueue()
-
-	pq.mu.Lock()
-	defer pq.mu.Unlock()
+	if nb, ok := pq.not_before_pq.Get(id); ok {
+		return nb.Item, true
+	}
+	return pq.pqs[channel].Get(id)
+}
 
-	item, err := pq.pqs[channel].Dequeue()
-	if err != nil {
-		return "", "", err
+// replace replaces a pending item by its coalesced version, moving it between
+// not_before_pq and its channel when its not-before time has changed.
+func (pq *MemPQueue) replace(channel int, item pqItem, now time.Time) {
+	if b, ok := pq.blocked[item.Id]; ok {
+		pq.retainBlob(item)
+		pq.releaseBlob(b.Item)
+		b.Item = item
+		pq.blocked[item.Id] = b
+		return
+	}
+	old, ok := pq.deleteNotBefore(item.Id)
+	previous := old.Item
+	if !ok {
+		if previous, ok = pq.take(channel, item.Id); !ok {
+			return
+		}
+	}
+	pq.retainBlob(item) // before the release, the items may share a blob
+	pq.releaseBlob(previous)
+	if !item.Not_before.IsZero() && now.Before(item.Not_before) {
+		pq.not_before_pq.Enqueue(notBeforeItem{Item: item, Channel: channel})
+	} else {
+		pq.pqs[channel].Enqueue(item)
 	}
+}
 
-	reservationId := uuid.New().String()
+// reserve adds a reservation for an item taken from its channel.
+// Replayed reservations logged before fencing tokens existed keep token 0.
+func (pq *MemPQueue) reserve(reservationId string, item pqItem, channel int, consumer string, token int64, now time.Time) {
+	pq.unindex(item, channel)
+	item.Attempts++
+	item.Expired = time.Time{}
+	item.CoalesceKey = ""
 	pq.reserved[reservationId] = reservedItem{
 		Item:      item,
 		Channel:   channel,
-		Timestamp: time.Now(),
+		Timestamp: now,
+		Consumer:  consumer,
+		Token:     token,
 	}
+	pq.fence = max(pq.fence, token)
+	pq.counters[channel].Dequeued++
+	pq.record(priorityqueue.EVENT_RESERVE, channel, item, now)
+}
 
-	if pq.snapshotFile != "" {
-		err := pq.appendWAL(walOp{Op: "dequeueWithReservation", Channel: channel, Item: item, ResId: reservationId, Time: time.Now()})
-		if err != nil {
-			log.Printf("Error appending to WAL: %v", err)
-			pq.pqs[channel].Enqueue(item)
-			delete(pq.reserved, reservationId)
-			return "", "", err
+// finish keeps the status of a completed or deleted item and drops the statuses past the retention period.
+// The offloaded payload of the item is released.
+func (pq *MemPQueue) finish(item pqItem, channel int, status string, now time.Time) {
+	pq.releaseBlob(item)
+	for len(pq.finishedOrder) > 0 {
+		id := pq.finishedOrder[0]
+		if t, ok := pq.finished[id]; ok && now.Sub(t.Finished) < pq.retention {
+			break
 		}
-		pq.maybeCheckpoint()
+		delete(pq.finished, id)
+		pq.finishedOrder = pq.finishedOrder[1:]
+	}
+	if item.Id == "" || pq.retention <= 0 {
+		return
 	}
-	return item.Obj, reservationId, nil
+	pq.finished[item.Id] = tombstone{
+		Id:       item.Id,
+		Status:   status,
+		Channel:  channel,
+		Attempts: item.Attempts,
+		Enqueued: item.Enqueued,
+		Finished: now,
+	}
+	pq.finishedOrder = append(pq.finishedOrder, item.Id)
 }
 
-func (pq *MemPQueue) ConfirmReservation(reservationId string) (bool, error) {
-	pq.mu.Lock()
-	defer pq.mu.Unlock()
+// payload helpers, callers must hold pq.mu
 
-	_, exists := pq.reserved[reservationId]
-	if !exists {
-		return false, errors.New("invalid or expired reservation ID")
+// seal encrypts a payload enqueued to a channel with Encrypt set, returning the payload to keep and the key id, if any.
+func (pq *MemPQueue) seal(channel int, obj string) (string, string, error) {
+	if !pq.configs[channel].Encrypt {
+		return obj, "", nil
 	}
-
-	if pq.snapshotFile != "" {
-		err := pq.appendWAL(walOp{Op: "confirm", ResId: reservationId, Time: time.Now()})
-		if err != nil {
-			log.Printf("Error appending to WAL: %v", err)
-			return false, err
-		}
+	if pq.keyring == nil {
+		return "", "", fmt.Errorf("channel %d encrypts payloads but no keyring is set", channel)
 	}
-
-	delete(pq.reserved, reservationId)
-	pq.maybeCheckpoint()
-	return true, nil
+	return pq.keyring.Encrypt(obj)
 }
 
-func (pq *MemPQueue) RequeueExpiredReservations(timeout time.Duration) (int, error) {
-	pq.mu.Lock()
-	defer pq.mu.Unlock()
-
-	c := 0
-	now := time.Now()
-	for reservationId, reserved := range pq.reserved {
-		if now.Sub(reserved.Timestamp) > timeout {
-			if pq.snapshotFile != "" {
-				err := pq.appendWAL(walOp{Op: "delete_reserved", Channel: reserved.Channel, Item: reserved.Item, Time: time.Now()})
-				if err != nil {
-					return c, err
-				}
-				err = pq.appendWAL(walOp{Op: "enqueue", Channel: reserved.Channel, Item: reserved.Item, Time: time.Now()})
-				if err != nil {
-					return c, err
-				}
-			}
+// offload stores a payload above the blob threshold in the blob store,
+// returning the payload to keep in the item and the reference of the blob, if any.
+func (pq *MemPQueue) offload(obj string) (string, string, error) {
+	if pq.blobs == nil || len(obj) <= pq.blobThreshold {
+		return obj, "", nil
+	}
+	ref, err := pq.blobs.Put(obj)
+	if err != nil {
+		return "", "", err
+	}
+	return "", ref, nil
+}
 
-			pq.pqs[reserved.Channel].Enqueue(reserved.Item)
-			delete(pq.reserved, reservationId)
-			c++
-			pq.maybeCheckpoint()
+// payload returns the payload of an item, read from the blob store if offloaded and decrypted if encrypted.
+func (pq *MemPQueue) payload(item pqItem) (string, error) {
+	obj := item.Obj
+	if item.Blob != "" {
+		if pq.blobs == nil {
+			return "", fmt.Errorf("payload of item %s is offloaded but no blob store is set", item.Id)
+		}
+		var err error
+		if obj, err = pq.blobs.Get(item.Blob); err != nil {
+			return "", err
 		}
 	}
-	return c, nil
+	if item.KeyId == "" {
+		return obj, nil
+	}
+	if pq.keyring == nil {
+		return "", fmt.Errorf("payload of item %s is encrypted but no keyring is set", item.Id)
+	}
+	return pq.keyring.Decrypt(obj, item.KeyId)
 }
 
-func (pq *MemPQueue) ResetQueue() error {
-	pq.mu.Lock()
-	defer pq.mu.Unlock()
+// match reports whether an item matches a filter, reading an offloaded payload only for JSON path filters.
+// Encrypted payloads never match a JSON path filter.
+func (pq *MemPQueue) match(filter priorityqueue.Filter, item pqItem) bool {
+	if item.KeyId != "" && filter.Path != "" {
+		return false
+	}
+	obj := item.Obj
+	if item.Blob != "" && filter.Path != "" {
+		var err error
+		if obj, err = pq.payload(item); err != nil {
+			return false
+		}
+	}
+	return filter.Match(obj, item.Attributes)
+}
 
-	pqs := make([]pqueue.PriorityQueue[pqItem], MAX_CHANNEL)
-	for i := 0; i < MAX_CHANNEL; i++ {
-		pqs[i] = *pqueue.NewPriorityQueue(less)
+func (pq *MemPQueue) retainBlob(item pqItem) {
+	if item.Blob != "" {
+		pq.blobRefs[item.Blob]++
 	}
+}
 
-	pq.pqs = pqs
-	pq.not_before_pq = *pqueue.NewPriorityQueue(less_not_before)
-	pq.reserved = make(map[string]reservedItem)
+// releaseBlob drops a reference to the offloaded payload of an item and removes the blob with the last one.
+// Blobs are only removed once a blob store is set, after the WAL has been replayed.
+func (pq *MemPQueue) releaseBlob(item pqItem) {
+	if item.Blob == "" {
+		return
+	}
+	pq.blobRefs[item.Blob]--
+	if pq.blobRefs[item.Blob] > 0 {
+		return
+	}
+	delete(pq.blobRefs, item.Blob)
+	if pq.blobs != nil {
+		if err := pq.blobs.Delete(item.Blob); err != nil {
+			log.Printf("Error removing blob %s: %v", item.Blob, err)
+		}
+	}
+}
 
-	if pq.snapshotFile != "" {
-		if err := os.Remove(pq.snapshotFile); err != nil && !os.IsNotExist(err) {
-			return err
+// discardBlobs removes the blobs offloaded for operations that were not applied, unless referenced by other items.
+func (pq *MemPQueue) discardBlobs(ops ...walOp) {
+	for _, op := range ops {
+		pq.discardBlobs(op.Group...)
+		if op.Item.Blob == "" || pq.blobRefs[op.Item.Blob] > 0 || pq.blobs == nil {
+			continue
 		}
-		if err := os.Remove(pq.walFile); err != nil && !os.IsNotExist(err) {
-			return err
+		if err := pq.blobs.Delete(op.Item.Blob); err != nil {
+			log.Printf("Error removing blob %s: %v", op.Item.Blob, err)
 		}
 	}
+}
 
-	return nil
+// record adds an event for an item, notified to the observers by flush.
+func (pq *MemPQueue) record(eventType string, channel int, item pqItem, now time.Time) {
+	prio := item.Prio
+	if !pq.isMinQueue {
+		prio = -prio
+	}
+	pq.events = append(pq.events, priorityqueue.Event{Type: eventType, Channel: channel, ItemId: item.Id, Prio: prio, Time: now})
 }
 
-func (pq *MemPQueue) processNotBeforeQueue() {
+// flush notifies the observers of the recorded events, callers must not hold pq.mu.
+func (pq *MemPQueue) flush() {
 	pq.mu.Lock()
-	defer pq.mu.Unlock()
-	for {
-		if pq.not_before_pq.IsEmpty() {
-			return
-		}
-		notBeforeItem, err := pq.not_before_pq.Peek()
-		if err != nil {
-			log.Printf("Error peeking not_before_pq in processNotBefore: %v", err)
-			return
-		}
-		if time.Now().Before(notBeforeItem.Item.Not_before) {
-			return
-
-		}
-		notBeforeItem, err = pq.not_before_pq.Dequeue()
-		if err != nil {
-			log.Printf("Error dequeueing not_before_pq in processNotBefore: %v", err)
-			return
-		}
+	events := pq.events
+	pq.events = nil
+	pq.mu.Unlock()
+	pq.observers.Notify(events...)
+}
 
-		if pq.snapshotFile != "" {
-			err := pq.appendWAL(walOp{Op: "enqueue", Channel: notBeforeItem.Channel, Item: notBeforeItem.Item, Time: time.Now()})
-			if err != nil {
-				log.Printf("Error appending to WAL: %v", err)
-				pq.not_before_pq.Enqueue(notBeforeItem)
-				return
-			}
+// storeResult stores a non-empty result and drops results that have expired.
+func (pq *MemPQueue) storeResult(itemId string, result storedResult, now time.Time) {
+	for id, stored := range pq.results {
+		if !now.Before(stored.Expires) {
+			delete(pq.results, id)
 		}
-		pq.pqs[notBeforeItem.Channel].Enqueue(notBeforeItem.Item)
-		pq.maybeCheckpoint()
+	}
+	if result.Value != "" && itemId != "" {
+		pq.results[itemId] = result
 	}
 }
 
@@ -417,7 +2472,9 @@ func (pq *MemPQueue) resetIfNoData() (bool, error) {
 		return false, nil
 	}
 
-	if len(pq.reserved) > 0 {
+	pq.storeResult("", storedResult{}, time.Now())
+	pq.finish(pqItem{}, 0, "", time.Now())
+	if len(pq.finished) > 0 || len(pq.reserved) > 0 || len(pq.blocked) > 0 || len(pq.results) > 0 || len(pq.paused) > 0 || len(pq.topics) > 0 || len(pq.configs) > 0 || len(pq.rules) > 0 || len(pq.schemas) > 0 {
 		return false, nil
 	}
 
@@ -484,17 +2541,10 @@ func (pq *MemPQueue) save() error {
 
 	pqItems := make([][]pqItem, len(pq.pqs))
 	for i := range pq.pqs {
-		var items []pqItem
-		for item := range pq.pqs[i].GetEnumerator() {
-			items = append(items, item)
-		}
-		pqItems[i] = items
+		pqItems[i] = pq.pqs[i].Items()
 	}
 
-	var notBeforeItems []notBeforeItem
-	for item := range pq.not_before_pq.GetEnumerator() {
-		notBeforeItems = append(notBeforeItems, item)
-	}
+	notBeforeItems := pq.not_before_pq.Items()
 
 	var reservedItems []reservedItem
 	var reservedIds []string
@@ -503,6 +2553,11 @@ func (pq *MemPQueue) save() error {
 		reservedIds = append(reservedIds, id)
 	}
 
+	var blockedItems []blockedItem
+	for _, blocked := range pq.blocked {
+		blockedItems = append(blockedItems, blocked)
+	}
+
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
 
@@ -522,6 +2577,56 @@ func (pq *MemPQueue) save() error {
 	if err != nil {
 		return err
 	}
+	err = enc.Encode(blockedItems)
+	if err != nil {
+		return err
+	}
+	err = enc.Encode(pq.results)
+	if err != nil {
+		return err
+	}
+	err = enc.Encode(pq.paused)
+	if err != nil {
+		return err
+	}
+	err = enc.Encode(pq.topics)
+	if err != nil {
+		return err
+	}
+	err = enc.Encode(pq.counters)
+	if err != nil {
+		return err
+	}
+	tombstones := make([]tombstone, 0, len(pq.finishedOrder))
+	for _, id := range pq.finishedOrder {
+		if t, ok := pq.finished[id]; ok {
+			tombstones = append(tombstones, t)
+		}
+	}
+	err = enc.Encode(tombstones)
+	if err != nil {
+		return err
+	}
+	err = enc.Encode(pq.configs)
+	if err != nil {
+		return err
+	}
+	err = enc.Encode(pq.fence)
+	if err != nil {
+		return err
+	}
+	err = enc.Encode(pq.cursors)
+	if err != nil {
+		return err
+	}
+	err = enc.Encode(pq.rules)
+	if err != nil {
+		return err
+	}
+	err = enc.Encode(pq.schemas)
+	if err != nil {
+		return err
+	}
 
 	f, err := os.OpenFile(pq.snapshotFile, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
 	if err != nil {
@@ -566,29 +2671,164 @@ func (pq *MemPQueue) load() error {
 					return err
 				}
 
+				// Decode blocked, missing in snapshots written before dependencies existed
+				var blocked []blockedItem
+				if err := dec.Decode(&blocked); err != nil && err != io.EOF {
+					return err
+				}
+
+				// Decode results
+				results := make(map[string]storedResult)
+				if err := dec.Decode(&results); err != nil && err != io.EOF {
+					return err
+				}
+
+				// Decode paused channels
+				paused := make(map[int]bool)
+				if err := dec.Decode(&paused); err != nil && err != io.EOF {
+					return err
+				}
+
+				// Decode topic subscriptions
+				topics := make(map[string][]int)
+				if err := dec.Decode(&topics); err != nil && err != io.EOF {
+					return err
+				}
+
+				// Decode counters
+				counters := make([]priorityqueue.ChannelCounters, MAX_CHANNEL)
+				if err := dec.Decode(&counters); err != nil && err != io.EOF {
+					return err
+				}
+
+				// Decode statuses of finished items, oldest first
+				var tombstones []tombstone
+				if err := dec.Decode(&tombstones); err != nil && err != io.EOF {
+					return err
+				}
+
+				// Decode channel configs
+				configs := make(map[int]priorityqueue.ChannelConfig)
+				if err := dec.Decode(&configs); err != nil && err != io.EOF {
+					return err
+				}
+				pq.configs = configs
+
+				// Decode the last fencing token
+				var fence int64
+				if err := dec.Decode(&fence); err != nil && err != io.EOF {
+					return err
+				}
+				pq.fence = fence
+
+				// Decode the round-robin cursors of fair channels
+				cursors := make(map[int]string)
+				if err := dec.Decode(&cursors); err != nil && err != io.EOF {
+					return err
+				}
+				pq.cursors = cursors
+
+				// Decode routing rules
+				var rules []priorityqueue.RoutingRule
+				if err := dec.Decode(&rules); err != nil && err != io.EOF {
+					return err
+				}
+				pq.rules = rules
+
+				// Decode channel schemas
+				schemas := make(map[int][]priorityqueue.SchemaVersion)
+				if err := dec.Decode(&schemas); err != nil && err != io.EOF {
+					return err
+				}
+				pq.schemas = schemas
+
+				// Partition items saved before partitions existed
+				for i := range pqItems {
+					for j := range pqItems[i] {
+						pqItems[i][j] = partitioned(pqItems[i][j])
+					}
+				}
+				for i := range notBeforeItems {
+					notBeforeItems[i].Item = partitioned(notBeforeItems[i].Item)
+				}
+				for i := range reserved {
+					reserved[i].Item = partitioned(reserved[i].Item)
+				}
+				for i := range blocked {
+					blocked[i].Item = partitioned(blocked[i].Item)
+				}
+
 				// Rebuild pqs
-				pqs := make([]pqueue.PriorityQueue[pqItem], MAX_CHANNEL)
+				pqs := make([]*channelQueue, MAX_CHANNEL)
 				for i := 0; i < MAX_CHANNEL; i++ {
-					q := pqueue.NewPriorityQueue(less)
+					pqs[i] = newChannelQueue(pq.lessFor(i), pq.configs[i].Fair)
 					for _, item := range pqItems[i] {
-						q.Enqueue(item)
+						pqs[i].Enqueue(item)
 					}
-					pqs[i] = *q
 				}
 				pq.pqs = pqs
 
 				// Rebuild not_before_pq
-				nbq := pqueue.NewPriorityQueue(less_not_before)
+				pq.not_before_pq = newNotBeforeHeap()
 				for _, item := range notBeforeItems {
-					nbq.Enqueue(item)
+					pq.not_before_pq.Enqueue(item)
 				}
-				pq.not_before_pq = *nbq
 
 				// Restore reserved
 				pq.reserved = make(map[string]reservedItem)
 				for i := 0; i < len(reserved); i++ {
 					pq.reserved[reservedIds[i]] = reserved[i]
 				}
+
+				// Restore blocked and rebuild dependents
+				pq.blocked = make(map[string]blockedItem)
+				pq.dependents = make(map[string][]string)
+				for _, b := range blocked {
+					pq.block(b.Item, b.Channel, b.Parents)
+				}
+
+				// Rebuild the coalesce key index
+				pq.keys = make(map[coalesceKey]string)
+				for i := range pq.pqs {
+					for _, item := range pq.pqs[i].Items() {
+						pq.index(item, i)
+					}
+				}
+				for _, nb := range notBeforeItems {
+					pq.index(nb.Item, nb.Channel)
+				}
+				for _, b := range blocked {
+					pq.index(b.Item, b.Channel)
+				}
+
+				// Count the references to offloaded payloads
+				pq.blobRefs = make(map[string]int)
+				for i := range pq.pqs {
+					for _, item := range pq.pqs[i].Items() {
+						pq.retainBlob(item)
+					}
+				}
+				for _, nb := range notBeforeItems {
+					pq.retainBlob(nb.Item)
+				}
+				for _, r := range reserved {
+					pq.retainBlob(r.Item)
+				}
+				for _, b := range blocked {
+					pq.retainBlob(b.Item)
+				}
+
+				pq.results = results
+				pq.paused = paused
+				pq.topics = topics
+				copy(pq.counters, counters)
+
+				pq.finished = make(map[string]tombstone, len(tombstones))
+				pq.finishedOrder = make([]string, 0, len(tombstones))
+				for _, t := range tombstones {
+					pq.finished[t.Id] = t
+					pq.finishedOrder = append(pq.finishedOrder, t.Id)
+				}
 			}
 		}
 	}
@@ -605,45 +2845,43 @@ func (pq *MemPQueue) load() error {
 					if err := dec.Decode(&op); err != nil {
 						break
 					}
-					switch op.Op {
-					case "enqueue":
-						pq.pqs[op.Channel].Enqueue(op.Item)
-					case "enqueue_notbefore":
-						pq.not_before_pq.Enqueue(notBeforeItem{
-							Item:    op.Item,
-							Channel: op.Channel,
-						})
-					case "dequeue":
-						// Remove one item from the queue (simulate dequeue)
-						_, _ = pq.pqs[op.Channel].Dequeue()
-					case "dequeueWithReservation":
-						// Remove from queue and add to reserved
-						item, err := pq.pqs[op.Channel].Dequeue()
-						if err == nil {
-							pq.reserved[op.ResId] = reservedItem{
-								Item:      item,
-								Channel:   op.Channel,
-								Timestamp: op.Time,
-							}
-						}
-					case "confirm":
-						// Remove reservation
-						delete(pq.reserved, op.ResId)
-					case "delete_reserved":
-						// Remove reservation by value (reserved item)
-						for id, reserved := range pq.reserved {
-							if reserved.Item == op.Item && reserved.Channel == op.Channel {
-								delete(pq.reserved, id)
-								break
-							}
-						}
-					}
+					pq.apply(op)
 				}
 			}
 		}
 	}
+	pq.events = nil // replayed operations are not notified
 	return nil
 }
 
+func itemStatus(item pqItem, channel int, status string) priorityqueue.ItemStatus {
+	return priorityqueue.ItemStatus{
+		Status:     status,
+		Channel:    channel,
+		Attempts:   item.Attempts,
+		EnqueuedAt: item.Enqueued,
+		NotBefore:  item.Not_before,
+		Deadline:   item.Deadline,
+		ExpiredAt:  item.Expired,
+	}
+}
+
+// partitioned sets the partition hash of an item logged before partitions existed to the hash of its id,
+// as for items enqueued without a partition key. Items logged before ids existed stay in partition 0.
+func partitioned(item pqItem) pqItem {
+	if item.PartitionHash == 0 && item.Id != "" {
+		item.PartitionHash = priorityqueue.PartitionHash(item.Id)
+	}
+	return item
+}
+
+// sameItem compares items by id, or by value for items logged before ids existed.
+func sameItem(a, b pqItem) bool {
+	if a.Id != "" || b.Id != "" {
+		return a.Id == b.Id
+	}
+	return a.Obj == b.Obj && a.Prio == b.Prio && a.Not_before.Equal(b.Not_before)
+}
+
 // Ensure MemPQueue implements IPriorityQueue
 var _ priorityqueue.IPriorityQueue = (*MemPQueue)(nil)
@@ -1,11 +1,19 @@
 package mempqueue
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/jnsoft/jnq/src/blobstore"
+	"github.com/jnsoft/jnq/src/keyring"
+	"github.com/jnsoft/jnq/src/priorityqueue"
 	. "github.com/jnsoft/jnq/src/testhelper"
 )
 
@@ -112,6 +120,1131 @@ func TestMemPQueue(t *testing.T) {
 		AssertTrue(t, isEmpty)
 	})
 
+	t.Run("dependencies", func(t *testing.T) {
+		q := NewMemPQueue(true)
+
+		idA, err := q.EnqueueWithOptions("A", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+		AssertNoError(t, err)
+		idB, err := q.EnqueueWithOptions("B", 2, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+		AssertNoError(t, err)
+		_, err = q.EnqueueWithOptions("C", 0, channel, time.Time{}, priorityqueue.EnqueueOptions{DependsOn: []string{idA, idB, "unknown"}})
+		AssertNoError(t, err)
+
+		// C is blocked
+		size, err := q.Size(channel)
+		AssertNil(t, err)
+		AssertEqual(t, size, 2)
+
+		value, resA, err := q.DequeueWithReservation(channel)
+		AssertNil(t, err)
+		AssertEqual(t, value, "A")
+		value, resB, err := q.DequeueWithReservation(channel)
+		AssertNil(t, err)
+		AssertEqual(t, value, "B")
+
+		_, err = q.ConfirmReservation(resA)
+		AssertNil(t, err)
+		isEmpty, _ := q.IsEmpty(channel)
+		AssertTrue(t, isEmpty)
+
+		_, err = q.ConfirmReservation(resB)
+		AssertNil(t, err)
+		value, err = q.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, value, "C")
+	})
+
+	t.Run("delete cascades to dependents", func(t *testing.T) {
+		q := NewMemPQueue(true)
+
+		idA, _ := q.EnqueueWithOptions("A", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+		idB, _ := q.EnqueueWithOptions("B", 2, channel, time.Time{}, priorityqueue.EnqueueOptions{DependsOn: []string{idA}})
+		q.EnqueueWithOptions("C", 3, channel, time.Time{}, priorityqueue.EnqueueOptions{DependsOn: []string{idB}})
+
+		deleted, err := q.Delete(idA)
+		AssertNil(t, err)
+		AssertTrue(t, deleted)
+		AssertEqual(t, len(q.blocked), 0)
+
+		deleted, err = q.Delete(idA)
+		AssertNil(t, err)
+		AssertFalse(t, deleted)
+	})
+
+	t.Run("results", func(t *testing.T) {
+		q := NewMemPQueue(true)
+
+		id, _ := q.EnqueueWithOptions("job", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+		_, found, err := q.GetResult(id)
+		AssertNil(t, err)
+		AssertFalse(t, found)
+
+		_, resId, err := q.DequeueWithReservation(channel)
+		AssertNil(t, err)
+		ok, err := q.ConfirmReservationWithResult(resId, `{"answer":42}`, time.Minute)
+		AssertNil(t, err)
+		AssertTrue(t, ok)
+
+		result, found, err := q.GetResult(id)
+		AssertNil(t, err)
+		AssertTrue(t, found)
+		AssertEqual(t, result, `{"answer":42}`)
+
+		// expired results are not returned
+		id, _ = q.EnqueueWithOptions("job", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+		_, resId, _ = q.DequeueWithReservation(channel)
+		q.ConfirmReservationWithResult(resId, "short lived", time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+		_, found, err = q.GetResult(id)
+		AssertNil(t, err)
+		AssertFalse(t, found)
+	})
+
+	t.Run("pause and resume", func(t *testing.T) {
+		q := NewMemPQueue(true)
+
+		q.Enqueue("item1", 1, channel, time.Time{})
+		q.Enqueue("item2", 2, channel, time.Time{})
+		_, resId, err := q.DequeueWithReservation(channel)
+		AssertNil(t, err)
+
+		err = q.PauseChannel(channel)
+		AssertNil(t, err)
+		_, err = q.Dequeue(channel)
+		AssertNotEqual(t, err, nil)
+		_, _, err = q.DequeueWithReservation(channel)
+		AssertNotEqual(t, err, nil)
+
+		// enqueue and requeue keep working
+		err = q.Enqueue("item3", 3, channel, time.Time{})
+		AssertNil(t, err)
+		requeued, err := q.RequeueExpiredReservations(0)
+		AssertNil(t, err)
+		AssertEqual(t, requeued, 1)
+		size, _ := q.Size(channel)
+		AssertEqual(t, size, 3)
+		_, err = q.ConfirmReservation(resId)
+		AssertNotEqual(t, err, nil)
+
+		paused, err := q.PausedChannels()
+		AssertNil(t, err)
+		CollectionAssertEqual(t, paused, []int{channel})
+
+		err = q.ResumeChannel(channel)
+		AssertNil(t, err)
+		value, err := q.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, value, "item1")
+	})
+
+	t.Run("transactions", func(t *testing.T) {
+		q := NewMemPQueue(true)
+
+		q.Enqueue("job", 1, channel, time.Time{})
+		_, resId, err := q.DequeueWithReservation(channel)
+		AssertNil(t, err)
+
+		ops := []priorityqueue.TxOp{
+			{Op: priorityqueue.TX_CONFIRM, ReservationId: resId},
+			{Op: priorityqueue.TX_ENQUEUE, Obj: "followup1", Prio: 1, Channel: channel},
+			{Op: priorityqueue.TX_ENQUEUE, Obj: "followup2", Prio: 2, Channel: channel},
+		}
+		itemIds, err := q.ApplyTransaction(ops)
+		AssertNil(t, err)
+		AssertEqual(t, len(itemIds), 3)
+		AssertEqual(t, itemIds[0], "")
+		AssertNotEqual(t, itemIds[1], "")
+		AssertEqual(t, len(q.reserved), 0)
+		size, _ := q.Size(channel)
+		AssertEqual(t, size, 2)
+
+		// the reservation is gone, so nothing is applied
+		_, err = q.ApplyTransaction(ops)
+		AssertNotEqual(t, err, nil)
+		size, _ = q.Size(channel)
+		AssertEqual(t, size, 2)
+
+		// release and delete
+		_, resId, _ = q.DequeueWithReservation(channel)
+		_, err = q.ApplyTransaction([]priorityqueue.TxOp{
+			{Op: priorityqueue.TX_RELEASE, ReservationId: resId},
+			{Op: priorityqueue.TX_DELETE, ItemId: itemIds[2]},
+		})
+		AssertNil(t, err)
+		value, err := q.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, value, "followup1")
+		isEmpty, _ := q.IsEmpty(channel)
+		AssertTrue(t, isEmpty)
+	})
+
+	t.Run("request reply", func(t *testing.T) {
+		q := NewMemPQueue(true)
+		replyChannel := channel + 1
+
+		q.EnqueueWithOptions("request", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{ReplyTo: &replyChannel, CorrelationId: "abc"})
+		_, resId, err := q.DequeueWithReservation(channel)
+		AssertNil(t, err)
+		_, err = q.ConfirmReservationWithResult(resId, `{"sum":3}`, time.Minute)
+		AssertNil(t, err)
+
+		reply, err := q.Dequeue(replyChannel)
+		AssertNil(t, err)
+		AssertEqual(t, reply, `{"correlation_id":"abc","value":{"sum":3}}`)
+	})
+
+	t.Run("filtered reservation", func(t *testing.T) {
+		q := NewMemPQueue(true)
+
+		eu := priorityqueue.EnqueueOptions{Attributes: map[string]string{"region": "eu"}}
+		us := priorityqueue.EnqueueOptions{Attributes: map[string]string{"region": "us"}}
+		q.EnqueueWithOptions(`{"type":"report","size":2}`, 1, channel, time.Time{}, us)
+		q.EnqueueWithOptions(`{"type":"invoice","size":3}`, 2, channel, time.Time{}, eu)
+		q.EnqueueWithOptions(`{"type":"report","size":1}`, 3, channel, time.Time{}, eu)
+
+		var filter priorityqueue.Filter
+		AssertNil(t, filter.Parse("region=eu"))
+		value, _, err := q.DequeueWithReservationFiltered(channel, filter)
+		AssertNil(t, err)
+		AssertEqual(t, value, `{"type":"invoice","size":3}`)
+
+		AssertNil(t, filter.Parse("$.type=invoice"))
+		_, _, err = q.DequeueWithReservationFiltered(channel, filter)
+		AssertNotEqual(t, err, nil)
+
+		filter = priorityqueue.Filter{Path: "$.size", Value: "1"}
+		value, _, err = q.DequeueWithReservationFiltered(channel, filter)
+		AssertNil(t, err)
+		AssertEqual(t, value, `{"type":"report","size":1}`)
+
+		// the non-matching item is untouched
+		value, err = q.Peek(channel)
+		AssertNil(t, err)
+		AssertEqual(t, value, `{"type":"report","size":2}`)
+
+		err = filter.Parse("$.bad path=1")
+		AssertNotEqual(t, err, nil)
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		q := NewMemPQueue(true)
+
+		q.Enqueue("item1", 1, channel, time.Time{})
+		q.Enqueue("item2", 2, channel, time.Time{})
+		q.Enqueue("later", 1, channel, time.Now().Add(time.Hour))
+		_, resId, err := q.DequeueWithReservation(channel)
+		AssertNil(t, err)
+		_, resId2, err := q.DequeueWithReservation(channel)
+		AssertNil(t, err)
+		_, err = q.ConfirmReservation(resId)
+		AssertNil(t, err)
+		time.Sleep(10 * time.Millisecond)
+		q.Enqueue("item3", 1, channel, time.Time{})
+		requeued, err := q.RequeueExpiredReservations(0)
+		AssertNil(t, err)
+		AssertEqual(t, requeued, 1)
+		_, err = q.ConfirmReservation(resId2)
+		AssertNotEqual(t, err, nil)
+
+		stats, err := q.Stats()
+		AssertNil(t, err)
+		AssertEqual(t, len(stats), 1)
+		s := stats[channel]
+		AssertEqual(t, s.Ready, 2)
+		AssertEqual(t, s.Scheduled, 1)
+		AssertEqual(t, s.Reserved, 0)
+		AssertEqual(t, s.Enqueued, int64(4))
+		AssertEqual(t, s.Dequeued, int64(2))
+		AssertEqual(t, s.Confirmed, int64(1))
+		AssertEqual(t, s.Requeued, int64(1))
+		AssertTrue(t, s.OldestReadyAge >= 0.01)
+		AssertEqual(t, s.OldestReservationAge, 0.0)
+
+		q.DequeueWithReservation(channel)
+		stats, _ = q.Stats()
+		AssertEqual(t, stats[channel].Reserved, 1)
+		AssertTrue(t, stats[channel].OldestReservationAge > 0)
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		q := NewMemPQueue(true)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := q.EnqueueContext(ctx, "item1", 1, channel, time.Now())
+		AssertTrue(t, errors.Is(err, context.Canceled))
+		_, err = q.DequeueContext(ctx, channel)
+		AssertTrue(t, errors.Is(err, context.Canceled))
+
+		AssertNil(t, q.EnqueueContext(context.Background(), "item2", 1, channel, time.Now()))
+		size, err := q.Size(channel)
+		AssertNil(t, err)
+		AssertEqual(t, size, 1)
+	})
+
+	t.Run("sentinel errors", func(t *testing.T) {
+		q := NewMemPQueue(true)
+
+		_, err := q.Dequeue(channel)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrEmpty))
+		_, _, err = q.DequeueWithReservation(channel)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrEmpty))
+		_, err = q.Peek(channel)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrEmpty))
+
+		err = q.Enqueue("item", 1, priorityqueue.MAX_CHANNEL, time.Now())
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidChannel))
+		_, err = q.Dequeue(-1)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidChannel))
+
+		confirmed, err := q.ConfirmReservation("unknown")
+		AssertFalse(t, confirmed)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrReservationNotFound))
+		_, err = q.ReleaseReservation("unknown")
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrReservationNotFound))
+
+		_, err = q.ApplyTransaction([]priorityqueue.TxOp{{Op: priorityqueue.TX_DELETE, ItemId: "unknown"}})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrItemNotFound))
+		_, err = q.ApplyTransaction([]priorityqueue.TxOp{{Op: "unknown"}})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+	})
+
+	t.Run("item status", func(t *testing.T) {
+		q := NewMemPQueue(true)
+
+		_, err := q.GetStatus("unknown")
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrItemNotFound))
+
+		id, err := q.EnqueueWithOptions("item1", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+		AssertNil(t, err)
+		laterId, err := q.EnqueueWithOptions("later", 1, channel, time.Now().Add(time.Hour), priorityqueue.EnqueueOptions{})
+		AssertNil(t, err)
+		childId, err := q.EnqueueWithOptions("child", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{DependsOn: []string{id}})
+		AssertNil(t, err)
+
+		status, err := q.GetStatus(id)
+		AssertNil(t, err)
+		AssertEqual(t, status.Status, priorityqueue.STATUS_PENDING)
+		AssertEqual(t, status.Channel, channel)
+		AssertFalse(t, status.EnqueuedAt.IsZero())
+		status, _ = q.GetStatus(laterId)
+		AssertEqual(t, status.Status, priorityqueue.STATUS_SCHEDULED)
+		status, _ = q.GetStatus(childId)
+		AssertEqual(t, status.Status, priorityqueue.STATUS_BLOCKED)
+
+		_, _, err = q.DequeueWithReservation(channel)
+		AssertNil(t, err)
+		status, _ = q.GetStatus(id)
+		AssertEqual(t, status.Status, priorityqueue.STATUS_RESERVED)
+		AssertEqual(t, status.Attempts, 1)
+		AssertFalse(t, status.ReservedAt.IsZero())
+
+		time.Sleep(10 * time.Millisecond)
+		_, err = q.RequeueExpiredReservations(0)
+		AssertNil(t, err)
+		status, _ = q.GetStatus(id)
+		AssertEqual(t, status.Status, priorityqueue.STATUS_EXPIRED)
+		AssertFalse(t, status.ExpiredAt.IsZero())
+
+		_, resId, err := q.DequeueWithReservation(channel)
+		AssertNil(t, err)
+		_, err = q.ConfirmReservation(resId)
+		AssertNil(t, err)
+		status, err = q.GetStatus(id)
+		AssertNil(t, err)
+		AssertEqual(t, status.Status, priorityqueue.STATUS_COMPLETED)
+		AssertEqual(t, status.Attempts, 2)
+		AssertFalse(t, status.FinishedAt.IsZero())
+
+		_, err = q.Delete(laterId)
+		AssertNil(t, err)
+		status, _ = q.GetStatus(laterId)
+		AssertEqual(t, status.Status, priorityqueue.STATUS_DELETED)
+
+		q.SetStatusRetention(0)
+		_, err = q.GetStatus(id)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrItemNotFound))
+	})
+
+	t.Run("events", func(t *testing.T) {
+		q := NewMemPQueue(true)
+
+		var events []priorityqueue.Event
+		unsubscribe := q.Subscribe(func(event priorityqueue.Event) {
+			events = append(events, event)
+		})
+
+		id, err := q.EnqueueWithOptions("item1", 2, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+		AssertNil(t, err)
+		_, resId, err := q.DequeueWithReservation(channel)
+		AssertNil(t, err)
+		_, err = q.ReleaseReservation(resId)
+		AssertNil(t, err)
+		_, resId, err = q.DequeueWithReservation(channel)
+		AssertNil(t, err)
+		time.Sleep(10 * time.Millisecond)
+		_, err = q.RequeueExpiredReservations(5 * time.Millisecond)
+		AssertNil(t, err)
+		_, resId, err = q.DequeueWithReservation(channel)
+		AssertNil(t, err)
+		_, err = q.ConfirmReservation(resId)
+		AssertNil(t, err)
+		id2, err := q.EnqueueWithOptions("item2", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+		AssertNil(t, err)
+		_, err = q.Delete(id2)
+		AssertNil(t, err)
+		q.Enqueue("item3", 1, channel, time.Time{})
+		_, err = q.Dequeue(channel)
+		AssertNil(t, err)
+
+		// a failed transaction is not observed
+		_, err = q.ApplyTransaction([]priorityqueue.TxOp{
+			{Op: priorityqueue.TX_ENQUEUE, Obj: "txitem", Prio: 1, Channel: channel},
+			{Op: priorityqueue.TX_CONFIRM, ReservationId: "unknown"},
+		})
+		AssertNotEqual(t, err, nil)
+		AssertNil(t, q.ResetQueue())
+
+		types := make([]string, len(events))
+		for i, event := range events {
+			types[i] = event.Type
+		}
+		CollectionAssertEqual(t, types, []string{
+			priorityqueue.EVENT_ENQUEUE, priorityqueue.EVENT_RESERVE, priorityqueue.EVENT_REQUEUE, priorityqueue.EVENT_RESERVE, priorityqueue.EVENT_EXPIRE,
+			priorityqueue.EVENT_RESERVE, priorityqueue.EVENT_CONFIRM, priorityqueue.EVENT_ENQUEUE, priorityqueue.EVENT_DELETE, priorityqueue.EVENT_ENQUEUE,
+			priorityqueue.EVENT_DEQUEUE, priorityqueue.EVENT_RESET,
+		})
+		for _, event := range events[:7] {
+			AssertEqual(t, event.ItemId, id)
+			AssertEqual(t, event.Channel, channel)
+			AssertEqual(t, event.Prio, 2.0)
+		}
+		AssertEqual(t, events[8].ItemId, id2)
+
+		unsubscribe()
+		q.Enqueue("item4", 1, channel, time.Time{})
+		AssertEqual(t, len(events), 12)
+	})
+
+	t.Run("deadline mode", func(t *testing.T) {
+		q := NewMemPQueue(true)
+		now := time.Now()
+		due := func(d time.Duration) priorityqueue.EnqueueOptions {
+			return priorityqueue.EnqueueOptions{Deadline: now.Add(d)}
+		}
+
+		q.EnqueueWithOptions("late", 1, channel, time.Time{}, due(2*time.Hour))
+		q.EnqueueWithOptions("none", 0, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+		q.EnqueueWithOptions("soon", 2, channel, time.Time{}, due(time.Hour))
+		q.EnqueueWithOptions("past", 3, channel, time.Time{}, due(-time.Hour))
+		AssertNil(t, q.SetChannelConfig(channel, priorityqueue.ChannelConfig{EDF: true}))
+
+		stats, err := q.Stats()
+		AssertNil(t, err)
+		AssertEqual(t, stats[channel].Overdue, 1)
+		for _, expected := range []string{"past", "soon", "late", "none"} {
+			item, err := q.Dequeue(channel)
+			AssertNil(t, err)
+			AssertEqual(t, item, expected)
+		}
+
+		overdue := channel + 1
+		AssertNil(t, q.SetChannelConfig(channel, priorityqueue.ChannelConfig{EDF: true, OverdueChannel: &overdue}))
+		q.EnqueueWithOptions("past", 1, channel, time.Time{}, due(-time.Hour))
+		q.EnqueueWithOptions("future", 1, channel, time.Time{}, due(time.Hour))
+		// peek returns the item dequeue returns, overdue items are moved first
+		item, err := q.Peek(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "future")
+		item, err = q.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "future")
+		item, err = q.Dequeue(overdue)
+		AssertNil(t, err)
+		AssertEqual(t, item, "past")
+
+		err = q.SetChannelConfig(overdue, priorityqueue.ChannelConfig{EDF: true, OverdueChannel: &channel})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+		err = q.SetChannelConfig(overdue+1, priorityqueue.ChannelConfig{OverdueChannel: &channel})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+
+		configs, err := q.ChannelConfigs()
+		AssertNil(t, err)
+		AssertEqual(t, len(configs), 1)
+		AssertEqual(t, *configs[channel].OverdueChannel, overdue)
+		AssertNil(t, q.SetChannelConfig(channel, priorityqueue.ChannelConfig{}))
+		configs, _ = q.ChannelConfigs()
+		AssertEqual(t, len(configs), 0)
+	})
+
+	t.Run("coalescing", func(t *testing.T) {
+		q := NewMemPQueue(true)
+		opts := priorityqueue.EnqueueOptions{CoalesceKey: "report-1"}
+
+		id, err := q.EnqueueWithOptions("v1", 1, channel, time.Time{}, opts)
+		AssertNil(t, err)
+		q.Enqueue("other", 2, channel, time.Time{})
+		coalescedId, err := q.EnqueueWithOptions("v2", 5, channel, time.Time{}, opts)
+		AssertNil(t, err)
+		AssertEqual(t, coalescedId, id)
+		size, _ := q.Size(channel)
+		AssertEqual(t, size, 2)
+
+		// the priority is kept, reserved items are no longer coalesced
+		item, _, err := q.DequeueWithReservation(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "v2")
+		newId, err := q.EnqueueWithOptions("v3", 1, channel, time.Time{}, opts)
+		AssertNil(t, err)
+		AssertNotEqual(t, newId, id)
+
+		replaceAll := priorityqueue.EnqueueOptions{CoalesceKey: "report-1", CoalescePrio: true, CoalesceNotBefore: true}
+		coalescedId, err = q.EnqueueWithOptions("v4", 3, channel, time.Now().Add(time.Hour), replaceAll)
+		AssertNil(t, err)
+		AssertEqual(t, coalescedId, newId)
+		status, _ := q.GetStatus(newId)
+		AssertEqual(t, status.Status, priorityqueue.STATUS_SCHEDULED)
+		item, err = q.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "other")
+		_, err = q.Dequeue(channel)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrEmpty))
+
+		// keys are scoped by channel
+		otherId, err := q.EnqueueWithOptions("v1", 1, channel+1, time.Time{}, opts)
+		AssertNil(t, err)
+		AssertNotEqual(t, otherId, newId)
+
+		_, err = q.ApplyTransaction([]priorityqueue.TxOp{{Op: priorityqueue.TX_ENQUEUE, Obj: "v5", Channel: channel, Options: opts}})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+	})
+
+	t.Run("reservation ownership", func(t *testing.T) {
+		q := NewMemPQueue(true)
+		q.Enqueue("item1", 1, channel, time.Time{})
+		q.Enqueue("item2", 2, channel, time.Time{})
+		q.Enqueue("item3", 3, channel, time.Time{})
+
+		_, reservation, err := q.DequeueWithReservationOptions(channel, priorityqueue.ReserveOptions{Consumer: "worker-1"})
+		AssertNil(t, err)
+		resId := reservation.ReservationId
+		_, otherReservation, err := q.DequeueWithReservationOptions(channel, priorityqueue.ReserveOptions{Consumer: "worker-2"})
+		AssertNil(t, err)
+		otherResId := otherReservation.ReservationId
+		_, anyResId, err := q.DequeueWithReservation(channel)
+		AssertNil(t, err)
+
+		owner := priorityqueue.ReservationClaim{Consumer: "worker-1"}
+		other := priorityqueue.ReservationClaim{Consumer: "worker-2"}
+		_, err = q.ConfirmReservation(resId)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrNotOwner))
+		_, err = q.ConfirmReservationAs(resId, other, "", 0)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrNotOwner))
+		_, err = q.ReleaseReservationAs(resId, other)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrNotOwner))
+		_, err = q.ExtendReservation(resId, other)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrNotOwner))
+		_, err = q.ApplyTransaction([]priorityqueue.TxOp{{Op: priorityqueue.TX_CONFIRM, ReservationId: resId, Claim: other}})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrNotOwner))
+		_, err = q.ExtendReservation("unknown", owner)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrReservationNotFound))
+
+		reservations, err := q.Reservations()
+		AssertNil(t, err)
+		AssertEqual(t, len(reservations), 3)
+		AssertEqual(t, len(reservations["worker-1"]), 1)
+		AssertEqual(t, reservations["worker-1"][0].ReservationId, resId)
+		AssertEqual(t, reservations["worker-2"][0].ReservationId, otherResId)
+		AssertEqual(t, reservations[""][0].ReservationId, anyResId)
+
+		// an extended reservation does not expire with the others
+		time.Sleep(50 * time.Millisecond)
+		ok, err := q.ExtendReservation(resId, owner)
+		AssertNil(t, err)
+		AssertTrue(t, ok)
+		requeued, err := q.RequeueExpiredReservations(25 * time.Millisecond)
+		AssertNil(t, err)
+		AssertEqual(t, requeued, 2)
+
+		ok, err = q.ConfirmReservationAs(resId, owner, "", 0)
+		AssertNil(t, err)
+		AssertTrue(t, ok)
+		reservations, _ = q.Reservations()
+		AssertEqual(t, len(reservations), 0)
+	})
+
+	t.Run("requeue consumer reservations", func(t *testing.T) {
+		q := NewMemPQueue(true)
+		q.Enqueue("item1", 1, channel, time.Time{})
+		q.Enqueue("item2", 2, channel, time.Time{})
+		_, _, err := q.DequeueWithReservationOptions(channel, priorityqueue.ReserveOptions{Consumer: "worker-1"})
+		AssertNil(t, err)
+		_, otherReservation, err := q.DequeueWithReservationOptions(channel, priorityqueue.ReserveOptions{Consumer: "worker-2"})
+		AssertNil(t, err)
+		otherResId := otherReservation.ReservationId
+
+		requeued, err := q.RequeueConsumerReservations("worker-1")
+		AssertNil(t, err)
+		AssertEqual(t, requeued, 1)
+		item, err := q.Peek(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "item1")
+		stats, _ := q.Stats()
+		AssertEqual(t, stats[channel].Requeued, int64(1))
+
+		reservations, _ := q.Reservations()
+		AssertEqual(t, len(reservations), 1)
+		AssertEqual(t, reservations["worker-2"][0].ReservationId, otherResId)
+
+		_, err = q.RequeueConsumerReservations("")
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+	})
+
+	t.Run("fencing tokens", func(t *testing.T) {
+		q := NewMemPQueue(true)
+		q.Enqueue("item1", 1, channel, time.Time{})
+		q.Enqueue("item2", 2, channel, time.Time{})
+
+		_, first, err := q.DequeueWithReservationOptions(channel, priorityqueue.ReserveOptions{})
+		AssertNil(t, err)
+		_, second, err := q.DequeueWithReservationOptions(channel, priorityqueue.ReserveOptions{Consumer: "worker"})
+		AssertNil(t, err)
+		AssertTrue(t, first.Token > 0)
+		AssertTrue(t, second.Token > first.Token)
+		AssertEqual(t, second.Consumer, "worker")
+
+		// a released item is reserved again with a higher token
+		ok, err := q.ReleaseReservationAs(first.ReservationId, priorityqueue.ReservationClaim{Token: first.Token})
+		AssertNil(t, err)
+		AssertTrue(t, ok)
+		_, third, err := q.DequeueWithReservationOptions(channel, priorityqueue.ReserveOptions{})
+		AssertNil(t, err)
+		AssertTrue(t, third.Token > second.Token)
+
+		stale := priorityqueue.ReservationClaim{Token: first.Token}
+		_, err = q.ConfirmReservationAs(third.ReservationId, stale, "", 0)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrStaleToken))
+		_, err = q.ExtendReservation(third.ReservationId, stale)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrStaleToken))
+		_, err = q.ApplyTransaction([]priorityqueue.TxOp{{Op: priorityqueue.TX_CONFIRM, ReservationId: third.ReservationId, Claim: stale}})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrStaleToken))
+
+		reservations, err := q.Reservations()
+		AssertNil(t, err)
+		AssertEqual(t, reservations["worker"][0].Token, second.Token)
+
+		ok, err = q.ExtendReservation(third.ReservationId, priorityqueue.ReservationClaim{Token: third.Token})
+		AssertNil(t, err)
+		AssertTrue(t, ok)
+		ok, err = q.ConfirmReservationAs(third.ReservationId, priorityqueue.ReservationClaim{Token: third.Token}, "", 0)
+		AssertNil(t, err)
+		AssertTrue(t, ok)
+		ok, err = q.ConfirmReservationAs(second.ReservationId, priorityqueue.ReservationClaim{Consumer: "worker", Token: second.Token}, "", 0)
+		AssertNil(t, err)
+		AssertTrue(t, ok)
+	})
+
+	t.Run("batch reservation", func(t *testing.T) {
+		q := NewMemPQueue(true)
+		names := []string{"item1", "item2", "item3", "item4", "item5"}
+		for i, name := range names {
+			q.Enqueue(name, float64(i), channel, time.Time{})
+		}
+
+		items, err := q.DequeueWithReservationBatch(channel, 3, priorityqueue.ReserveOptions{Consumer: "worker"})
+		AssertNil(t, err)
+		AssertEqual(t, len(items), 3)
+		for i, item := range items {
+			AssertEqual(t, item.Value, names[i])
+			AssertEqual(t, item.Reservation.Consumer, "worker")
+			if i > 0 {
+				AssertTrue(t, item.Reservation.Token > items[i-1].Reservation.Token)
+			}
+		}
+		rest, err := q.DequeueWithReservationBatch(channel, 10, priorityqueue.ReserveOptions{})
+		AssertNil(t, err)
+		AssertEqual(t, len(rest), 2)
+		_, err = q.DequeueWithReservationBatch(channel, 10, priorityqueue.ReserveOptions{})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrEmpty))
+		_, err = q.DequeueWithReservationBatch(channel, 0, priorityqueue.ReserveOptions{})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+
+		ids := []string{items[0].Reservation.ReservationId, "unknown", items[1].Reservation.ReservationId, items[0].Reservation.ReservationId, rest[0].Reservation.ReservationId}
+		results, err := q.ConfirmReservationBatch(ids, priorityqueue.ReservationClaim{Consumer: "worker"})
+		AssertNil(t, err)
+		AssertEqual(t, len(results), len(ids))
+		AssertNil(t, results[0])
+		AssertTrue(t, errors.Is(results[1], priorityqueue.ErrReservationNotFound))
+		AssertNil(t, results[2])
+		AssertTrue(t, errors.Is(results[3], priorityqueue.ErrReservationNotFound))
+		AssertNil(t, results[4])
+
+		results, err = q.ConfirmReservationBatch([]string{items[2].Reservation.ReservationId, rest[1].Reservation.ReservationId}, priorityqueue.ReservationClaim{})
+		AssertNil(t, err)
+		AssertTrue(t, errors.Is(results[0], priorityqueue.ErrNotOwner))
+		AssertNil(t, results[1])
+
+		stats, _ := q.Stats()
+		AssertEqual(t, stats[channel].Dequeued, int64(5))
+		AssertEqual(t, stats[channel].Confirmed, int64(4))
+		reservations, _ := q.Reservations()
+		AssertEqual(t, len(reservations["worker"]), 1)
+	})
+
+	t.Run("fair queuing", func(t *testing.T) {
+		q := NewMemPQueue(true)
+		AssertNil(t, q.SetChannelConfig(channel, priorityqueue.ChannelConfig{Fair: true}))
+		for _, item := range []struct {
+			obj    string
+			prio   float64
+			tenant string
+		}{{"a3", 3, "A"}, {"a1", 1, "A"}, {"a2", 2, "A"}, {"b1", 1, "B"}, {"x1", 1, ""}} {
+			_, err := q.EnqueueWithOptions(item.obj, item.prio, channel, time.Time{}, priorityqueue.EnqueueOptions{Tenant: item.tenant})
+			AssertNil(t, err)
+		}
+
+		stats, err := q.Stats()
+		AssertNil(t, err)
+		AssertEqual(t, len(stats[channel].Tenants), 2)
+		AssertEqual(t, stats[channel].Tenants["A"], 3)
+		AssertEqual(t, stats[channel].Tenants["B"], 1)
+
+		// tenants are served in turn, in tenant order, items without a tenant form the first group
+		item, err := q.Peek(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "x1")
+		item, err = q.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "x1")
+		items, err := q.DequeueWithReservationBatch(channel, 3, priorityqueue.ReserveOptions{})
+		AssertNil(t, err)
+		AssertEqual(t, len(items), 3)
+		AssertEqual(t, items[0].Value, "a1")
+		AssertEqual(t, items[1].Value, "b1")
+		AssertEqual(t, items[2].Value, "a2")
+		item, err = q.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "a3")
+
+		// the round continues after the tenant served last
+		for tenant, obj := range map[string]string{"A": "a4", "B": "b2", "C": "c1"} {
+			_, err := q.EnqueueWithOptions(obj, 1, channel, time.Time{}, priorityqueue.EnqueueOptions{Tenant: tenant})
+			AssertNil(t, err)
+		}
+		item, _, err = q.DequeueWithReservation(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "b2")
+		item, err = q.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "c1")
+		item, err = q.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "a4")
+
+		// reservations failing to be logged leave the round where it was
+		for tenant, obj := range map[string]string{"A": "a5", "B": "b3"} {
+			_, err := q.EnqueueWithOptions(obj, 1, channel, time.Time{}, priorityqueue.EnqueueOptions{Tenant: tenant})
+			AssertNil(t, err)
+		}
+		walDir := t.TempDir() // appending to a directory fails
+		q.snapshotFile, q.walFile = "unused", walDir
+		_, err = q.DequeueWithReservationBatch(channel, 1, priorityqueue.ReserveOptions{})
+		AssertTrue(t, err != nil)
+		q.snapshotFile, q.walFile = "", ""
+		item, err = q.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "b3")
+		q.snapshotFile, q.walFile = "unused", walDir
+		_, err = q.Dequeue(channel)
+		AssertTrue(t, err != nil)
+		q.snapshotFile, q.walFile = "", ""
+		_, err = q.EnqueueWithOptions("b4", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{Tenant: "B"})
+		AssertNil(t, err)
+		item, err = q.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "a5")
+	})
+
+	t.Run("routing rules", func(t *testing.T) {
+		q := NewMemPQueue(true)
+		prio := 5.0
+		invoices := priorityqueue.RoutingRule{Name: "invoices", Conditions: []string{"$.type=invoice"}, Channel: channel, Prio: &prio}
+		urgent := priorityqueue.RoutingRule{Name: "urgent", Conditions: []string{"urgent=true"}, Channel: channel + 1}
+		AssertNil(t, q.SetRoutingRule(invoices))
+		AssertNil(t, q.SetRoutingRule(urgent))
+		err := q.SetRoutingRule(priorityqueue.RoutingRule{Name: "empty", Channel: channel})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+		err = q.SetRoutingRule(priorityqueue.RoutingRule{Name: "bad", Conditions: []string{"urgent=true"}, Channel: MAX_CHANNEL})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidChannel))
+
+		// a rule with an existing name is replaced in place
+		invoices.Channel = channel + 2
+		AssertNil(t, q.SetRoutingRule(invoices))
+		rules, err := q.RoutingRules()
+		AssertNil(t, err)
+		AssertEqual(t, len(rules), 2)
+		AssertEqual(t, rules[0].Name, "invoices")
+		AssertEqual(t, rules[0].Channel, channel+2)
+		AssertEqual(t, *rules[0].Prio, prio)
+		AssertEqual(t, rules[1].Name, "urgent")
+
+		// the first matching rule applies
+		rule, ok := priorityqueue.Route(rules, `{"type":"invoice"}`, map[string]string{"urgent": "true"})
+		AssertTrue(t, ok)
+		AssertEqual(t, rule.Name, "invoices")
+		rule, ok = priorityqueue.Route(rules, `{"type":"order"}`, map[string]string{"urgent": "true"})
+		AssertTrue(t, ok)
+		AssertEqual(t, rule.Name, "urgent")
+		_, ok = priorityqueue.Route(rules, `{"type":"order"}`, nil)
+		AssertFalse(t, ok)
+
+		deleted, err := q.DeleteRoutingRule("invoices")
+		AssertNil(t, err)
+		AssertTrue(t, deleted)
+		deleted, err = q.DeleteRoutingRule("invoices")
+		AssertNil(t, err)
+		AssertFalse(t, deleted)
+		rules, _ = q.RoutingRules()
+		AssertEqual(t, len(rules), 1)
+		AssertEqual(t, rules[0].Name, "urgent")
+	})
+
+	t.Run("channel schemas", func(t *testing.T) {
+		q := NewMemPQueue(true)
+		minimum := 0.0
+		schema := priorityqueue.Schema{
+			Type:     "object",
+			Required: []string{"type", "amount"},
+			Properties: map[string]*priorityqueue.Schema{
+				"type":   {Type: "string", Enum: []any{"invoice", "credit"}},
+				"amount": {Type: "number", Minimum: &minimum},
+				"lines":  {Type: "array", Items: &priorityqueue.Schema{Type: "integer"}},
+			},
+		}
+		_, err := q.SetChannelSchema(channel, priorityqueue.Schema{Type: "decimal"})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+		_, err = q.SetChannelSchema(MAX_CHANNEL, schema)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidChannel))
+
+		version, err := q.SetChannelSchema(channel, priorityqueue.Schema{Type: "object"})
+		AssertNil(t, err)
+		AssertEqual(t, version, 1)
+		version, err = q.SetChannelSchema(channel, schema)
+		AssertNil(t, err)
+		AssertEqual(t, version, 2)
+		versions, err := q.ChannelSchemas(channel)
+		AssertNil(t, err)
+		AssertEqual(t, len(versions), 2)
+		AssertEqual(t, versions[0].Schema.Type, "object")
+		AssertEqual(t, versions[1].Version, 2)
+		AssertEqual(t, versions[1].Channel, channel)
+		versions, _ = q.ChannelSchemas(channel + 1)
+		AssertEqual(t, len(versions), 0)
+
+		// the stored schema checks payloads
+		versions, _ = q.ChannelSchemas(channel)
+		latest := versions[len(versions)-1].Schema
+		AssertEqual(t, len(latest.Violations(`{"type":"invoice","amount":12.5,"lines":[1,2]}`)), 0)
+		violations := latest.Violations(`{"type":"order","amount":-1,"lines":[1,2.5]}`)
+		AssertEqual(t, len(violations), 3)
+		AssertEqual(t, violations[0], "$.amount: must be at least 0")
+		AssertEqual(t, violations[1], "$.lines[1]: expected integer, got number")
+		AssertEqual(t, violations[2], `$.type: must be one of ["invoice","credit"]`)
+		AssertEqual(t, latest.Violations(`{"type":"credit"}`)[0], `$: missing required property "amount"`)
+		AssertEqual(t, latest.Violations(`not json`)[0], "$: payload is not valid JSON")
+
+		// every enqueue path checks payloads against the latest version
+		_, err = q.EnqueueWithOptions(`{"type":"order","amount":1}`, 1, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+		var violation *priorityqueue.SchemaViolationError
+		AssertTrue(t, errors.As(err, &violation))
+		AssertEqual(t, violation.Version, 2)
+		AssertEqual(t, violation.Violations[0], `$.type: must be one of ["invoice","credit"]`)
+		AssertNil(t, q.AddSubscription("invoices", channel))
+		_, err = q.Publish("invoices", `{"type":"order","amount":1}`, 1, time.Time{}, priorityqueue.EnqueueOptions{})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrSchemaViolation))
+		_, err = q.ApplyTransaction([]priorityqueue.TxOp{{Op: priorityqueue.TX_ENQUEUE, Obj: `{"type":"order","amount":1}`, Prio: 1, Channel: channel}})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrSchemaViolation))
+
+		// replies are checked too, a non-conforming reply fails the confirmation
+		replyTo := channel
+		_, err = q.EnqueueWithOptions("job", 1, channel+1, time.Time{}, priorityqueue.EnqueueOptions{ReplyTo: &replyTo})
+		AssertNil(t, err)
+		_, resId, err := q.DequeueWithReservation(channel + 1)
+		AssertNil(t, err)
+		_, err = q.ConfirmReservationWithResult(resId, "done", time.Minute)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrSchemaViolation))
+		isEmpty, err := q.IsEmpty(channel)
+		AssertNil(t, err)
+		AssertTrue(t, isEmpty)
+
+		deleted, err := q.DeleteChannelSchema(channel)
+		AssertNil(t, err)
+		AssertTrue(t, deleted)
+		deleted, err = q.DeleteChannelSchema(channel)
+		AssertNil(t, err)
+		AssertFalse(t, deleted)
+		versions, _ = q.ChannelSchemas(channel)
+		AssertEqual(t, len(versions), 0)
+	})
+
+	t.Run("blob offloading", func(t *testing.T) {
+		q := NewMemPQueue(true)
+		dir := t.TempDir()
+		AssertNil(t, q.SetBlobStore(dir, 16))
+		large := `{"type":"report","data":"` + strings.Repeat("x", 100) + `"}`
+
+		AssertNil(t, q.Enqueue("small", 1, channel, time.Time{}))
+		AssertNil(t, q.Enqueue(large, 2, channel, time.Time{}))
+		AssertNil(t, q.Enqueue(large, 1, channel+1, time.Time{}))
+		blobs, _ := os.ReadDir(dir)
+		AssertEqual(t, len(blobs), 1) // equal payloads share a blob
+		for _, item := range q.pqs[channel+1].Items() {
+			AssertEqual(t, item.Obj, "")
+			AssertEqual(t, item.Blob, blobs[0].Name())
+		}
+
+		// payloads are read back when peeked, reserved and dequeued
+		value, err := q.Peek(channel + 1)
+		AssertNil(t, err)
+		AssertEqual(t, value, large)
+		value, resId, err := q.DequeueWithReservationFiltered(channel, priorityqueue.Filter{Path: "$.type", Value: "report"})
+		AssertNil(t, err)
+		AssertEqual(t, value, large)
+		value, err = q.Dequeue(channel + 1)
+		AssertNil(t, err)
+		AssertEqual(t, value, large)
+		blobs, _ = os.ReadDir(dir)
+		AssertEqual(t, len(blobs), 1) // still referenced by the reservation
+
+		// the blob is removed with its last item
+		confirmed, err := q.ConfirmReservation(resId)
+		AssertNil(t, err)
+		AssertTrue(t, confirmed)
+		blobs, _ = os.ReadDir(dir)
+		AssertEqual(t, len(blobs), 0)
+		AssertNil(t, q.Enqueue(large, 1, channel, time.Time{}))
+		itemId, err := q.EnqueueWithOptions(large+" ", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+		AssertNil(t, err)
+		deleted, err := q.Delete(itemId)
+		AssertNil(t, err)
+		AssertTrue(t, deleted)
+		blobs, _ = os.ReadDir(dir)
+		AssertEqual(t, len(blobs), 1)
+		AssertNil(t, q.ResetQueue())
+		blobs, _ = os.ReadDir(dir)
+		AssertEqual(t, len(blobs), 0)
+
+		// replacing an item by an item sharing its blob keeps the blob
+		opts := priorityqueue.EnqueueOptions{CoalesceKey: "report"}
+		_, err = q.EnqueueWithOptions(large, 1, channel, time.Time{}, opts)
+		AssertNil(t, err)
+		_, err = q.EnqueueWithOptions(large, 1, channel, time.Time{}, opts)
+		AssertNil(t, err)
+		value, resId, err = q.DequeueWithReservation(channel)
+		AssertNil(t, err)
+		AssertEqual(t, value, large)
+		_, err = q.ApplyTransaction([]priorityqueue.TxOp{
+			{Op: priorityqueue.TX_CONFIRM, ReservationId: resId},
+			{Op: priorityqueue.TX_ENQUEUE, Obj: large, Prio: 1, Channel: channel},
+		})
+		AssertNil(t, err)
+		value, err = q.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, value, large)
+
+		// blobs of rejected operations are not kept
+		_, err = q.ApplyTransaction([]priorityqueue.TxOp{
+			{Op: priorityqueue.TX_ENQUEUE, Obj: large, Prio: 1, Channel: channel},
+			{Op: priorityqueue.TX_CONFIRM, ReservationId: "missing"},
+		})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrReservationNotFound))
+		blobs, _ = os.ReadDir(dir)
+		AssertEqual(t, len(blobs), 0)
+
+		// blobs no item refers to are removed when the store is set
+		AssertNil(t, os.WriteFile(filepath.Join(dir, blobstore.Ref("orphan")), []byte("orphan"), 0644))
+		AssertNil(t, q.SetBlobStore(dir, 16))
+		blobs, _ = os.ReadDir(dir)
+		AssertEqual(t, len(blobs), 0)
+	})
+
+	t.Run("payload encryption", func(t *testing.T) {
+		q := NewMemPQueue(true)
+		err := q.SetChannelConfig(channel, priorityqueue.ChannelConfig{Encrypt: true})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+
+		old, err := keyring.Parse("old MDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDA=")
+		AssertNil(t, err)
+		q.SetKeyring(old)
+		AssertNil(t, q.SetChannelConfig(channel, priorityqueue.ChannelConfig{Encrypt: true}))
+		AssertNil(t, q.Enqueue(`{"secret":1}`, 1, channel, time.Time{}))
+
+		// after a rotation new payloads use the new key, the old key still decrypts
+		rotated, err := keyring.Parse("# rotated\nold MDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDA=\nnew MTExMTExMTExMTExMTExMTExMTExMTExMTExMTExMTE=")
+		AssertNil(t, err)
+		AssertEqual(t, rotated.Current(), "new")
+		q.SetKeyring(rotated)
+		AssertNil(t, q.Enqueue(`{"secret":2}`, 2, channel, time.Time{}))
+		AssertNil(t, q.Enqueue("plain", 3, channel+1, time.Time{}))
+
+		// payloads are encrypted at rest, tagged with their key
+		keyIds := map[string]bool{}
+		for _, item := range q.pqs[channel].Items() {
+			AssertFalse(t, strings.Contains(item.Obj, "secret"))
+			keyIds[item.KeyId] = true
+		}
+		AssertTrue(t, keyIds["old"] && keyIds["new"])
+
+		_, _, err = q.DequeueWithReservationFiltered(channel, priorityqueue.Filter{Path: "$.secret", Value: "1"})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrEmpty))
+		value, err := q.Peek(channel)
+		AssertNil(t, err)
+		AssertEqual(t, value, `{"secret":1}`)
+		value, err = q.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, value, `{"secret":1}`)
+		value, _, err = q.DequeueWithReservation(channel)
+		AssertNil(t, err)
+		AssertEqual(t, value, `{"secret":2}`)
+		value, err = q.Dequeue(channel + 1)
+		AssertNil(t, err)
+		AssertEqual(t, value, "plain")
+
+		// results are encrypted with the key of the item's channel
+		id, err := q.EnqueueWithOptions("job", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+		AssertNil(t, err)
+		_, resId, err := q.DequeueWithReservation(channel)
+		AssertNil(t, err)
+		ok, err := q.ConfirmReservationWithResult(resId, `{"secret":3}`, time.Minute)
+		AssertNil(t, err)
+		AssertTrue(t, ok)
+		AssertFalse(t, strings.Contains(q.results[id].Value, "secret"))
+		AssertEqual(t, q.results[id].KeyId, "new")
+		result, found, err := q.GetResult(id)
+		AssertNil(t, err)
+		AssertTrue(t, found)
+		AssertEqual(t, result, `{"secret":3}`)
+	})
+
+	t.Run("partitions", func(t *testing.T) {
+		q := NewMemPQueue(true)
+		err := q.SetChannelConfig(channel, priorityqueue.ChannelConfig{Partitions: 4})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+		err = q.RepartitionChannel(channel, 4)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+		AssertNil(t, q.PauseChannel(channel))
+		err = q.RepartitionChannel(channel, priorityqueue.MAX_PARTITIONS+1)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+		AssertNil(t, q.RepartitionChannel(channel, 4))
+		AssertNil(t, q.ResumeChannel(channel))
+
+		// setting the config keeps the partitions
+		AssertNil(t, q.SetChannelConfig(channel, priorityqueue.ChannelConfig{}))
+		configs, err := q.ChannelConfigs()
+		AssertNil(t, err)
+		AssertEqual(t, configs[channel].Partitions, 4)
+
+		keyOf := map[string]string{}
+		expected := make([]int, 4)
+		for i := range 8 {
+			key := fmt.Sprintf("key%d", i)
+			for n := 1; n <= 2; n++ {
+				obj := fmt.Sprintf("%s-%d", key, n)
+				_, err := q.EnqueueWithOptions(obj, float64(n), channel, time.Time{}, priorityqueue.EnqueueOptions{PartitionKey: key})
+				AssertNil(t, err)
+				keyOf[obj] = key
+			}
+			expected[configs[channel].Partition(priorityqueue.PartitionHash(key))] += 2
+		}
+		stats, err := q.Stats()
+		AssertNil(t, err)
+		AssertEqual(t, len(stats[channel].Partitions), 4)
+		for partition, ready := range expected {
+			AssertEqual(t, stats[channel].Partitions[partition], ready)
+		}
+
+		invalid := 4
+		_, err = q.DequeueWithReservationBatch(channel, 1, priorityqueue.ReserveOptions{Partition: &invalid})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+
+		// each partition only serves the items of its keys, in priority order
+		var reservations []string
+		for partition := range 4 {
+			items, err := q.DequeueWithReservationBatch(channel, 100, priorityqueue.ReserveOptions{Partition: &partition})
+			if expected[partition] == 0 {
+				AssertTrue(t, errors.Is(err, priorityqueue.ErrEmpty))
+				continue
+			}
+			AssertNil(t, err)
+			AssertEqual(t, len(items), expected[partition])
+			for i, item := range items {
+				AssertEqual(t, configs[channel].Partition(priorityqueue.PartitionHash(keyOf[item.Value])), partition)
+				AssertEqual(t, strings.HasSuffix(item.Value, "-1"), i < len(items)/2)
+				reservations = append(reservations, item.Reservation.ReservationId)
+			}
+		}
+
+		// outstanding reservations block a rebalance
+		AssertNil(t, q.PauseChannel(channel))
+		err = q.RepartitionChannel(channel, 2)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+		for _, reservationId := range reservations {
+			ok, err := q.ReleaseReservation(reservationId)
+			AssertNil(t, err)
+			AssertTrue(t, ok)
+		}
+		AssertNil(t, q.RepartitionChannel(channel, 2))
+		AssertNil(t, q.ResumeChannel(channel))
+
+		stats, err = q.Stats()
+		AssertNil(t, err)
+		AssertEqual(t, len(stats[channel].Partitions), 2)
+		AssertEqual(t, stats[channel].Partitions[0]+stats[channel].Partitions[1], 16)
+		one := 1
+		items, err := q.DequeueWithReservationBatch(channel, 100, priorityqueue.ReserveOptions{Partition: &one})
+		AssertNil(t, err)
+		AssertEqual(t, len(items), stats[channel].Partitions[1])
+		for _, item := range items {
+			AssertEqual(t, priorityqueue.PartitionHash(keyOf[item.Value])%2, uint32(1))
+		}
+	})
+
+	t.Run("topics", func(t *testing.T) {
+		q := NewMemPQueue(true)
+
+		itemIds, err := q.Publish("orders", "nobody", 1, time.Time{}, priorityqueue.EnqueueOptions{})
+		AssertNil(t, err)
+		AssertEqual(t, len(itemIds), 0)
+
+		AssertNil(t, q.AddSubscription("orders", channel))
+		AssertNil(t, q.AddSubscription("orders", channel+1))
+		AssertNil(t, q.AddSubscription("orders", channel+1))
+		subscriptions, _ := q.Subscriptions()
+		CollectionAssertEqual(t, subscriptions["orders"], []int{channel, channel + 1})
+
+		itemIds, err = q.Publish("orders", "order1", 1, time.Time{}, priorityqueue.EnqueueOptions{})
+		AssertNil(t, err)
+		AssertEqual(t, len(itemIds), 2)
+		AssertNotEqual(t, itemIds[0], itemIds[1])
+
+		value, err := q.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, value, "order1")
+		value, err = q.Dequeue(channel + 1)
+		AssertNil(t, err)
+		AssertEqual(t, value, "order1")
+
+		AssertNil(t, q.RemoveSubscription("orders", channel))
+		itemIds, _ = q.Publish("orders", "order2", 1, time.Time{}, priorityqueue.EnqueueOptions{})
+		AssertEqual(t, len(itemIds), 1)
+		isEmpty, _ := q.IsEmpty(channel)
+		AssertTrue(t, isEmpty)
+
+		err = q.AddSubscription("orders", MAX_CHANNEL)
+		AssertNotEqual(t, err, nil)
+	})
+
 }
 
 func TestMemPQueuePersistence(t *testing.T) {
@@ -176,7 +1309,53 @@ func TestMemPQueuePersistence(t *testing.T) {
 	q = NewMemPQueuePersistent(true, snap, wal)
 	AssertTrue(t, len(q.reserved) == 0)
 
-	// 5. Test not-before persistence
+	// 5. Test result persistence
+	q.Enqueue("resultitem", 1, channel, time.Time{})
+	_, resId, err = q.DequeueWithReservation(channel)
+	AssertNil(t, err)
+	resItemId := q.reserved[resId].Item.Id
+	q.ConfirmReservationWithResult(resId, "done", time.Minute)
+	q = NewMemPQueuePersistent(true, snap, wal)
+	result, found, err := q.GetResult(resItemId)
+	AssertNil(t, err)
+	AssertTrue(t, found)
+	AssertEqual(t, result, "done")
+
+	// 6. Test reply persistence
+	replyChannel := channel + 1
+	q.EnqueueWithOptions("request", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{ReplyTo: &replyChannel, CorrelationId: "abc"})
+	_, resId, err = q.DequeueWithReservation(channel)
+	AssertNil(t, err)
+	q.ConfirmReservationWithResult(resId, "pong", time.Minute)
+	q = NewMemPQueuePersistent(true, snap, wal)
+	val, err = q.Dequeue(replyChannel)
+	AssertNil(t, err)
+	AssertEqual(t, val, `{"correlation_id":"abc","value":"pong"}`)
+
+	// 7. Test paused persistence
+	q.PauseChannel(channel)
+	q = NewMemPQueuePersistent(true, snap, wal)
+	AssertTrue(t, q.paused[channel])
+	q.ResumeChannel(channel)
+	q = NewMemPQueuePersistent(true, snap, wal)
+	AssertFalse(t, q.paused[channel])
+
+	// 8. Test transaction persistence
+	q.Enqueue("txitem", 1, channel, time.Time{})
+	_, resId, err = q.DequeueWithReservation(channel)
+	AssertNil(t, err)
+	_, err = q.ApplyTransaction([]priorityqueue.TxOp{
+		{Op: priorityqueue.TX_CONFIRM, ReservationId: resId},
+		{Op: priorityqueue.TX_ENQUEUE, Obj: "txfollowup", Prio: 1, Channel: channel},
+	})
+	AssertNil(t, err)
+	q = NewMemPQueuePersistent(true, snap, wal)
+	AssertEqual(t, len(q.reserved), 0)
+	val, err = q.Dequeue(channel)
+	AssertNil(t, err)
+	AssertEqual(t, val, "txfollowup")
+
+	// 9. Test not-before persistence
 
 	q = NewMemPQueuePersistent(true, snap, wal)
 	q.Enqueue("futureitem", 1, channel, time.Now().Add(500*time.Millisecond))
@@ -189,10 +1368,389 @@ func TestMemPQueuePersistence(t *testing.T) {
 	size, err = q.Size(channel)
 	AssertNil(t, err)
 	AssertEqual(t, size, 1)
+
+	// replaying the move takes the item out of not_before_pq
+	q = NewMemPQueuePersistent(true, snap, wal)
+	AssertEqual(t, q.not_before_pq.Size(), 0)
+	size, err = q.Size(channel)
+	AssertNil(t, err)
+	AssertEqual(t, size, 1)
 	val, err = q.Dequeue(channel)
 	AssertNil(t, err)
 	AssertEqual(t, val, "futureitem")
 
+	// 10. Test dependency persistence
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	parentId, err := q.EnqueueWithOptions("parent", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+	AssertNoError(t, err)
+	_, err = q.EnqueueWithOptions("child", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{DependsOn: []string{parentId}})
+	AssertNoError(t, err)
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	AssertEqual(t, len(q.blocked), 1)
+	val, err = q.Dequeue(channel)
+	AssertNil(t, err)
+	AssertEqual(t, val, "parent")
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	AssertEqual(t, len(q.blocked), 0)
+	val, err = q.Dequeue(channel)
+	AssertNil(t, err)
+	AssertEqual(t, val, "child")
+
+	// 11. Test subscription persistence
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	AssertNil(t, q.AddSubscription("events", channel))
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	_, err = q.Publish("events", "event1", 1, time.Time{}, priorityqueue.EnqueueOptions{})
+	AssertNil(t, err)
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	val, err = q.Dequeue(channel)
+	AssertNil(t, err)
+	AssertEqual(t, val, "event1")
+	AssertNil(t, q.RemoveSubscription("events", channel))
+
+	// 12. Test attribute persistence
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	q.EnqueueWithOptions("euitem", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{Attributes: map[string]string{"region": "eu"}})
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	val, _, err = q.DequeueWithReservationFiltered(channel, priorityqueue.Filter{Attributes: map[string]string{"region": "eu"}})
+	AssertNil(t, err)
+	AssertEqual(t, val, "euitem")
+
+	// 13. Test counter persistence
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	stats, err := q.Stats()
+	AssertNil(t, err)
+	AssertTrue(t, stats[channel].Enqueued > 0)
+	AssertEqual(t, stats[channel].Dequeued, stats[channel].Enqueued)
+
+	// 14. Test item status persistence, through the WAL and through a snapshot
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	statusId, err := q.EnqueueWithOptions("statusitem", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+	AssertNoError(t, err)
+	_, resId, err = q.DequeueWithReservation(channel)
+	AssertNil(t, err)
+	q.ConfirmReservation(resId)
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	status, err := q.GetStatus(statusId)
+	AssertNil(t, err)
+	AssertEqual(t, status.Status, priorityqueue.STATUS_COMPLETED)
+	AssertEqual(t, status.Attempts, 1)
+
+	AssertNil(t, q.save())
+	AssertNil(t, os.Truncate(wal, 0))
+	q = NewMemPQueuePersistent(true, snap, wal)
+	status, err = q.GetStatus(statusId)
+	AssertNil(t, err)
+	AssertEqual(t, status.Status, priorityqueue.STATUS_COMPLETED)
+
+	// 15. Test channel config persistence, EDF order must survive a restart
+
+	overdue := channel + 1
+	AssertNil(t, q.SetChannelConfig(channel, priorityqueue.ChannelConfig{EDF: true, OverdueChannel: &overdue}))
+	q.EnqueueWithOptions("late", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{Deadline: time.Now().Add(2 * time.Hour)})
+	q.EnqueueWithOptions("soon", 2, channel, time.Time{}, priorityqueue.EnqueueOptions{Deadline: time.Now().Add(time.Hour)})
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	configs, err := q.ChannelConfigs()
+	AssertNil(t, err)
+	AssertEqual(t, *configs[channel].OverdueChannel, overdue)
+
+	AssertNil(t, q.save())
+	AssertNil(t, os.Truncate(wal, 0))
+	q = NewMemPQueuePersistent(true, snap, wal)
+	item, err := q.Dequeue(channel)
+	AssertNil(t, err)
+	AssertEqual(t, item, "soon")
+
+	// 16. Test coalesce key persistence, through the WAL and through a snapshot
+
+	opts := priorityqueue.EnqueueOptions{CoalesceKey: "key"}
+	keyId, err := q.EnqueueWithOptions("v1", 1, channel, time.Time{}, opts)
+	AssertNoError(t, err)
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	coalescedId, err := q.EnqueueWithOptions("v2", 1, channel, time.Time{}, opts)
+	AssertNoError(t, err)
+	AssertEqual(t, coalescedId, keyId)
+
+	AssertNil(t, q.save())
+	AssertNil(t, os.Truncate(wal, 0))
+	q = NewMemPQueuePersistent(true, snap, wal)
+	coalescedId, err = q.EnqueueWithOptions("v3", 1, channel, time.Time{}, opts)
+	AssertNoError(t, err)
+	AssertEqual(t, coalescedId, keyId)
+
+	// 17. Test reservation owner persistence
+
+	_, owned, err := q.DequeueWithReservationOptions(channel, priorityqueue.ReserveOptions{Consumer: "worker"})
+	AssertNoError(t, err)
+	ownedResId := owned.ReservationId
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	_, err = q.ConfirmReservation(ownedResId)
+	AssertTrue(t, errors.Is(err, priorityqueue.ErrNotOwner))
+	ok, err := q.ConfirmReservationAs(ownedResId, priorityqueue.ReservationClaim{Consumer: "worker"}, "", 0)
+	AssertNoError(t, err)
+	AssertTrue(t, ok)
+
+	// 18. Test fencing token persistence
+
+	q.Enqueue("fenced", 1, channel, time.Time{})
+	_, fenced, err := q.DequeueWithReservationOptions(channel, priorityqueue.ReserveOptions{})
+	AssertNoError(t, err)
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	reservations, err := q.Reservations()
+	AssertNoError(t, err)
+	listed := false
+	for _, reservation := range reservations[""] {
+		if reservation.ReservationId == fenced.ReservationId {
+			AssertEqual(t, reservation.Token, fenced.Token)
+			listed = true
+		}
+	}
+	AssertTrue(t, listed)
+	_, err = q.ConfirmReservationAs(fenced.ReservationId, priorityqueue.ReservationClaim{Token: fenced.Token - 1}, "", 0)
+	AssertTrue(t, errors.Is(err, priorityqueue.ErrStaleToken))
+	AssertNoError(t, q.save())
+	AssertNil(t, os.Truncate(wal, 0))
+	q = NewMemPQueuePersistent(true, snap, wal)
+	q.Enqueue("fenced2", 1, channel, time.Time{})
+	_, next, err := q.DequeueWithReservationOptions(channel, priorityqueue.ReserveOptions{})
+	AssertNoError(t, err)
+	AssertTrue(t, next.Token > fenced.Token)
+
+	// 19. Test batch reservation and confirmation persistence
+
+	q.Enqueue("batch1", 1, channel, time.Time{})
+	q.Enqueue("batch2", 1, channel, time.Time{})
+	batch, err := q.DequeueWithReservationBatch(channel, 10, priorityqueue.ReserveOptions{})
+	AssertNoError(t, err)
+	batchIds := make([]string, len(batch))
+	for i, item := range batch {
+		batchIds[i] = item.Reservation.ReservationId
+	}
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	confirmed, err := q.ConfirmReservationBatch(batchIds, priorityqueue.ReservationClaim{})
+	AssertNoError(t, err)
+	for _, err := range confirmed {
+		AssertNil(t, err)
+	}
+	q = NewMemPQueuePersistent(true, snap, wal)
+	confirmed, err = q.ConfirmReservationBatch(batchIds, priorityqueue.ReservationClaim{})
+	AssertNoError(t, err)
+	for _, err := range confirmed {
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrReservationNotFound))
+	}
+
+	// 20. Test fair channel cursor persistence
+
+	fair := channel + 2
+	AssertNoError(t, q.SetChannelConfig(fair, priorityqueue.ChannelConfig{Fair: true}))
+	for _, tenant := range []string{"A", "B", "C"} {
+		_, err := q.EnqueueWithOptions(tenant, 1, fair, time.Time{}, priorityqueue.EnqueueOptions{Tenant: tenant})
+		AssertNoError(t, err)
+	}
+	item, err = q.Dequeue(fair)
+	AssertNoError(t, err)
+	AssertEqual(t, item, "A")
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	item, err = q.Dequeue(fair)
+	AssertNoError(t, err)
+	AssertEqual(t, item, "B")
+	q.EnqueueWithOptions("A2", 1, fair, time.Time{}, priorityqueue.EnqueueOptions{Tenant: "A"})
+	AssertNoError(t, q.save())
+	AssertNil(t, os.Truncate(wal, 0))
+	q = NewMemPQueuePersistent(true, snap, wal)
+	item, err = q.Dequeue(fair)
+	AssertNoError(t, err)
+	AssertEqual(t, item, "C")
+
+	// 21. Test routing rule persistence
+
+	AssertNoError(t, q.SetRoutingRule(priorityqueue.RoutingRule{Name: "first", Conditions: []string{"a=1"}, Channel: 1}))
+	AssertNoError(t, q.SetRoutingRule(priorityqueue.RoutingRule{Name: "second", Conditions: []string{"b=2"}, Channel: 2}))
+	deleted, err := q.DeleteRoutingRule("first")
+	AssertNoError(t, err)
+	AssertTrue(t, deleted)
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	rules, err := q.RoutingRules()
+	AssertNoError(t, err)
+	AssertEqual(t, len(rules), 1)
+	AssertEqual(t, rules[0].Name, "second")
+	AssertNoError(t, q.save())
+	AssertNil(t, os.Truncate(wal, 0))
+	q = NewMemPQueuePersistent(true, snap, wal)
+	rules, err = q.RoutingRules()
+	AssertNoError(t, err)
+	AssertEqual(t, len(rules), 1)
+	AssertEqual(t, rules[0].Channel, 2)
+
+	// 22. Test channel schema persistence
+
+	_, err = q.SetChannelSchema(1, priorityqueue.Schema{Type: "object", Enum: []any{nil}})
+	AssertNoError(t, err)
+	_, err = q.SetChannelSchema(1, priorityqueue.Schema{Type: "object", Required: []string{"id"}})
+	AssertNoError(t, err)
+	_, err = q.SetChannelSchema(2, priorityqueue.Schema{Type: "string"})
+	AssertNoError(t, err)
+	deleted, err = q.DeleteChannelSchema(2)
+	AssertNoError(t, err)
+	AssertTrue(t, deleted)
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	versions, err := q.ChannelSchemas(1)
+	AssertNoError(t, err)
+	AssertEqual(t, len(versions), 2)
+	AssertEqual(t, versions[1].Schema.Required[0], "id")
+	versions, _ = q.ChannelSchemas(2)
+	AssertEqual(t, len(versions), 0)
+	AssertNoError(t, q.save())
+	AssertNil(t, os.Truncate(wal, 0))
+	q = NewMemPQueuePersistent(true, snap, wal)
+	versions, err = q.ChannelSchemas(1)
+	AssertNoError(t, err)
+	AssertEqual(t, len(versions), 2)
+	AssertEqual(t, versions[1].Version, 2)
+	version, err := q.SetChannelSchema(1, priorityqueue.Schema{})
+	AssertNoError(t, err)
+	AssertEqual(t, version, 3)
+
+	// 23. Test that offloaded payloads stay out of the WAL and the snapshot
+
+	blobDir := t.TempDir()
+	AssertNoError(t, q.SetBlobStore(blobDir, 16))
+	large := strings.Repeat("large payload ", 10)
+	AssertNoError(t, q.Enqueue(large, 1, 7, time.Time{}))
+	walData, err := os.ReadFile(wal)
+	AssertNoError(t, err)
+	AssertFalse(t, strings.Contains(string(walData), large))
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	AssertNoError(t, q.SetBlobStore(blobDir, 16))
+	AssertNoError(t, q.save())
+	AssertNil(t, os.Truncate(wal, 0))
+	snapData, err := os.ReadFile(snap)
+	AssertNoError(t, err)
+	AssertFalse(t, strings.Contains(string(snapData), large))
+	q = NewMemPQueuePersistent(true, snap, wal)
+	AssertNoError(t, q.SetBlobStore(blobDir, 16))
+	blobs, _ := os.ReadDir(blobDir)
+	AssertEqual(t, len(blobs), 1)
+	item, err = q.Dequeue(7)
+	AssertNoError(t, err)
+	AssertEqual(t, item, large)
+	blobs, _ = os.ReadDir(blobDir)
+	AssertEqual(t, len(blobs), 0)
+
+	// 24. Test that encrypted payloads stay encrypted in the WAL, the snapshot and the blob store
+
+	keys, err := keyring.Parse("k1 MDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDA=")
+	AssertNoError(t, err)
+	q.SetKeyring(keys)
+	AssertNoError(t, q.SetChannelConfig(8, priorityqueue.ChannelConfig{Encrypt: true}))
+	AssertNoError(t, q.Enqueue("personal data", 1, 8, time.Time{}))
+	AssertNoError(t, q.Enqueue(large, 2, 8, time.Time{}))
+	jobId, err := q.EnqueueWithOptions("job", 0, 8, time.Time{}, priorityqueue.EnqueueOptions{})
+	AssertNoError(t, err)
+	_, jobResId, err := q.DequeueWithReservation(8)
+	AssertNoError(t, err)
+	_, err = q.ConfirmReservationWithResult(jobResId, "personal result", time.Hour)
+	AssertNoError(t, err)
+	walData, err = os.ReadFile(wal)
+	AssertNoError(t, err)
+	AssertFalse(t, strings.Contains(string(walData), "personal data"))
+	AssertFalse(t, strings.Contains(string(walData), "personal result"))
+	blobs, _ = os.ReadDir(blobDir)
+	AssertEqual(t, len(blobs), 2) // encrypted payloads are offloaded by their encrypted size
+	for _, blob := range blobs {
+		blobData, err := os.ReadFile(filepath.Join(blobDir, blob.Name()))
+		AssertNoError(t, err)
+		AssertFalse(t, strings.Contains(string(blobData), "personal data") || strings.Contains(string(blobData), "large payload"))
+	}
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	q.SetKeyring(keys)
+	AssertNoError(t, q.SetBlobStore(blobDir, 16))
+	AssertNoError(t, q.save())
+	AssertNil(t, os.Truncate(wal, 0))
+	snapData, err = os.ReadFile(snap)
+	AssertNoError(t, err)
+	AssertFalse(t, strings.Contains(string(snapData), "personal data"))
+	AssertFalse(t, strings.Contains(string(snapData), "personal result"))
+	q = NewMemPQueuePersistent(true, snap, wal)
+	q.SetKeyring(keys)
+	AssertNoError(t, q.SetBlobStore(blobDir, 16))
+	result, found, err = q.GetResult(jobId)
+	AssertNoError(t, err)
+	AssertTrue(t, found)
+	AssertEqual(t, result, "personal result")
+	item, err = q.Dequeue(8)
+	AssertNoError(t, err)
+	AssertEqual(t, item, "personal data")
+	item, err = q.Dequeue(8)
+	AssertNoError(t, err)
+	AssertEqual(t, item, large)
+
+	// 25. Test that partitions and the partition of items survive a restart
+
+	AssertNoError(t, q.PauseChannel(9))
+	AssertNoError(t, q.RepartitionChannel(9, 3))
+	AssertNoError(t, q.ResumeChannel(9))
+	_, err = q.EnqueueWithOptions("p1", 1, 9, time.Time{}, priorityqueue.EnqueueOptions{PartitionKey: "user-1"})
+	AssertNoError(t, err)
+	partition := priorityqueue.ChannelConfig{Partitions: 3}.Partition(priorityqueue.PartitionHash("user-1"))
+	other := (partition + 1) % 3
+
+	q = NewMemPQueuePersistent(true, snap, wal)
+	configs, err = q.ChannelConfigs()
+	AssertNoError(t, err)
+	AssertEqual(t, configs[9].Partitions, 3)
+	_, _, err = q.DequeueWithReservationOptions(9, priorityqueue.ReserveOptions{Partition: &other})
+	AssertTrue(t, errors.Is(err, priorityqueue.ErrEmpty))
+	item, _, err = q.DequeueWithReservationOptions(9, priorityqueue.ReserveOptions{Partition: &partition})
+	AssertNoError(t, err)
+	AssertEqual(t, item, "p1")
+	_, err = q.EnqueueWithOptions("p2", 1, 9, time.Time{}, priorityqueue.EnqueueOptions{PartitionKey: "user-1"})
+	AssertNoError(t, err)
+	AssertNoError(t, q.save())
+	AssertNil(t, os.Truncate(wal, 0))
+	q = NewMemPQueuePersistent(true, snap, wal)
+	item, _, err = q.DequeueWithReservationOptions(9, priorityqueue.ReserveOptions{Partition: &partition})
+	AssertNoError(t, err)
+	AssertEqual(t, item, "p2")
+
+	// 26. Test that items logged or saved before partitions existed are partitioned by their id
+
+	AssertNoError(t, q.appendWAL(walOp{Op: "enqueue", Channel: 9, Item: pqItem{Id: "legacy", Obj: "legacy", Prio: 1}, Time: time.Now()}))
+	q = NewMemPQueuePersistent(true, snap, wal)
+	partition = priorityqueue.ChannelConfig{Partitions: 3}.Partition(priorityqueue.PartitionHash("legacy"))
+	item, _, err = q.DequeueWithReservationOptions(9, priorityqueue.ReserveOptions{Partition: &partition})
+	AssertNoError(t, err)
+	AssertEqual(t, item, "legacy")
+
+	q.pqs[9].Enqueue(pqItem{Id: "old", Obj: "old", Prio: 1})
+	AssertNoError(t, q.save())
+	AssertNil(t, os.Truncate(wal, 0))
+	q = NewMemPQueuePersistent(true, snap, wal)
+	partition = priorityqueue.ChannelConfig{Partitions: 3}.Partition(priorityqueue.PartitionHash("old"))
+	item, _, err = q.DequeueWithReservationOptions(9, priorityqueue.ReserveOptions{Partition: &partition})
+	AssertNoError(t, err)
+	AssertEqual(t, item, "old")
 }
 
 func TestMemPQueueSnapshot(t *testing.T) {
@@ -239,3 +1797,70 @@ func TestMemPQueueSnapshot(t *testing.T) {
 	AssertEqual(t, size, no_of_messages-dequed)
 
 }
+
+func TestChannelQueue(t *testing.T) {
+	q := newChannelQueue(less, false)
+	for i := range 100 {
+		q.Enqueue(pqItem{Id: strconv.Itoa(i), Prio: float64((i * 37) % 100)})
+	}
+
+	// removal by id keeps the heap ordered
+	for i := 0; i < 100; i += 3 {
+		item, ok := q.Remove(strconv.Itoa(i))
+		AssertTrue(t, ok)
+		AssertEqual(t, item.Id, strconv.Itoa(i))
+	}
+	_, ok := q.Remove("0")
+	AssertFalse(t, ok)
+	AssertEqual(t, q.Size(), 66)
+
+	// matching visits items in order and stops at the n-th match
+	visited := 0
+	even := q.Matching(func(item pqItem) bool {
+		visited++
+		return int(item.Prio)%2 == 0
+	}, 3)
+	AssertEqual(t, len(even), 3)
+	AssertTrue(t, visited < 10)
+	for i := 1; i < len(even); i++ {
+		AssertTrue(t, even[i-1].Prio < even[i].Prio)
+	}
+
+	last := -1.0
+	for !q.IsEmpty() {
+		item, err := q.Dequeue()
+		AssertNil(t, err)
+		AssertTrue(t, item.Prio > last)
+		id, _ := strconv.Atoi(item.Id)
+		AssertTrue(t, id%3 != 0)
+		last = item.Prio
+	}
+
+	// fair queues keep a heap per tenant, tenants leave the ring with their last item
+	fair := newChannelQueue(less, true)
+	for i, tenant := range []string{"B", "A", "C", "A", "B"} {
+		fair.Enqueue(pqItem{Id: strconv.Itoa(i), Prio: float64(i), Tenant: tenant})
+	}
+	AssertEqual(t, strings.Join(fair.ring, ","), "A,B,C")
+	all := func(pqItem) bool { return true }
+	item, ok := fair.nextTenant("", false, all)
+	AssertTrue(t, ok)
+	AssertEqual(t, item.Id, "1")
+	item, ok = fair.nextTenant("B", true, all)
+	AssertTrue(t, ok)
+	AssertEqual(t, item.Id, "2")
+	fair.Remove("2")
+	AssertEqual(t, strings.Join(fair.ring, ","), "A,B")
+	item, ok = fair.nextTenant("B", true, all)
+	AssertTrue(t, ok)
+	AssertEqual(t, item.Id, "1")
+	item, ok = fair.nextTenant("A", true, func(item pqItem) bool { return item.Id == "4" })
+	AssertTrue(t, ok)
+	AssertEqual(t, item.Id, "4")
+	item, err := fair.Dequeue()
+	AssertNil(t, err)
+	AssertEqual(t, item.Id, "0")
+	fair.reorder(less, false)
+	AssertEqual(t, len(fair.ring), 0)
+	AssertEqual(t, fair.Size(), 3)
+}
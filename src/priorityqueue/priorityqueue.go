@@ -1,15 +1,839 @@
 package priorityqueue
 
-import "time"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
 
+// MAX_CHANNEL is the number of channels, valid channels are 0 to MAX_CHANNEL-1.
+const MAX_CHANNEL = 100
+
+// MAX_PARTITIONS is the largest number of partitions of a channel, see ChannelConfig.
+const MAX_PARTITIONS = 1024
+
+// Errors returned by the queue backends, match them with errors.Is.
+var (
+	ErrEmpty               = errors.New("queue is empty") // no item available, the text matches pqueue.EMPTY_QUEUE
+	ErrInvalidChannel      = errors.New("invalid channel")
+	ErrReservationNotFound = errors.New("invalid or expired reservation ID")
+	ErrItemNotFound        = errors.New("item not found")
+	ErrInvalidArgument     = errors.New("invalid argument")
+	ErrFull                = errors.New("queue is full") // for queues with a capacity limit
+	ErrNotOwner            = errors.New("reservation is held by another consumer")
+	ErrStaleToken          = errors.New("stale fencing token")
+	ErrSchemaViolation     = errors.New("payload does not conform to the schema of the channel") // see SchemaViolationError
+)
+
+// ValidateChannel returns ErrInvalidChannel for channels out of range.
+func ValidateChannel(channel int) error {
+	if channel < 0 || channel >= MAX_CHANNEL {
+		return ErrInvalidChannel
+	}
+	return nil
+}
+
+// EnqueueOptions holds optional settings for EnqueueWithOptions.
+type EnqueueOptions struct {
+	// DependsOn lists the item IDs that must complete before the item becomes visible.
+	// Until then the item is blocked and neither counted by Size nor returned by Dequeue.
+	// A parent completes when it is dequeued or its reservation is confirmed.
+	// IDs that do not refer to an unfinished item are treated as already completed.
+	// If a parent is deleted (or dead-lettered) instead, its dependents are deleted with it.
+	DependsOn []string
+
+	// ReplyTo, if set, is the channel a reply is enqueued to when the item is confirmed with a result.
+	// The reply is enqueued atomically with the confirmation, see ReplyPayload.
+	ReplyTo *int
+	// CorrelationId is carried by the reply, it defaults to the item ID.
+	CorrelationId string
+
+	// Attributes are key/value pairs consumers can select items by, see Filter.
+	// Keys are limited to letters, digits, '_' and '-'.
+	Attributes map[string]string
+
+	// Deadline orders the item on channels in EDF mode, see ChannelConfig, and counts it as overdue once passed.
+	Deadline time.Time
+
+	// CoalesceKey, if set, makes the enqueue replace the payload of the pending item with the same key
+	// in the channel instead of adding a new item, and return the ID of that item.
+	// Items are pending until reserved or dequeued, a reserved item no longer has a key.
+	// Coalescing is not supported in transactions.
+	CoalesceKey string
+	// CoalescePrio and CoalesceNotBefore also replace the priority and the not-before time of the pending item.
+	CoalescePrio      bool
+	CoalesceNotBefore bool
+
+	// Tenant groups the items served in turn on channels in fair mode, see ChannelConfig.
+	// Items without a tenant form a group of their own.
+	Tenant string
+
+	// PartitionKey places the item in a partition of a partitioned channel, see ChannelConfig.
+	// Items with the same key share a partition, items without a key are spread by their item ID.
+	PartitionKey string
+}
+
+var (
+	attributeKeyRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	jsonPathRegex     = regexp.MustCompile(`^\$(\.[A-Za-z0-9_-]+)+$`)
+)
+
+// ValidateAttributes checks that all attribute keys can be filtered on.
+func ValidateAttributes(attributes map[string]string) error {
+	for key := range attributes {
+		if !attributeKeyRegex.MatchString(key) {
+			return fmt.Errorf("%w: invalid attribute key %q", ErrInvalidArgument, key)
+		}
+	}
+	return nil
+}
+
+// Filter selects the items a consumer accepts, see DequeueWithReservationFiltered.
+// An item matches when all conditions hold, the zero Filter matches every item.
+type Filter struct {
+	// Attributes must all be equal to the attributes the item was enqueued with.
+	Attributes map[string]string
+
+	// Path is a simple JSON path into the payload, such as $.region or $.job.type,
+	// and the value found there must equal Value. Strings compare by content,
+	// numbers and booleans by their JSON text. Payloads that are not JSON never match.
+	Path  string
+	Value string
+}
+
+// ReserveOptions are the options of DequeueWithReservationOptions.
+type ReserveOptions struct {
+	Filter Filter
+	// Consumer owns the reservation, only the same consumer may confirm, release or extend it.
+	Consumer string
+	// Partition, if set, only reserves items of that partition of the channel.
+	// An unpartitioned channel has the single partition 0.
+	Partition *int
+}
+
+// ReservationClaim identifies who acts on a reservation.
+// Reservations made without a consumer may be acted on by anyone.
+type ReservationClaim struct {
+	Consumer string
+	// Token is the fencing token handed out with the reservation, zero skips the check.
+	Token int64
+}
+
+// Check returns ErrNotOwner unless the claim may act on a reservation owned by owner,
+// and ErrStaleToken if the claim carries a token other than the reservation's.
+func (c ReservationClaim) Check(owner string, token int64) error {
+	if owner != "" && c.Consumer != owner {
+		return ErrNotOwner
+	}
+	if c.Token != 0 && c.Token != token {
+		return ErrStaleToken
+	}
+	return nil
+}
+
+// Reservation describes a reservation, see Reservations.
+type Reservation struct {
+	ReservationId string    `json:"reservation_id"`
+	ItemId        string    `json:"item_id"`
+	Channel       int       `json:"channel"`
+	Consumer      string    `json:"consumer,omitempty"`
+	ReservedAt    time.Time `json:"reserved_at"`
+	// Token is the fencing token, it increases with every reservation made by the queue
+	// so downstream systems can reject writes from a worker whose reservation was lost.
+	Token int64 `json:"token"`
+}
+
+// ReservedItem is an item reserved by DequeueWithReservationBatch.
+type ReservedItem struct {
+	Value       string
+	Reservation Reservation
+}
+
+// Parse parses a filter expression, either key=value for an attribute
+// or $.path=value for a JSON path, and adds it to the filter.
+func (f *Filter) Parse(expr string) error {
+	key, value, ok := strings.Cut(expr, "=")
+	if !ok {
+		return fmt.Errorf("%w: invalid filter %q", ErrInvalidArgument, expr)
+	}
+	if strings.HasPrefix(key, "$") {
+		if f.Path != "" {
+			return fmt.Errorf("%w: only one JSON path filter is supported", ErrInvalidArgument)
+		}
+		f.Path = key
+		f.Value = value
+	} else {
+		if f.Attributes == nil {
+			f.Attributes = make(map[string]string)
+		}
+		f.Attributes[key] = value
+	}
+	return f.Validate()
+}
+
+// Validate checks the attribute keys and the JSON path of the filter.
+func (f Filter) Validate() error {
+	if err := ValidateAttributes(f.Attributes); err != nil {
+		return err
+	}
+	if f.Path != "" && !jsonPathRegex.MatchString(f.Path) {
+		return fmt.Errorf("%w: invalid JSON path %q", ErrInvalidArgument, f.Path)
+	}
+	return nil
+}
+
+// IsEmpty reports whether the filter matches every item.
+func (f Filter) IsEmpty() bool {
+	return len(f.Attributes) == 0 && f.Path == ""
+}
+
+// PathKeys returns the keys of the JSON path, $.job.type gives [job type].
+func (f Filter) PathKeys() []string {
+	if f.Path == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimPrefix(f.Path, "$."), ".")
+}
+
+// Match reports whether an item with the given payload and attributes matches the filter.
+func (f Filter) Match(obj string, attributes map[string]string) bool {
+	for key, value := range f.Attributes {
+		if actual, ok := attributes[key]; !ok || actual != value {
+			return false
+		}
+	}
+	if f.Path == "" {
+		return true
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader([]byte(obj)))
+	decoder.UseNumber()
+	var node any
+	if err := decoder.Decode(&node); err != nil {
+		return false
+	}
+	for _, key := range f.PathKeys() {
+		object, ok := node.(map[string]any)
+		if !ok {
+			return false
+		}
+		if node, ok = object[key]; !ok {
+			return false
+		}
+	}
+
+	switch v := node.(type) {
+	case string:
+		return v == f.Value
+	case json.Number:
+		return v.String() == f.Value
+	case bool:
+		return fmt.Sprint(v) == f.Value
+	}
+	return false
+}
+
+// ChannelConfig holds the settings of a channel, the zero value is the default.
+type ChannelConfig struct {
+	// EDF orders the channel earliest deadline first: items with a deadline come before items without,
+	// and the priority orders items with the same deadline.
+	EDF bool `json:"edf,omitempty"`
+	// OverdueChannel, if set on an EDF channel, is the channel ready items are moved to once past their deadline.
+	// Items are moved the next time the queue is used.
+	OverdueChannel *int `json:"overdue_channel,omitempty"`
+	// Fair serves the tenants of the channel round-robin, one item per tenant in turn, in tenant order.
+	// Within a tenant, items are served in the order of the channel.
+	Fair bool `json:"fair,omitempty"`
+	// Encrypt encrypts the payloads enqueued to the channel at rest with the keyring of the queue,
+	// they are decrypted when dequeued, peeked or reserved. JSON path filters do not match encrypted payloads.
+	Encrypt bool `json:"encrypt,omitempty"`
+	// Partitions splits the channel into partitions by the hash of the partition key of the items,
+	// 0 leaves it unpartitioned. It is changed by RepartitionChannel only, SetChannelConfig keeps it.
+	Partitions int `json:"partitions,omitempty"`
+}
+
+// PartitionHash returns the hash of a partition key, the FNV-1a hash of the key.
+func PartitionHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// Partition returns the partition of an item with the given partition hash.
+func (c ChannelConfig) Partition(hash uint32) int {
+	if c.Partitions <= 1 {
+		return 0
+	}
+	return int(hash % uint32(c.Partitions))
+}
+
+// ValidatePartition returns ErrInvalidArgument unless the partition exists in the channel.
+func (c ChannelConfig) ValidatePartition(partition int) error {
+	if partition < 0 || partition >= max(c.Partitions, 1) {
+		return fmt.Errorf("%w: partition %d does not exist", ErrInvalidArgument, partition)
+	}
+	return nil
+}
+
+// ValidatePartitions checks the number of partitions of a channel.
+func ValidatePartitions(partitions int) error {
+	if partitions < 0 || partitions > MAX_PARTITIONS {
+		return fmt.Errorf("%w: the number of partitions must be between 0 and %d", ErrInvalidArgument, MAX_PARTITIONS)
+	}
+	return nil
+}
+
+// ValidateChannelConfig checks the config of a channel against the configs of the other channels.
+// Overdue items are moved at most once: a channel receiving overdue items cannot move them on.
+func ValidateChannelConfig(channel int, config ChannelConfig, configs map[int]ChannelConfig) error {
+	if err := ValidateChannel(channel); err != nil {
+		return err
+	}
+	if config.Partitions != 0 && config.Partitions != configs[channel].Partitions {
+		return fmt.Errorf("%w: the partitions of a channel are changed by RepartitionChannel", ErrInvalidArgument)
+	}
+	if config.OverdueChannel == nil {
+		return nil
+	}
+	overdue := *config.OverdueChannel
+	if err := ValidateChannel(overdue); err != nil {
+		return err
+	}
+	if !config.EDF {
+		return fmt.Errorf("%w: an overdue channel requires EDF mode", ErrInvalidArgument)
+	}
+	if overdue == channel || configs[overdue].OverdueChannel != nil {
+		return fmt.Errorf("%w: channel %d cannot receive overdue items", ErrInvalidArgument, overdue)
+	}
+	for other, otherConfig := range configs {
+		if other != channel && otherConfig.OverdueChannel != nil && *otherConfig.OverdueChannel == channel {
+			return fmt.Errorf("%w: channel %d receives overdue items from channel %d", ErrInvalidArgument, channel, other)
+		}
+	}
+	return nil
+}
+
+// RoutingRule places the items enqueued over the API that match all its conditions in Channel,
+// with Prio if set, overriding the channel and priority given by the producer. See Route.
+type RoutingRule struct {
+	Name string `json:"name"`
+	// Conditions are filter expressions, key=value for an attribute or $.path=value for the payload, see Filter.Parse.
+	Conditions []string `json:"conditions"`
+	Channel    int      `json:"channel"`
+	Prio       *float64 `json:"prio,omitempty"`
+}
+
+// Filter returns the filter of the conditions of the rule.
+func (r RoutingRule) Filter() (Filter, error) {
+	var filter Filter
+	for _, condition := range r.Conditions {
+		if err := filter.Parse(condition); err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+// Validate checks the name, the conditions and the channel of the rule.
+func (r RoutingRule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("%w: a routing rule requires a name", ErrInvalidArgument)
+	}
+	if len(r.Conditions) == 0 {
+		return fmt.Errorf("%w: a routing rule requires a condition", ErrInvalidArgument)
+	}
+	if _, err := r.Filter(); err != nil {
+		return err
+	}
+	return ValidateChannel(r.Channel)
+}
+
+// Route returns the first rule, in order, whose conditions an item with the given payload and attributes matches.
+func Route(rules []RoutingRule, obj string, attributes map[string]string) (RoutingRule, bool) {
+	for _, rule := range rules {
+		filter, err := rule.Filter()
+		if err == nil && filter.Match(obj, attributes) {
+			return rule, true
+		}
+	}
+	return RoutingRule{}, false
+}
+
+// Schema is the subset of JSON Schema payloads can be checked against: types, required properties,
+// enums and ranges. A schema with no keywords accepts every JSON payload.
+type Schema struct {
+	// Type is object, array, string, number, integer, boolean or null, empty allows any type.
+	Type       string             `json:"type,omitempty"`
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	Required   []string           `json:"required,omitempty"`
+	// Items is the schema of the elements of an array.
+	Items *Schema `json:"items,omitempty"`
+	// Enum lists the allowed values, strings, numbers, booleans or null.
+	Enum      []any    `json:"enum,omitempty"`
+	Minimum   *float64 `json:"minimum,omitempty"`
+	Maximum   *float64 `json:"maximum,omitempty"`
+	MinLength *int     `json:"minLength,omitempty"` // in characters
+	MaxLength *int     `json:"maxLength,omitempty"`
+
+	// annotations, not checked
+	Dialect     string `json:"$schema,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+var schemaTypes = []string{"object", "array", "string", "number", "integer", "boolean", "null"}
+
+// Validate checks the keywords of the schema and of the schemas nested in it.
+func (s Schema) Validate() error {
+	if s.Type != "" && !slices.Contains(schemaTypes, s.Type) {
+		return fmt.Errorf("%w: unknown schema type %q", ErrInvalidArgument, s.Type)
+	}
+	for _, value := range s.Enum {
+		switch value.(type) {
+		case nil, string, bool, float64, float32, int, int64:
+		default:
+			return fmt.Errorf("%w: enum values must be strings, numbers, booleans or null", ErrInvalidArgument)
+		}
+	}
+	if s.Minimum != nil && s.Maximum != nil && *s.Minimum > *s.Maximum {
+		return fmt.Errorf("%w: schema minimum is above maximum", ErrInvalidArgument)
+	}
+	if (s.MinLength != nil && *s.MinLength < 0) || (s.MaxLength != nil && *s.MaxLength < 0) {
+		return fmt.Errorf("%w: schema lengths cannot be negative", ErrInvalidArgument)
+	}
+	if s.MinLength != nil && s.MaxLength != nil && *s.MinLength > *s.MaxLength {
+		return fmt.Errorf("%w: schema minLength is above maxLength", ErrInvalidArgument)
+	}
+	for _, key := range s.Required {
+		if key == "" {
+			return fmt.Errorf("%w: empty required property", ErrInvalidArgument)
+		}
+	}
+	for key, property := range s.Properties {
+		if property == nil {
+			return fmt.Errorf("%w: property %q has no schema", ErrInvalidArgument, key)
+		}
+		if err := property.Validate(); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.Validate()
+	}
+	return nil
+}
+
+// Clone returns a deep copy of the schema, with enum numbers as float64 like decoded JSON.
+func (s Schema) Clone() Schema {
+	var clone Schema
+	encoded, err := json.Marshal(s)
+	if err == nil {
+		err = json.Unmarshal(encoded, &clone)
+	}
+	if err != nil {
+		return s
+	}
+	return clone
+}
+
+// Violations checks a payload against the schema and returns what is wrong with it, nil if it conforms.
+// Each violation starts with the path of the offending value, such as $.lines[2].amount.
+func (s Schema) Violations(obj string) []string {
+	var node any
+	if err := json.Unmarshal([]byte(obj), &node); err != nil {
+		return []string{"$: payload is not valid JSON"}
+	}
+	var violations []string
+	s.check("$", node, &violations)
+	return violations
+}
+
+func (s Schema) check(path string, node any, violations *[]string) {
+	if s.Type != "" && !hasSchemaType(node, s.Type) {
+		*violations = append(*violations, fmt.Sprintf("%s: expected %s, got %s", path, s.Type, schemaTypeOf(node)))
+		return
+	}
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(value any) bool { return jsonEqual(value, node) }) {
+		allowed, _ := json.Marshal(s.Enum)
+		*violations = append(*violations, fmt.Sprintf("%s: must be one of %s", path, allowed))
+	}
+
+	switch v := node.(type) {
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			*violations = append(*violations, fmt.Sprintf("%s: must be at least %v", path, *s.Minimum))
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			*violations = append(*violations, fmt.Sprintf("%s: must be at most %v", path, *s.Maximum))
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			*violations = append(*violations, fmt.Sprintf("%s: must be at least %d characters long", path, *s.MinLength))
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			*violations = append(*violations, fmt.Sprintf("%s: must be at most %d characters long", path, *s.MaxLength))
+		}
+	case map[string]any:
+		for _, key := range s.Required {
+			if _, ok := v[key]; !ok {
+				*violations = append(*violations, fmt.Sprintf("%s: missing required property %q", path, key))
+			}
+		}
+		for _, key := range slices.Sorted(maps.Keys(s.Properties)) {
+			if child, ok := v[key]; ok {
+				s.Properties[key].check(path+"."+key, child, violations)
+			}
+		}
+	case []any:
+		if s.Items != nil {
+			for i, child := range v {
+				s.Items.check(fmt.Sprintf("%s[%d]", path, i), child, violations)
+			}
+		}
+	}
+}
+
+func hasSchemaType(node any, schemaType string) bool {
+	if schemaType == "integer" {
+		number, ok := node.(float64)
+		return ok && number == math.Trunc(number)
+	}
+	return schemaTypeOf(node) == schemaType
+}
+
+func schemaTypeOf(node any) string {
+	switch node.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return "null"
+}
+
+// jsonEqual compares two scalar values by their JSON text, so 1 equals 1.0.
+func jsonEqual(a, b any) bool {
+	encodedA, errA := json.Marshal(a)
+	encodedB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(encodedA, encodedB)
+}
+
+// SchemaVersion is a version of the schema of a channel, see SetChannelSchema.
+// Versions are numbered from 1 per channel, the latest version is the one payloads are checked against.
+type SchemaVersion struct {
+	Channel   int       `json:"channel"`
+	Version   int       `json:"version"`
+	Schema    Schema    `json:"schema"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SchemaViolationError is returned for a payload not conforming to the latest schema version of its channel.
+// It matches ErrSchemaViolation.
+type SchemaViolationError struct {
+	Channel    int
+	Version    int
+	Violations []string
+}
+
+func (e *SchemaViolationError) Error() string {
+	return fmt.Sprintf("payload does not conform to version %d of the schema of channel %d", e.Version, e.Channel)
+}
+
+func (e *SchemaViolationError) Is(target error) bool {
+	return target == ErrSchemaViolation
+}
+
+// CheckSchema checks a payload enqueued to a channel against the latest of the schema versions of the channel,
+// oldest first, returning a *SchemaViolationError if it does not conform. Payloads of channels without a schema always conform.
+func CheckSchema(versions []SchemaVersion, obj string) error {
+	if len(versions) == 0 {
+		return nil
+	}
+	latest := versions[len(versions)-1]
+	if violations := latest.Schema.Violations(obj); len(violations) > 0 {
+		return &SchemaViolationError{Channel: latest.Channel, Version: latest.Version, Violations: violations}
+	}
+	return nil
+}
+
+// ReplyPayload builds the item enqueued to a reply channel: a JSON object holding the
+// correlation id and the reply, embedded as JSON when the reply is valid JSON.
+func ReplyPayload(correlationId, reply string) string {
+	var value any = reply
+	if json.Valid([]byte(reply)) {
+		value = json.RawMessage(reply)
+	}
+	payload, _ := json.Marshal(map[string]any{
+		"correlation_id": correlationId,
+		"value":          value,
+	})
+	return string(payload)
+}
+
+// Operations of a transaction
+const (
+	TX_ENQUEUE = "enqueue"
+	TX_CONFIRM = "confirm"
+	TX_RELEASE = "release"
+	TX_DELETE  = "delete"
+)
+
+// TxOp is one operation of a transaction applied by ApplyTransaction.
+type TxOp struct {
+	Op string // TX_ENQUEUE, TX_CONFIRM, TX_RELEASE or TX_DELETE
+
+	// TX_ENQUEUE
+	Obj       string
+	Prio      float64
+	Channel   int
+	NotBefore time.Time
+	Options   EnqueueOptions
+
+	// TX_CONFIRM and TX_RELEASE
+	ReservationId string
+	Claim         ReservationClaim
+	Result        string // TX_CONFIRM only, see ConfirmReservationWithResult
+	ResultTTL     time.Duration
+
+	// TX_DELETE
+	ItemId string
+}
+
+// ChannelCounters counts the operations on a channel since the queue was created or reset.
+type ChannelCounters struct {
+	Enqueued  int64 `json:"enqueued"`  // new items, including published copies and replies
+	Dequeued  int64 `json:"dequeued"`  // items dequeued or reserved
+	Confirmed int64 `json:"confirmed"` // reservations confirmed
+	Requeued  int64 `json:"requeued"`  // reservations released or expired
+}
+
+// ChannelStats holds the current state and the counters of a channel.
+type ChannelStats struct {
+	Ready     int `json:"ready"`     // items that can be dequeued now
+	Scheduled int `json:"scheduled"` // items waiting for their not-before time
+	Reserved  int `json:"reserved"`
+	Blocked   int `json:"blocked"`   // items waiting for their dependencies
+	Overdue   int `json:"overdue"`   // items not yet completed whose deadline has passed
+	Consumers int `json:"consumers"` // live consumers registered for the channel, filled in by the server
+	ChannelCounters
+
+	// Ages in seconds of the item that has been ready the longest and of the oldest reservation, 0 if none
+	OldestReadyAge       float64 `json:"oldest_ready_age"`
+	OldestReservationAge float64 `json:"oldest_reservation_age"`
+
+	// Tenants holds the number of ready items by tenant, for items enqueued with a tenant
+	Tenants map[string]int `json:"tenants,omitempty"`
+	// Partitions holds the number of ready items by partition of a partitioned channel
+	Partitions []int `json:"partitions,omitempty"`
+}
+
+// Item states reported by GetStatus
+const (
+	STATUS_PENDING   = "pending"   // ready to be dequeued
+	STATUS_SCHEDULED = "scheduled" // waiting for its not-before time
+	STATUS_BLOCKED   = "blocked"   // waiting for its dependencies
+	STATUS_RESERVED  = "reserved"
+	STATUS_EXPIRED   = "expired"   // ready again after its reservation expired
+	STATUS_COMPLETED = "completed" // dequeued or confirmed
+	STATUS_DELETED   = "deleted"
+)
+
+// DEFAULT_STATUS_RETENTION is how long the status of completed and deleted items is kept by default.
+const DEFAULT_STATUS_RETENTION = 24 * time.Hour
+
+// ItemStatus describes where an item is in its lifecycle.
+// Completed and deleted items are reported until the status retention period has passed.
+type ItemStatus struct {
+	Status     string    `json:"status"`
+	Channel    int       `json:"channel"`
+	Attempts   int       `json:"attempts"` // number of times the item has been reserved
+	EnqueuedAt time.Time `json:"enqueued_at,omitzero"`
+	NotBefore  time.Time `json:"not_before,omitzero"`
+	Deadline   time.Time `json:"deadline,omitzero"`
+	ReservedAt time.Time `json:"reserved_at,omitzero"` // start of the current reservation
+	ExpiredAt  time.Time `json:"expired_at,omitzero"`  // when the last reservation expired
+	FinishedAt time.Time `json:"finished_at,omitzero"` // when the item was completed or deleted
+}
+
+// Event types delivered to observers
+const (
+	EVENT_ENQUEUE = "enqueue" // new item, including published copies and replies
+	EVENT_DEQUEUE = "dequeue"
+	EVENT_RESERVE = "reserve"
+	EVENT_CONFIRM = "confirm"
+	EVENT_REQUEUE = "requeue" // reservation released
+	EVENT_EXPIRE  = "expire"  // reservation expired and the item requeued
+	EVENT_DELETE  = "delete"
+	EVENT_RESET   = "reset" // the queue was reset, Channel and ItemId are not set
+)
+
+// Event describes a change to a queue, see Subscribe.
+type Event struct {
+	Type    string
+	Channel int
+	ItemId  string
+	Prio    float64
+	Time    time.Time
+}
+
+// Observers holds the observers of a queue, the zero value has none.
+type Observers struct {
+	mu        sync.Mutex
+	next      int
+	observers []observer
+}
+
+type observer struct {
+	id int
+	fn func(Event)
+}
+
+// Subscribe adds an observer and returns the function removing it.
+func (o *Observers) Subscribe(fn func(Event)) func() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	id := o.next
+	o.next++
+	o.observers = append(o.observers, observer{id: id, fn: fn})
+
+	return func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		o.observers = slices.DeleteFunc(o.observers, func(other observer) bool { return other.id == id })
+	}
+}
+
+// Notify calls every observer with the events, in order.
+// Observers are called without holding any lock, so they may call back into the queue.
+func (o *Observers) Notify(events ...Event) {
+	if len(events) == 0 {
+		return
+	}
+	o.mu.Lock()
+	observers := slices.Clone(o.observers)
+	o.mu.Unlock()
+
+	for _, event := range events {
+		for _, observer := range observers {
+			observer.fn(event)
+		}
+	}
+}
+
+// IPriorityQueueContext is the context-first version of IPriorityQueue.
+// An operation whose context is done before it completes returns the context's error and has no effect.
+type IPriorityQueueContext interface {
+	IsEmptyContext(ctx context.Context, channel int) (bool, error)
+	SizeContext(ctx context.Context, channel int) (int, error)
+	PeekContext(ctx context.Context, channel int) (string, error)
+	EnqueueContext(ctx context.Context, obj string, prio float64, channel int, notBefore time.Time) error
+	EnqueueWithOptionsContext(ctx context.Context, obj string, prio float64, channel int, notBefore time.Time, opts EnqueueOptions) (string, error)
+	DequeueContext(ctx context.Context, channel int) (string, error)
+	DeleteContext(ctx context.Context, itemId string) (bool, error)
+	ResetQueueContext(ctx context.Context) error
+	RequeueExpiredReservationsContext(ctx context.Context, timeout time.Duration) (int, error)
+	RequeueConsumerReservationsContext(ctx context.Context, consumer string) (int, error)
+	DequeueWithReservationContext(ctx context.Context, channel int) (string, string, error)
+	DequeueWithReservationFilteredContext(ctx context.Context, channel int, filter Filter) (string, string, error)
+	DequeueWithReservationOptionsContext(ctx context.Context, channel int, opts ReserveOptions) (string, Reservation, error)
+	DequeueWithReservationBatchContext(ctx context.Context, channel int, n int, opts ReserveOptions) ([]ReservedItem, error)
+	ConfirmReservationContext(ctx context.Context, reservationId string) (bool, error)
+	ConfirmReservationWithResultContext(ctx context.Context, reservationId string, result string, ttl time.Duration) (bool, error)
+	ConfirmReservationAsContext(ctx context.Context, reservationId string, claim ReservationClaim, result string, ttl time.Duration) (bool, error)
+	ConfirmReservationBatchContext(ctx context.Context, reservationIds []string, claim ReservationClaim) ([]error, error)
+	GetResultContext(ctx context.Context, itemId string) (string, bool, error)
+	PauseChannelContext(ctx context.Context, channel int) error
+	ResumeChannelContext(ctx context.Context, channel int) error
+	PausedChannelsContext(ctx context.Context) ([]int, error)
+	ReleaseReservationContext(ctx context.Context, reservationId string) (bool, error)
+	ReleaseReservationAsContext(ctx context.Context, reservationId string, claim ReservationClaim) (bool, error)
+	ExtendReservationContext(ctx context.Context, reservationId string, claim ReservationClaim) (bool, error)
+	ReservationsContext(ctx context.Context) (map[string][]Reservation, error)
+	ApplyTransactionContext(ctx context.Context, ops []TxOp) ([]string, error)
+	PublishContext(ctx context.Context, topic string, obj string, prio float64, notBefore time.Time, opts EnqueueOptions) ([]string, error)
+	AddSubscriptionContext(ctx context.Context, topic string, channel int) error
+	RemoveSubscriptionContext(ctx context.Context, topic string, channel int) error
+	SubscriptionsContext(ctx context.Context) (map[string][]int, error)
+	StatsContext(ctx context.Context) (map[int]ChannelStats, error)
+	SetChannelConfigContext(ctx context.Context, channel int, config ChannelConfig) error
+	ChannelConfigsContext(ctx context.Context) (map[int]ChannelConfig, error)
+	RepartitionChannelContext(ctx context.Context, channel int, partitions int) error
+	SetRoutingRuleContext(ctx context.Context, rule RoutingRule) error
+	DeleteRoutingRuleContext(ctx context.Context, name string) (bool, error)
+	RoutingRulesContext(ctx context.Context) ([]RoutingRule, error)
+	SetChannelSchemaContext(ctx context.Context, channel int, schema Schema) (int, error)
+	DeleteChannelSchemaContext(ctx context.Context, channel int) (bool, error)
+	ChannelSchemasContext(ctx context.Context, channel int) ([]SchemaVersion, error)
+	GetStatusContext(ctx context.Context, itemId string) (ItemStatus, error)
+}
+
+// IPriorityQueue holds the context-first methods and the original methods,
+// which call them with context.Background().
 type IPriorityQueue interface {
+	IPriorityQueueContext
+
+	// Subscribe adds an observer called with the events of every operation once it has been applied,
+	// and returns the function removing it. Observers should return quickly, they delay the caller.
+	Subscribe(observer func(Event)) func()
+
 	IsEmpty(channel int) (bool, error)
 	Size(channel int) (int, error)
 	Peek(channel int) (string, error)
 	Enqueue(obj string, prio float64, channel int, notBefore time.Time) error
+	EnqueueWithOptions(obj string, prio float64, channel int, notBefore time.Time, opts EnqueueOptions) (string, error)
 	Dequeue(channel int) (string, error)
+	Delete(itemId string) (bool, error)
 	ResetQueue() error
 	RequeueExpiredReservations(timeout time.Duration) (int, error)
+	RequeueConsumerReservations(consumer string) (int, error)
 	DequeueWithReservation(channel int) (string, string, error)
+	DequeueWithReservationFiltered(channel int, filter Filter) (string, string, error)
+	DequeueWithReservationOptions(channel int, opts ReserveOptions) (string, Reservation, error)
+	DequeueWithReservationBatch(channel int, n int, opts ReserveOptions) ([]ReservedItem, error)
 	ConfirmReservation(reservationId string) (bool, error)
+	ConfirmReservationWithResult(reservationId string, result string, ttl time.Duration) (bool, error)
+	ConfirmReservationAs(reservationId string, claim ReservationClaim, result string, ttl time.Duration) (bool, error)
+	ConfirmReservationBatch(reservationIds []string, claim ReservationClaim) ([]error, error)
+	GetResult(itemId string) (string, bool, error)
+	PauseChannel(channel int) error
+	ResumeChannel(channel int) error
+	PausedChannels() ([]int, error)
+	ReleaseReservation(reservationId string) (bool, error)
+	ReleaseReservationAs(reservationId string, claim ReservationClaim) (bool, error)
+	ExtendReservation(reservationId string, claim ReservationClaim) (bool, error)
+	Reservations() (map[string][]Reservation, error)
+	ApplyTransaction(ops []TxOp) ([]string, error)
+	Publish(topic string, obj string, prio float64, notBefore time.Time, opts EnqueueOptions) ([]string, error)
+	AddSubscription(topic string, channel int) error
+	RemoveSubscription(topic string, channel int) error
+	Subscriptions() (map[string][]int, error)
+	Stats() (map[int]ChannelStats, error)
+	SetChannelConfig(channel int, config ChannelConfig) error
+	ChannelConfigs() (map[int]ChannelConfig, error)
+	RepartitionChannel(channel int, partitions int) error
+	SetRoutingRule(rule RoutingRule) error
+	DeleteRoutingRule(name string) (bool, error)
+	RoutingRules() ([]RoutingRule, error)
+	SetChannelSchema(channel int, schema Schema) (int, error)
+	DeleteChannelSchema(channel int) (bool, error)
+	ChannelSchemas(channel int) ([]SchemaVersion, error)
+	GetStatus(itemId string) (ItemStatus, error)
 }
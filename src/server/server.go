@@ -4,16 +4,19 @@ import (
 	"context"
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/jnsoft/jngo/pqueue"
 	"github.com/jnsoft/jnq/src/httphelper"
 	"github.com/jnsoft/jnq/src/mempqueue"
 	"github.com/jnsoft/jnq/src/priorityqueue"
@@ -24,6 +27,14 @@ const (
 	DEFAULT_CHANNEL = 0
 	API_KEY_HEADER  = "X-API-Key"
 	API_KEY         = "api-key"
+	ITEM_ID_HEADER  = "X-Item-Id"
+	ROUTE_HEADER    = "X-Route" // name of the routing rule that placed an enqueued item
+
+	DEFAULT_RESULT_TTL   = time.Hour
+	MAX_RESULT_WAIT      = 30 * time.Second
+	RESULT_POLL_INTERVAL = 100 * time.Millisecond
+
+	MAX_BATCH_SIZE = 1000 // items reserved or reservations confirmed by one batch request
 )
 
 //go:embed swagger.json
@@ -36,6 +47,69 @@ type (
 		api_key string
 		verbose bool
 		server  *http.Server
+		cancel  context.CancelFunc // cancels the contexts of in-flight requests
+
+		reservationTimeout time.Duration // set by StartRequeueTask, 0 if reservations do not expire
+		consumers          consumerRegistry
+	}
+
+	// ConsumerInfo describes a registered consumer, see /consumers
+	ConsumerInfo struct {
+		Id            string    `json:"id"`
+		Channels      []int     `json:"channels,omitempty"` // channels the consumer reserves from
+		RegisteredAt  time.Time `json:"registered_at"`
+		LastHeartbeat time.Time `json:"last_heartbeat"`
+		Reservations  int       `json:"reservations"` // reservations currently held
+	}
+
+	// consumerRegistry keeps the consumers that have registered and not missed their heartbeats.
+	// It is not persisted, after a restart heartbeats fail with 404 until the consumers register again.
+	consumerRegistry struct {
+		mu        sync.Mutex
+		consumers map[string]ConsumerInfo
+	}
+
+	// ItemStatusResponse is the body of an /items/{id}/status response
+	ItemStatusResponse struct {
+		priorityqueue.ItemStatus
+		ReservationDeadline time.Time `json:"reservation_deadline,omitzero"` // when the current reservation expires
+	}
+
+	// ReservedItemResponse is one item of a /reserve_batch response
+	ReservedItemResponse struct {
+		Value         json.RawMessage `json:"value"`
+		ReservationId string          `json:"reservation_id"`
+		Token         int64           `json:"token"`
+	}
+
+	// ConfirmBatchResult is the outcome for one reservation of a /confirm_batch request
+	ConfirmBatchResult struct {
+		ReservationId string `json:"reservation_id"`
+		Confirmed     bool   `json:"confirmed"`
+		Code          string `json:"code,omitempty"`
+		Error         string `json:"error,omitempty"`
+	}
+
+	// TxRequestOp is one operation in the body of a /tx request
+	TxRequestOp struct {
+		Op            string            `json:"op"`
+		Item          json.RawMessage   `json:"item,omitempty"`
+		Prio          float64           `json:"prio,omitempty"`
+		Channel       int               `json:"channel,omitempty"`
+		NotBefore     time.Time         `json:"notbefore,omitempty"`
+		Deadline      time.Time         `json:"deadline,omitzero"`
+		DependsOn     []string          `json:"depends_on,omitempty"`
+		ReplyTo       *int              `json:"reply_to,omitempty"`
+		CorrelationId string            `json:"correlation_id,omitempty"`
+		Attributes    map[string]string `json:"attributes,omitempty"`
+		Tenant        string            `json:"tenant,omitempty"`
+		PartitionKey  string            `json:"partition_key,omitempty"`
+		ReservationId string            `json:"reservation_id,omitempty"`
+		Consumer      string            `json:"consumer,omitempty"`
+		Token         int64             `json:"token,omitempty"`
+		Result        json.RawMessage   `json:"result,omitempty"`
+		TTL           int               `json:"ttl,omitempty"`
+		ItemId        string            `json:"item_id,omitempty"`
 	}
 )
 
@@ -51,7 +125,7 @@ func (s *Server) apiKeyMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		apiKey := r.Header.Get(API_KEY_HEADER)
 		if apiKey != s.api_key {
-			http.Error(w, "Forbidden", http.StatusForbidden)
+			jsonError(w, "Forbidden", http.StatusForbidden)
 			return
 		}
 		next.ServeHTTP(w, r)
@@ -61,12 +135,25 @@ func (s *Server) apiKeyMiddleware(next http.Handler) http.Handler {
 // EnqueueHandler handles the enqueue requests
 // @Summary Enqueue an item
 // @Description Enqueue an item to the priority queue. The item is provided in the request body as a string (which can be a JSON object).
-// Query parameters are used to specify the priority, channel, and notbefore timestamp.
+// Query parameters are used to specify the priority, channel, notbefore timestamp and dependencies.
+// The id of the enqueued item is returned in the X-Item-Id response header.
+// A matching routing rule, see /routes, overrides the channel and priority and is named in the X-Route response header.
+// Payloads not conforming to the schema of the channel, see /schemas, are rejected with the list of violations.
 // @Accept  plain
 // @Produce  plain
 // @Param  prio  query  float  false  "Priority of the item"
 // @Param  channel  query  int  false  "Channel to enqueue the item to"
 // @Param  notbefore  query  timestamp  false  "Timestamp in RFC3339 format specifying when the item becomes valid"
+// @Param  deadline  query  timestamp  false  "Timestamp in RFC3339 format specifying when the item is due, orders items in EDF channels"
+// @Param  depends_on  query  string  false  "Comma separated item ids that must be confirmed before the item becomes visible"
+// @Param  reply_to  query  int  false  "Channel the result is enqueued to as a reply when the item is confirmed"
+// @Param  correlation_id  query  string  false  "Correlation id carried by the reply, defaults to the item id"
+// @Param  attr  query  string  false  "Attribute as key=value that consumers can filter on, may be repeated"
+// @Param  coalesce_key  query  string  false  "Replace the payload of the pending item with this key in the channel instead of adding an item"
+// @Param  coalesce_prio  query  bool  false  "Also replace the priority of the pending item"
+// @Param  coalesce_notbefore  query  bool  false  "Also replace the not-before time of the pending item"
+// @Param  tenant  query  string  false  "Tenant of the item, channels in fair mode serve tenants in turn"
+// @Param  partition_key  query  string  false  "Partition key of the item, items with the same key go to the same partition of a partitioned channel"
 // @Param  item  body  string  true  "Item to enqueue (string or JSON object)"
 // @Success 200 "Item enqueued"
 // @Failure 400 "Bad Request"
@@ -77,7 +164,7 @@ func (s *Server) apiKeyMiddleware(next http.Handler) http.Handler {
 // @Method post
 func (s *Server) EnqueueHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	s.mu.Lock()
@@ -90,6 +177,104 @@ func (s *Server) EnqueueHandler(w http.ResponseWriter, r *http.Request) {
 		channel = DEFAULT_CHANNEL
 	}
 
+	priority, notBefore, opts, err := parseEnqueueParams(r)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		jsonError(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	item := string(bodyBytes)
+
+	if item == "" {
+		jsonError(w, "Request body is required", http.StatusBadRequest)
+		return
+	}
+
+	rules, err := s.pq.RoutingRulesContext(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if rule, ok := priorityqueue.Route(rules, item, opts.Attributes); ok {
+		channel = rule.Channel
+		if rule.Prio != nil {
+			priority = *rule.Prio
+		}
+		w.Header().Set(ROUTE_HEADER, rule.Name)
+	}
+
+	itemId, err := s.pq.EnqueueWithOptionsContext(r.Context(), item, priority, channel, notBefore, opts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set(ITEM_ID_HEADER, itemId)
+
+	var resStr string
+	if s.verbose {
+		resStr = fmt.Sprintf("EnqueueHandler: enqueued item %s: %s with priority: %f, channel: %d, notbefore: %s", itemId, item, priority, channel, notBefore.Format(time.RFC3339))
+	} else {
+		resStr = "Item enqueued"
+	}
+
+	w.Write([]byte(resStr))
+
+	if s.verbose {
+		log.Println(resStr)
+	}
+}
+
+// parseReserveParams parses the query parameters shared by /reserve and /reserve_batch
+func parseReserveParams(r *http.Request) (int, priorityqueue.ReserveOptions, error) {
+	opts := priorityqueue.ReserveOptions{Consumer: r.URL.Query().Get("consumer")}
+
+	channelStr := r.URL.Query().Get("channel")
+	channel, err := strconv.Atoi(channelStr)
+	if err != nil {
+		channel = DEFAULT_CHANNEL
+	}
+	if !validChannel(channel) {
+		return 0, opts, errors.New(invalidChannel)
+	}
+
+	for _, expr := range r.URL.Query()["filter"] {
+		if err := opts.Filter.Parse(expr); err != nil {
+			return 0, opts, err
+		}
+	}
+
+	if partitionStr := r.URL.Query().Get("partition"); partitionStr != "" {
+		partition, err := strconv.Atoi(partitionStr)
+		if err != nil || partition < 0 {
+			return 0, opts, errors.New("Invalid partition")
+		}
+		opts.Partition = &partition
+	}
+	return channel, opts, nil
+}
+
+// parseClaim parses the consumer and fencing token acting on a reservation
+func parseClaim(r *http.Request) (priorityqueue.ReservationClaim, error) {
+	claim := priorityqueue.ReservationClaim{Consumer: r.URL.Query().Get("consumer")}
+	if tokenStr := r.URL.Query().Get("token"); tokenStr != "" {
+		token, err := strconv.ParseInt(tokenStr, 10, 64)
+		if err != nil || token <= 0 {
+			return claim, errors.New("Invalid token")
+		}
+		claim.Token = token
+	}
+	return claim, nil
+}
+
+// parseEnqueueParams parses the query parameters shared by /enqueue and /publish
+func parseEnqueueParams(r *http.Request) (float64, time.Time, priorityqueue.EnqueueOptions, error) {
+	var opts priorityqueue.EnqueueOptions
+
 	prioStr := r.URL.Query().Get("prio")
 	priority, err := strconv.ParseFloat(prioStr, 64)
 	if err != nil {
@@ -101,41 +286,215 @@ func (s *Server) EnqueueHandler(w http.ResponseWriter, r *http.Request) {
 	if notBeforeStr != "" {
 		notBefore, err = time.Parse(time.RFC3339, notBeforeStr)
 		if err != nil {
-			http.Error(w, "Invalid notbefore timestamp", http.StatusBadRequest)
-			return
+			return 0, notBefore, opts, errors.New("Invalid notbefore timestamp")
 		}
 		notBefore = notBefore.UTC() // Ensure the timestamp is in UTC
 	}
 
+	if deadlineStr := r.URL.Query().Get("deadline"); deadlineStr != "" {
+		deadline, err := time.Parse(time.RFC3339, deadlineStr)
+		if err != nil {
+			return 0, notBefore, opts, errors.New("Invalid deadline timestamp")
+		}
+		opts.Deadline = deadline.UTC()
+	}
+
+	if dependsOnStr := r.URL.Query().Get("depends_on"); dependsOnStr != "" {
+		for _, id := range strings.Split(dependsOnStr, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				opts.DependsOn = append(opts.DependsOn, id)
+			}
+		}
+	}
+
+	if replyToStr := r.URL.Query().Get("reply_to"); replyToStr != "" {
+		replyTo, err := strconv.Atoi(replyToStr)
+		if err != nil || !validChannel(replyTo) {
+			return 0, notBefore, opts, errors.New("Invalid reply_to channel")
+		}
+		opts.ReplyTo = &replyTo
+		opts.CorrelationId = r.URL.Query().Get("correlation_id")
+	}
+
+	for _, attr := range r.URL.Query()["attr"] {
+		key, value, ok := strings.Cut(attr, "=")
+		if !ok {
+			return 0, notBefore, opts, errors.New("Invalid attr, expected key=value")
+		}
+		if opts.Attributes == nil {
+			opts.Attributes = make(map[string]string)
+		}
+		opts.Attributes[key] = value
+	}
+	if err := priorityqueue.ValidateAttributes(opts.Attributes); err != nil {
+		return 0, notBefore, opts, err
+	}
+
+	if opts.CoalesceKey = r.URL.Query().Get("coalesce_key"); opts.CoalesceKey != "" {
+		opts.CoalescePrio, _ = strconv.ParseBool(r.URL.Query().Get("coalesce_prio"))
+		opts.CoalesceNotBefore, _ = strconv.ParseBool(r.URL.Query().Get("coalesce_notbefore"))
+	}
+	opts.Tenant = r.URL.Query().Get("tenant")
+	opts.PartitionKey = r.URL.Query().Get("partition_key")
+
+	return priority, notBefore, opts, nil
+}
+
+// PublishHandler handles publish requests
+// @Summary Publish an item to a topic
+// @Description Enqueue a copy of the item to every channel subscribed to the topic, atomically. Each copy is consumed independently.
+// @Accept  plain
+// @Produce  json
+// @Param  topic  query  string  true  "Topic to publish to"
+// @Param  prio  query  float  false  "Priority of the item"
+// @Param  notbefore  query  timestamp  false  "Timestamp in RFC3339 format specifying when the item becomes valid"
+// @Param  item  body  string  true  "Item to publish (string or JSON object)"
+// @Success 200 {object} map[string][]string "Ids of the enqueued copies"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 405 "Method Not Allowed"
+// @Failure 500 "Internal Server Error"
+// @Router /publish [post]
+// @Method post
+func (s *Server) PublishHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		jsonError(w, "Missing topic", http.StatusBadRequest)
+		return
+	}
+
+	priority, notBefore, opts, err := parseEnqueueParams(r)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		jsonError(w, "Failed to read request body", http.StatusBadRequest)
 		return
 	}
 	item := string(bodyBytes)
 
 	if item == "" {
-		http.Error(w, "Request body is required", http.StatusBadRequest)
+		jsonError(w, "Request body is required", http.StatusBadRequest)
 		return
 	}
 
-	err = s.pq.Enqueue(item, priority, channel, notBefore)
+	s.mu.Lock()
+	itemIds, err := s.pq.PublishContext(r.Context(), topic, item, priority, notBefore, opts)
+	s.mu.Unlock()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
-	var resStr string
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"item_ids": itemIds})
+
 	if s.verbose {
-		resStr = fmt.Sprintf("EnqueueHandler: enqueued item: %s with priority: %f, channel: %d, notbefore: %s", item, priority, channel, notBefore.Format(time.RFC3339))
-	} else {
-		resStr = "Item enqueued"
+		log.Printf("PublishHandler: published item to topic %s as %d copies\n", topic, len(itemIds))
+	}
+}
+
+// SubscriptionsHandler dispatches requests to /subscriptions by method
+func (s *Server) SubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.ListSubscriptionsHandler(w, r)
+	case http.MethodPost:
+		s.AddSubscriptionHandler(w, r)
+	case http.MethodDelete:
+		s.RemoveSubscriptionHandler(w, r)
+	default:
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 	}
+}
 
-	w.Write([]byte(resStr))
+// ListSubscriptionsHandler handles requests to list topic subscriptions
+// @Summary List subscriptions
+// @Description Returns the subscribed channels of every topic
+// @Produce json
+// @Success 200 {object} map[string][]int "Subscribed channels by topic"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /subscriptions [get]
+// @Method get
+func (s *Server) ListSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := s.pq.SubscriptionsContext(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subscriptions)
+}
+
+// AddSubscriptionHandler handles requests to subscribe a channel to a topic
+// @Summary Subscribe a channel to a topic
+// @Description Items published to the topic are copied to the channel
+// @Produce plain
+// @Param topic query string true "Topic to subscribe to"
+// @Param channel query int true "Channel to subscribe"
+// @Success 200 "Subscription added"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /subscriptions [post]
+// @Method post
+func (s *Server) AddSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	s.setSubscription(w, r, true)
+}
+
+// RemoveSubscriptionHandler handles requests to unsubscribe a channel from a topic
+// @Summary Unsubscribe a channel from a topic
+// @Description Items published to the topic are no longer copied to the channel
+// @Produce plain
+// @Param topic query string true "Topic to unsubscribe from"
+// @Param channel query int true "Channel to unsubscribe"
+// @Success 200 "Subscription removed"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /subscriptions [delete]
+// @Method delete
+func (s *Server) RemoveSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	s.setSubscription(w, r, false)
+}
+
+func (s *Server) setSubscription(w http.ResponseWriter, r *http.Request, subscribed bool) {
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		jsonError(w, "Missing topic", http.StatusBadRequest)
+		return
+	}
+
+	channelStr := r.URL.Query().Get("channel")
+	channel, err := strconv.Atoi(channelStr)
+	if err != nil || !validChannel(channel) {
+		jsonError(w, invalidChannel, http.StatusBadRequest)
+		return
+	}
+
+	if subscribed {
+		err = s.pq.AddSubscriptionContext(r.Context(), topic, channel)
+	} else {
+		err = s.pq.RemoveSubscriptionContext(r.Context(), topic, channel)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 
+	w.WriteHeader(http.StatusOK)
 	if s.verbose {
-		log.Println(resStr)
+		log.Printf("setSubscription: topic %s channel %d subscribed: %t\n", topic, channel, subscribed)
 	}
 }
 
@@ -154,7 +513,7 @@ func (s *Server) EnqueueHandler(w http.ResponseWriter, r *http.Request) {
 // @Method get
 func (s *Server) DequeueHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	s.mu.Lock()
@@ -166,18 +525,14 @@ func (s *Server) DequeueHandler(w http.ResponseWriter, r *http.Request) {
 		channel = DEFAULT_CHANNEL
 	}
 
-	if channel < 0 || channel > mempqueue.MAX_CHANNEL {
-		http.Error(w, "Channel must be between 0 and 100", http.StatusBadRequest)
+	if !validChannel(channel) {
+		jsonError(w, invalidChannel, http.StatusBadRequest)
 		return
 	}
 
-	value, err := s.pq.Dequeue(channel)
+	value, err := s.pq.DequeueContext(r.Context(), channel)
 	if err != nil {
-		if err.Error() == pqueue.EMPTY_QUEUE {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
@@ -192,10 +547,13 @@ func (s *Server) DequeueHandler(w http.ResponseWriter, r *http.Request) {
 
 // DequeueWithReservationHandler handles dequeue requests with reservation
 // @Summary Dequeue an item with reservation
-// @Description Dequeue an item from the priority queue with a reservation ID
+// @Description Dequeue an item from the priority queue with a reservation ID. With filters, the highest-priority matching item is reserved and other items are left in place.
 // @Produce  json
 // @Param  channel  query  int  false  "Channel to dequeue from"
-// @Success 200 {object} map[string]string "Dequeued item and reservation ID"
+// @Param  filter  query  string  false  "Attribute filter as key=value, or JSON path filter on the payload as $.path=value, may be repeated"
+// @Param  consumer  query  string  false  "Consumer owning the reservation, only it may confirm, release or extend the reservation"
+// @Param  partition  query  int  false  "Only reserve items of this partition of a partitioned channel"
+// @Success 200 {object} map[string]string "Dequeued item, reservation ID and fencing token"
 // @Failure 204 "No Content"
 // @Failure 400 "Bad Request"
 // @Failure 403 "Forbidden"
@@ -205,28 +563,19 @@ func (s *Server) DequeueHandler(w http.ResponseWriter, r *http.Request) {
 // @Method get
 func (s *Server) DequeueWithReservationHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	channelStr := r.URL.Query().Get("channel")
-	channel, err := strconv.Atoi(channelStr)
+	channel, opts, err := parseReserveParams(r)
 	if err != nil {
-		channel = DEFAULT_CHANNEL
-	}
-
-	if channel < 0 || channel > mempqueue.MAX_CHANNEL {
-		http.Error(w, "Channel must be between 0 and 100", http.StatusBadRequest)
+		jsonError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	value, reservationId, err := s.pq.DequeueWithReservation(channel)
+	value, reservation, err := s.pq.DequeueWithReservationOptionsContext(r.Context(), channel, opts)
 	if err != nil {
-		if err.Error() == pqueue.EMPTY_QUEUE {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
@@ -242,51 +591,138 @@ func (s *Server) DequeueWithReservationHandler(w http.ResponseWriter, r *http.Re
 	if err := json.Unmarshal([]byte(value), &raw); err == nil {
 		response := map[string]any{
 			"value":          raw,
-			"reservation_id": reservationId,
+			"reservation_id": reservation.ReservationId,
+			"token":          reservation.Token,
 		}
 		json.NewEncoder(w).Encode(response)
 	} else {
 		// Value is not valid JSON, return as string
 		response := map[string]interface{}{
 			"value":          value,
-			"reservation_id": reservationId,
+			"reservation_id": reservation.ReservationId,
+			"token":          reservation.Token,
 		}
 		json.NewEncoder(w).Encode(response)
 	}
 
 	if s.verbose {
-		log.Printf("DequeueWithReservationHandler: dequeued item: %s with reservation ID: %s\n", value, reservationId)
+		log.Printf("DequeueWithReservationHandler: dequeued item: %s with reservation ID: %s\n", value, reservation.ReservationId)
+	}
+}
+
+// DequeueWithReservationBatchHandler handles requests reserving several items at once
+// @Summary Reserve a batch of items
+// @Description Reserve up to n items of a channel at once, highest priority first. Each item gets its own reservation ID and fencing token.
+// @Produce  json
+// @Param  channel  query  int  false  "Channel to dequeue from"
+// @Param  n  query  int  true  "Maximum number of items to reserve, at most 1000"
+// @Param  filter  query  string  false  "Attribute filter as key=value, or JSON path filter on the payload as $.path=value, may be repeated"
+// @Param  consumer  query  string  false  "Consumer owning the reservations"
+// @Param  partition  query  int  false  "Only reserve items of this partition of a partitioned channel"
+// @Success 200 {object} []ReservedItemResponse "Reserved items"
+// @Failure 204 "No Content"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 405 "Method Not Allowed"
+// @Failure 500 "Internal Server Error"
+// @Router /reserve_batch [get]
+// @Method get
+func (s *Server) DequeueWithReservationBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	channel, opts, err := parseReserveParams(r)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil || n <= 0 || n > MAX_BATCH_SIZE {
+		jsonError(w, "n must be between 1 and 1000", http.StatusBadRequest)
+		return
+	}
+
+	items, err := s.pq.DequeueWithReservationBatchContext(r.Context(), channel, n, opts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := make([]ReservedItemResponse, len(items))
+	for i, item := range items {
+		value := json.RawMessage(item.Value)
+		if !json.Valid(value) {
+			// Value is not valid JSON, return as string
+			value, _ = json.Marshal(item.Value)
+		}
+		response[i] = ReservedItemResponse{Value: value, ReservationId: item.Reservation.ReservationId, Token: item.Reservation.Token}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+
+	if s.verbose {
+		log.Printf("DequeueWithReservationBatchHandler: reserved %d items from channel %d\n", len(items), channel)
 	}
 }
 
 // ConfirmReservationHandler handles requests to confirm a reservation
 // @Summary Confirm a reservation
-// @Description Confirm a reservation by providing the reservation Id as a path parameter
+// @Description Confirm a reservation by providing the reservation Id as a path parameter. An optional request body is stored as the result of the item, and enqueued as a reply if the item has a reply channel.
 // @Accept  json
 // @Produce  json
 // @Param  reservation_id  path string true "Reservation Id to confirm"
+// @Param  ttl  query  int  false  "Seconds to retain the result, defaults to 3600"
+// @Param  consumer  query  string  false  "Consumer the reservation was made for, if any"
+// @Param  token  query  int  false  "Fencing token of the reservation, rejected if stale"
+// @Param  result  body  string  false  "Result of the item (string or JSON object)"
 // @Success 200 "Reservation confirmed"
 // @Failure 400 "Bad Request"
 // @Failure 403 "Forbidden"
+// @Failure 404 "Reservation not found"
 // @Failure 405 "Method Not Allowed"
+// @Failure 409 "Reservation held by another consumer or stale token"
 // @Failure 500 "Internal Server Error"
 // @Router /confirm/{reservation_id} [post]
 // @Method post
 func (s *Server) ConfirmReservationHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	parts := httphelper.SplitPath(r.URL.Path)
 	if len(parts) != 2 || parts[0] != "confirm" || parts[1] == "" {
-		http.Error(w, "Missing or invalid reservation_id in path", http.StatusBadRequest)
+		jsonError(w, "Missing or invalid reservation_id in path", http.StatusBadRequest)
 		return
 	}
 	reservationId := parts[1]
 
-	if _, err := s.pq.ConfirmReservation(reservationId); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	ttl := DEFAULT_RESULT_TTL
+	if ttlStr := r.URL.Query().Get("ttl"); ttlStr != "" {
+		seconds, err := strconv.Atoi(ttlStr)
+		if err != nil || seconds <= 0 {
+			jsonError(w, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		jsonError(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	result := string(bodyBytes)
+
+	claim, err := parseClaim(r)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := s.pq.ConfirmReservationAsContext(r.Context(), reservationId, claim, result, ttl); err != nil {
+		writeError(w, err)
 		return
 	}
 
@@ -296,80 +732,1198 @@ func (s *Server) ConfirmReservationHandler(w http.ResponseWriter, r *http.Reques
 	}
 }
 
-// SizeHandler handles requests to get the current size of the queue
-// @Summary Get the size of the queue
-// @Description Returns the number of items in the queue for a specified channel
-// @Produce json
-// @Param channel query int false "Channel to get the size of"
-// @Success 200 {object} map[string]int "Queue size"
+// ConfirmReservationBatchHandler handles requests confirming several reservations at once
+// @Summary Confirm a batch of reservations
+// @Description Confirm the reservations listed in the body, a JSON array of reservation Ids. The outcome is reported per reservation, a failed reservation does not affect the others.
+// @Accept  json
+// @Produce  json
+// @Param  consumer  query  string  false  "Consumer the reservations were made for, if any"
+// @Param  reservation_ids  body  array  true  "Reservation Ids to confirm, at most 1000"
+// @Success 200 {object} []ConfirmBatchResult "Outcome per reservation"
 // @Failure 400 "Bad Request"
 // @Failure 403 "Forbidden"
+// @Failure 405 "Method Not Allowed"
 // @Failure 500 "Internal Server Error"
-// @Router /size [get]
-// @Method get
-func (s *Server) SizeHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+// @Router /confirm_batch [post]
+// @Method post
+func (s *Server) ConfirmReservationBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	channelStr := r.URL.Query().Get("channel")
-	channel, err := strconv.Atoi(channelStr)
-	if err != nil || channel < 0 || channel > mempqueue.MAX_CHANNEL {
-		http.Error(w, "Invalid channel. Must be between 0 and 100.", http.StatusBadRequest)
+	var reservationIds []string
+	if err := json.NewDecoder(r.Body).Decode(&reservationIds); err != nil {
+		jsonError(w, "Invalid request body, expected a JSON array of reservation ids", http.StatusBadRequest)
+		return
+	}
+	if len(reservationIds) == 0 || len(reservationIds) > MAX_BATCH_SIZE {
+		jsonError(w, "Between 1 and 1000 reservation ids are required", http.StatusBadRequest)
 		return
 	}
 
-	size, err := s.pq.Size(channel)
+	claim := priorityqueue.ReservationClaim{Consumer: r.URL.Query().Get("consumer")}
+	errs, err := s.pq.ConfirmReservationBatchContext(r.Context(), reservationIds, claim)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get queue size: %v", err), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
-	response := map[string]int{"size": size}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
-		return
+	results := make([]ConfirmBatchResult, len(reservationIds))
+	for i, reservationId := range reservationIds {
+		results[i] = ConfirmBatchResult{ReservationId: reservationId, Confirmed: errs[i] == nil}
+		if errs[i] != nil {
+			results[i].Code = errorCode(errs[i])
+			results[i].Error = errs[i].Error()
+		}
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
 
 	if s.verbose {
-		log.Printf("SizeHandler: channel %d has size %d\n", channel, size)
+		log.Printf("ConfirmReservationBatchHandler: confirmed batch of %d reservations\n", len(reservationIds))
 	}
 }
 
-func (s *Server) ServeSwagger(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(swaggerJSON)
-}
-
-// ResetHandler handles the reset requests
-// @Summary Reset the queue
-// @Description Reset the priority queue
-// @Accept  json
-// @Produce json
-// @Success 200 "Queue reset successfully"
+// ReleaseReservationHandler handles requests to release a reservation
+// @Summary Release a reservation
+// @Description Return a reserved item to its channel without waiting for the reservation to expire
+// @Produce  plain
+// @Param  reservation_id  path string true "Reservation Id to release"
+// @Param  consumer  query  string  false  "Consumer the reservation was made for, if any"
+// @Param  token  query  int  false  "Fencing token of the reservation, rejected if stale"
+// @Success 200 "Reservation released"
+// @Failure 400 "Bad Request"
 // @Failure 403 "Forbidden"
+// @Failure 404 "Reservation not found"
 // @Failure 405 "Method Not Allowed"
+// @Failure 409 "Reservation held by another consumer or stale token"
 // @Failure 500 "Internal Server Error"
-// @Router /reset [post]
+// @Router /release/{reservation_id} [post]
 // @Method post
-func (s *Server) ResetHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) ReleaseReservationHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := httphelper.SplitPath(r.URL.Path)
+	if len(parts) != 2 || parts[0] != "release" || parts[1] == "" {
+		jsonError(w, "Missing or invalid reservation_id in path", http.StatusBadRequest)
+		return
+	}
+	reservationId := parts[1]
+
+	claim, err := parseClaim(r)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, err = s.pq.ReleaseReservationAsContext(r.Context(), reservationId, claim)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if s.verbose {
+		log.Printf("ReleaseReservationHandler: released reservation Id: %s\n", reservationId)
+	}
+}
+
+// ExtendReservationHandler handles requests to extend a reservation
+// @Summary Extend a reservation
+// @Description Restart the timeout of a reservation, as if the item was reserved now
+// @Produce  plain
+// @Param  reservation_id  path string true "Reservation Id to extend"
+// @Param  consumer  query  string  false  "Consumer the reservation was made for, if any"
+// @Param  token  query  int  false  "Fencing token of the reservation, rejected if stale"
+// @Success 200 "Reservation extended"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Reservation not found"
+// @Failure 405 "Method Not Allowed"
+// @Failure 409 "Reservation held by another consumer or stale token"
+// @Failure 500 "Internal Server Error"
+// @Router /extend/{reservation_id} [post]
+// @Method post
+func (s *Server) ExtendReservationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := httphelper.SplitPath(r.URL.Path)
+	if len(parts) != 2 || parts[0] != "extend" || parts[1] == "" {
+		jsonError(w, "Missing or invalid reservation_id in path", http.StatusBadRequest)
+		return
+	}
+	reservationId := parts[1]
+
+	claim, err := parseClaim(r)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := s.pq.ExtendReservationContext(r.Context(), reservationId, claim); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if s.verbose {
+		log.Printf("ExtendReservationHandler: extended reservation Id: %s\n", reservationId)
+	}
+}
+
+// ReservationsHandler handles requests to list reservations
+// @Summary List reservations
+// @Description Returns the current reservations grouped by consumer, oldest first. Reservations made without a consumer are listed under the empty key.
+// @Produce json
+// @Success 200 {object} map[string][]priorityqueue.Reservation "Reservations by consumer"
+// @Failure 403 "Forbidden"
+// @Failure 405 "Method Not Allowed"
+// @Failure 500 "Internal Server Error"
+// @Router /reservations [get]
+// @Method get
+func (s *Server) ReservationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reservations, err := s.pq.ReservationsContext(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reservations)
+}
+
+// TxHandler handles transaction requests
+// @Summary Apply a transaction
+// @Description Apply a list of enqueue, confirm, release and delete operations atomically. The body is a JSON array of operations such as {"op": "confirm", "reservation_id": "..."} and {"op": "enqueue", "channel": 1, "item": {...}}. Either all operations are applied or none, a payload not conforming to the schema of its channel rejects the transaction with the list of violations.
+// @Accept  json
+// @Produce  json
+// @Param  ops  body  array  true  "Operations to apply"
+// @Success 200 {object} map[string][]string "Ids of the enqueued items, aligned with the operations"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Reservation or item not found"
+// @Failure 405 "Method Not Allowed"
+// @Router /tx [post]
+// @Method post
+func (s *Server) TxHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqOps []TxRequestOp
+	if err := json.NewDecoder(r.Body).Decode(&reqOps); err != nil {
+		jsonError(w, "Invalid transaction body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ops := make([]priorityqueue.TxOp, len(reqOps))
+	for i, reqOp := range reqOps {
+		op := priorityqueue.TxOp{
+			Op:            reqOp.Op,
+			Obj:           string(reqOp.Item),
+			Prio:          reqOp.Prio,
+			Channel:       reqOp.Channel,
+			NotBefore:     reqOp.NotBefore.UTC(),
+			ReservationId: reqOp.ReservationId,
+			Claim:         priorityqueue.ReservationClaim{Consumer: reqOp.Consumer, Token: reqOp.Token},
+			Result:        string(reqOp.Result),
+			ResultTTL:     DEFAULT_RESULT_TTL,
+			ItemId:        reqOp.ItemId,
+			Options: priorityqueue.EnqueueOptions{
+				DependsOn:     reqOp.DependsOn,
+				ReplyTo:       reqOp.ReplyTo,
+				CorrelationId: reqOp.CorrelationId,
+				Attributes:    reqOp.Attributes,
+				Deadline:      reqOp.Deadline.UTC(),
+				Tenant:        reqOp.Tenant,
+				PartitionKey:  reqOp.PartitionKey,
+			},
+		}
+		if reqOp.TTL > 0 {
+			op.ResultTTL = time.Duration(reqOp.TTL) * time.Second
+		}
+		if op.Op == priorityqueue.TX_ENQUEUE && op.Obj == "" {
+			jsonError(w, fmt.Sprintf("Operation %d: item is required", i), http.StatusBadRequest)
+			return
+		}
+		ops[i] = op
+	}
+
+	s.mu.Lock()
+	itemIds, err := s.pq.ApplyTransactionContext(r.Context(), ops)
+	s.mu.Unlock()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"item_ids": itemIds})
+
+	if s.verbose {
+		log.Printf("TxHandler: applied %d operations\n", len(ops))
+	}
+}
+
+// ItemsHandler dispatches requests below /items/{id}
+func (s *Server) ItemsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := httphelper.SplitPath(r.URL.Path)
+	if len(parts) != 3 || parts[0] != "items" || parts[1] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch parts[2] {
+	case "result":
+		s.ItemResultHandler(w, r)
+	case "status":
+		s.ItemStatusHandler(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// ItemResultHandler handles requests for the result of a confirmed item
+// @Summary Get the result of an item
+// @Description Returns the result stored when the reservation of the item was confirmed. With wait, the request is held until the result is available or the wait has passed.
+// @Produce  json
+// @Param  id  path  string  true  "Item id, as returned by enqueue"
+// @Param  wait  query  int  false  "Seconds to wait for the result, at most 30"
+// @Success 200 "Result of the item" json
+// @Failure 204 "No Content"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 405 "Method Not Allowed"
+// @Failure 500 "Internal Server Error"
+// @Router /items/{id}/result [get]
+// @Method get
+func (s *Server) ItemResultHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	itemId := httphelper.SplitPath(r.URL.Path)[1]
+
+	var wait time.Duration
+	if waitStr := r.URL.Query().Get("wait"); waitStr != "" {
+		seconds, err := strconv.Atoi(waitStr)
+		if err != nil || seconds < 0 {
+			jsonError(w, "Invalid wait", http.StatusBadRequest)
+			return
+		}
+		wait = min(time.Duration(seconds)*time.Second, MAX_RESULT_WAIT)
+	}
+	deadline := time.Now().Add(wait)
+
+	// wake up as soon as the item is confirmed, polling still picks up results stored by other processes
+	confirmed := make(chan struct{}, 1)
+	if wait > 0 {
+		unsubscribe := s.pq.Subscribe(func(event priorityqueue.Event) {
+			if event.Type == priorityqueue.EVENT_CONFIRM && event.ItemId == itemId {
+				select {
+				case confirmed <- struct{}{}:
+				default:
+				}
+			}
+		})
+		defer unsubscribe()
+	}
+
+	for {
+		result, ok, err := s.pq.GetResultContext(r.Context(), itemId)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(result))
+			if s.verbose {
+				log.Printf("ItemResultHandler: result of item %s: %s\n", itemId, result)
+			}
+			return
+		}
+		if !time.Now().Before(deadline) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-confirmed:
+		case <-time.After(RESULT_POLL_INTERVAL):
+		}
+	}
+}
+
+// ItemStatusHandler handles requests for the status of an item
+// @Summary Get the status of an item
+// @Description Returns the status of an item: pending, scheduled, blocked, reserved, expired, completed or deleted, with its timestamps and number of reservations. Reserved items include the deadline of the reservation. Completed and deleted items are reported for the status retention period.
+// @Produce  json
+// @Param  id  path  string  true  "Item id, as returned by enqueue"
+// @Success 200 {object} ItemStatusResponse "Status of the item"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Item not found"
+// @Failure 405 "Method Not Allowed"
+// @Failure 500 "Internal Server Error"
+// @Router /items/{id}/status [get]
+// @Method get
+func (s *Server) ItemStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	itemId := httphelper.SplitPath(r.URL.Path)[1]
+
+	status, err := s.pq.GetStatusContext(r.Context(), itemId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := ItemStatusResponse{ItemStatus: status}
+	s.mu.Lock()
+	timeout := s.reservationTimeout
+	s.mu.Unlock()
+	if status.Status == priorityqueue.STATUS_RESERVED && timeout > 0 {
+		response.ReservationDeadline = status.ReservedAt.Add(timeout)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// queueErrors maps the errors of the queue backends to HTTP status codes and the codes of JSON error bodies
+var queueErrors = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{priorityqueue.ErrEmpty, http.StatusNoContent, "empty"},
+	{priorityqueue.ErrInvalidChannel, http.StatusBadRequest, "invalid_channel"},
+	{priorityqueue.ErrInvalidArgument, http.StatusBadRequest, "invalid_argument"},
+	{priorityqueue.ErrReservationNotFound, http.StatusNotFound, "reservation_not_found"},
+	{priorityqueue.ErrItemNotFound, http.StatusNotFound, "item_not_found"},
+	{priorityqueue.ErrFull, http.StatusServiceUnavailable, "full"},
+	{priorityqueue.ErrNotOwner, http.StatusConflict, "not_owner"},
+	{priorityqueue.ErrStaleToken, http.StatusConflict, "stale_token"},
+	{priorityqueue.ErrSchemaViolation, http.StatusBadRequest, "schema_violation"},
+	{context.Canceled, http.StatusServiceUnavailable, "canceled"},
+	{context.DeadlineExceeded, http.StatusServiceUnavailable, "timeout"},
+}
+
+// ErrorResponse is the JSON body of error responses
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code,omitempty"` // set for errors of the queue backends
+	// Violations lists what is wrong with a payload rejected by the schema of its channel
+	Violations []string `json:"violations,omitempty"`
+}
+
+// writeError replies with the status code and JSON body of a queue error, 500 for other errors.
+// ErrEmpty is replied as 204 No Content without a body.
+func writeError(w http.ResponseWriter, err error) {
+	for _, queueError := range queueErrors {
+		if errors.Is(err, queueError.err) {
+			if queueError.status == http.StatusNoContent {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			response := ErrorResponse{Error: err.Error(), Code: queueError.code}
+			var violation *priorityqueue.SchemaViolationError
+			if errors.As(err, &violation) {
+				response.Violations = violation.Violations
+			}
+			writeErrorResponse(w, response, queueError.status)
+			return
+		}
+	}
+	writeErrorResponse(w, ErrorResponse{Error: err.Error(), Code: "internal"}, http.StatusInternalServerError)
+}
+
+// errorCode returns the code of a queue error, "internal" for other errors.
+func errorCode(err error) string {
+	for _, queueError := range queueErrors {
+		if errors.Is(err, queueError.err) {
+			return queueError.code
+		}
+	}
+	return "internal"
+}
+
+// invalidChannel is the error message for a channel parameter out of range
+var invalidChannel = fmt.Sprintf("Invalid channel. Must be between 0 and %d.", mempqueue.MAX_CHANNEL-1)
+
+// validChannel reports whether a channel parameter is between 0 and MAX_CHANNEL-1
+func validChannel(channel int) bool {
+	return channel >= 0 && channel < mempqueue.MAX_CHANNEL
+}
+
+// jsonError replies with a JSON error body, like http.Error does with plain text
+func jsonError(w http.ResponseWriter, message string, status int) {
+	writeErrorResponse(w, ErrorResponse{Error: message}, status)
+}
+
+func writeErrorResponse(w http.ResponseWriter, response ErrorResponse, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// SizeHandler handles requests to get the current size of the queue
+// @Summary Get the size of the queue
+// @Description Returns the number of items in the queue for a specified channel
+// @Produce json
+// @Param channel query int false "Channel to get the size of"
+// @Success 200 {object} map[string]int "Queue size"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /size [get]
+// @Method get
+func (s *Server) SizeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	channelStr := r.URL.Query().Get("channel")
+	channel, err := strconv.Atoi(channelStr)
+	if err != nil || !validChannel(channel) {
+		jsonError(w, invalidChannel, http.StatusBadRequest)
+		return
+	}
+
+	size, err := s.pq.SizeContext(r.Context(), channel)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := map[string]int{"size": size}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		jsonError(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+
+	if s.verbose {
+		log.Printf("SizeHandler: channel %d has size %d\n", channel, size)
+	}
+}
+
+// StatsHandler handles requests for queue statistics
+// @Summary Get queue statistics
+// @Description Returns per-channel ready, scheduled, reserved and blocked counts, the number of live consumers registered for the channel, operation counters and the ages in seconds of the oldest ready item and the oldest reservation
+// @Produce json
+// @Param channel query int false "Channel to get the statistics of, all channels in use if omitted"
+// @Success 200 {object} map[string]priorityqueue.ChannelStats "Statistics by channel"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 405 "Method Not Allowed"
+// @Failure 500 "Internal Server Error"
+// @Router /stats [get]
+// @Method get
+func (s *Server) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, err := s.pq.StatsContext(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for _, consumer := range s.consumers.list() {
+		for _, channel := range consumer.Channels {
+			channelStats := stats[channel]
+			channelStats.Consumers++
+			stats[channel] = channelStats
+		}
+	}
+
+	if channelStr := r.URL.Query().Get("channel"); channelStr != "" {
+		channel, err := strconv.Atoi(channelStr)
+		if err != nil || !validChannel(channel) {
+			jsonError(w, invalidChannel, http.StatusBadRequest)
+			return
+		}
+		stats = map[int]priorityqueue.ChannelStats{channel: stats[channel]}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (s *Server) ServeSwagger(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(swaggerJSON)
+}
+
+// ResetHandler handles the reset requests
+// @Summary Reset the queue
+// @Description Reset the priority queue
+// @Accept  json
+// @Produce json
+// @Success 200 "Queue reset successfully"
+// @Failure 403 "Forbidden"
+// @Failure 405 "Method Not Allowed"
+// @Failure 500 "Internal Server Error"
+// @Router /reset [post]
+// @Method post
+func (s *Server) ResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	err := s.pq.ResetQueue()
+	err := s.pq.ResetQueueContext(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// PauseHandler handles requests to pause a channel
+// @Summary Pause a channel
+// @Description Stop dequeue and reserve from serving a channel. Enqueue keeps working and expired reservations are still requeued.
+// @Produce plain
+// @Param channel query int true "Channel to pause"
+// @Success 200 "Channel paused"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 405 "Method Not Allowed"
+// @Failure 500 "Internal Server Error"
+// @Router /pause [post]
+// @Method post
+func (s *Server) PauseHandler(w http.ResponseWriter, r *http.Request) {
+	s.setPaused(w, r, true)
+}
+
+// ResumeHandler handles requests to resume a paused channel
+// @Summary Resume a channel
+// @Description Resume dequeue and reserve for a paused channel
+// @Produce plain
+// @Param channel query int true "Channel to resume"
+// @Success 200 "Channel resumed"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 405 "Method Not Allowed"
+// @Failure 500 "Internal Server Error"
+// @Router /resume [post]
+// @Method post
+func (s *Server) ResumeHandler(w http.ResponseWriter, r *http.Request) {
+	s.setPaused(w, r, false)
+}
+
+func (s *Server) setPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	channelStr := r.URL.Query().Get("channel")
+	channel, err := strconv.Atoi(channelStr)
+	if err != nil || !validChannel(channel) {
+		jsonError(w, invalidChannel, http.StatusBadRequest)
+		return
+	}
+
+	if paused {
+		err = s.pq.PauseChannelContext(r.Context(), channel)
+	} else {
+		err = s.pq.ResumeChannelContext(r.Context(), channel)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if s.verbose {
+		log.Printf("setPaused: channel %d paused: %t\n", channel, paused)
+	}
+}
+
+// PausedHandler handles requests to list paused channels
+// @Summary List paused channels
+// @Description Returns the channels that are currently paused
+// @Produce json
+// @Success 200 {object} map[string][]int "Paused channels"
+// @Failure 403 "Forbidden"
+// @Failure 405 "Method Not Allowed"
+// @Failure 500 "Internal Server Error"
+// @Router /paused [get]
+// @Method get
+func (s *Server) PausedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	channels, err := s.pq.PausedChannelsContext(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]int{"channels": channels})
+}
+
+// ChannelsHandler dispatches requests to /channels by method
+func (s *Server) ChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.ListChannelConfigsHandler(w, r)
+	case http.MethodPost:
+		s.SetChannelConfigHandler(w, r)
+	default:
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ListChannelConfigsHandler handles requests to list channel configs
+// @Summary List channel configs
+// @Description Returns the config of every channel not using the default settings
+// @Produce json
+// @Success 200 {object} map[string]priorityqueue.ChannelConfig "Configs by channel"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /channels [get]
+// @Method get
+func (s *Server) ListChannelConfigsHandler(w http.ResponseWriter, r *http.Request) {
+	configs, err := s.pq.ChannelConfigsContext(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(configs)
+}
+
+// SetChannelConfigHandler handles requests to configure a channel
+// @Summary Configure a channel
+// @Description Set the mode of a channel. With "edf" the channel dequeues the item with the earliest deadline first, items without a deadline last. With "overdue_channel" ready items past their deadline are moved to that channel. With "fair" the tenants of the channel are served round-robin, in priority order within each tenant. With "encrypt" payloads enqueued to the channel are stored encrypted with the server's key file and decrypted when dequeued. The partitions of a channel are kept, see /repartition. An empty config restores the default.
+// @Accept json
+// @Produce plain
+// @Param channel query int true "Channel to configure"
+// @Param config body priorityqueue.ChannelConfig true "Channel config"
+// @Success 200 "Channel configured"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /channels [post]
+// @Method post
+func (s *Server) SetChannelConfigHandler(w http.ResponseWriter, r *http.Request) {
+	channelStr := r.URL.Query().Get("channel")
+	channel, err := strconv.Atoi(channelStr)
+	if err != nil || !validChannel(channel) {
+		jsonError(w, invalidChannel, http.StatusBadRequest)
+		return
+	}
+
+	var config priorityqueue.ChannelConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		jsonError(w, "Invalid channel config: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.pq.SetChannelConfigContext(r.Context(), channel, config); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if s.verbose {
+		log.Printf("SetChannelConfigHandler: channel %d configured: %+v\n", channel, config)
+	}
+}
+
+// RepartitionHandler handles requests to change the number of partitions of a channel
+// @Summary Repartition a channel
+// @Description Split a channel into the given number of partitions, items are assigned to a partition by the hash of their partition key. 0 removes the partitioning. The channel must be paused and have no outstanding reservations, resume it once the consumers have been assigned their new partitions.
+// @Produce plain
+// @Param channel query int true "Channel to repartition"
+// @Param partitions query int true "Number of partitions, at most 1024"
+// @Success 200 "Channel repartitioned"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 405 "Method Not Allowed"
+// @Failure 500 "Internal Server Error"
+// @Router /repartition [post]
+// @Method post
+func (s *Server) RepartitionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	channelStr := r.URL.Query().Get("channel")
+	channel, err := strconv.Atoi(channelStr)
+	if err != nil || !validChannel(channel) {
+		jsonError(w, invalidChannel, http.StatusBadRequest)
+		return
+	}
+	partitions, err := strconv.Atoi(r.URL.Query().Get("partitions"))
+	if err != nil {
+		jsonError(w, "Invalid partitions", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.pq.RepartitionChannelContext(r.Context(), channel, partitions); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if s.verbose {
+		log.Printf("RepartitionHandler: channel %d split into %d partitions\n", channel, partitions)
+	}
+}
+
+// RoutesHandler dispatches requests to /routes by method
+func (s *Server) RoutesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.ListRoutingRulesHandler(w, r)
+	case http.MethodPost:
+		s.SetRoutingRuleHandler(w, r)
+	case http.MethodDelete:
+		s.DeleteRoutingRuleHandler(w, r)
+	default:
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ListRoutingRulesHandler handles requests to list routing rules
+// @Summary List routing rules
+// @Description Returns the routing rules in the order they are evaluated by /enqueue
+// @Produce json
+// @Success 200 {object} []priorityqueue.RoutingRule "Routing rules"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /routes [get]
+// @Method get
+func (s *Server) ListRoutingRulesHandler(w http.ResponseWriter, r *http.Request) {
+	rules, err := s.pq.RoutingRulesContext(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// SetRoutingRuleHandler handles requests to add or replace a routing rule
+// @Summary Add or replace a routing rule
+// @Description Items enqueued with /enqueue that match all conditions of a rule are placed in the channel of the rule, with its priority if set, whatever the query parameters say. Conditions are key=value for an attribute or $.path=value for the payload. The first matching rule applies. A new rule is evaluated after the existing rules, a rule with the name of an existing rule replaces it in place.
+// @Accept json
+// @Produce plain
+// @Param rule body priorityqueue.RoutingRule true "Routing rule"
+// @Success 200 "Routing rule set"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /routes [post]
+// @Method post
+func (s *Server) SetRoutingRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var rule priorityqueue.RoutingRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		jsonError(w, "Invalid routing rule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.pq.SetRoutingRuleContext(r.Context(), rule); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if s.verbose {
+		log.Printf("SetRoutingRuleHandler: routing rule set: %+v\n", rule)
+	}
+}
+
+// DeleteRoutingRuleHandler handles requests to delete a routing rule
+// @Summary Delete a routing rule
+// @Description Remove a routing rule by name
+// @Produce plain
+// @Param name query string true "Name of the routing rule"
+// @Success 200 "Routing rule deleted"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Routing rule not found"
+// @Failure 500 "Internal Server Error"
+// @Router /routes [delete]
+// @Method delete
+func (s *Server) DeleteRoutingRuleHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		jsonError(w, "Missing name", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := s.pq.DeleteRoutingRuleContext(r.Context(), name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !deleted {
+		jsonError(w, "Routing rule not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if s.verbose {
+		log.Printf("DeleteRoutingRuleHandler: routing rule %s deleted\n", name)
+	}
+}
+
+// SchemasHandler dispatches requests to /schemas by method
+func (s *Server) SchemasHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.ListChannelSchemasHandler(w, r)
+	case http.MethodPost:
+		s.SetChannelSchemaHandler(w, r)
+	case http.MethodDelete:
+		s.DeleteChannelSchemaHandler(w, r)
+	default:
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ListChannelSchemasHandler handles requests to list the schema versions of a channel
+// @Summary List the schema versions of a channel
+// @Description Returns the versions of the schema of a channel, oldest first. Payloads are checked against the latest version.
+// @Produce json
+// @Param channel query int true "Channel"
+// @Success 200 {object} []priorityqueue.SchemaVersion "Schema versions"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /schemas [get]
+// @Method get
+func (s *Server) ListChannelSchemasHandler(w http.ResponseWriter, r *http.Request) {
+	channel, err := strconv.Atoi(r.URL.Query().Get("channel"))
+	if err != nil || !validChannel(channel) {
+		jsonError(w, invalidChannel, http.StatusBadRequest)
+		return
+	}
+
+	versions, err := s.pq.ChannelSchemasContext(r.Context(), channel)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+// SetChannelSchemaHandler handles requests to set the schema of a channel
+// @Summary Set the schema of a channel
+// @Description Store a new version of the schema payloads enqueued to the channel must conform to, whether by /enqueue, /publish, /tx or as the reply to a confirmed item. The schema is a subset of JSON Schema: type, properties, required, items, enum, minimum, maximum, minLength and maxLength, other keywords are rejected. Returns the version number.
+// @Accept json
+// @Produce json
+// @Param channel query int true "Channel"
+// @Param schema body priorityqueue.Schema true "JSON Schema"
+// @Success 200 {object} map[string]int "Version of the schema"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /schemas [post]
+// @Method post
+func (s *Server) SetChannelSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	channel, err := strconv.Atoi(r.URL.Query().Get("channel"))
+	if err != nil || !validChannel(channel) {
+		jsonError(w, invalidChannel, http.StatusBadRequest)
+		return
+	}
+
+	var schema priorityqueue.Schema
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&schema); err != nil {
+		jsonError(w, "Invalid schema: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	version, err := s.pq.SetChannelSchemaContext(r.Context(), channel, schema)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"version": version})
+	if s.verbose {
+		log.Printf("SetChannelSchemaHandler: version %d of the schema of channel %d set\n", version, channel)
+	}
+}
+
+// DeleteChannelSchemaHandler handles requests to delete the schema of a channel
+// @Summary Delete the schema of a channel
+// @Description Remove all versions of the schema of a channel, payloads are no longer checked
+// @Produce plain
+// @Param channel query int true "Channel"
+// @Success 200 "Schema deleted"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Channel has no schema"
+// @Failure 500 "Internal Server Error"
+// @Router /schemas [delete]
+// @Method delete
+func (s *Server) DeleteChannelSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	channel, err := strconv.Atoi(r.URL.Query().Get("channel"))
+	if err != nil || !validChannel(channel) {
+		jsonError(w, invalidChannel, http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := s.pq.DeleteChannelSchemaContext(r.Context(), channel)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !deleted {
+		jsonError(w, "Channel has no schema", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if s.verbose {
+		log.Printf("DeleteChannelSchemaHandler: schema of channel %d deleted\n", channel)
+	}
+}
+
+// ConsumersHandler dispatches requests to /consumers by method
+func (s *Server) ConsumersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.ListConsumersHandler(w, r)
+	case http.MethodPost:
+		s.RegisterConsumerHandler(w, r)
+	case http.MethodDelete:
+		s.DeregisterConsumerHandler(w, r)
+	default:
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ListConsumersHandler handles requests to list consumers
+// @Summary List consumers
+// @Description Returns the registered consumers that have not missed their heartbeats, with the number of reservations they hold
+// @Produce json
+// @Success 200 {object} []ConsumerInfo "Live consumers"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /consumers [get]
+// @Method get
+func (s *Server) ListConsumersHandler(w http.ResponseWriter, r *http.Request) {
+	reservations, err := s.pq.ReservationsContext(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	consumers := s.consumers.list()
+	for i := range consumers {
+		consumers[i].Reservations = len(reservations[consumers[i].Id])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(consumers)
+}
+
+// RegisterConsumerHandler handles requests to register a consumer
+// @Summary Register a consumer
+// @Description Register a consumer, or update the channels of a registered one. The consumer must then send heartbeats, when it misses them its reservations are requeued.
+// @Produce plain
+// @Param consumer query string true "Consumer id, as passed to /reserve"
+// @Param channel query int false "Channel the consumer reserves from, may be repeated"
+// @Success 200 "Consumer registered"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Router /consumers [post]
+// @Method post
+func (s *Server) RegisterConsumerHandler(w http.ResponseWriter, r *http.Request) {
+	consumer := r.URL.Query().Get("consumer")
+	if consumer == "" {
+		jsonError(w, "Missing consumer", http.StatusBadRequest)
+		return
+	}
+
+	var channels []int
+	for _, channelStr := range r.URL.Query()["channel"] {
+		channel, err := strconv.Atoi(channelStr)
+		if err != nil || !validChannel(channel) {
+			jsonError(w, invalidChannel, http.StatusBadRequest)
+			return
+		}
+		channels = append(channels, channel)
+	}
+
+	s.consumers.register(consumer, channels, time.Now())
+
+	w.WriteHeader(http.StatusOK)
+	if s.verbose {
+		log.Printf("RegisterConsumerHandler: registered consumer %s for channels %v\n", consumer, channels)
+	}
+}
+
+// DeregisterConsumerHandler handles requests to deregister a consumer
+// @Summary Deregister a consumer
+// @Description Remove a consumer from the registry and requeue the reservations it still holds
+// @Produce json
+// @Param consumer query string true "Consumer id"
+// @Success 200 {object} map[string]int "Number of requeued reservations"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Consumer not found"
+// @Failure 500 "Internal Server Error"
+// @Router /consumers [delete]
+// @Method delete
+func (s *Server) DeregisterConsumerHandler(w http.ResponseWriter, r *http.Request) {
+	consumer := r.URL.Query().Get("consumer")
+	if consumer == "" {
+		jsonError(w, "Missing consumer", http.StatusBadRequest)
+		return
+	}
+
+	if !s.consumers.deregister(consumer) {
+		jsonError(w, "Consumer not found", http.StatusNotFound)
+		return
+	}
+
+	requeued, err := s.pq.RequeueConsumerReservationsContext(r.Context(), consumer)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"requeued": requeued})
+	if s.verbose {
+		log.Printf("DeregisterConsumerHandler: deregistered consumer %s, requeued %d reservations\n", consumer, requeued)
+	}
+}
+
+// HeartbeatHandler handles consumer heartbeats
+// @Summary Send a consumer heartbeat
+// @Description Mark a registered consumer as alive. A 404 means the consumer is not registered, for example after it missed its heartbeats or the server restarted, and must register again.
+// @Produce plain
+// @Param consumer query string true "Consumer id"
+// @Success 200 "Heartbeat received"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Consumer not found"
+// @Failure 405 "Method Not Allowed"
+// @Router /heartbeat [post]
+// @Method post
+func (s *Server) HeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	consumer := r.URL.Query().Get("consumer")
+	if consumer == "" {
+		jsonError(w, "Missing consumer", http.StatusBadRequest)
+		return
+	}
+
+	if !s.consumers.heartbeat(consumer, time.Now()) {
+		jsonError(w, "Consumer not found", http.StatusNotFound)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
+func (c *consumerRegistry) register(id string, channels []int, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.consumers == nil {
+		c.consumers = make(map[string]ConsumerInfo)
+	}
+
+	info, ok := c.consumers[id]
+	if !ok {
+		info = ConsumerInfo{Id: id, RegisteredAt: now}
+	}
+	info.Channels = channels
+	info.LastHeartbeat = now
+	c.consumers[id] = info
+}
+
+func (c *consumerRegistry) heartbeat(id string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info, ok := c.consumers[id]
+	if ok {
+		info.LastHeartbeat = now
+		c.consumers[id] = info
+	}
+	return ok
+}
+
+func (c *consumerRegistry) deregister(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.consumers[id]
+	delete(c.consumers, id)
+	return ok
+}
+
+// expire removes and returns the consumers whose last heartbeat is older than timeout.
+func (c *consumerRegistry) expire(timeout time.Duration, now time.Time) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var expired []string
+	for id, info := range c.consumers {
+		if now.Sub(info.LastHeartbeat) > timeout {
+			delete(c.consumers, id)
+			expired = append(expired, id)
+		}
+	}
+	return expired
+}
+
+// list returns the registered consumers ordered by id.
+func (c *consumerRegistry) list() []ConsumerInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	consumers := make([]ConsumerInfo, 0, len(c.consumers))
+	for _, info := range c.consumers {
+		info.Channels = slices.Clone(info.Channels)
+		consumers = append(consumers, info)
+	}
+	slices.SortFunc(consumers, func(a, b ConsumerInfo) int { return strings.Compare(a.Id, b.Id) })
+	return consumers
+}
+
 // Serve the Swagger UI index.html with the correct URL for the swagger.json file
 func (s *Server) ServeSwaggerUi(w http.ResponseWriter, r *http.Request) {
 	swaggerUIPath := filepath.Join("swagger-ui")
@@ -381,6 +1935,10 @@ func (s *Server) ServeSwaggerUi(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) StartRequeueTask(timeout time.Duration) {
+	s.mu.Lock()
+	s.reservationTimeout = timeout
+	s.mu.Unlock()
+
 	ticker := time.NewTicker(timeout / 2)
 	go func() {
 		for range ticker.C {
@@ -396,21 +1954,67 @@ func (s *Server) StartRequeueTask(timeout time.Duration) {
 	}()
 }
 
+// StartConsumerTask periodically requeues the reservations of consumers that missed their heartbeats for timeout.
+func (s *Server) StartConsumerTask(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 2)
+	go func() {
+		for range ticker.C {
+			s.reapConsumers(timeout)
+		}
+	}()
+}
+
+// reapConsumers removes the consumers that missed their heartbeats and requeues their reservations.
+func (s *Server) reapConsumers(timeout time.Duration) {
+	for _, consumer := range s.consumers.expire(timeout, time.Now()) {
+		requeued, err := s.pq.RequeueConsumerReservations(consumer)
+		if err != nil {
+			log.Printf("Error requeuing the reservations of consumer %s: %v\n", consumer, err)
+			continue
+		}
+		if s.verbose {
+			log.Printf("Consumer %s missed its heartbeats, requeued %d reservations", consumer, requeued)
+		}
+	}
+}
+
 func (s *Server) Start(addr string, ready chan<- struct{}) error {
 	mux := http.NewServeMux() // custom ServeMux
 
 	mux.Handle("/enqueue", s.apiKeyMiddleware(http.HandlerFunc(s.EnqueueHandler)))
 	mux.Handle("/dequeue", s.apiKeyMiddleware(http.HandlerFunc(s.DequeueHandler)))
 	mux.Handle("/reserve", s.apiKeyMiddleware(http.HandlerFunc(s.DequeueWithReservationHandler)))
+	mux.Handle("/reserve_batch", s.apiKeyMiddleware(http.HandlerFunc(s.DequeueWithReservationBatchHandler)))
 	mux.Handle("/confirm/", s.apiKeyMiddleware(http.HandlerFunc(s.ConfirmReservationHandler)))
+	mux.Handle("/confirm_batch", s.apiKeyMiddleware(http.HandlerFunc(s.ConfirmReservationBatchHandler)))
+	mux.Handle("/release/", s.apiKeyMiddleware(http.HandlerFunc(s.ReleaseReservationHandler)))
+	mux.Handle("/extend/", s.apiKeyMiddleware(http.HandlerFunc(s.ExtendReservationHandler)))
+	mux.Handle("/reservations", s.apiKeyMiddleware(http.HandlerFunc(s.ReservationsHandler)))
+	mux.Handle("/consumers", s.apiKeyMiddleware(http.HandlerFunc(s.ConsumersHandler)))
+	mux.Handle("/heartbeat", s.apiKeyMiddleware(http.HandlerFunc(s.HeartbeatHandler)))
+	mux.Handle("/tx", s.apiKeyMiddleware(http.HandlerFunc(s.TxHandler)))
+	mux.Handle("/stats", s.apiKeyMiddleware(http.HandlerFunc(s.StatsHandler)))
+	mux.Handle("/publish", s.apiKeyMiddleware(http.HandlerFunc(s.PublishHandler)))
+	mux.Handle("/subscriptions", s.apiKeyMiddleware(http.HandlerFunc(s.SubscriptionsHandler)))
 	mux.Handle("/reset", s.apiKeyMiddleware(http.HandlerFunc(s.ResetHandler)))
 	mux.Handle("/size", s.apiKeyMiddleware(http.HandlerFunc(s.SizeHandler)))
+	mux.Handle("/items/", s.apiKeyMiddleware(http.HandlerFunc(s.ItemsHandler)))
+	mux.Handle("/pause", s.apiKeyMiddleware(http.HandlerFunc(s.PauseHandler)))
+	mux.Handle("/resume", s.apiKeyMiddleware(http.HandlerFunc(s.ResumeHandler)))
+	mux.Handle("/paused", s.apiKeyMiddleware(http.HandlerFunc(s.PausedHandler)))
+	mux.Handle("/channels", s.apiKeyMiddleware(http.HandlerFunc(s.ChannelsHandler)))
+	mux.Handle("/repartition", s.apiKeyMiddleware(http.HandlerFunc(s.RepartitionHandler)))
+	mux.Handle("/routes", s.apiKeyMiddleware(http.HandlerFunc(s.RoutesHandler)))
+	mux.Handle("/schemas", s.apiKeyMiddleware(http.HandlerFunc(s.SchemasHandler)))
 	mux.HandleFunc("/swagger.json", s.ServeSwagger)
 	mux.HandleFunc("/swagger-ui/", s.ServeSwaggerUi)
 
+	baseCtx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
 	s.server = &http.Server{
-		Addr:    addr,
-		Handler: mux,
+		Addr:        addr,
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
 	}
 
 	// Signal ready
@@ -424,7 +2028,9 @@ func (s *Server) Start(addr string, ready chan<- struct{}) error {
 	return nil
 }
 
+// Shutdown stops the server gracefully, operations still in flight when ctx is done are cancelled.
 func (s *Server) Shutdown(ctx context.Context) error {
+	defer s.cancel()
 	return s.server.Shutdown(ctx)
 }
 
@@ -1,13 +1,16 @@
 package sqlpqueue
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/jnsoft/jngo/pqueue"
+	"github.com/jnsoft/jnq/src/keyring"
 	"github.com/jnsoft/jnq/src/priorityqueue"
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -15,23 +18,157 @@ import (
 const (
 	defaultTable            = "QueueItems"
 	defaultConnectionString = "queue.db"
+	depsSuffix              = "_Deps"
+	resultsSuffix           = "_Results"
+	pausedSuffix            = "_Paused"
+	subscriptionsSuffix     = "_Subscriptions"
+	statsSuffix             = "_Stats"
+	finishedSuffix          = "_Finished"
+	channelsSuffix          = "_Channels"
+	fenceSuffix             = "_Fence" // last fencing token, kept by ResetQueue so tokens never repeat
+	cursorsSuffix           = "_Cursors"
+	routesSuffix            = "_Routes"
+	schemasSuffix           = "_Schemas"
 	createTableSQL          = `
-        CREATE TABLE IF NOT EXISTS %s (
+        CREATE TABLE IF NOT EXISTS %[1]s (
             Id INTEGER PRIMARY KEY AUTOINCREMENT,
             Prio DOUBLE NOT NULL,
             Obj TEXT NOT NULL,
 			Channel INTEGER NOT NULL,
             NotBefore INTEGER NOT NULL,
+			NotBeforeNs INTEGER NOT NULL DEFAULT 0,
 			Reserved INTEGER NOT NULL,
-			ReservedId TEXT NULL
+			ReservedId TEXT NULL,
+			ItemId TEXT NULL,
+			Blocked INTEGER NOT NULL DEFAULT 0,
+			ReplyTo INTEGER NULL,
+			CorrelationId TEXT NULL,
+			Attributes TEXT NULL,
+			EnqueuedAt INTEGER NULL,
+			ReservedAt INTEGER NULL,
+			Attempts INTEGER NOT NULL DEFAULT 0,
+			ExpiredAt INTEGER NULL,
+			Deadline INTEGER NULL,
+			CoalesceKey TEXT NULL,
+			Consumer TEXT NULL,
+			Token INTEGER NULL,
+			Tenant TEXT NULL,
+			KeyId TEXT NULL, -- key Obj is encrypted with, if any
+			PartitionHash INTEGER NULL -- hash of the partition key, or of the ItemId for items without a key
+        );
+        CREATE TABLE IF NOT EXISTS %[1]s_Deps (
+            ItemId TEXT NOT NULL,
+            ParentId TEXT NOT NULL
+        );
+        CREATE TABLE IF NOT EXISTS %[1]s_Results (
+            ItemId TEXT PRIMARY KEY,
+            Result TEXT NOT NULL,
+            Expires INTEGER NOT NULL, -- unix nanoseconds
+            KeyId TEXT NULL -- key Result is encrypted with, if any
+        );
+        CREATE TABLE IF NOT EXISTS %[1]s_Paused (
+            Channel INTEGER PRIMARY KEY
+        );
+        CREATE TABLE IF NOT EXISTS %[1]s_Subscriptions (
+            Topic TEXT NOT NULL,
+            Channel INTEGER NOT NULL,
+            PRIMARY KEY (Topic, Channel)
+        );
+        CREATE TABLE IF NOT EXISTS %[1]s_Stats (
+            Channel INTEGER PRIMARY KEY,
+            Enqueued INTEGER NOT NULL DEFAULT 0,
+            Dequeued INTEGER NOT NULL DEFAULT 0,
+            Confirmed INTEGER NOT NULL DEFAULT 0,
+            Requeued INTEGER NOT NULL DEFAULT 0
+        );
+        CREATE TABLE IF NOT EXISTS %[1]s_Finished (
+            ItemId TEXT PRIMARY KEY,
+            Status TEXT NOT NULL,
+            Channel INTEGER NOT NULL,
+            Attempts INTEGER NOT NULL,
+            EnqueuedAt INTEGER NULL,
+            FinishedAt INTEGER NOT NULL
+        );
+        CREATE INDEX IF NOT EXISTS %[1]s_Finished_FinishedAt ON %[1]s_Finished (FinishedAt);
+        CREATE TABLE IF NOT EXISTS %[1]s_Channels (
+            Channel INTEGER PRIMARY KEY,
+            Config TEXT NOT NULL
+        );
+        CREATE TABLE IF NOT EXISTS %[1]s_Cursors (
+            Channel INTEGER PRIMARY KEY,
+            Tenant TEXT NOT NULL
+        );
+        CREATE TABLE IF NOT EXISTS %[1]s_Routes (
+            Id INTEGER PRIMARY KEY AUTOINCREMENT,
+            Name TEXT NOT NULL UNIQUE,
+            Rule TEXT NOT NULL
+        );
+        CREATE TABLE IF NOT EXISTS %[1]s_Schemas (
+            Channel INTEGER NOT NULL,
+            Version INTEGER NOT NULL,
+            Schema TEXT NOT NULL,
+            CreatedAt INTEGER NOT NULL,
+            PRIMARY KEY (Channel, Version)
+        );
+        CREATE TABLE IF NOT EXISTS %[1]s_Fence (
+            Id INTEGER PRIMARY KEY CHECK (Id = 1),
+            Token INTEGER NOT NULL
         );`
-	selectSQL = "SELECT * FROM %s WHERE Reserved = 0 and Channel = ? and NotBefore <= ? ORDER BY Prio %s LIMIT 1"
+	// created after the migrations, which may add the indexed columns
+	createIndexSQL = `
+        CREATE UNIQUE INDEX IF NOT EXISTS %[1]s_CoalesceKey ON %[1]s (Channel, CoalesceKey) WHERE CoalesceKey IS NOT NULL;`
+	readyCondition = "Reserved = 0 and Blocked = 0 and Channel = ? and NotBeforeNs <= ?"
 )
 
+// tables kept next to the queue table, named <table><suffix>
+var auxSuffixes = []string{depsSuffix, resultsSuffix, pausedSuffix, subscriptionsSuffix, statsSuffix, finishedSuffix, channelsSuffix, cursorsSuffix, routesSuffix, schemasSuffix}
+
+// columns added after the first release, added to existing tables by initDb
+// together with the update filling them in for existing rows, if any
+var migrations = []struct {
+	column     string
+	definition string
+	update     string
+}{
+	{"ItemId", "TEXT NULL", ""},
+	{"Blocked", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"ReplyTo", "INTEGER NULL", ""},
+	{"CorrelationId", "TEXT NULL", ""},
+	{"Attributes", "TEXT NULL", ""},
+	{"EnqueuedAt", "INTEGER NULL", ""}, // unix nanoseconds
+	{"ReservedAt", "INTEGER NULL", ""}, // unix nanoseconds
+	// NotBefore holds unix seconds, NotBeforeNs the same time in nanoseconds, 0 for the zero time
+	{"NotBeforeNs", "INTEGER NOT NULL DEFAULT 0", "UPDATE %s SET NotBeforeNs = CASE WHEN NotBefore > 0 THEN NotBefore * 1000000000 ELSE 0 END"},
+	{"Attempts", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"ExpiredAt", "INTEGER NULL", ""}, // unix nanoseconds
+	{"Deadline", "INTEGER NULL", ""},  // unix nanoseconds
+	{"CoalesceKey", "TEXT NULL", ""},
+	{"Consumer", "TEXT NULL", ""},
+	{"Token", "INTEGER NULL", ""},
+	{"Tenant", "TEXT NULL", ""},
+	{"KeyId", "TEXT NULL", ""}, // key Obj is encrypted with, if any
+	// hash of the partition key, or of the ItemId for items without a key, set for existing rows by backfillPartitions
+	{"PartitionHash", "INTEGER NULL", ""},
+}
+
 type SqLitePQueue struct {
 	connectionString string
 	table            string
 	isMinQueue       bool
+	retention        time.Duration // how long finished items are kept in the _Finished table
+	keyring          *keyring.Keyring
+	observers        priorityqueue.Observers
+}
+
+// queryer is implemented by *sql.DB and *eventTx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// eventTx is a transaction collecting the events notified once it has been committed.
+type eventTx struct {
+	*sql.Tx
+	events []priorityqueue.Event
 }
 
 func NewSqLitePQueue(connectionString, table string, isMinQueue bool) *SqLitePQueue {
@@ -45,32 +182,105 @@ func NewSqLitePQueue(connectionString, table string, isMinQueue bool) *SqLitePQu
 		connectionString: connectionString,
 		table:            table,
 		isMinQueue:       isMinQueue,
+		retention:        priorityqueue.DEFAULT_STATUS_RETENTION,
 	}
 	pq.initDb()
 	return pq
 }
 
+// SetStatusRetention sets how long the status of completed and deleted items is kept, 0 keeps none.
+func (pq *SqLitePQueue) SetStatusRetention(retention time.Duration) {
+	pq.retention = retention
+}
+
+// SetKeyring sets the keys payloads of channels with Encrypt set are encrypted with, see priorityqueue.ChannelConfig.
+// Encrypted payloads are stored in the Obj column as base64 text, with the id of their key in the KeyId column.
+func (pq *SqLitePQueue) SetKeyring(k *keyring.Keyring) {
+	pq.keyring = k
+}
+
+// Subscribe adds an observer called with the events of every transaction once it has been committed.
+// Only operations through this SqLitePQueue are observed, not other users of the database.
+func (pq *SqLitePQueue) Subscribe(observer func(priorityqueue.Event)) func() {
+	return pq.observers.Subscribe(observer)
+}
+
+func (pq *SqLitePQueue) beginTx(ctx context.Context, db *sql.DB) (*eventTx, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &eventTx{Tx: tx}, nil
+}
+
+// commit commits the transaction and notifies its events.
+func (pq *SqLitePQueue) commit(tx *eventTx) {
+	if tx.Commit() == nil {
+		pq.observers.Notify(tx.events...)
+	}
+}
+
+// record adds an event to the events of the transaction.
+func (tx *eventTx) record(eventType string, channel int, itemId string, prio float64) {
+	tx.events = append(tx.events, priorityqueue.Event{Type: eventType, Channel: channel, ItemId: itemId, Prio: prio, Time: time.Now()})
+}
+
 func (pq *SqLitePQueue) Enqueue(obj string, prio float64, channel int, notBefore time.Time) error {
+	return pq.EnqueueContext(context.Background(), obj, prio, channel, notBefore)
+}
+
+func (pq *SqLitePQueue) EnqueueContext(ctx context.Context, obj string, prio float64, channel int, notBefore time.Time) error {
+	_, err := pq.EnqueueWithOptionsContext(ctx, obj, prio, channel, notBefore, priorityqueue.EnqueueOptions{})
+	return err
+}
+
+func (pq *SqLitePQueue) EnqueueWithOptions(obj string, prio float64, channel int, notBefore time.Time, opts priorityqueue.EnqueueOptions) (string, error) {
+	return pq.EnqueueWithOptionsContext(context.Background(), obj, prio, channel, notBefore, opts)
+}
+
+// EnqueueWithOptionsContext enqueues an item and returns its item ID.
+// Items with unfinished dependencies are stored with a non-zero Blocked count.
+func (pq *SqLitePQueue) EnqueueWithOptionsContext(ctx context.Context, obj string, prio float64, channel int, notBefore time.Time, opts priorityqueue.EnqueueOptions) (string, error) {
 	db, err := sql.Open("sqlite3", pq.connectionString)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer db.Close()
 
-	nb := notBefore.Unix()
-	insertSQL := fmt.Sprintf("INSERT INTO %s (Prio, Obj, Channel, NotBefore, Reserved) VALUES (?, ?, ?, ?, ?)", pq.table)
-	_, err = db.Exec(insertSQL, prio, obj, channel, nb, 0)
-	return err
+	tx, err := pq.beginTx(ctx, db)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			pq.commit(tx)
+		}
+	}()
+
+	itemId, err := pq.enqueue(ctx, tx, obj, prio, channel, notBefore, opts)
+	if err != nil {
+		return "", err
+	}
+	return itemId, nil
 }
 
 func (pq *SqLitePQueue) Dequeue(channel int) (string, error) {
+	return pq.DequeueContext(context.Background(), channel)
+}
+
+func (pq *SqLitePQueue) DequeueContext(ctx context.Context, channel int) (string, error) {
+	if err := priorityqueue.ValidateChannel(channel); err != nil {
+		return "", err
+	}
 	db, err := sql.Open("sqlite3", pq.connectionString)
 	if err != nil {
 		return "", err
 	}
 	defer db.Close()
 
-	tx, err := db.Begin()
+	tx, err := pq.beginTx(ctx, db)
 	if err != nil {
 		return "", err
 	}
@@ -78,233 +288,2166 @@ func (pq *SqLitePQueue) Dequeue(channel int) (string, error) {
 		if err != nil {
 			tx.Rollback()
 		} else {
-			tx.Commit()
+			pq.commit(tx)
 		}
 	}()
 
-	order := "ASC"
-	if !pq.isMinQueue {
-		order = "DESC"
+	paused, err := pq.isPaused(ctx, tx, channel)
+	if err != nil {
+		return "", err
+	}
+	if paused {
+		return "", priorityqueue.ErrEmpty
 	}
 
-	selectSQL := fmt.Sprintf(selectSQL, pq.table, order)
-	row := tx.QueryRow(selectSQL, channel, time.Now().Unix())
+	var config priorityqueue.ChannelConfig
+	config, err = pq.prepareChannel(ctx, tx, channel)
+	if err != nil {
+		return "", err
+	}
+	var ready []readyItem
+	ready, err = pq.selectReady(ctx, tx, channel, config, priorityqueue.Filter{}, nil, 1)
+	if err != nil {
+		return "", err
+	}
+	if len(ready) == 0 {
+		err = priorityqueue.ErrEmpty
+		return "", err
+	}
+	id, obj, itemId, prio := ready[0].id, ready[0].obj, ready[0].itemId, ready[0].prio
+	err = pq.served(ctx, tx, channel, config, ready)
+	if err != nil {
+		return "", err
+	}
 
-	var id int
-	var prio float64
-	var obj string
-	var notBefore int64
-	var reserved int
-	var reservedId sql.NullString
-	err = row.Scan(&id, &prio, &obj, &channel, &notBefore, &reserved, &reservedId)
-	if err == sql.ErrNoRows {
-		return "", errors.New(pqueue.EMPTY_QUEUE)
-	} else if err != nil {
+	err = pq.finish(ctx, tx, priorityqueue.STATUS_COMPLETED, "Id = ?", id)
+	if err != nil {
 		return "", err
 	}
 
 	deleteSQL := fmt.Sprintf("DELETE FROM %s WHERE Id = ?", pq.table)
-	_, err = tx.Exec(deleteSQL, id)
+	_, err = tx.ExecContext(ctx, deleteSQL, id)
 	if err != nil {
 		return "", err
 	}
 
-	return obj, nil
+	err = pq.count(ctx, tx, channel, "Dequeued", 1)
+	if err != nil {
+		return "", err
+	}
+	tx.record(priorityqueue.EVENT_DEQUEUE, channel, itemId.String, prio)
 
-	/*
-		hasItem, id, item, err := pq.peek(channel)
+	if itemId.Valid {
+		err = pq.complete(ctx, tx, itemId.String)
 		if err != nil {
 			return "", err
 		}
-		if hasItem {
-			deleteSQL := fmt.Sprintf("DELETE FROM %s WHERE Id = ?", pq.table)
-			_, err = db.Exec(deleteSQL, id)
-			if err != nil {
-				return "", err
-			}
-			return item, nil
+	}
+
+	return obj, nil
+}
+
+func (pq *SqLitePQueue) Delete(itemId string) (bool, error) {
+	return pq.DeleteContext(context.Background(), itemId)
+}
+
+// DeleteContext removes an unfinished item, whether it is ready, scheduled, blocked or reserved.
+// Items depending on the deleted item are deleted as well.
+func (pq *SqLitePQueue) DeleteContext(ctx context.Context, itemId string) (bool, error) {
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	tx, err := pq.beginTx(ctx, db)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			pq.commit(tx)
 		}
-		return "", errors.New(pqueue.EMPTY_QUEUE)
-	*/
+	}()
+
+	deleted, err := pq.delete(ctx, tx, itemId)
+	if err != nil {
+		return false, err
+	}
+	return deleted, nil
 }
 
 func (pq *SqLitePQueue) DequeueWithReservation(channel int) (string, string, error) {
+	return pq.DequeueWithReservationContext(context.Background(), channel)
+}
+
+func (pq *SqLitePQueue) DequeueWithReservationContext(ctx context.Context, channel int) (string, string, error) {
+	return pq.DequeueWithReservationFilteredContext(ctx, channel, priorityqueue.Filter{})
+}
+
+func (pq *SqLitePQueue) DequeueWithReservationFiltered(channel int, filter priorityqueue.Filter) (string, string, error) {
+	return pq.DequeueWithReservationFilteredContext(context.Background(), channel, filter)
+}
+
+// DequeueWithReservationFilteredContext reserves the highest-priority item matching the filter,
+// using json_extract on the Attributes column and the payload.
+func (pq *SqLitePQueue) DequeueWithReservationFilteredContext(ctx context.Context, channel int, filter priorityqueue.Filter) (string, string, error) {
+	obj, reservation, err := pq.DequeueWithReservationOptionsContext(ctx, channel, priorityqueue.ReserveOptions{Filter: filter})
+	return obj, reservation.ReservationId, err
+}
+
+func (pq *SqLitePQueue) DequeueWithReservationOptions(channel int, opts priorityqueue.ReserveOptions) (string, priorityqueue.Reservation, error) {
+	return pq.DequeueWithReservationOptionsContext(context.Background(), channel, opts)
+}
+
+// DequeueWithReservationOptionsContext reserves the highest-priority item matching the filter of opts
+// and stores the consumer of opts, if any, as the owner of the reservation.
+// The reservation gets the next fencing token, counted in the _Fence table.
+func (pq *SqLitePQueue) DequeueWithReservationOptionsContext(ctx context.Context, channel int, opts priorityqueue.ReserveOptions) (string, priorityqueue.Reservation, error) {
+	items, err := pq.DequeueWithReservationBatchContext(ctx, channel, 1, opts)
+	if err != nil {
+		return "", priorityqueue.Reservation{}, err
+	}
+	return items[0].Value, items[0].Reservation, nil
+}
+
+func (pq *SqLitePQueue) DequeueWithReservationBatch(channel int, n int, opts priorityqueue.ReserveOptions) ([]priorityqueue.ReservedItem, error) {
+	return pq.DequeueWithReservationBatchContext(context.Background(), channel, n, opts)
+}
+
+// DequeueWithReservationBatchContext reserves up to n items matching the filter of opts, highest priority first,
+// in a single transaction. Returns ErrEmpty if no item is available.
+func (pq *SqLitePQueue) DequeueWithReservationBatchContext(ctx context.Context, channel int, n int, opts priorityqueue.ReserveOptions) ([]priorityqueue.ReservedItem, error) {
+	filter := opts.Filter
+	if err := priorityqueue.ValidateChannel(channel); err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, fmt.Errorf("%w: batch size must be positive", priorityqueue.ErrInvalidArgument)
+	}
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+
 	db, err := sql.Open("sqlite3", pq.connectionString)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 	defer db.Close()
 
-	tx, err := db.Begin()
+	tx, err := pq.beginTx(ctx, db)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 	defer func() {
 		if err != nil {
 			tx.Rollback()
 		} else {
-			tx.Commit()
+			pq.commit(tx)
 		}
 	}()
 
-	order := "ASC"
-	if !pq.isMinQueue {
-		order = "DESC"
+	paused, err := pq.isPaused(ctx, tx, channel)
+	if err != nil {
+		return nil, err
 	}
-	selectSQL := fmt.Sprintf(selectSQL, pq.table, order)
-	row := tx.QueryRow(selectSQL, channel, time.Now().Unix())
-
-	var id int
-	var obj string
-	err = row.Scan(&id, &obj)
-	if err == sql.ErrNoRows {
-		return "", "", errors.New(pqueue.EMPTY_QUEUE)
-	} else if err != nil {
-		return "", "", err
+	if paused {
+		err = priorityqueue.ErrEmpty
+		return nil, err
 	}
 
-	reservationId := uuid.New().String()
-	updateSQL := fmt.Sprintf("UPDATE %s SET Reserved = 1, ReservedId = ? WHERE Id = ?", pq.table)
-	_, err = tx.Exec(updateSQL, reservationId, id)
+	var config priorityqueue.ChannelConfig
+	config, err = pq.prepareChannel(ctx, tx, channel)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Partition != nil {
+		err = config.ValidatePartition(*opts.Partition)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var selected []readyItem
+	selected, err = pq.selectReady(ctx, tx, channel, config, filter, opts.Partition, n)
+	if err != nil {
+		return nil, err
+	}
+	if len(selected) == 0 {
+		err = priorityqueue.ErrEmpty
+		return nil, err
+	}
+	err = pq.served(ctx, tx, channel, config, selected)
 	if err != nil {
-		return "", "", err
+		return nil, err
+	}
+
+	var consumer any
+	if opts.Consumer != "" {
+		consumer = opts.Consumer
 	}
 
-	return obj, reservationId, nil
+	now := time.Now()
+	updateSQL := fmt.Sprintf("UPDATE %s SET Reserved = 1, ReservedId = ?, ReservedAt = ?, Attempts = Attempts + 1, ExpiredAt = NULL, CoalesceKey = NULL, Consumer = ?, Token = ? WHERE Id = ?", pq.table)
+	reserved := make([]priorityqueue.ReservedItem, 0, len(selected))
+	for _, r := range selected {
+		var token int64
+		token, err = pq.nextToken(ctx, tx)
+		if err != nil {
+			return nil, err
+		}
+		reservation := priorityqueue.Reservation{
+			ReservationId: uuid.New().String(),
+			ItemId:        r.itemId.String,
+			Channel:       channel,
+			Consumer:      opts.Consumer,
+			ReservedAt:    now,
+			Token:         token,
+		}
+		_, err = tx.ExecContext(ctx, updateSQL, reservation.ReservationId, now.UnixNano(), consumer, token, r.id)
+		if err != nil {
+			return nil, err
+		}
+		tx.record(priorityqueue.EVENT_RESERVE, channel, r.itemId.String, r.prio)
+		reserved = append(reserved, priorityqueue.ReservedItem{Value: r.obj, Reservation: reservation})
+	}
 
+	err = pq.count(ctx, tx, channel, "Dequeued", len(reserved))
+	if err != nil {
+		return nil, err
+	}
+	return reserved, nil
 }
 
 func (pq *SqLitePQueue) ConfirmReservation(reservationId string) (bool, error) {
+	return pq.ConfirmReservationContext(context.Background(), reservationId)
+}
+
+func (pq *SqLitePQueue) ConfirmReservationContext(ctx context.Context, reservationId string) (bool, error) {
+	return pq.ConfirmReservationWithResultContext(ctx, reservationId, "", 0)
+}
+
+func (pq *SqLitePQueue) ConfirmReservationWithResult(reservationId string, result string, ttl time.Duration) (bool, error) {
+	return pq.ConfirmReservationWithResultContext(context.Background(), reservationId, result, ttl)
+}
+
+// ConfirmReservationWithResultContext confirms a reservation and stores a non-empty result
+// against the item id, retrievable with GetResult until the ttl has passed.
+// If the item was enqueued with a reply channel, the result is also enqueued there as a reply.
+func (pq *SqLitePQueue) ConfirmReservationWithResultContext(ctx context.Context, reservationId string, result string, ttl time.Duration) (bool, error) {
+	return pq.ConfirmReservationAsContext(ctx, reservationId, priorityqueue.ReservationClaim{}, result, ttl)
+}
+
+func (pq *SqLitePQueue) ConfirmReservationAs(reservationId string, claim priorityqueue.ReservationClaim, result string, ttl time.Duration) (bool, error) {
+	return pq.ConfirmReservationAsContext(context.Background(), reservationId, claim, result, ttl)
+}
+
+// ConfirmReservationAsContext confirms a reservation like ConfirmReservationWithResultContext,
+// returning ErrNotOwner if the reservation is owned by another consumer than the claim's.
+func (pq *SqLitePQueue) ConfirmReservationAsContext(ctx context.Context, reservationId string, claim priorityqueue.ReservationClaim, result string, ttl time.Duration) (bool, error) {
 	db, err := sql.Open("sqlite3", pq.connectionString)
 	if err != nil {
 		return false, err
 	}
 	defer db.Close()
 
-	deleteSQL := fmt.Sprintf("DELETE FROM %s WHERE Reserved = 1 and ReservedId = ?", pq.table)
-	res, err := db.Exec(deleteSQL, reservationId)
-
+	tx, err := pq.beginTx(ctx, db)
 	if err != nil {
 		return false, err
 	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			pq.commit(tx)
+		}
+	}()
 
-	rowsAffected, err := res.RowsAffected()
+	confirmed, err := pq.confirm(ctx, tx, reservationId, claim, result, ttl)
+	if err == nil && !confirmed {
+		err = priorityqueue.ErrReservationNotFound
+	}
 	if err != nil {
 		return false, err
 	}
-	return rowsAffected > 0, nil
+	return true, nil
 }
 
-func (pq *SqLitePQueue) RequeueExpiredReservations(timeout time.Duration) (int, error) {
+func (pq *SqLitePQueue) ConfirmReservationBatch(reservationIds []string, claim priorityqueue.ReservationClaim) ([]error, error) {
+	return pq.ConfirmReservationBatchContext(context.Background(), reservationIds, claim)
+}
+
+// ConfirmReservationBatchContext confirms many reservations in a single transaction.
+// The outcome is reported per reservation, nil or the error ConfirmReservationAs would return,
+// the claim applies to every reservation.
+func (pq *SqLitePQueue) ConfirmReservationBatchContext(ctx context.Context, reservationIds []string, claim priorityqueue.ReservationClaim) ([]error, error) {
 	db, err := sql.Open("sqlite3", pq.connectionString)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	defer db.Close()
 
-	requeueTime := time.Now().Add(-timeout).Unix()
-	requeueSQL := fmt.Sprintf("UPDATE %s SET Reserved = 0, ReservedId = NULL WHERE Reserved = 1 AND NotBefore <= ?", pq.table)
-	res, err := db.Exec(requeueSQL, requeueTime)
+	tx, err := pq.beginTx(ctx, db)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	rowsAffected, err := res.RowsAffected()
-	if err != nil {
-		return 0, err
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			pq.commit(tx)
+		}
+	}()
+
+	results := make([]error, len(reservationIds))
+	for i, reservationId := range reservationIds {
+		var confirmed bool
+		confirmed, err = pq.confirm(ctx, tx, reservationId, claim, "", 0)
+		if errors.Is(err, priorityqueue.ErrNotOwner) || errors.Is(err, priorityqueue.ErrStaleToken) {
+			results[i], err = err, nil
+		} else if err != nil {
+			return nil, err
+		} else if !confirmed {
+			results[i] = priorityqueue.ErrReservationNotFound
+		}
 	}
-	return int(rowsAffected), nil
+	return results, nil
 }
 
-func (pq *SqLitePQueue) Size(channel int) (int, error) {
-	db, err := sql.Open("sqlite3", pq.connectionString)
-	if err != nil {
-		return 0, err
-	}
-	defer db.Close()
+func (pq *SqLitePQueue) ReleaseReservation(reservationId string) (bool, error) {
+	return pq.ReleaseReservationContext(context.Background(), reservationId)
+}
 
-	countSQL := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE Reserved = 0 and Channel = ? and NotBefore <= ?", pq.table)
-	row := db.QueryRow(countSQL, channel, time.Now().Unix())
-	var count int
-	err = row.Scan(&count)
-	return count, err
+// ReleaseReservationContext returns a reserved item to its channel without waiting for the reservation to expire.
+func (pq *SqLitePQueue) ReleaseReservationContext(ctx context.Context, reservationId string) (bool, error) {
+	return pq.ReleaseReservationAsContext(ctx, reservationId, priorityqueue.ReservationClaim{})
 }
 
-func (pq *SqLitePQueue) IsEmpty(channel int) (bool, error) {
+func (pq *SqLitePQueue) ReleaseReservationAs(reservationId string, claim priorityqueue.ReservationClaim) (bool, error) {
+	return pq.ReleaseReservationAsContext(context.Background(), reservationId, claim)
+}
+
+// ReleaseReservationAsContext releases a reservation like ReleaseReservationContext,
+// returning ErrNotOwner if the reservation is owned by another consumer than the claim's.
+func (pq *SqLitePQueue) ReleaseReservationAsContext(ctx context.Context, reservationId string, claim priorityqueue.ReservationClaim) (bool, error) {
 	db, err := sql.Open("sqlite3", pq.connectionString)
 	if err != nil {
 		return false, err
 	}
 	defer db.Close()
 
-	checkSQL := fmt.Sprintf("SELECT 1 FROM %s WHERE Reserved = 0 and Channel = ? and NotBefore <= ? LIMIT 1", pq.table)
-	row := db.QueryRow(checkSQL, channel, time.Now().Unix())
-	var exists int
-	err = row.Scan(&exists)
-	if err == sql.ErrNoRows {
-		return true, nil
+	tx, err := pq.beginTx(ctx, db)
+	if err != nil {
+		return false, err
 	}
-	return false, err
-}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			pq.commit(tx)
+		}
+	}()
 
-func (pq *SqLitePQueue) Peek(channel int) (string, error) {
-	hasItem, _, item, err := pq.peek(channel)
-	if !hasItem {
-		return "", errors.New(pqueue.EMPTY_QUEUE)
+	released, err := pq.release(ctx, tx, reservationId, claim)
+	if err == nil && !released {
+		err = priorityqueue.ErrReservationNotFound
 	}
-	return item, err
-}
-
-func (pq *SqLitePQueue) ResetQueue() error {
-	db, err := sql.Open("sqlite3", pq.connectionString)
 	if err != nil {
-		return err
+		return false, err
 	}
-	defer db.Close()
+	return true, nil
+}
 
-	resetSQL := fmt.Sprintf("DROP TABLE IF EXISTS %s; %s", pq.table, fmt.Sprintf(createTableSQL, pq.table))
-	_, err = db.Exec(resetSQL)
-	return err
+func (pq *SqLitePQueue) ExtendReservation(reservationId string, claim priorityqueue.ReservationClaim) (bool, error) {
+	return pq.ExtendReservationContext(context.Background(), reservationId, claim)
 }
 
-func (pq *SqLitePQueue) peek(channel int) (bool, int, string, error) {
+// ExtendReservationContext restarts the timeout of a reservation, as if the item was reserved now.
+func (pq *SqLitePQueue) ExtendReservationContext(ctx context.Context, reservationId string, claim priorityqueue.ReservationClaim) (bool, error) {
 	db, err := sql.Open("sqlite3", pq.connectionString)
 	if err != nil {
-		return false, 0, "", err
+		return false, err
 	}
 	defer db.Close()
 
-	order := "ASC"
-	if !pq.isMinQueue {
-		order = "DESC"
+	tx, err := pq.beginTx(ctx, db)
+	if err != nil {
+		return false, err
 	}
-	selectSQL := fmt.Sprintf(selectSQL, pq.table, order)
-	row := db.QueryRow(selectSQL, channel, time.Now().Unix())
-	var id int
-	var prio float64
-	var obj string
-	var ch int
-	var notBefore int64
-	var reserved int
-	var reservedId sql.NullString
-	err = row.Scan(&id, &prio, &obj, &ch, &notBefore, &reserved, &reservedId)
-	if err == sql.ErrNoRows {
-		return false, 0, "", nil
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			pq.commit(tx)
+		}
+	}()
+
+	err = pq.checkOwner(ctx, tx, reservationId, claim)
+	if err != nil {
+		return false, err
+	}
+	extendSQL := fmt.Sprintf("UPDATE %s SET ReservedAt = ? WHERE Reserved = 1 and ReservedId = ?", pq.table)
+	_, err = tx.ExecContext(ctx, extendSQL, time.Now().UnixNano(), reservationId)
+	if err != nil {
+		return false, err
 	}
-	return true, id, obj, err
+	return true, nil
 }
 
-func (pq *SqLitePQueue) initDb() {
+func (pq *SqLitePQueue) Reservations() (map[string][]priorityqueue.Reservation, error) {
+	return pq.ReservationsContext(context.Background())
+}
+
+// ReservationsContext returns the current reservations grouped by consumer, oldest first.
+// Reservations made without a consumer are listed under "".
+func (pq *SqLitePQueue) ReservationsContext(ctx context.Context) (map[string][]priorityqueue.Reservation, error) {
 	db, err := sql.Open("sqlite3", pq.connectionString)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer db.Close()
 
-	createTable := fmt.Sprintf(createTableSQL, pq.table)
-	_, err = db.Exec(createTable)
+	selectSQL := fmt.Sprintf("SELECT ReservedId, ItemId, Channel, Consumer, ReservedAt, Token FROM %s WHERE Reserved = 1 ORDER BY ReservedAt", pq.table)
+	rows, err := db.QueryContext(ctx, selectSQL)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	reservations := make(map[string][]priorityqueue.Reservation)
+	for rows.Next() {
+		var reservation priorityqueue.Reservation
+		var itemId, consumer sql.NullString
+		var reservedAt, token sql.NullInt64
+		if err := rows.Scan(&reservation.ReservationId, &itemId, &reservation.Channel, &consumer, &reservedAt, &token); err != nil {
+			return nil, err
+		}
+		reservation.Token = token.Int64
+		reservation.ItemId = itemId.String
+		reservation.Consumer = consumer.String
+		reservation.ReservedAt = fromUnixNano(reservedAt)
+		reservations[reservation.Consumer] = append(reservations[reservation.Consumer], reservation)
+	}
+	return reservations, rows.Err()
+}
+
+// checkOwner returns ErrReservationNotFound for an unknown reservation and ErrNotOwner
+// or ErrStaleToken unless the claim may act on it.
+func (pq *SqLitePQueue) checkOwner(ctx context.Context, tx *eventTx, reservationId string, claim priorityqueue.ReservationClaim) error {
+	var consumer sql.NullString
+	var token sql.NullInt64
+	selectSQL := fmt.Sprintf("SELECT Consumer, Token FROM %s WHERE Reserved = 1 and ReservedId = ?", pq.table)
+	err := tx.QueryRowContext(ctx, selectSQL, reservationId).Scan(&consumer, &token)
+	if err == sql.ErrNoRows {
+		return priorityqueue.ErrReservationNotFound
+	} else if err != nil {
+		return err
+	}
+	return claim.Check(consumer.String, token.Int64)
+}
+
+// nextToken increments and returns the fencing token.
+func (pq *SqLitePQueue) nextToken(ctx context.Context, tx *eventTx) (int64, error) {
+	var token int64
+	fenceSQL := fmt.Sprintf("INSERT INTO %s%s (Id, Token) VALUES (1, 1) ON CONFLICT(Id) DO UPDATE SET Token = Token + 1 RETURNING Token", pq.table, fenceSuffix)
+	err := tx.QueryRowContext(ctx, fenceSQL).Scan(&token)
+	return token, err
+}
+
+func (pq *SqLitePQueue) ApplyTransaction(ops []priorityqueue.TxOp) ([]string, error) {
+	return pq.ApplyTransactionContext(context.Background(), ops)
+}
+
+// ApplyTransactionContext applies enqueue, confirm, release and delete operations all-or-nothing in one SQL transaction.
+// The transaction is rolled back if any operation fails or refers to an unknown reservation or item.
+// Returns the ids of the enqueued items, aligned with ops.
+func (pq *SqLitePQueue) ApplyTransactionContext(ctx context.Context, ops []priorityqueue.TxOp) ([]string, error) {
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	tx, err := pq.beginTx(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			pq.commit(tx)
+		}
+	}()
+
+	itemIds := make([]string, len(ops))
+	for i, op := range ops {
+		ok := true
+		switch op.Op {
+		case priorityqueue.TX_ENQUEUE:
+			if op.Options.CoalesceKey != "" {
+				err = fmt.Errorf("%w: coalescing is not supported in transactions", priorityqueue.ErrInvalidArgument)
+				return nil, err
+			}
+			itemIds[i], err = pq.enqueue(ctx, tx, op.Obj, op.Prio, op.Channel, op.NotBefore, op.Options)
+		case priorityqueue.TX_CONFIRM:
+			ok, err = pq.confirm(ctx, tx, op.ReservationId, op.Claim, op.Result, op.ResultTTL)
+		case priorityqueue.TX_RELEASE:
+			ok, err = pq.release(ctx, tx, op.ReservationId, op.Claim)
+		case priorityqueue.TX_DELETE:
+			if ok, err = pq.delete(ctx, tx, op.ItemId); err == nil && !ok {
+				err = priorityqueue.ErrItemNotFound
+			}
+		default:
+			err = fmt.Errorf("%w: unknown transaction operation %q", priorityqueue.ErrInvalidArgument, op.Op)
+		}
+		if err == nil && !ok {
+			err = priorityqueue.ErrReservationNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return itemIds, nil
+}
+
+func (pq *SqLitePQueue) GetResult(itemId string) (string, bool, error) {
+	return pq.GetResultContext(context.Background(), itemId)
+}
+
+// GetResultContext returns the result stored for an item, and whether one exists.
+func (pq *SqLitePQueue) GetResultContext(ctx context.Context, itemId string) (string, bool, error) {
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return "", false, err
+	}
+	defer db.Close()
+
+	selectSQL := fmt.Sprintf("SELECT Result, KeyId FROM %s%s WHERE ItemId = ? and Expires > ?", pq.table, resultsSuffix)
+	var result string
+	var keyId sql.NullString
+	err = db.QueryRowContext(ctx, selectSQL, itemId, time.Now().UnixNano()).Scan(&result, &keyId)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	result, err = pq.open(result, keyId)
+	if err != nil {
+		return "", false, err
+	}
+	return result, true, nil
+}
+
+func (pq *SqLitePQueue) GetStatus(itemId string) (priorityqueue.ItemStatus, error) {
+	return pq.GetStatusContext(context.Background(), itemId)
+}
+
+// GetStatusContext returns the status of an unfinished item, or of a finished item within the retention period.
+func (pq *SqLitePQueue) GetStatusContext(ctx context.Context, itemId string) (priorityqueue.ItemStatus, error) {
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return priorityqueue.ItemStatus{}, err
+	}
+	defer db.Close()
+
+	now := time.Now()
+	var status priorityqueue.ItemStatus
+	var reserved, blocked int
+	var notBefore int64
+	var enqueuedAt, reservedAt, expiredAt, deadline sql.NullInt64
+	selectSQL := fmt.Sprintf("SELECT Channel, Reserved, Blocked, NotBeforeNs, Attempts, EnqueuedAt, ReservedAt, ExpiredAt, Deadline FROM %s WHERE ItemId = ?", pq.table)
+	err = db.QueryRowContext(ctx, selectSQL, itemId).Scan(&status.Channel, &reserved, &blocked, &notBefore, &status.Attempts, &enqueuedAt, &reservedAt, &expiredAt, &deadline)
+	if err == nil {
+		status.EnqueuedAt = fromUnixNano(enqueuedAt)
+		status.Deadline = fromUnixNano(deadline)
+		status.ReservedAt = fromUnixNano(reservedAt)
+		status.ExpiredAt = fromUnixNano(expiredAt)
+		if notBefore > 0 {
+			status.NotBefore = time.Unix(0, notBefore)
+		}
+		switch {
+		case reserved != 0:
+			status.Status = priorityqueue.STATUS_RESERVED
+		case blocked > 0:
+			status.Status = priorityqueue.STATUS_BLOCKED
+		case notBefore > now.UnixNano():
+			status.Status = priorityqueue.STATUS_SCHEDULED
+		case expiredAt.Valid:
+			status.Status = priorityqueue.STATUS_EXPIRED
+		default:
+			status.Status = priorityqueue.STATUS_PENDING
+		}
+		return status, nil
+	} else if err != sql.ErrNoRows {
+		return priorityqueue.ItemStatus{}, err
+	}
+
+	var finishedAt int64
+	finishedSQL := fmt.Sprintf("SELECT Status, Channel, Attempts, EnqueuedAt, FinishedAt FROM %s%s WHERE ItemId = ? and FinishedAt > ?", pq.table, finishedSuffix)
+	err = db.QueryRowContext(ctx, finishedSQL, itemId, now.Add(-pq.retention).UnixNano()).Scan(&status.Status, &status.Channel, &status.Attempts, &enqueuedAt, &finishedAt)
+	if err == sql.ErrNoRows {
+		return priorityqueue.ItemStatus{}, priorityqueue.ErrItemNotFound
+	} else if err != nil {
+		return priorityqueue.ItemStatus{}, err
+	}
+	status.EnqueuedAt = fromUnixNano(enqueuedAt)
+	status.FinishedAt = time.Unix(0, finishedAt)
+	return status, nil
+}
+
+func (pq *SqLitePQueue) PauseChannel(channel int) error {
+	return pq.PauseChannelContext(context.Background(), channel)
+}
+
+// PauseChannelContext stops Dequeue and DequeueWithReservation from serving a channel until it is resumed.
+// Enqueue and requeueing of expired reservations are not affected.
+func (pq *SqLitePQueue) PauseChannelContext(ctx context.Context, channel int) error {
+	if err := priorityqueue.ValidateChannel(channel); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	pauseSQL := fmt.Sprintf("INSERT OR IGNORE INTO %s%s (Channel) VALUES (?)", pq.table, pausedSuffix)
+	_, err = db.ExecContext(ctx, pauseSQL, channel)
+	return err
+}
+
+func (pq *SqLitePQueue) ResumeChannel(channel int) error {
+	return pq.ResumeChannelContext(context.Background(), channel)
+}
+
+// ResumeChannelContext resumes a paused channel.
+func (pq *SqLitePQueue) ResumeChannelContext(ctx context.Context, channel int) error {
+	if err := priorityqueue.ValidateChannel(channel); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	resumeSQL := fmt.Sprintf("DELETE FROM %s%s WHERE Channel = ?", pq.table, pausedSuffix)
+	_, err = db.ExecContext(ctx, resumeSQL, channel)
+	return err
+}
+
+func (pq *SqLitePQueue) PausedChannels() ([]int, error) {
+	return pq.PausedChannelsContext(context.Background())
+}
+
+// PausedChannelsContext returns the paused channels in ascending order.
+func (pq *SqLitePQueue) PausedChannelsContext(ctx context.Context) ([]int, error) {
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT Channel FROM %s%s ORDER BY Channel", pq.table, pausedSuffix))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	channels := []int{}
+	for rows.Next() {
+		var channel int
+		if err := rows.Scan(&channel); err != nil {
+			return nil, err
+		}
+		channels = append(channels, channel)
+	}
+	return channels, rows.Err()
+}
+
+func (pq *SqLitePQueue) Stats() (map[int]priorityqueue.ChannelStats, error) {
+	return pq.StatsContext(context.Background())
+}
+
+// StatsContext returns the statistics of every channel holding items or with non-zero counters.
+func (pq *SqLitePQueue) StatsContext(ctx context.Context) (map[int]priorityqueue.ChannelStats, error) {
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	now := time.Now()
+	stats := make(map[int]priorityqueue.ChannelStats)
+
+	// an item is ready since it was enqueued or since its not-before time, whichever is later
+	itemsSQL := fmt.Sprintf(`SELECT Channel,
+			SUM(Reserved = 0 and Blocked = 0 and NotBeforeNs <= ?),
+			SUM(Reserved = 0 and Blocked = 0 and NotBeforeNs > ?),
+			SUM(Reserved = 1),
+			SUM(Reserved = 0 and Blocked > 0),
+			SUM(Deadline IS NOT NULL and Deadline < ?),
+			MIN(CASE WHEN Reserved = 0 and Blocked = 0 and NotBeforeNs <= ? THEN MAX(COALESCE(EnqueuedAt, 0), NotBeforeNs) END),
+			MIN(CASE WHEN Reserved = 1 THEN ReservedAt END)
+		FROM %s GROUP BY Channel`, pq.table)
+	rows, err := db.QueryContext(ctx, itemsSQL, now.UnixNano(), now.UnixNano(), now.UnixNano(), now.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var channel int
+		var channelStats priorityqueue.ChannelStats
+		var readySince sql.NullInt64
+		var reservedAt sql.NullInt64
+		if err := rows.Scan(&channel, &channelStats.Ready, &channelStats.Scheduled, &channelStats.Reserved, &channelStats.Blocked, &channelStats.Overdue, &readySince, &reservedAt); err != nil {
+			return nil, err
+		}
+		if readySince.Valid && readySince.Int64 > 0 {
+			channelStats.OldestReadyAge = now.Sub(time.Unix(0, readySince.Int64)).Seconds()
+		}
+		if reservedAt.Valid {
+			channelStats.OldestReservationAge = now.Sub(time.Unix(0, reservedAt.Int64)).Seconds()
+		}
+		stats[channel] = channelStats
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tenantsSQL := fmt.Sprintf("SELECT Channel, Tenant, COUNT(*) FROM %s WHERE Tenant IS NOT NULL and Reserved = 0 and Blocked = 0 and NotBeforeNs <= ? GROUP BY Channel, Tenant", pq.table)
+	tenantRows, err := db.QueryContext(ctx, tenantsSQL, now.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer tenantRows.Close()
+	for tenantRows.Next() {
+		var channel, ready int
+		var tenant string
+		if err := tenantRows.Scan(&channel, &tenant, &ready); err != nil {
+			return nil, err
+		}
+		channelStats := stats[channel]
+		if channelStats.Tenants == nil {
+			channelStats.Tenants = make(map[string]int)
+		}
+		channelStats.Tenants[tenant] = ready
+		stats[channel] = channelStats
+	}
+	if err := tenantRows.Err(); err != nil {
+		return nil, err
+	}
+
+	configs, err := pq.channelConfigs(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	partitionsSQL := fmt.Sprintf("SELECT COALESCE(PartitionHash, 0) %% ?, COUNT(*) FROM %s WHERE %s GROUP BY 1", pq.table, readyCondition)
+	for channel, config := range configs {
+		channelStats := stats[channel]
+		if config.Partitions == 0 || channelStats.Ready == 0 {
+			continue
+		}
+		channelStats.Partitions = make([]int, config.Partitions)
+		partitionRows, err := db.QueryContext(ctx, partitionsSQL, config.Partitions, channel, now.UnixNano())
+		if err != nil {
+			return nil, err
+		}
+		for partitionRows.Next() {
+			var partition, ready int
+			if err := partitionRows.Scan(&partition, &ready); err != nil {
+				partitionRows.Close()
+				return nil, err
+			}
+			channelStats.Partitions[partition] = ready
+		}
+		partitionRows.Close()
+		if err := partitionRows.Err(); err != nil {
+			return nil, err
+		}
+		stats[channel] = channelStats
+	}
+
+	countersSQL := fmt.Sprintf("SELECT Channel, Enqueued, Dequeued, Confirmed, Requeued FROM %s%s", pq.table, statsSuffix)
+	counterRows, err := db.QueryContext(ctx, countersSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer counterRows.Close()
+	for counterRows.Next() {
+		var channel int
+		var counters priorityqueue.ChannelCounters
+		if err := counterRows.Scan(&channel, &counters.Enqueued, &counters.Dequeued, &counters.Confirmed, &counters.Requeued); err != nil {
+			return nil, err
+		}
+		channelStats := stats[channel]
+		channelStats.ChannelCounters = counters
+		stats[channel] = channelStats
+	}
+	return stats, counterRows.Err()
+}
+
+func (pq *SqLitePQueue) SetChannelConfig(channel int, config priorityqueue.ChannelConfig) error {
+	return pq.SetChannelConfigContext(context.Background(), channel, config)
+}
+
+// SetChannelConfigContext sets the config of a channel, the zero config restores the default.
+func (pq *SqLitePQueue) SetChannelConfigContext(ctx context.Context, channel int, config priorityqueue.ChannelConfig) error {
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := pq.beginTx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			pq.commit(tx)
+		}
+	}()
+
+	var configs map[int]priorityqueue.ChannelConfig
+	configs, err = pq.channelConfigs(ctx, tx)
+	if err != nil {
+		return err
+	}
+	err = priorityqueue.ValidateChannelConfig(channel, config, configs)
+	if err != nil {
+		return err
+	}
+	if config.Encrypt && pq.keyring == nil {
+		err = fmt.Errorf("%w: encryption requires a keyring", priorityqueue.ErrInvalidArgument)
+		return err
+	}
+	config.Partitions = configs[channel].Partitions
+	err = pq.storeConfig(ctx, tx, channel, config)
+	return err
+}
+
+func (pq *SqLitePQueue) RepartitionChannel(channel int, partitions int) error {
+	return pq.RepartitionChannelContext(context.Background(), channel, partitions)
+}
+
+// RepartitionChannelContext changes the number of partitions of a channel, 0 removes the partitioning.
+// Items are rebalanced by the PartitionHash column, no rows are rewritten. The channel must be paused
+// and without reservations, so no consumer holds items assigned by the old partitioning.
+func (pq *SqLitePQueue) RepartitionChannelContext(ctx context.Context, channel int, partitions int) error {
+	if err := priorityqueue.ValidateChannel(channel); err != nil {
+		return err
+	}
+	if err := priorityqueue.ValidatePartitions(partitions); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := pq.beginTx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			pq.commit(tx)
+		}
+	}()
+
+	var paused bool
+	paused, err = pq.isPaused(ctx, tx, channel)
+	if err != nil {
+		return err
+	}
+	if !paused {
+		err = fmt.Errorf("%w: pause the channel before repartitioning it", priorityqueue.ErrInvalidArgument)
+		return err
+	}
+	var reserved int
+	err = tx.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE Channel = ? and Reserved = 1", pq.table), channel).Scan(&reserved)
+	if err != nil {
+		return err
+	}
+	if reserved > 0 {
+		err = fmt.Errorf("%w: the channel has outstanding reservations", priorityqueue.ErrInvalidArgument)
+		return err
+	}
+
+	var configs map[int]priorityqueue.ChannelConfig
+	configs, err = pq.channelConfigs(ctx, tx)
+	if err != nil {
+		return err
+	}
+	config := configs[channel]
+	config.Partitions = partitions
+	err = pq.storeConfig(ctx, tx, channel, config)
+	return err
+}
+
+// storeConfig writes the config of a channel, deleting it for the zero config.
+func (pq *SqLitePQueue) storeConfig(ctx context.Context, tx *eventTx, channel int, config priorityqueue.ChannelConfig) error {
+	if config == (priorityqueue.ChannelConfig{}) {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s%s WHERE Channel = ?", pq.table, channelsSuffix), channel)
+		return err
+	}
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT OR REPLACE INTO %s%s (Channel, Config) VALUES (?, ?)", pq.table, channelsSuffix), channel, string(encoded))
+	return err
+}
+
+func (pq *SqLitePQueue) SetRoutingRule(rule priorityqueue.RoutingRule) error {
+	return pq.SetRoutingRuleContext(context.Background(), rule)
+}
+
+// SetRoutingRuleContext adds a routing rule after the existing rules, or replaces the rule with the same name in place.
+func (pq *SqLitePQueue) SetRoutingRuleContext(ctx context.Context, rule priorityqueue.RoutingRule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	upsertSQL := fmt.Sprintf("INSERT INTO %s%s (Name, Rule) VALUES (?, ?) ON CONFLICT(Name) DO UPDATE SET Rule = excluded.Rule", pq.table, routesSuffix)
+	_, err = db.ExecContext(ctx, upsertSQL, rule.Name, string(encoded))
+	return err
+}
+
+func (pq *SqLitePQueue) DeleteRoutingRule(name string) (bool, error) {
+	return pq.DeleteRoutingRuleContext(context.Background(), name)
+}
+
+// DeleteRoutingRuleContext removes a routing rule, returns false if there is no rule with the name.
+func (pq *SqLitePQueue) DeleteRoutingRuleContext(ctx context.Context, name string) (bool, error) {
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	result, err := db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s%s WHERE Name = ?", pq.table, routesSuffix), name)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func (pq *SqLitePQueue) RoutingRules() ([]priorityqueue.RoutingRule, error) {
+	return pq.RoutingRulesContext(context.Background())
+}
+
+// RoutingRulesContext returns the routing rules in the order they are evaluated.
+func (pq *SqLitePQueue) RoutingRulesContext(ctx context.Context) ([]priorityqueue.RoutingRule, error) {
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT Rule FROM %s%s ORDER BY Id", pq.table, routesSuffix))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []priorityqueue.RoutingRule{}
+	for rows.Next() {
+		var encoded string
+		if err := rows.Scan(&encoded); err != nil {
+			return nil, err
+		}
+		var rule priorityqueue.RoutingRule
+		if err := json.Unmarshal([]byte(encoded), &rule); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func (pq *SqLitePQueue) SetChannelSchema(channel int, schema priorityqueue.Schema) (int, error) {
+	return pq.SetChannelSchemaContext(context.Background(), channel, schema)
+}
+
+// SetChannelSchemaContext stores a new version of the schema of a channel and returns its version number.
+func (pq *SqLitePQueue) SetChannelSchemaContext(ctx context.Context, channel int, schema priorityqueue.Schema) (int, error) {
+	if err := priorityqueue.ValidateChannel(channel); err != nil {
+		return 0, err
+	}
+	if err := schema.Validate(); err != nil {
+		return 0, err
+	}
+	encoded, err := json.Marshal(schema)
+	if err != nil {
+		return 0, err
+	}
+
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	insertSQL := fmt.Sprintf("INSERT INTO %[1]s%[2]s (Channel, Version, Schema, CreatedAt) SELECT ?, COALESCE(MAX(Version), 0) + 1, ?, ? FROM %[1]s%[2]s WHERE Channel = ? RETURNING Version", pq.table, schemasSuffix)
+	var version int
+	err = db.QueryRowContext(ctx, insertSQL, channel, string(encoded), time.Now().UnixNano(), channel).Scan(&version)
+	return version, err
+}
+
+func (pq *SqLitePQueue) DeleteChannelSchema(channel int) (bool, error) {
+	return pq.DeleteChannelSchemaContext(context.Background(), channel)
+}
+
+// DeleteChannelSchemaContext removes all versions of the schema of a channel, returns false if it has none.
+func (pq *SqLitePQueue) DeleteChannelSchemaContext(ctx context.Context, channel int) (bool, error) {
+	if err := priorityqueue.ValidateChannel(channel); err != nil {
+		return false, err
+	}
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	result, err := db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s%s WHERE Channel = ?", pq.table, schemasSuffix), channel)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func (pq *SqLitePQueue) ChannelSchemas(channel int) ([]priorityqueue.SchemaVersion, error) {
+	return pq.ChannelSchemasContext(context.Background(), channel)
+}
+
+// ChannelSchemasContext returns the versions of the schema of a channel, oldest first.
+func (pq *SqLitePQueue) ChannelSchemasContext(ctx context.Context, channel int) ([]priorityqueue.SchemaVersion, error) {
+	if err := priorityqueue.ValidateChannel(channel); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return pq.channelSchemas(ctx, db, channel)
+}
+
+func (pq *SqLitePQueue) channelSchemas(ctx context.Context, q queryer, channel int) ([]priorityqueue.SchemaVersion, error) {
+	rows, err := q.QueryContext(ctx, fmt.Sprintf("SELECT Version, Schema, CreatedAt FROM %s%s WHERE Channel = ? ORDER BY Version", pq.table, schemasSuffix), channel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []priorityqueue.SchemaVersion{}
+	for rows.Next() {
+		version := priorityqueue.SchemaVersion{Channel: channel}
+		var encoded string
+		var createdAt int64
+		if err := rows.Scan(&version.Version, &encoded, &createdAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(encoded), &version.Schema); err != nil {
+			return nil, err
+		}
+		version.CreatedAt = time.Unix(0, createdAt).UTC()
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+func (pq *SqLitePQueue) ChannelConfigs() (map[int]priorityqueue.ChannelConfig, error) {
+	return pq.ChannelConfigsContext(context.Background())
+}
+
+// ChannelConfigsContext returns the config of every channel not using the default.
+func (pq *SqLitePQueue) ChannelConfigsContext(ctx context.Context) (map[int]priorityqueue.ChannelConfig, error) {
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return pq.channelConfigs(ctx, db)
+}
+
+func (pq *SqLitePQueue) channelConfigs(ctx context.Context, q queryer) (map[int]priorityqueue.ChannelConfig, error) {
+	rows, err := q.QueryContext(ctx, fmt.Sprintf("SELECT Channel, Config FROM %s%s", pq.table, channelsSuffix))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	configs := make(map[int]priorityqueue.ChannelConfig)
+	for rows.Next() {
+		var channel int
+		var encoded string
+		if err := rows.Scan(&channel, &encoded); err != nil {
+			return nil, err
+		}
+		var config priorityqueue.ChannelConfig
+		if err := json.Unmarshal([]byte(encoded), &config); err != nil {
+			return nil, err
+		}
+		configs[channel] = config
+	}
+	return configs, rows.Err()
+}
+
+// prepareChannel moves overdue items to their overdue channels and returns the config of the channel.
+func (pq *SqLitePQueue) prepareChannel(ctx context.Context, tx *eventTx, channel int) (priorityqueue.ChannelConfig, error) {
+	configs, err := pq.channelConfigs(ctx, tx)
+	if err != nil {
+		return priorityqueue.ChannelConfig{}, err
+	}
+
+	now := time.Now().UnixNano()
+	moveSQL := fmt.Sprintf("UPDATE %s SET Channel = ?, CoalesceKey = NULL WHERE Channel = ? and Reserved = 0 and Blocked = 0 and NotBeforeNs <= ? and Deadline < ?", pq.table)
+	for source, config := range configs {
+		if config.EDF && config.OverdueChannel != nil {
+			if _, err := tx.ExecContext(ctx, moveSQL, *config.OverdueChannel, source, now, now); err != nil {
+				return priorityqueue.ChannelConfig{}, err
+			}
+		}
+	}
+	return configs[channel], nil
+}
+
+// readyItem is a ready row selected by selectReady
+type readyItem struct {
+	id     int
+	obj    string // decrypted
+	itemId sql.NullString
+	prio   float64
+	tenant string
+	keyId  sql.NullString
+}
+
+// selectReady returns up to n ready items of a channel matching the filter and, if set, in the partition,
+// in the order they are served. Fair channels serve the tenants in rounds, each round takes the first item
+// of every tenant, starting with the tenant following the tenant served last.
+func (pq *SqLitePQueue) selectReady(ctx context.Context, q queryer, channel int, config priorityqueue.ChannelConfig, filter priorityqueue.Filter, partition *int, n int) ([]readyItem, error) {
+	conditions, filterArgs := filterSQL(filter)
+	args := append([]any{channel, time.Now().UnixNano()}, filterArgs...)
+	if partition != nil {
+		conditions += " and COALESCE(PartitionHash, 0) % ? = ?"
+		args = append(args, max(config.Partitions, 1), *partition)
+	}
+	order := pq.orderBy(config)
+
+	selectSQL := fmt.Sprintf("SELECT Id, Obj, ItemId, Prio, COALESCE(Tenant, ''), KeyId FROM %s WHERE %s%s ORDER BY %s LIMIT ?", pq.table, readyCondition, conditions, order)
+	if config.Fair {
+		var cursor sql.NullString
+		cursorSQL := fmt.Sprintf("SELECT Tenant FROM %s%s WHERE Channel = ?", pq.table, cursorsSuffix)
+		rows, err := q.QueryContext(ctx, cursorSQL, channel)
+		if err != nil {
+			return nil, err
+		}
+		if rows.Next() {
+			err = rows.Scan(&cursor)
+		}
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		selectSQL = fmt.Sprintf(`SELECT Id, Obj, ItemId, Prio, Tenant, KeyId FROM (
+				SELECT Id, Obj, ItemId, Prio, COALESCE(Tenant, '') AS Tenant, KeyId,
+					ROW_NUMBER() OVER (PARTITION BY COALESCE(Tenant, '') ORDER BY %s) AS Round
+				FROM %s WHERE %s%s)
+			ORDER BY Round, (? and Tenant <= ?), Tenant LIMIT ?`, order, pq.table, readyCondition, conditions)
+		args = append(args, cursor.Valid, cursor.String)
+	}
+
+	rows, err := q.QueryContext(ctx, selectSQL, append(args, n)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ready []readyItem
+	for rows.Next() {
+		var item readyItem
+		if err := rows.Scan(&item.id, &item.obj, &item.itemId, &item.prio, &item.tenant, &item.keyId); err != nil {
+			return nil, err
+		}
+		if item.obj, err = pq.open(item.obj, item.keyId); err != nil {
+			return nil, err
+		}
+		ready = append(ready, item)
+	}
+	return ready, rows.Err()
+}
+
+// checkSchema checks a payload enqueued to a channel against the latest version of the schema of the channel, if any.
+func (pq *SqLitePQueue) checkSchema(ctx context.Context, tx *eventTx, channel int, obj string) error {
+	versions, err := pq.channelSchemas(ctx, tx, channel)
+	if err != nil {
+		return err
+	}
+	return priorityqueue.CheckSchema(versions, obj)
+}
+
+// seal encrypts a payload enqueued to a channel with Encrypt set, returning the payload to store and the key id, if any.
+func (pq *SqLitePQueue) seal(ctx context.Context, tx *eventTx, channel int, obj string) (string, any, error) {
+	configs, err := pq.channelConfigs(ctx, tx)
+	if err != nil {
+		return "", nil, err
+	}
+	if !configs[channel].Encrypt {
+		return obj, nil, nil
+	}
+	if pq.keyring == nil {
+		return "", nil, fmt.Errorf("channel %d encrypts payloads but no keyring is set", channel)
+	}
+	return pq.keyring.Encrypt(obj)
+}
+
+// open decrypts a stored payload encrypted with the key keyId, if any.
+func (pq *SqLitePQueue) open(obj string, keyId sql.NullString) (string, error) {
+	if !keyId.Valid {
+		return obj, nil
+	}
+	if pq.keyring == nil {
+		return "", errors.New("payload is encrypted but no keyring is set")
+	}
+	return pq.keyring.Decrypt(obj, keyId.String)
+}
+
+// served moves the round-robin cursor of a fair channel past the tenant of the last served item.
+func (pq *SqLitePQueue) served(ctx context.Context, tx *eventTx, channel int, config priorityqueue.ChannelConfig, ready []readyItem) error {
+	if !config.Fair || len(ready) == 0 {
+		return nil
+	}
+	cursorSQL := fmt.Sprintf("INSERT OR REPLACE INTO %s%s (Channel, Tenant) VALUES (?, ?)", pq.table, cursorsSuffix)
+	_, err := tx.ExecContext(ctx, cursorSQL, channel, ready[len(ready)-1].tenant)
+	return err
+}
+
+// orderBy returns the ORDER BY clause of a channel, EDF channels sort NULL deadlines last.
+func (pq *SqLitePQueue) orderBy(config priorityqueue.ChannelConfig) string {
+	order := "Prio ASC"
+	if !pq.isMinQueue {
+		order = "Prio DESC"
+	}
+	if config.EDF {
+		order = "Deadline IS NULL, Deadline, " + order
+	}
+	return order
+}
+
+func (pq *SqLitePQueue) Publish(topic string, obj string, prio float64, notBefore time.Time, opts priorityqueue.EnqueueOptions) ([]string, error) {
+	return pq.PublishContext(context.Background(), topic, obj, prio, notBefore, opts)
+}
+
+// PublishContext enqueues a copy of the item to every channel subscribed to the topic, in one transaction.
+// Returns the ids of the copies, in the order of the subscribed channels.
+func (pq *SqLitePQueue) PublishContext(ctx context.Context, topic string, obj string, prio float64, notBefore time.Time, opts priorityqueue.EnqueueOptions) ([]string, error) {
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	tx, err := pq.beginTx(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			pq.commit(tx)
+		}
+	}()
+
+	var channels []int
+	channels, err = pq.subscribedChannels(ctx, tx, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	itemIds := make([]string, 0, len(channels))
+	for _, channel := range channels {
+		var itemId string
+		itemId, err = pq.enqueue(ctx, tx, obj, prio, channel, notBefore, opts)
+		if err != nil {
+			return nil, err
+		}
+		itemIds = append(itemIds, itemId)
+	}
+	return itemIds, nil
+}
+
+func (pq *SqLitePQueue) AddSubscription(topic string, channel int) error {
+	return pq.AddSubscriptionContext(context.Background(), topic, channel)
+}
+
+// AddSubscriptionContext subscribes a channel to a topic.
+func (pq *SqLitePQueue) AddSubscriptionContext(ctx context.Context, topic string, channel int) error {
+	if err := priorityqueue.ValidateChannel(channel); err != nil {
+		return err
+	}
+	if topic == "" {
+		return fmt.Errorf("%w: empty topic", priorityqueue.ErrInvalidArgument)
+	}
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	subscribeSQL := fmt.Sprintf("INSERT OR IGNORE INTO %s%s (Topic, Channel) VALUES (?, ?)", pq.table, subscriptionsSuffix)
+	_, err = db.ExecContext(ctx, subscribeSQL, topic, channel)
+	return err
+}
+
+func (pq *SqLitePQueue) RemoveSubscription(topic string, channel int) error {
+	return pq.RemoveSubscriptionContext(context.Background(), topic, channel)
+}
+
+// RemoveSubscriptionContext unsubscribes a channel from a topic.
+func (pq *SqLitePQueue) RemoveSubscriptionContext(ctx context.Context, topic string, channel int) error {
+	if err := priorityqueue.ValidateChannel(channel); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	unsubscribeSQL := fmt.Sprintf("DELETE FROM %s%s WHERE Topic = ? and Channel = ?", pq.table, subscriptionsSuffix)
+	_, err = db.ExecContext(ctx, unsubscribeSQL, topic, channel)
+	return err
+}
+
+func (pq *SqLitePQueue) Subscriptions() (map[string][]int, error) {
+	return pq.SubscriptionsContext(context.Background())
+}
+
+// SubscriptionsContext returns the subscribed channels of every topic.
+func (pq *SqLitePQueue) SubscriptionsContext(ctx context.Context) (map[string][]int, error) {
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT Topic, Channel FROM %s%s ORDER BY Topic, Channel", pq.table, subscriptionsSuffix))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := make(map[string][]int)
+	for rows.Next() {
+		var topic string
+		var channel int
+		if err := rows.Scan(&topic, &channel); err != nil {
+			return nil, err
+		}
+		subscriptions[topic] = append(subscriptions[topic], channel)
+	}
+	return subscriptions, rows.Err()
+}
+
+func (pq *SqLitePQueue) subscribedChannels(ctx context.Context, tx *eventTx, topic string) ([]int, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT Channel FROM %s%s WHERE Topic = ? ORDER BY Channel", pq.table, subscriptionsSuffix), topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channels []int
+	for rows.Next() {
+		var channel int
+		if err := rows.Scan(&channel); err != nil {
+			return nil, err
+		}
+		channels = append(channels, channel)
+	}
+	return channels, rows.Err()
+}
+
+func (pq *SqLitePQueue) isPaused(ctx context.Context, tx *eventTx, channel int) (bool, error) {
+	var paused int
+	err := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s%s WHERE Channel = ?", pq.table, pausedSuffix), channel).Scan(&paused)
+	return paused > 0, err
+}
+
+func (pq *SqLitePQueue) RequeueExpiredReservations(timeout time.Duration) (int, error) {
+	return pq.RequeueExpiredReservationsContext(context.Background(), timeout)
+}
+
+func (pq *SqLitePQueue) RequeueExpiredReservationsContext(ctx context.Context, timeout time.Duration) (int, error) {
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	tx, err := pq.beginTx(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			pq.commit(tx)
+		}
+	}()
+
+	// reservations made before ReservedAt existed fall back to the not-before time
+	requeueTime := time.Now().Add(-timeout)
+	var requeued int
+	requeued, err = pq.expire(ctx, tx, "COALESCE(ReservedAt, NotBeforeNs) <= ?", requeueTime.UnixNano())
+	return requeued, err
+}
+
+func (pq *SqLitePQueue) RequeueConsumerReservations(consumer string) (int, error) {
+	return pq.RequeueConsumerReservationsContext(context.Background(), consumer)
+}
+
+// RequeueConsumerReservationsContext expires all reservations of a consumer now, without waiting for their timeout.
+func (pq *SqLitePQueue) RequeueConsumerReservationsContext(ctx context.Context, consumer string) (int, error) {
+	if consumer == "" {
+		return 0, fmt.Errorf("%w: missing consumer", priorityqueue.ErrInvalidArgument)
+	}
+
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	tx, err := pq.beginTx(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			pq.commit(tx)
+		}
+	}()
+
+	var requeued int
+	requeued, err = pq.expire(ctx, tx, "Consumer = ?", consumer)
+	return requeued, err
+}
+
+// expire requeues the reservations matching condition as expired.
+func (pq *SqLitePQueue) expire(ctx context.Context, tx *eventTx, condition string, args ...any) (int, error) {
+	expiredCondition := "Reserved = 1 AND " + condition
+	countSQL := fmt.Sprintf(`INSERT INTO %[1]s%[2]s (Channel, Requeued) SELECT Channel, COUNT(*) FROM %[1]s WHERE %[3]s GROUP BY Channel
+		ON CONFLICT(Channel) DO UPDATE SET Requeued = Requeued + excluded.Requeued`, pq.table, statsSuffix, expiredCondition)
+	_, err := tx.ExecContext(ctx, countSQL, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	err = pq.collect(ctx, tx, priorityqueue.EVENT_EXPIRE, expiredCondition, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	requeueSQL := fmt.Sprintf("UPDATE %s SET Reserved = 0, ReservedId = NULL, ReservedAt = NULL, Consumer = NULL, ExpiredAt = ? WHERE %s", pq.table, expiredCondition)
+	res, err := tx.ExecContext(ctx, requeueSQL, append([]any{time.Now().UnixNano()}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(rowsAffected), nil
+}
+
+func (pq *SqLitePQueue) Size(channel int) (int, error) {
+	return pq.SizeContext(context.Background(), channel)
+}
+
+func (pq *SqLitePQueue) SizeContext(ctx context.Context, channel int) (int, error) {
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	countSQL := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE Reserved = 0 and Blocked = 0 and Channel = ? and NotBeforeNs <= ?", pq.table)
+	row := db.QueryRowContext(ctx, countSQL, channel, time.Now().UnixNano())
+	var count int
+	err = row.Scan(&count)
+	return count, err
+}
+
+func (pq *SqLitePQueue) IsEmpty(channel int) (bool, error) {
+	return pq.IsEmptyContext(context.Background(), channel)
+}
+
+func (pq *SqLitePQueue) IsEmptyContext(ctx context.Context, channel int) (bool, error) {
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	checkSQL := fmt.Sprintf("SELECT 1 FROM %s WHERE Reserved = 0 and Blocked = 0 and Channel = ? and NotBeforeNs <= ? LIMIT 1", pq.table)
+	row := db.QueryRowContext(ctx, checkSQL, channel, time.Now().UnixNano())
+	var exists int
+	err = row.Scan(&exists)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	return false, err
+}
+
+func (pq *SqLitePQueue) Peek(channel int) (string, error) {
+	return pq.PeekContext(context.Background(), channel)
+}
+
+func (pq *SqLitePQueue) PeekContext(ctx context.Context, channel int) (string, error) {
+	if err := priorityqueue.ValidateChannel(channel); err != nil {
+		return "", err
+	}
+	hasItem, _, item, err := pq.peek(ctx, channel)
+	if err != nil {
+		return "", err
+	}
+	if !hasItem {
+		return "", priorityqueue.ErrEmpty
+	}
+	return item, nil
+}
+
+func (pq *SqLitePQueue) ResetQueue() error {
+	return pq.ResetQueueContext(context.Background())
+}
+
+func (pq *SqLitePQueue) ResetQueueContext(ctx context.Context) error {
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	resetSQL := fmt.Sprintf("DROP TABLE IF EXISTS %s;", pq.table)
+	for _, suffix := range auxSuffixes {
+		resetSQL += fmt.Sprintf(" DROP TABLE IF EXISTS %s%s;", pq.table, suffix)
+	}
+	resetSQL += fmt.Sprintf(createTableSQL, pq.table)
+	resetSQL += fmt.Sprintf(createIndexSQL, pq.table)
+	_, err = db.ExecContext(ctx, resetSQL)
+	if err != nil {
+		return err
+	}
+	pq.observers.Notify(priorityqueue.Event{Type: priorityqueue.EVENT_RESET, Time: time.Now()})
+	return nil
+}
+
+// peek returns the item Dequeue would return next, moving overdue items first like Dequeue does.
+func (pq *SqLitePQueue) peek(ctx context.Context, channel int) (hasItem bool, id int, obj string, err error) {
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		return false, 0, "", err
+	}
+	defer db.Close()
+
+	tx, err := pq.beginTx(ctx, db)
+	if err != nil {
+		return false, 0, "", err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			pq.commit(tx)
+		}
+	}()
+
+	config, err := pq.prepareChannel(ctx, tx, channel)
+	if err != nil {
+		return false, 0, "", err
+	}
+	ready, err := pq.selectReady(ctx, tx, channel, config, priorityqueue.Filter{}, nil, 1)
+	if err != nil || len(ready) == 0 {
+		return false, 0, "", err
+	}
+	return true, ready[0].id, ready[0].obj, nil
+}
+
+func (pq *SqLitePQueue) initDb() {
+	db, err := sql.Open("sqlite3", pq.connectionString)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	createTable := fmt.Sprintf(createTableSQL, pq.table)
+	_, err = db.Exec(createTable)
+	if err != nil {
+		panic(err)
+	}
+
+	if err = pq.migrate(db); err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(fmt.Sprintf(createIndexSQL, pq.table))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// migrate adds columns missing from tables created by earlier versions.
+func (pq *SqLitePQueue) migrate(db *sql.DB) error {
+	existing, err := columns(db, pq.table)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if existing[strings.ToLower(m.column)] {
+			continue
+		}
+		if err := pq.addColumn(db, m.column, m.definition, m.update); err != nil {
+			return err
+		}
+	}
+	if err := pq.backfillPartitions(db); err != nil {
+		return err
+	}
+
+	// results stored by earlier versions expire in unix seconds, any time after 1970 in nanoseconds is larger
+	_, err = db.Exec(fmt.Sprintf("UPDATE %s%s SET Expires = Expires * 1000000000 WHERE Expires < 100000000000", pq.table, resultsSuffix))
+	if err != nil {
+		return err
+	}
+
+	// results stored by earlier versions are not encrypted
+	existing, err = columns(db, pq.table+resultsSuffix)
+	if err != nil {
+		return err
+	}
+	if !existing["keyid"] {
+		_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s%s ADD COLUMN KeyId TEXT NULL", pq.table, resultsSuffix))
+	}
+	return err
+}
+
+// columns returns the lower-cased names of the columns of a table.
+func columns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		existing[strings.ToLower(name)] = true
+	}
+	return existing, rows.Err()
+}
+
+// addColumn adds a column and fills it in for existing rows in one transaction.
+func (pq *SqLitePQueue) addColumn(db *sql.DB, column, definition, update string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", pq.table, column, definition))
+	if err != nil {
+		return err
+	}
+	if update != "" {
+		_, err = tx.Exec(fmt.Sprintf(update, pq.table))
+	}
+	return err
+}
+
+// backfillPartitions sets the partition hash of rows added before partitions existed to the hash of
+// their ItemId, as for items enqueued without a partition key. Rows without an ItemId stay in partition 0.
+func (pq *SqLitePQueue) backfillPartitions(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+
+	rows, err := tx.Query(fmt.Sprintf("SELECT Id, ItemId FROM %s WHERE PartitionHash IS NULL", pq.table))
+	if err != nil {
+		return err
+	}
+	hashes := make(map[int64]uint32)
+	for rows.Next() {
+		var id int64
+		var itemId sql.NullString
+		if err = rows.Scan(&id, &itemId); err != nil {
+			rows.Close()
+			return err
+		}
+		hashes[id] = 0
+		if itemId.Valid {
+			hashes[id] = priorityqueue.PartitionHash(itemId.String)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	updateSQL := fmt.Sprintf("UPDATE %s SET PartitionHash = ? WHERE Id = ?", pq.table)
+	for id, hash := range hashes {
+		if _, err = tx.Exec(updateSQL, hash, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unixNano converts a not-before time to the NotBeforeNs column, the zero time is stored as 0.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano converts a nullable nanosecond column to a time, NULL gives the zero time.
+func fromUnixNano(ns sql.NullInt64) time.Time {
+	if !ns.Valid {
+		return time.Time{}
+	}
+	return time.Unix(0, ns.Int64)
+}
+
+// enqueue inserts a new item, blocked while it has unfinished parents.
+func (pq *SqLitePQueue) enqueue(ctx context.Context, tx *eventTx, obj string, prio float64, channel int, notBefore time.Time, opts priorityqueue.EnqueueOptions) (string, error) {
+	if err := priorityqueue.ValidateChannel(channel); err != nil {
+		return "", err
+	}
+	if opts.ReplyTo != nil {
+		if err := priorityqueue.ValidateChannel(*opts.ReplyTo); err != nil {
+			return "", err
+		}
+	}
+	if err := priorityqueue.ValidateAttributes(opts.Attributes); err != nil {
+		return "", err
+	}
+	if err := pq.checkSchema(ctx, tx, channel, obj); err != nil {
+		return "", err
+	}
+	obj, keyId, err := pq.seal(ctx, tx, channel, obj)
+	if err != nil {
+		return "", err
+	}
+	if opts.CoalesceKey != "" {
+		itemId, ok, err := pq.coalesce(ctx, tx, obj, keyId, prio, channel, notBefore, opts)
+		if err != nil || ok {
+			return itemId, err
+		}
+	}
+	itemId := uuid.New().String()
+
+	var replyTo, correlationId any
+	if opts.ReplyTo != nil {
+		replyTo = *opts.ReplyTo
+		correlationId = opts.CorrelationId
+		if opts.CorrelationId == "" {
+			correlationId = itemId
+		}
+	}
+
+	blocked := 0
+	seen := make(map[string]bool)
+	existsSQL := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE ItemId = ?", pq.table)
+	depSQL := fmt.Sprintf("INSERT INTO %s%s (ItemId, ParentId) VALUES (?, ?)", pq.table, depsSuffix)
+	for _, parent := range opts.DependsOn {
+		if parent == "" || seen[parent] {
+			continue
+		}
+		seen[parent] = true
+
+		var exists int
+		err := tx.QueryRowContext(ctx, existsSQL, parent).Scan(&exists)
+		if err != nil {
+			return "", err
+		}
+		if exists == 0 {
+			continue // already completed
+		}
+		_, err = tx.ExecContext(ctx, depSQL, itemId, parent)
+		if err != nil {
+			return "", err
+		}
+		blocked++
+	}
+
+	var attributes any
+	if len(opts.Attributes) > 0 {
+		encoded, err := json.Marshal(opts.Attributes)
+		if err != nil {
+			return "", err
+		}
+		attributes = string(encoded)
+	}
+
+	partitionHash := priorityqueue.PartitionHash(itemId)
+	if opts.PartitionKey != "" {
+		partitionHash = priorityqueue.PartitionHash(opts.PartitionKey)
+	}
+
+	var deadline, coalesceKey, tenant any
+	if !opts.Deadline.IsZero() {
+		deadline = opts.Deadline.UnixNano()
+	}
+	if opts.CoalesceKey != "" {
+		coalesceKey = opts.CoalesceKey
+	}
+	if opts.Tenant != "" {
+		tenant = opts.Tenant
+	}
+
+	insertSQL := fmt.Sprintf("INSERT INTO %s (Prio, Obj, Channel, NotBefore, NotBeforeNs, Reserved, ItemId, Blocked, ReplyTo, CorrelationId, Attributes, EnqueuedAt, Deadline, CoalesceKey, Tenant, KeyId, PartitionHash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", pq.table)
+	_, err = tx.ExecContext(ctx, insertSQL, prio, obj, channel, notBefore.Unix(), unixNano(notBefore), 0, itemId, blocked, replyTo, correlationId, attributes, time.Now().UnixNano(), deadline, coalesceKey, tenant, keyId, partitionHash)
+	if err != nil {
+		return "", err
+	}
+
+	err = pq.count(ctx, tx, channel, "Enqueued", 1)
+	if err != nil {
+		return "", err
+	}
+	tx.record(priorityqueue.EVENT_ENQUEUE, channel, itemId, prio)
+	return itemId, nil
+}
+
+// coalesce replaces the payload of the pending item with the coalesce key of opts, if there is one.
+// Reserving an item clears its key, so every row with a key is pending.
+func (pq *SqLitePQueue) coalesce(ctx context.Context, tx *eventTx, obj string, keyId any, prio float64, channel int, notBefore time.Time, opts priorityqueue.EnqueueOptions) (string, bool, error) {
+	var itemId string
+	selectSQL := fmt.Sprintf("SELECT ItemId FROM %s WHERE Channel = ? and CoalesceKey = ?", pq.table)
+	err := tx.QueryRowContext(ctx, selectSQL, channel, opts.CoalesceKey).Scan(&itemId)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	set, args := "Obj = ?, KeyId = ?", []any{obj, keyId}
+	if opts.CoalescePrio {
+		set += ", Prio = ?"
+		args = append(args, prio)
+	}
+	if opts.CoalesceNotBefore {
+		set += ", NotBefore = ?, NotBeforeNs = ?"
+		args = append(args, notBefore.Unix(), unixNano(notBefore))
+	}
+	updateSQL := fmt.Sprintf("UPDATE %s SET %s WHERE ItemId = ?", pq.table, set)
+	_, err = tx.ExecContext(ctx, updateSQL, append(args, itemId)...)
+	if err != nil {
+		return "", false, err
+	}
+	return itemId, true, nil
+}
+
+// confirm deletes a reserved item, releases its dependents, stores the result and enqueues the reply, if any.
+func (pq *SqLitePQueue) confirm(ctx context.Context, tx *eventTx, reservationId string, claim priorityqueue.ReservationClaim, result string, ttl time.Duration) (bool, error) {
+	selectSQL := fmt.Sprintf("SELECT ItemId, Prio, Channel, ReplyTo, CorrelationId, Consumer, Token FROM %s WHERE Reserved = 1 and ReservedId = ?", pq.table)
+	var itemId, correlationId, consumer sql.NullString
+	var prio float64
+	var channel int
+	var replyTo, token sql.NullInt64
+	err := tx.QueryRowContext(ctx, selectSQL, reservationId).Scan(&itemId, &prio, &channel, &replyTo, &correlationId, &consumer, &token)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := claim.Check(consumer.String, token.Int64); err != nil {
+		return false, err
+	}
+
+	err = pq.finish(ctx, tx, priorityqueue.STATUS_COMPLETED, "Reserved = 1 and ReservedId = ?", reservationId)
+	if err != nil {
+		return false, err
+	}
+
+	deleteSQL := fmt.Sprintf("DELETE FROM %s WHERE Reserved = 1 and ReservedId = ?", pq.table)
+	_, err = tx.ExecContext(ctx, deleteSQL, reservationId)
+	if err != nil {
+		return false, err
+	}
+
+	err = pq.count(ctx, tx, channel, "Confirmed", 1)
+	if err != nil {
+		return false, err
+	}
+	tx.record(priorityqueue.EVENT_CONFIRM, channel, itemId.String, prio)
+
+	if itemId.Valid {
+		err = pq.complete(ctx, tx, itemId.String)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	now := time.Now()
+	expiredSQL := fmt.Sprintf("DELETE FROM %s%s WHERE Expires <= ?", pq.table, resultsSuffix)
+	_, err = tx.ExecContext(ctx, expiredSQL, now.UnixNano())
+	if err != nil {
+		return false, err
+	}
+
+	if result != "" && itemId.Valid {
+		value, keyId, err := pq.seal(ctx, tx, channel, result)
+		if err != nil {
+			return false, err
+		}
+		resultSQL := fmt.Sprintf("INSERT OR REPLACE INTO %s%s (ItemId, Result, Expires, KeyId) VALUES (?, ?, ?, ?)", pq.table, resultsSuffix)
+		_, err = tx.ExecContext(ctx, resultSQL, itemId.String, value, now.Add(ttl).UnixNano(), keyId)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if result != "" && replyTo.Valid {
+		replyId := uuid.New().String()
+		reply := priorityqueue.ReplyPayload(correlationId.String, result)
+		if err := pq.checkSchema(ctx, tx, int(replyTo.Int64), reply); err != nil {
+			return false, err
+		}
+		reply, keyId, err := pq.seal(ctx, tx, int(replyTo.Int64), reply)
+		if err != nil {
+			return false, err
+		}
+		replySQL := fmt.Sprintf("INSERT INTO %s (Prio, Obj, Channel, NotBefore, Reserved, ItemId, Blocked, EnqueuedAt, KeyId, PartitionHash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", pq.table)
+		_, err = tx.ExecContext(ctx, replySQL, prio, reply, replyTo.Int64, 0, 0, replyId, 0, now.UnixNano(), keyId, priorityqueue.PartitionHash(replyId))
+		if err != nil {
+			return false, err
+		}
+		err = pq.count(ctx, tx, int(replyTo.Int64), "Enqueued", 1)
+		if err != nil {
+			return false, err
+		}
+		tx.record(priorityqueue.EVENT_ENQUEUE, int(replyTo.Int64), replyId, prio)
+	}
+	return true, nil
+}
+
+func (pq *SqLitePQueue) release(ctx context.Context, tx *eventTx, reservationId string, claim priorityqueue.ReservationClaim) (bool, error) {
+	var channel int
+	var itemId, consumer sql.NullString
+	var prio float64
+	var token sql.NullInt64
+	err := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT Channel, ItemId, Prio, Consumer, Token FROM %s WHERE Reserved = 1 and ReservedId = ?", pq.table), reservationId).Scan(&channel, &itemId, &prio, &consumer, &token)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := claim.Check(consumer.String, token.Int64); err != nil {
+		return false, err
+	}
+
+	releaseSQL := fmt.Sprintf("UPDATE %s SET Reserved = 0, ReservedId = NULL, ReservedAt = NULL, Consumer = NULL WHERE Reserved = 1 and ReservedId = ?", pq.table)
+	_, err = tx.ExecContext(ctx, releaseSQL, reservationId)
+	if err != nil {
+		return false, err
+	}
+	tx.record(priorityqueue.EVENT_REQUEUE, channel, itemId.String, prio)
+	return true, pq.count(ctx, tx, channel, "Requeued", 1)
+}
+
+// finish keeps the status of the items matching condition, which are about to be removed,
+// and drops the statuses past the retention period.
+func (pq *SqLitePQueue) finish(ctx context.Context, tx *eventTx, status string, condition string, args ...any) error {
+	now := time.Now()
+	pruneSQL := fmt.Sprintf("DELETE FROM %s%s WHERE FinishedAt <= ?", pq.table, finishedSuffix)
+	if _, err := tx.ExecContext(ctx, pruneSQL, now.Add(-pq.retention).UnixNano()); err != nil {
+		return err
+	}
+	if pq.retention <= 0 {
+		return nil
+	}
+
+	finishSQL := fmt.Sprintf(`INSERT OR REPLACE INTO %[1]s%[2]s (ItemId, Status, Channel, Attempts, EnqueuedAt, FinishedAt)
+		SELECT ItemId, ?, Channel, Attempts, EnqueuedAt, ? FROM %[1]s WHERE ItemId IS NOT NULL and %[3]s`, pq.table, finishedSuffix, condition)
+	_, err := tx.ExecContext(ctx, finishSQL, append([]any{status, now.UnixNano()}, args...)...)
+	return err
+}
+
+// collect records an event for every item matching condition.
+func (pq *SqLitePQueue) collect(ctx context.Context, tx *eventTx, eventType string, condition string, args ...any) error {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT Channel, ItemId, Prio FROM %s WHERE %s", pq.table, condition), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var channel int
+		var itemId sql.NullString
+		var prio float64
+		if err := rows.Scan(&channel, &itemId, &prio); err != nil {
+			return err
+		}
+		tx.record(eventType, channel, itemId.String, prio)
+	}
+	return rows.Err()
+}
+
+// count adds n to a counter of the channel in the stats table.
+func (pq *SqLitePQueue) count(ctx context.Context, tx *eventTx, channel int, counter string, n int) error {
+	countSQL := fmt.Sprintf("INSERT INTO %[1]s%[2]s (Channel, %[3]s) VALUES (?, ?) ON CONFLICT(Channel) DO UPDATE SET %[3]s = %[3]s + excluded.%[3]s", pq.table, statsSuffix, counter)
+	_, err := tx.ExecContext(ctx, countSQL, channel, n)
+	return err
+}
+
+// delete removes an unfinished item and, recursively, the items depending on it.
+func (pq *SqLitePQueue) delete(ctx context.Context, tx *eventTx, itemId string) (bool, error) {
+	err := pq.finish(ctx, tx, priorityqueue.STATUS_DELETED, "ItemId = ?", itemId)
+	if err != nil {
+		return false, err
+	}
+	err = pq.collect(ctx, tx, priorityqueue.EVENT_DELETE, "ItemId = ?", itemId)
+	if err != nil {
+		return false, err
+	}
+
+	deleteSQL := fmt.Sprintf("DELETE FROM %s WHERE ItemId = ?", pq.table)
+	res, err := tx.ExecContext(ctx, deleteSQL, itemId)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if rowsAffected == 0 {
+		return false, nil
+	}
+
+	err = pq.deleteDependents(ctx, tx, itemId)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// complete releases the dependents of a completed item.
+func (pq *SqLitePQueue) complete(ctx context.Context, tx *eventTx, itemId string) error {
+	releaseSQL := fmt.Sprintf("UPDATE %[1]s SET Blocked = Blocked - 1 WHERE ItemId IN (SELECT ItemId FROM %[1]s%[2]s WHERE ParentId = ?)", pq.table, depsSuffix)
+	if _, err := tx.ExecContext(ctx, releaseSQL, itemId); err != nil {
+		return err
+	}
+	deleteSQL := fmt.Sprintf("DELETE FROM %s%s WHERE ParentId = ?", pq.table, depsSuffix)
+	_, err := tx.ExecContext(ctx, deleteSQL, itemId)
+	return err
+}
+
+// deleteDependents deletes, recursively, the items depending on a deleted item.
+func (pq *SqLitePQueue) deleteDependents(ctx context.Context, tx *eventTx, itemId string) error {
+	childrenSQL := fmt.Sprintf("SELECT ItemId FROM %s%s WHERE ParentId = ?", pq.table, depsSuffix)
+	depsSQL := fmt.Sprintf("DELETE FROM %s%s WHERE ParentId = ? OR ItemId = ?", pq.table, depsSuffix)
+	deleteSQL := fmt.Sprintf("DELETE FROM %s WHERE ItemId = ?", pq.table)
+
+	pending := []string{itemId}
+	for len(pending) > 0 {
+		id := pending[0]
+		pending = pending[1:]
+
+		rows, err := tx.QueryContext(ctx, childrenSQL, id)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var child string
+			if err := rows.Scan(&child); err != nil {
+				rows.Close()
+				return err
+			}
+			pending = append(pending, child)
+		}
+		rows.Close()
+
+		if _, err := tx.ExecContext(ctx, depsSQL, id, id); err != nil {
+			return err
+		}
+		if id != itemId {
+			if err := pq.finish(ctx, tx, priorityqueue.STATUS_DELETED, "ItemId = ?", id); err != nil {
+				return err
+			}
+			if err := pq.collect(ctx, tx, priorityqueue.EVENT_DELETE, "ItemId = ?", id); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, deleteSQL, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// filterSQL builds the conditions and arguments selecting items that match the filter.
+// Keys and paths are validated by the filter, json_valid keeps non-JSON payloads from failing the query.
+func filterSQL(filter priorityqueue.Filter) (string, []any) {
+	var conditions strings.Builder
+	var args []any
+	for key, value := range filter.Attributes {
+		conditions.WriteString(" and json_extract(Attributes, ?) = ?")
+		args = append(args, fmt.Sprintf("$.%q", key), value)
+	}
+	if filter.Path != "" {
+		conditions.WriteString(` and CASE WHEN json_valid(Obj) THEN
+			CASE json_type(Obj, ?) WHEN 'text' THEN json_extract(Obj, ?) WHEN 'integer' THEN CAST(json_extract(Obj, ?) AS TEXT)
+				WHEN 'real' THEN CAST(json_extract(Obj, ?) AS TEXT) WHEN 'true' THEN 'true' WHEN 'false' THEN 'false' END
+			END = ?`)
+		args = append(args, filter.Path, filter.Path, filter.Path, filter.Path, filter.Value)
 	}
+	return conditions.String(), args
 }
 
 // Ensure SqLitePQueue implements IPriorityQueue
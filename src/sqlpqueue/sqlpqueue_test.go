@@ -1,9 +1,17 @@
 package sqlpqueue
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/jnsoft/jnq/src/keyring"
+	"github.com/jnsoft/jnq/src/priorityqueue"
 	. "github.com/jnsoft/jnq/src/testhelper"
 )
 
@@ -111,4 +119,1151 @@ func TestPriorityQueue(t *testing.T) {
 		AssertNoError(t, err)
 		AssertEqual(t, item, "item2")
 	})
+
+	t.Run("dependencies", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+
+		idA, err := pq.EnqueueWithOptions("A", 1, channel, time.Now(), priorityqueue.EnqueueOptions{})
+		AssertNoError(t, err)
+		idB, err := pq.EnqueueWithOptions("B", 2, channel, time.Now(), priorityqueue.EnqueueOptions{})
+		AssertNoError(t, err)
+		_, err = pq.EnqueueWithOptions("C", 0, channel, time.Now(), priorityqueue.EnqueueOptions{DependsOn: []string{idA, idB, "unknown"}})
+		AssertNoError(t, err)
+
+		// C is blocked
+		size, err := pq.Size(channel)
+		AssertNoError(t, err)
+		AssertEqual(t, size, 2)
+
+		item, resA, err := pq.DequeueWithReservation(channel)
+		AssertNoError(t, err)
+		AssertEqual(t, item, "A")
+
+		ok, err := pq.ConfirmReservation(resA)
+		AssertNoError(t, err)
+		AssertTrue(t, ok)
+
+		item, err = pq.Dequeue(channel)
+		AssertNoError(t, err)
+		AssertEqual(t, item, "B")
+
+		item, err = pq.Dequeue(channel)
+		AssertNoError(t, err)
+		AssertEqual(t, item, "C")
+	})
+
+	t.Run("delete cascades to dependents", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+
+		idA, _ := pq.EnqueueWithOptions("A", 1, channel, time.Now(), priorityqueue.EnqueueOptions{})
+		idB, _ := pq.EnqueueWithOptions("B", 2, channel, time.Now(), priorityqueue.EnqueueOptions{DependsOn: []string{idA}})
+		pq.EnqueueWithOptions("C", 3, channel, time.Now(), priorityqueue.EnqueueOptions{DependsOn: []string{idB}})
+
+		deleted, err := pq.Delete(idA)
+		AssertNoError(t, err)
+		AssertTrue(t, deleted)
+
+		deleted, err = pq.Delete(idB)
+		AssertNoError(t, err)
+		AssertFalse(t, deleted)
+
+		isEmpty, err := pq.IsEmpty(channel)
+		AssertNoError(t, err)
+		AssertTrue(t, isEmpty)
+	})
+
+	t.Run("results", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+
+		id, err := pq.EnqueueWithOptions("job", 1, channel, time.Now(), priorityqueue.EnqueueOptions{})
+		AssertNoError(t, err)
+
+		_, found, err := pq.GetResult(id)
+		AssertNoError(t, err)
+		AssertFalse(t, found)
+
+		_, resId, err := pq.DequeueWithReservation(channel)
+		AssertNoError(t, err)
+		ok, err := pq.ConfirmReservationWithResult(resId, `{"answer":42}`, time.Minute)
+		AssertNoError(t, err)
+		AssertTrue(t, ok)
+
+		result, found, err := pq.GetResult(id)
+		AssertNoError(t, err)
+		AssertTrue(t, found)
+		AssertEqual(t, result, `{"answer":42}`)
+
+		// sub-second TTLs expire with the same precision as in memory
+		id, err = pq.EnqueueWithOptions("short", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+		AssertNoError(t, err)
+		_, resId, err = pq.DequeueWithReservation(channel)
+		AssertNoError(t, err)
+		ok, err = pq.ConfirmReservationWithResult(resId, "brief", 300*time.Millisecond)
+		AssertNoError(t, err)
+		AssertTrue(t, ok)
+		_, found, err = pq.GetResult(id)
+		AssertNoError(t, err)
+		AssertTrue(t, found)
+		time.Sleep(400 * time.Millisecond)
+		_, found, err = pq.GetResult(id)
+		AssertNoError(t, err)
+		AssertFalse(t, found)
+	})
+
+	t.Run("request reply", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+		replyChannel := channel + 1
+
+		id, err := pq.EnqueueWithOptions("request", 1, channel, time.Now(), priorityqueue.EnqueueOptions{ReplyTo: &replyChannel})
+		AssertNoError(t, err)
+		_, resId, err := pq.DequeueWithReservation(channel)
+		AssertNoError(t, err)
+		_, err = pq.ConfirmReservationWithResult(resId, "pong", time.Minute)
+		AssertNoError(t, err)
+
+		reply, err := pq.Dequeue(replyChannel)
+		AssertNoError(t, err)
+		AssertEqual(t, reply, priorityqueue.ReplyPayload(id, "pong"))
+	})
+
+	t.Run("pause and resume", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+
+		err := pq.Enqueue("item1", 1, channel, time.Now())
+		AssertNoError(t, err)
+
+		err = pq.PauseChannel(channel)
+		AssertNoError(t, err)
+		_, err = pq.Dequeue(channel)
+		AssertNotEqual(t, err, nil)
+		_, _, err = pq.DequeueWithReservation(channel)
+		AssertNotEqual(t, err, nil)
+
+		err = pq.Enqueue("item2", 2, channel, time.Now())
+		AssertNoError(t, err)
+
+		// paused state is stored in the database
+		paused, err := NewSqLitePQueue("", "", true).PausedChannels()
+		AssertNoError(t, err)
+		CollectionAssertEqual(t, paused, []int{channel})
+
+		err = pq.ResumeChannel(channel)
+		AssertNoError(t, err)
+		item, err := pq.Dequeue(channel)
+		AssertNoError(t, err)
+		AssertEqual(t, item, "item1")
+	})
+
+	t.Run("transactions", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+
+		err := pq.Enqueue("job", 1, channel, time.Now())
+		AssertNoError(t, err)
+		_, resId, err := pq.DequeueWithReservation(channel)
+		AssertNoError(t, err)
+
+		ops := []priorityqueue.TxOp{
+			{Op: priorityqueue.TX_CONFIRM, ReservationId: resId},
+			{Op: priorityqueue.TX_ENQUEUE, Obj: "followup1", Prio: 1, Channel: channel},
+			{Op: priorityqueue.TX_ENQUEUE, Obj: "followup2", Prio: 2, Channel: channel},
+		}
+		itemIds, err := pq.ApplyTransaction(ops)
+		AssertNoError(t, err)
+		AssertEqual(t, len(itemIds), 3)
+		size, err := pq.Size(channel)
+		AssertNoError(t, err)
+		AssertEqual(t, size, 2)
+
+		// the reservation is gone, so the transaction is rolled back
+		_, err = pq.ApplyTransaction(ops)
+		AssertNotEqual(t, err, nil)
+		size, err = pq.Size(channel)
+		AssertNoError(t, err)
+		AssertEqual(t, size, 2)
+
+		_, resId, err = pq.DequeueWithReservation(channel)
+		AssertNoError(t, err)
+		_, err = pq.ApplyTransaction([]priorityqueue.TxOp{
+			{Op: priorityqueue.TX_RELEASE, ReservationId: resId},
+			{Op: priorityqueue.TX_DELETE, ItemId: itemIds[2]},
+		})
+		AssertNoError(t, err)
+		item, err := pq.Dequeue(channel)
+		AssertNoError(t, err)
+		AssertEqual(t, item, "followup1")
+		isEmpty, err := pq.IsEmpty(channel)
+		AssertNoError(t, err)
+		AssertTrue(t, isEmpty)
+	})
+
+	t.Run("filtered reservation", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+
+		eu := priorityqueue.EnqueueOptions{Attributes: map[string]string{"region": "eu"}}
+		us := priorityqueue.EnqueueOptions{Attributes: map[string]string{"region": "us"}}
+		_, err := pq.EnqueueWithOptions(`{"type":"report","size":2}`, 1, channel, time.Now(), us)
+		AssertNoError(t, err)
+		_, err = pq.EnqueueWithOptions(`{"type":"invoice","size":3}`, 2, channel, time.Now(), eu)
+		AssertNoError(t, err)
+		_, err = pq.EnqueueWithOptions(`{"type":"report","size":1}`, 3, channel, time.Now(), eu)
+		AssertNoError(t, err)
+		err = pq.Enqueue("not json", 4, channel, time.Now())
+		AssertNoError(t, err)
+
+		filter := priorityqueue.Filter{Attributes: map[string]string{"region": "eu"}}
+		item, _, err := pq.DequeueWithReservationFiltered(channel, filter)
+		AssertNoError(t, err)
+		AssertEqual(t, item, `{"type":"invoice","size":3}`)
+
+		filter.Path, filter.Value = "$.type", "invoice"
+		_, _, err = pq.DequeueWithReservationFiltered(channel, filter)
+		AssertNotEqual(t, err, nil)
+
+		filter = priorityqueue.Filter{Path: "$.size", Value: "1"}
+		item, _, err = pq.DequeueWithReservationFiltered(channel, filter)
+		AssertNoError(t, err)
+		AssertEqual(t, item, `{"type":"report","size":1}`)
+
+		item, err = pq.Peek(channel)
+		AssertNoError(t, err)
+		AssertEqual(t, item, `{"type":"report","size":2}`)
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+
+		past := time.Now().Add(-time.Second)
+		AssertNoError(t, pq.Enqueue("item1", 1, channel, past))
+		AssertNoError(t, pq.Enqueue("item2", 2, channel, past))
+		AssertNoError(t, pq.Enqueue("later", 1, channel, time.Now().Add(time.Hour)))
+		_, resId, err := pq.DequeueWithReservation(channel)
+		AssertNoError(t, err)
+		_, _, err = pq.DequeueWithReservation(channel)
+		AssertNoError(t, err)
+		_, err = pq.ConfirmReservation(resId)
+		AssertNoError(t, err)
+		AssertNoError(t, pq.Enqueue("item3", 1, channel, past))
+		time.Sleep(10 * time.Millisecond)
+		requeued, err := pq.RequeueExpiredReservations(5 * time.Millisecond)
+		AssertNoError(t, err)
+		AssertEqual(t, requeued, 1)
+
+		stats, err := pq.Stats()
+		AssertNoError(t, err)
+		AssertEqual(t, len(stats), 1)
+		s := stats[channel]
+		AssertEqual(t, s.Ready, 2)
+		AssertEqual(t, s.Scheduled, 1)
+		AssertEqual(t, s.Reserved, 0)
+		AssertEqual(t, s.Enqueued, int64(4))
+		AssertEqual(t, s.Dequeued, int64(2))
+		AssertEqual(t, s.Confirmed, int64(1))
+		AssertEqual(t, s.Requeued, int64(1))
+		AssertTrue(t, s.OldestReadyAge >= 0.01)
+
+		_, _, err = pq.DequeueWithReservation(channel)
+		AssertNoError(t, err)
+		stats, err = pq.Stats()
+		AssertNoError(t, err)
+		AssertEqual(t, stats[channel].Reserved, 1)
+		AssertTrue(t, stats[channel].OldestReservationAge > 0)
+	})
+
+	t.Run("sub-second not before", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+
+		err := pq.Enqueue("soon", 1, channel, time.Now().Add(300*time.Millisecond))
+		AssertNoError(t, err)
+
+		isEmpty, err := pq.IsEmpty(channel)
+		AssertNoError(t, err)
+		AssertTrue(t, isEmpty)
+
+		time.Sleep(400 * time.Millisecond)
+		item, err := pq.Dequeue(channel)
+		AssertNoError(t, err)
+		AssertEqual(t, item, "soon")
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		q := NewSqLitePQueue("", "", true)
+		defer q.ResetQueue()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := q.EnqueueContext(ctx, "item1", 1, channel, time.Now())
+		AssertTrue(t, errors.Is(err, context.Canceled))
+		_, err = q.DequeueContext(ctx, channel)
+		AssertTrue(t, errors.Is(err, context.Canceled))
+
+		AssertNoError(t, q.EnqueueContext(context.Background(), "item2", 1, channel, time.Now()))
+		size, err := q.Size(channel)
+		AssertNoError(t, err)
+		AssertEqual(t, size, 1)
+	})
+
+	t.Run("sentinel errors", func(t *testing.T) {
+		q := NewSqLitePQueue("", "", true)
+		defer q.ResetQueue()
+
+		_, err := q.Dequeue(channel)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrEmpty))
+		_, _, err = q.DequeueWithReservation(channel)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrEmpty))
+		_, err = q.Peek(channel)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrEmpty))
+
+		err = q.Enqueue("item", 1, priorityqueue.MAX_CHANNEL, time.Now())
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidChannel))
+		_, err = q.Dequeue(-1)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidChannel))
+
+		confirmed, err := q.ConfirmReservation("unknown")
+		AssertFalse(t, confirmed)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrReservationNotFound))
+		_, err = q.ReleaseReservation("unknown")
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrReservationNotFound))
+
+		_, err = q.ApplyTransaction([]priorityqueue.TxOp{{Op: priorityqueue.TX_DELETE, ItemId: "unknown"}})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrItemNotFound))
+		_, err = q.ApplyTransaction([]priorityqueue.TxOp{{Op: "unknown"}})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+	})
+
+	t.Run("item status", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+
+		_, err := pq.GetStatus("unknown")
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrItemNotFound))
+
+		id, err := pq.EnqueueWithOptions("item1", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+		AssertNoError(t, err)
+		laterId, err := pq.EnqueueWithOptions("later", 1, channel, time.Now().Add(time.Hour), priorityqueue.EnqueueOptions{})
+		AssertNoError(t, err)
+		childId, err := pq.EnqueueWithOptions("child", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{DependsOn: []string{id}})
+		AssertNoError(t, err)
+
+		status, err := pq.GetStatus(id)
+		AssertNoError(t, err)
+		AssertEqual(t, status.Status, priorityqueue.STATUS_PENDING)
+		AssertEqual(t, status.Channel, channel)
+		AssertFalse(t, status.EnqueuedAt.IsZero())
+		status, _ = pq.GetStatus(laterId)
+		AssertEqual(t, status.Status, priorityqueue.STATUS_SCHEDULED)
+		status, _ = pq.GetStatus(childId)
+		AssertEqual(t, status.Status, priorityqueue.STATUS_BLOCKED)
+
+		_, _, err = pq.DequeueWithReservation(channel)
+		AssertNoError(t, err)
+		status, _ = pq.GetStatus(id)
+		AssertEqual(t, status.Status, priorityqueue.STATUS_RESERVED)
+		AssertEqual(t, status.Attempts, 1)
+		AssertFalse(t, status.ReservedAt.IsZero())
+
+		time.Sleep(10 * time.Millisecond)
+		_, err = pq.RequeueExpiredReservations(5 * time.Millisecond)
+		AssertNoError(t, err)
+		status, _ = pq.GetStatus(id)
+		AssertEqual(t, status.Status, priorityqueue.STATUS_EXPIRED)
+		AssertFalse(t, status.ExpiredAt.IsZero())
+
+		_, resId, err := pq.DequeueWithReservation(channel)
+		AssertNoError(t, err)
+		_, err = pq.ConfirmReservation(resId)
+		AssertNoError(t, err)
+		status, err = pq.GetStatus(id)
+		AssertNoError(t, err)
+		AssertEqual(t, status.Status, priorityqueue.STATUS_COMPLETED)
+		AssertEqual(t, status.Attempts, 2)
+		AssertFalse(t, status.FinishedAt.IsZero())
+
+		_, err = pq.Delete(laterId)
+		AssertNoError(t, err)
+		status, _ = pq.GetStatus(laterId)
+		AssertEqual(t, status.Status, priorityqueue.STATUS_DELETED)
+
+		pq.SetStatusRetention(0)
+		_, err = pq.GetStatus(id)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrItemNotFound))
+	})
+
+	t.Run("events", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+
+		var events []priorityqueue.Event
+		unsubscribe := pq.Subscribe(func(event priorityqueue.Event) {
+			events = append(events, event)
+		})
+
+		id, err := pq.EnqueueWithOptions("item1", 2, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+		AssertNoError(t, err)
+		_, resId, err := pq.DequeueWithReservation(channel)
+		AssertNoError(t, err)
+		_, err = pq.ReleaseReservation(resId)
+		AssertNoError(t, err)
+		_, resId, err = pq.DequeueWithReservation(channel)
+		AssertNoError(t, err)
+		time.Sleep(10 * time.Millisecond)
+		_, err = pq.RequeueExpiredReservations(5 * time.Millisecond)
+		AssertNoError(t, err)
+		_, resId, err = pq.DequeueWithReservation(channel)
+		AssertNoError(t, err)
+		_, err = pq.ConfirmReservation(resId)
+		AssertNoError(t, err)
+		id2, err := pq.EnqueueWithOptions("item2", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+		AssertNoError(t, err)
+		_, err = pq.Delete(id2)
+		AssertNoError(t, err)
+		pq.Enqueue("item3", 1, channel, time.Time{})
+		_, err = pq.Dequeue(channel)
+		AssertNoError(t, err)
+
+		// a failed transaction is not observed
+		_, err = pq.ApplyTransaction([]priorityqueue.TxOp{
+			{Op: priorityqueue.TX_ENQUEUE, Obj: "txitem", Prio: 1, Channel: channel},
+			{Op: priorityqueue.TX_CONFIRM, ReservationId: "unknown"},
+		})
+		AssertNotEqual(t, err, nil)
+		AssertNoError(t, pq.ResetQueue())
+
+		types := make([]string, len(events))
+		for i, event := range events {
+			types[i] = event.Type
+		}
+		CollectionAssertEqual(t, types, []string{
+			priorityqueue.EVENT_ENQUEUE, priorityqueue.EVENT_RESERVE, priorityqueue.EVENT_REQUEUE, priorityqueue.EVENT_RESERVE, priorityqueue.EVENT_EXPIRE,
+			priorityqueue.EVENT_RESERVE, priorityqueue.EVENT_CONFIRM, priorityqueue.EVENT_ENQUEUE, priorityqueue.EVENT_DELETE, priorityqueue.EVENT_ENQUEUE,
+			priorityqueue.EVENT_DEQUEUE, priorityqueue.EVENT_RESET,
+		})
+		for _, event := range events[:7] {
+			AssertEqual(t, event.ItemId, id)
+			AssertEqual(t, event.Channel, channel)
+			AssertEqual(t, event.Prio, 2.0)
+		}
+		AssertEqual(t, events[8].ItemId, id2)
+
+		unsubscribe()
+		pq.Enqueue("item4", 1, channel, time.Time{})
+		AssertEqual(t, len(events), 12)
+	})
+
+	t.Run("deadline mode", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+		now := time.Now()
+		due := func(d time.Duration) priorityqueue.EnqueueOptions {
+			return priorityqueue.EnqueueOptions{Deadline: now.Add(d)}
+		}
+
+		pq.EnqueueWithOptions("late", 1, channel, time.Time{}, due(2*time.Hour))
+		pq.EnqueueWithOptions("none", 0, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+		pq.EnqueueWithOptions("soon", 2, channel, time.Time{}, due(time.Hour))
+		pq.EnqueueWithOptions("past", 3, channel, time.Time{}, due(-time.Hour))
+		AssertNil(t, pq.SetChannelConfig(channel, priorityqueue.ChannelConfig{EDF: true}))
+
+		stats, err := pq.Stats()
+		AssertNil(t, err)
+		AssertEqual(t, stats[channel].Overdue, 1)
+		for _, expected := range []string{"past", "soon", "late", "none"} {
+			item, err := pq.Dequeue(channel)
+			AssertNil(t, err)
+			AssertEqual(t, item, expected)
+		}
+
+		overdue := channel + 1
+		AssertNil(t, pq.SetChannelConfig(channel, priorityqueue.ChannelConfig{EDF: true, OverdueChannel: &overdue}))
+		pq.EnqueueWithOptions("past", 1, channel, time.Time{}, due(-time.Hour))
+		pq.EnqueueWithOptions("future", 1, channel, time.Time{}, due(time.Hour))
+		// peek returns the item dequeue returns, overdue items are moved first
+		item, err := pq.Peek(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "future")
+		item, err = pq.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "future")
+		item, err = pq.Dequeue(overdue)
+		AssertNil(t, err)
+		AssertEqual(t, item, "past")
+
+		err = pq.SetChannelConfig(overdue, priorityqueue.ChannelConfig{EDF: true, OverdueChannel: &channel})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+		err = pq.SetChannelConfig(overdue+1, priorityqueue.ChannelConfig{OverdueChannel: &channel})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+
+		configs, err := pq.ChannelConfigs()
+		AssertNil(t, err)
+		AssertEqual(t, len(configs), 1)
+		AssertEqual(t, *configs[channel].OverdueChannel, overdue)
+		AssertNil(t, pq.SetChannelConfig(channel, priorityqueue.ChannelConfig{}))
+		configs, _ = pq.ChannelConfigs()
+		AssertEqual(t, len(configs), 0)
+	})
+
+	t.Run("coalescing", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+		opts := priorityqueue.EnqueueOptions{CoalesceKey: "report-1"}
+
+		id, err := pq.EnqueueWithOptions("v1", 1, channel, time.Time{}, opts)
+		AssertNil(t, err)
+		pq.Enqueue("other", 2, channel, time.Time{})
+		coalescedId, err := pq.EnqueueWithOptions("v2", 5, channel, time.Time{}, opts)
+		AssertNil(t, err)
+		AssertEqual(t, coalescedId, id)
+		size, _ := pq.Size(channel)
+		AssertEqual(t, size, 2)
+
+		// the priority is kept, reserved items are no longer coalesced
+		item, _, err := pq.DequeueWithReservation(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "v2")
+		newId, err := pq.EnqueueWithOptions("v3", 1, channel, time.Time{}, opts)
+		AssertNil(t, err)
+		AssertNotEqual(t, newId, id)
+
+		replaceAll := priorityqueue.EnqueueOptions{CoalesceKey: "report-1", CoalescePrio: true, CoalesceNotBefore: true}
+		coalescedId, err = pq.EnqueueWithOptions("v4", 3, channel, time.Now().Add(time.Hour), replaceAll)
+		AssertNil(t, err)
+		AssertEqual(t, coalescedId, newId)
+		status, _ := pq.GetStatus(newId)
+		AssertEqual(t, status.Status, priorityqueue.STATUS_SCHEDULED)
+		item, err = pq.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "other")
+		_, err = pq.Dequeue(channel)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrEmpty))
+
+		// keys are scoped by channel
+		otherId, err := pq.EnqueueWithOptions("v1", 1, channel+1, time.Time{}, opts)
+		AssertNil(t, err)
+		AssertNotEqual(t, otherId, newId)
+
+		_, err = pq.ApplyTransaction([]priorityqueue.TxOp{{Op: priorityqueue.TX_ENQUEUE, Obj: "v5", Channel: channel, Options: opts}})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+	})
+
+	t.Run("reservation ownership", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+		pq.Enqueue("item1", 1, channel, time.Time{})
+		pq.Enqueue("item2", 2, channel, time.Time{})
+		pq.Enqueue("item3", 3, channel, time.Time{})
+
+		_, reservation, err := pq.DequeueWithReservationOptions(channel, priorityqueue.ReserveOptions{Consumer: "worker-1"})
+		AssertNil(t, err)
+		resId := reservation.ReservationId
+		_, otherReservation, err := pq.DequeueWithReservationOptions(channel, priorityqueue.ReserveOptions{Consumer: "worker-2"})
+		AssertNil(t, err)
+		otherResId := otherReservation.ReservationId
+		_, anyResId, err := pq.DequeueWithReservation(channel)
+		AssertNil(t, err)
+
+		owner := priorityqueue.ReservationClaim{Consumer: "worker-1"}
+		other := priorityqueue.ReservationClaim{Consumer: "worker-2"}
+		_, err = pq.ConfirmReservation(resId)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrNotOwner))
+		_, err = pq.ConfirmReservationAs(resId, other, "", 0)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrNotOwner))
+		_, err = pq.ReleaseReservationAs(resId, other)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrNotOwner))
+		_, err = pq.ExtendReservation(resId, other)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrNotOwner))
+		_, err = pq.ApplyTransaction([]priorityqueue.TxOp{{Op: priorityqueue.TX_CONFIRM, ReservationId: resId, Claim: other}})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrNotOwner))
+		_, err = pq.ExtendReservation("unknown", owner)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrReservationNotFound))
+
+		reservations, err := pq.Reservations()
+		AssertNil(t, err)
+		AssertEqual(t, len(reservations), 3)
+		AssertEqual(t, len(reservations["worker-1"]), 1)
+		AssertEqual(t, reservations["worker-1"][0].ReservationId, resId)
+		AssertEqual(t, reservations["worker-2"][0].ReservationId, otherResId)
+		AssertEqual(t, reservations[""][0].ReservationId, anyResId)
+
+		// an extended reservation does not expire with the others
+		time.Sleep(50 * time.Millisecond)
+		ok, err := pq.ExtendReservation(resId, owner)
+		AssertNil(t, err)
+		AssertTrue(t, ok)
+		requeued, err := pq.RequeueExpiredReservations(25 * time.Millisecond)
+		AssertNil(t, err)
+		AssertEqual(t, requeued, 2)
+
+		ok, err = pq.ConfirmReservationAs(resId, owner, "", 0)
+		AssertNil(t, err)
+		AssertTrue(t, ok)
+		reservations, _ = pq.Reservations()
+		AssertEqual(t, len(reservations), 0)
+	})
+
+	t.Run("requeue consumer reservations", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+		pq.Enqueue("item1", 1, channel, time.Time{})
+		pq.Enqueue("item2", 2, channel, time.Time{})
+		_, _, err := pq.DequeueWithReservationOptions(channel, priorityqueue.ReserveOptions{Consumer: "worker-1"})
+		AssertNil(t, err)
+		_, otherReservation, err := pq.DequeueWithReservationOptions(channel, priorityqueue.ReserveOptions{Consumer: "worker-2"})
+		AssertNil(t, err)
+		otherResId := otherReservation.ReservationId
+
+		requeued, err := pq.RequeueConsumerReservations("worker-1")
+		AssertNil(t, err)
+		AssertEqual(t, requeued, 1)
+		item, err := pq.Peek(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "item1")
+		stats, _ := pq.Stats()
+		AssertEqual(t, stats[channel].Requeued, int64(1))
+
+		reservations, _ := pq.Reservations()
+		AssertEqual(t, len(reservations), 1)
+		AssertEqual(t, reservations["worker-2"][0].ReservationId, otherResId)
+
+		_, err = pq.RequeueConsumerReservations("")
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+	})
+
+	t.Run("fencing tokens", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+		pq.Enqueue("item1", 1, channel, time.Time{})
+		pq.Enqueue("item2", 2, channel, time.Time{})
+
+		_, first, err := pq.DequeueWithReservationOptions(channel, priorityqueue.ReserveOptions{})
+		AssertNil(t, err)
+		_, second, err := pq.DequeueWithReservationOptions(channel, priorityqueue.ReserveOptions{Consumer: "worker"})
+		AssertNil(t, err)
+		AssertTrue(t, first.Token > 0)
+		AssertTrue(t, second.Token > first.Token)
+		AssertEqual(t, second.Consumer, "worker")
+
+		// a released item is reserved again with a higher token
+		ok, err := pq.ReleaseReservationAs(first.ReservationId, priorityqueue.ReservationClaim{Token: first.Token})
+		AssertNil(t, err)
+		AssertTrue(t, ok)
+		_, third, err := pq.DequeueWithReservationOptions(channel, priorityqueue.ReserveOptions{})
+		AssertNil(t, err)
+		AssertTrue(t, third.Token > second.Token)
+
+		stale := priorityqueue.ReservationClaim{Token: first.Token}
+		_, err = pq.ConfirmReservationAs(third.ReservationId, stale, "", 0)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrStaleToken))
+		_, err = pq.ExtendReservation(third.ReservationId, stale)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrStaleToken))
+		_, err = pq.ApplyTransaction([]priorityqueue.TxOp{{Op: priorityqueue.TX_CONFIRM, ReservationId: third.ReservationId, Claim: stale}})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrStaleToken))
+
+		reservations, err := pq.Reservations()
+		AssertNil(t, err)
+		AssertEqual(t, reservations["worker"][0].Token, second.Token)
+
+		ok, err = pq.ExtendReservation(third.ReservationId, priorityqueue.ReservationClaim{Token: third.Token})
+		AssertNil(t, err)
+		AssertTrue(t, ok)
+		ok, err = pq.ConfirmReservationAs(third.ReservationId, priorityqueue.ReservationClaim{Token: third.Token}, "", 0)
+		AssertNil(t, err)
+		AssertTrue(t, ok)
+		ok, err = pq.ConfirmReservationAs(second.ReservationId, priorityqueue.ReservationClaim{Consumer: "worker", Token: second.Token}, "", 0)
+		AssertNil(t, err)
+		AssertTrue(t, ok)
+	})
+
+	t.Run("batch reservation", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+		names := []string{"item1", "item2", "item3", "item4", "item5"}
+		for i, name := range names {
+			pq.Enqueue(name, float64(i), channel, time.Time{})
+		}
+
+		items, err := pq.DequeueWithReservationBatch(channel, 3, priorityqueue.ReserveOptions{Consumer: "worker"})
+		AssertNil(t, err)
+		AssertEqual(t, len(items), 3)
+		for i, item := range items {
+			AssertEqual(t, item.Value, names[i])
+			AssertEqual(t, item.Reservation.Consumer, "worker")
+			if i > 0 {
+				AssertTrue(t, item.Reservation.Token > items[i-1].Reservation.Token)
+			}
+		}
+		rest, err := pq.DequeueWithReservationBatch(channel, 10, priorityqueue.ReserveOptions{})
+		AssertNil(t, err)
+		AssertEqual(t, len(rest), 2)
+		_, err = pq.DequeueWithReservationBatch(channel, 10, priorityqueue.ReserveOptions{})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrEmpty))
+		_, err = pq.DequeueWithReservationBatch(channel, 0, priorityqueue.ReserveOptions{})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+
+		ids := []string{items[0].Reservation.ReservationId, "unknown", items[1].Reservation.ReservationId, items[0].Reservation.ReservationId, rest[0].Reservation.ReservationId}
+		results, err := pq.ConfirmReservationBatch(ids, priorityqueue.ReservationClaim{Consumer: "worker"})
+		AssertNil(t, err)
+		AssertEqual(t, len(results), len(ids))
+		AssertNil(t, results[0])
+		AssertTrue(t, errors.Is(results[1], priorityqueue.ErrReservationNotFound))
+		AssertNil(t, results[2])
+		AssertTrue(t, errors.Is(results[3], priorityqueue.ErrReservationNotFound))
+		AssertNil(t, results[4])
+
+		results, err = pq.ConfirmReservationBatch([]string{items[2].Reservation.ReservationId, rest[1].Reservation.ReservationId}, priorityqueue.ReservationClaim{})
+		AssertNil(t, err)
+		AssertTrue(t, errors.Is(results[0], priorityqueue.ErrNotOwner))
+		AssertNil(t, results[1])
+
+		stats, _ := pq.Stats()
+		AssertEqual(t, stats[channel].Dequeued, int64(5))
+		AssertEqual(t, stats[channel].Confirmed, int64(4))
+		reservations, _ := pq.Reservations()
+		AssertEqual(t, len(reservations["worker"]), 1)
+	})
+
+	t.Run("fair queuing", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+		AssertNil(t, pq.SetChannelConfig(channel, priorityqueue.ChannelConfig{Fair: true}))
+		for _, item := range []struct {
+			obj    string
+			prio   float64
+			tenant string
+		}{{"a3", 3, "A"}, {"a1", 1, "A"}, {"a2", 2, "A"}, {"b1", 1, "B"}, {"x1", 1, ""}} {
+			_, err := pq.EnqueueWithOptions(item.obj, item.prio, channel, time.Time{}, priorityqueue.EnqueueOptions{Tenant: item.tenant})
+			AssertNil(t, err)
+		}
+
+		stats, err := pq.Stats()
+		AssertNil(t, err)
+		AssertEqual(t, len(stats[channel].Tenants), 2)
+		AssertEqual(t, stats[channel].Tenants["A"], 3)
+		AssertEqual(t, stats[channel].Tenants["B"], 1)
+
+		// tenants are served in turn, in tenant order, items without a tenant form the first group
+		item, err := pq.Peek(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "x1")
+		item, err = pq.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "x1")
+		items, err := pq.DequeueWithReservationBatch(channel, 3, priorityqueue.ReserveOptions{})
+		AssertNil(t, err)
+		AssertEqual(t, len(items), 3)
+		AssertEqual(t, items[0].Value, "a1")
+		AssertEqual(t, items[1].Value, "b1")
+		AssertEqual(t, items[2].Value, "a2")
+		item, err = pq.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "a3")
+
+		// the round continues after the tenant served last
+		for tenant, obj := range map[string]string{"A": "a4", "B": "b2", "C": "c1"} {
+			_, err := pq.EnqueueWithOptions(obj, 1, channel, time.Time{}, priorityqueue.EnqueueOptions{Tenant: tenant})
+			AssertNil(t, err)
+		}
+		item, _, err = pq.DequeueWithReservation(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "b2")
+		item, err = pq.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "c1")
+		item, err = pq.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, item, "a4")
+	})
+
+	t.Run("routing rules", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+		prio := 5.0
+		invoices := priorityqueue.RoutingRule{Name: "invoices", Conditions: []string{"$.type=invoice"}, Channel: channel, Prio: &prio}
+		urgent := priorityqueue.RoutingRule{Name: "urgent", Conditions: []string{"urgent=true"}, Channel: channel + 1}
+		AssertNil(t, pq.SetRoutingRule(invoices))
+		AssertNil(t, pq.SetRoutingRule(urgent))
+		err := pq.SetRoutingRule(priorityqueue.RoutingRule{Name: "empty", Channel: channel})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+		err = pq.SetRoutingRule(priorityqueue.RoutingRule{Name: "bad", Conditions: []string{"urgent=true"}, Channel: priorityqueue.MAX_CHANNEL})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidChannel))
+
+		// a rule with an existing name is replaced in place
+		invoices.Channel = channel + 2
+		AssertNil(t, pq.SetRoutingRule(invoices))
+		rules, err := pq.RoutingRules()
+		AssertNil(t, err)
+		AssertEqual(t, len(rules), 2)
+		AssertEqual(t, rules[0].Name, "invoices")
+		AssertEqual(t, rules[0].Channel, channel+2)
+		AssertEqual(t, *rules[0].Prio, prio)
+		AssertEqual(t, rules[1].Name, "urgent")
+
+		// the first matching rule applies
+		rule, ok := priorityqueue.Route(rules, `{"type":"invoice"}`, map[string]string{"urgent": "true"})
+		AssertTrue(t, ok)
+		AssertEqual(t, rule.Name, "invoices")
+		rule, ok = priorityqueue.Route(rules, `{"type":"order"}`, map[string]string{"urgent": "true"})
+		AssertTrue(t, ok)
+		AssertEqual(t, rule.Name, "urgent")
+		_, ok = priorityqueue.Route(rules, `{"type":"order"}`, nil)
+		AssertFalse(t, ok)
+
+		deleted, err := pq.DeleteRoutingRule("invoices")
+		AssertNil(t, err)
+		AssertTrue(t, deleted)
+		deleted, err = pq.DeleteRoutingRule("invoices")
+		AssertNil(t, err)
+		AssertFalse(t, deleted)
+		rules, _ = pq.RoutingRules()
+		AssertEqual(t, len(rules), 1)
+		AssertEqual(t, rules[0].Name, "urgent")
+	})
+
+	t.Run("channel schemas", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+		minimum := 0.0
+		schema := priorityqueue.Schema{
+			Type:     "object",
+			Required: []string{"type", "amount"},
+			Properties: map[string]*priorityqueue.Schema{
+				"type":   {Type: "string", Enum: []any{"invoice", "credit"}},
+				"amount": {Type: "number", Minimum: &minimum},
+				"lines":  {Type: "array", Items: &priorityqueue.Schema{Type: "integer"}},
+			},
+		}
+		_, err := pq.SetChannelSchema(channel, priorityqueue.Schema{Type: "decimal"})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+		_, err = pq.SetChannelSchema(priorityqueue.MAX_CHANNEL, schema)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidChannel))
+
+		version, err := pq.SetChannelSchema(channel, priorityqueue.Schema{Type: "object"})
+		AssertNil(t, err)
+		AssertEqual(t, version, 1)
+		version, err = pq.SetChannelSchema(channel, schema)
+		AssertNil(t, err)
+		AssertEqual(t, version, 2)
+		versions, err := pq.ChannelSchemas(channel)
+		AssertNil(t, err)
+		AssertEqual(t, len(versions), 2)
+		AssertEqual(t, versions[0].Schema.Type, "object")
+		AssertEqual(t, versions[1].Version, 2)
+		AssertEqual(t, versions[1].Channel, channel)
+		versions, _ = pq.ChannelSchemas(channel + 1)
+		AssertEqual(t, len(versions), 0)
+
+		// the stored schema checks payloads
+		versions, _ = pq.ChannelSchemas(channel)
+		latest := versions[len(versions)-1].Schema
+		AssertEqual(t, len(latest.Violations(`{"type":"invoice","amount":12.5,"lines":[1,2]}`)), 0)
+		violations := latest.Violations(`{"type":"order","amount":-1,"lines":[1,2.5]}`)
+		AssertEqual(t, len(violations), 3)
+		AssertEqual(t, violations[0], "$.amount: must be at least 0")
+		AssertEqual(t, violations[1], "$.lines[1]: expected integer, got number")
+		AssertEqual(t, violations[2], `$.type: must be one of ["invoice","credit"]`)
+		AssertEqual(t, latest.Violations(`{"type":"credit"}`)[0], `$: missing required property "amount"`)
+		AssertEqual(t, latest.Violations(`not json`)[0], "$: payload is not valid JSON")
+
+		// every enqueue path checks payloads against the latest version
+		_, err = pq.EnqueueWithOptions(`{"type":"order","amount":1}`, 1, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+		var violation *priorityqueue.SchemaViolationError
+		AssertTrue(t, errors.As(err, &violation))
+		AssertEqual(t, violation.Version, 2)
+		AssertEqual(t, violation.Violations[0], `$.type: must be one of ["invoice","credit"]`)
+		AssertNil(t, pq.AddSubscription("invoices", channel))
+		_, err = pq.Publish("invoices", `{"type":"order","amount":1}`, 1, time.Time{}, priorityqueue.EnqueueOptions{})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrSchemaViolation))
+		_, err = pq.ApplyTransaction([]priorityqueue.TxOp{{Op: priorityqueue.TX_ENQUEUE, Obj: `{"type":"order","amount":1}`, Prio: 1, Channel: channel}})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrSchemaViolation))
+
+		// replies are checked too, a non-conforming reply fails the confirmation
+		replyTo := channel
+		_, err = pq.EnqueueWithOptions("job", 1, channel+1, time.Time{}, priorityqueue.EnqueueOptions{ReplyTo: &replyTo})
+		AssertNil(t, err)
+		_, resId, err := pq.DequeueWithReservation(channel + 1)
+		AssertNil(t, err)
+		_, err = pq.ConfirmReservationWithResult(resId, "done", time.Minute)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrSchemaViolation))
+		isEmpty, err := pq.IsEmpty(channel)
+		AssertNil(t, err)
+		AssertTrue(t, isEmpty)
+
+		deleted, err := pq.DeleteChannelSchema(channel)
+		AssertNil(t, err)
+		AssertTrue(t, deleted)
+		deleted, err = pq.DeleteChannelSchema(channel)
+		AssertNil(t, err)
+		AssertFalse(t, deleted)
+		versions, _ = pq.ChannelSchemas(channel)
+		AssertEqual(t, len(versions), 0)
+	})
+
+	t.Run("payload encryption", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+		err := pq.SetChannelConfig(channel, priorityqueue.ChannelConfig{Encrypt: true})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+
+		old, err := keyring.Parse("old MDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDA=")
+		AssertNil(t, err)
+		pq.SetKeyring(old)
+		AssertNil(t, pq.SetChannelConfig(channel, priorityqueue.ChannelConfig{Encrypt: true}))
+		AssertNil(t, pq.Enqueue(`{"secret":1}`, 1, channel, time.Time{}))
+
+		// after a rotation new payloads use the new key, the old key still decrypts
+		rotated, err := keyring.Parse("# rotated\nold MDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDA=\nnew MTExMTExMTExMTExMTExMTExMTExMTExMTExMTExMTE=")
+		AssertNil(t, err)
+		AssertEqual(t, rotated.Current(), "new")
+		pq.SetKeyring(rotated)
+		AssertNil(t, pq.Enqueue(`{"secret":2}`, 2, channel, time.Time{}))
+		AssertNil(t, pq.Enqueue("plain", 3, channel+1, time.Time{}))
+
+		// payloads are encrypted at rest, tagged with their key
+		db, err := sql.Open("sqlite3", pq.connectionString)
+		AssertNil(t, err)
+		var encrypted int
+		err = db.QueryRow("SELECT COUNT(*) FROM "+pq.table+" WHERE Obj NOT LIKE '%secret%' and KeyId IN ('old', 'new') and Channel = ?", channel).Scan(&encrypted)
+		db.Close()
+		AssertNil(t, err)
+		AssertEqual(t, encrypted, 2)
+
+		_, _, err = pq.DequeueWithReservationFiltered(channel, priorityqueue.Filter{Path: "$.secret", Value: "1"})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrEmpty))
+		value, err := pq.Peek(channel)
+		AssertNil(t, err)
+		AssertEqual(t, value, `{"secret":1}`)
+		value, err = pq.Dequeue(channel)
+		AssertNil(t, err)
+		AssertEqual(t, value, `{"secret":1}`)
+		value, _, err = pq.DequeueWithReservation(channel)
+		AssertNil(t, err)
+		AssertEqual(t, value, `{"secret":2}`)
+		value, err = pq.Dequeue(channel + 1)
+		AssertNil(t, err)
+		AssertEqual(t, value, "plain")
+
+		// results are encrypted with the key of the item's channel
+		id, err := pq.EnqueueWithOptions("job", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{})
+		AssertNil(t, err)
+		_, resId, err := pq.DequeueWithReservation(channel)
+		AssertNil(t, err)
+		ok, err := pq.ConfirmReservationWithResult(resId, `{"secret":3}`, time.Minute)
+		AssertNil(t, err)
+		AssertTrue(t, ok)
+		db, err = sql.Open("sqlite3", pq.connectionString)
+		AssertNil(t, err)
+		err = db.QueryRow("SELECT COUNT(*) FROM "+pq.table+"_Results WHERE Result NOT LIKE '%secret%' and KeyId = 'new' and ItemId = ?", id).Scan(&encrypted)
+		db.Close()
+		AssertNil(t, err)
+		AssertEqual(t, encrypted, 1)
+		result, found, err := pq.GetResult(id)
+		AssertNil(t, err)
+		AssertTrue(t, found)
+		AssertEqual(t, result, `{"secret":3}`)
+	})
+
+	t.Run("partitions", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+		err := pq.SetChannelConfig(channel, priorityqueue.ChannelConfig{Partitions: 4})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+		err = pq.RepartitionChannel(channel, 4)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+		AssertNil(t, pq.PauseChannel(channel))
+		err = pq.RepartitionChannel(channel, priorityqueue.MAX_PARTITIONS+1)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+		AssertNil(t, pq.RepartitionChannel(channel, 4))
+		AssertNil(t, pq.ResumeChannel(channel))
+
+		// setting the config keeps the partitions
+		AssertNil(t, pq.SetChannelConfig(channel, priorityqueue.ChannelConfig{}))
+		configs, err := pq.ChannelConfigs()
+		AssertNil(t, err)
+		AssertEqual(t, configs[channel].Partitions, 4)
+
+		keyOf := map[string]string{}
+		expected := make([]int, 4)
+		for i := range 8 {
+			key := fmt.Sprintf("key%d", i)
+			for n := 1; n <= 2; n++ {
+				obj := fmt.Sprintf("%s-%d", key, n)
+				_, err := pq.EnqueueWithOptions(obj, float64(n), channel, time.Time{}, priorityqueue.EnqueueOptions{PartitionKey: key})
+				AssertNil(t, err)
+				keyOf[obj] = key
+			}
+			expected[configs[channel].Partition(priorityqueue.PartitionHash(key))] += 2
+		}
+		stats, err := pq.Stats()
+		AssertNil(t, err)
+		AssertEqual(t, len(stats[channel].Partitions), 4)
+		for partition, ready := range expected {
+			AssertEqual(t, stats[channel].Partitions[partition], ready)
+		}
+
+		invalid := 4
+		_, err = pq.DequeueWithReservationBatch(channel, 1, priorityqueue.ReserveOptions{Partition: &invalid})
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+
+		// each partition only serves the items of its keys, in priority order
+		var reservations []string
+		for partition := range 4 {
+			items, err := pq.DequeueWithReservationBatch(channel, 100, priorityqueue.ReserveOptions{Partition: &partition})
+			if expected[partition] == 0 {
+				AssertTrue(t, errors.Is(err, priorityqueue.ErrEmpty))
+				continue
+			}
+			AssertNil(t, err)
+			AssertEqual(t, len(items), expected[partition])
+			for i, item := range items {
+				AssertEqual(t, configs[channel].Partition(priorityqueue.PartitionHash(keyOf[item.Value])), partition)
+				AssertEqual(t, strings.HasSuffix(item.Value, "-1"), i < len(items)/2)
+				reservations = append(reservations, item.Reservation.ReservationId)
+			}
+		}
+
+		// outstanding reservations block a rebalance
+		AssertNil(t, pq.PauseChannel(channel))
+		err = pq.RepartitionChannel(channel, 2)
+		AssertTrue(t, errors.Is(err, priorityqueue.ErrInvalidArgument))
+		for _, reservationId := range reservations {
+			ok, err := pq.ReleaseReservation(reservationId)
+			AssertNil(t, err)
+			AssertTrue(t, ok)
+		}
+		AssertNil(t, pq.RepartitionChannel(channel, 2))
+		AssertNil(t, pq.ResumeChannel(channel))
+
+		stats, err = pq.Stats()
+		AssertNil(t, err)
+		AssertEqual(t, len(stats[channel].Partitions), 2)
+		AssertEqual(t, stats[channel].Partitions[0]+stats[channel].Partitions[1], 16)
+		one := 1
+		items, err := pq.DequeueWithReservationBatch(channel, 100, priorityqueue.ReserveOptions{Partition: &one})
+		AssertNil(t, err)
+		AssertEqual(t, len(items), stats[channel].Partitions[1])
+		for _, item := range items {
+			AssertEqual(t, priorityqueue.PartitionHash(keyOf[item.Value])%2, uint32(1))
+		}
+	})
+
+	t.Run("topics", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+
+		err := pq.AddSubscription("orders", channel)
+		AssertNoError(t, err)
+		err = pq.AddSubscription("orders", channel+1)
+		AssertNoError(t, err)
+		err = pq.AddSubscription("orders", channel+1)
+		AssertNoError(t, err)
+		subscriptions, err := pq.Subscriptions()
+		AssertNoError(t, err)
+		CollectionAssertEqual(t, subscriptions["orders"], []int{channel, channel + 1})
+
+		itemIds, err := pq.Publish("orders", "order1", 1, time.Now(), priorityqueue.EnqueueOptions{})
+		AssertNoError(t, err)
+		AssertEqual(t, len(itemIds), 2)
+
+		item, err := pq.Dequeue(channel)
+		AssertNoError(t, err)
+		AssertEqual(t, item, "order1")
+		item, err = pq.Dequeue(channel + 1)
+		AssertNoError(t, err)
+		AssertEqual(t, item, "order1")
+
+		err = pq.RemoveSubscription("orders", channel)
+		AssertNoError(t, err)
+		itemIds, err = pq.Publish("orders", "order2", 1, time.Now(), priorityqueue.EnqueueOptions{})
+		AssertNoError(t, err)
+		AssertEqual(t, len(itemIds), 1)
+		isEmpty, err := pq.IsEmpty(channel)
+		AssertNoError(t, err)
+		AssertTrue(t, isEmpty)
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		pq := NewSqLitePQueue("", "", true)
+		defer pq.ResetQueue()
+
+		// the table is rebuilt with every column added since the first release
+		AssertNoError(t, pq.ResetQueue())
+		_, err := pq.EnqueueWithOptions("job", 1, channel, time.Time{}, priorityqueue.EnqueueOptions{Tenant: "acme", PartitionKey: "key"})
+		AssertNoError(t, err)
+		item, resId, err := pq.DequeueWithReservation(channel)
+		AssertNoError(t, err)
+		AssertEqual(t, item, "job")
+		confirmed, err := pq.ConfirmReservation(resId)
+		AssertNoError(t, err)
+		AssertTrue(t, confirmed)
+	})
+}
+
+func TestMigration(t *testing.T) {
+	dbFile, err := os.CreateTemp("", "deleteme-*.db")
+	AssertNoError(t, err)
+	dbFile.Close()
+	defer os.Remove(dbFile.Name())
+
+	// a table as created by the first release, with NotBefore in unix seconds
+	db, err := sql.Open("sqlite3", dbFile.Name())
+	AssertNoError(t, err)
+	_, err = db.Exec(`CREATE TABLE QueueItems (
+		Id INTEGER PRIMARY KEY AUTOINCREMENT, Prio DOUBLE NOT NULL, Obj TEXT NOT NULL, Channel INTEGER NOT NULL,
+		NotBefore INTEGER NOT NULL, Reserved INTEGER NOT NULL, ReservedId TEXT NULL)`)
+	AssertNoError(t, err)
+	_, err = db.Exec("INSERT INTO QueueItems (Prio, Obj, Channel, NotBefore, Reserved) VALUES (1, 'old', 0, ?, 0), (2, 'future', 0, ?, 0)",
+		time.Now().Add(-time.Minute).Unix(), time.Now().Add(time.Hour).Unix())
+	AssertNoError(t, err)
+	// a result stored when expiry times were unix seconds
+	_, err = db.Exec("CREATE TABLE QueueItems_Results (ItemId TEXT PRIMARY KEY, Result TEXT NOT NULL, Expires INTEGER NOT NULL)")
+	AssertNoError(t, err)
+	_, err = db.Exec("INSERT INTO QueueItems_Results (ItemId, Result, Expires) VALUES ('done', 'result', ?)", time.Now().Add(time.Hour).Unix())
+	AssertNoError(t, err)
+	db.Close()
+
+	pq := NewSqLitePQueue(dbFile.Name(), "", true)
+	size, err := pq.Size(0)
+	AssertNoError(t, err)
+	AssertEqual(t, size, 1)
+	item, err := pq.Dequeue(0)
+	AssertNoError(t, err)
+	AssertEqual(t, item, "old")
+	result, found, err := pq.GetResult("done")
+	AssertNoError(t, err)
+	AssertTrue(t, found)
+	AssertEqual(t, result, "result")
+
+	// a table created before partitions existed, its items are partitioned by their ItemId
+	db, err = sql.Open("sqlite3", dbFile.Name())
+	AssertNoError(t, err)
+	_, err = db.Exec(`CREATE TABLE Unpartitioned (
+		Id INTEGER PRIMARY KEY AUTOINCREMENT, Prio DOUBLE NOT NULL, Obj TEXT NOT NULL, Channel INTEGER NOT NULL,
+		NotBefore INTEGER NOT NULL, Reserved INTEGER NOT NULL, ReservedId TEXT NULL, ItemId TEXT NULL)`)
+	AssertNoError(t, err)
+	config := priorityqueue.ChannelConfig{Partitions: 4}
+	expected := make([]int, 4)
+	for i := range 8 {
+		itemId := fmt.Sprintf("item%d", i)
+		_, err = db.Exec("INSERT INTO Unpartitioned (Prio, Obj, Channel, NotBefore, Reserved, ItemId) VALUES (1, ?, 0, 0, 0, ?)", itemId, itemId)
+		AssertNoError(t, err)
+		expected[config.Partition(priorityqueue.PartitionHash(itemId))]++
+	}
+	db.Close()
+
+	pq = NewSqLitePQueue(dbFile.Name(), "Unpartitioned", true)
+	AssertNoError(t, pq.PauseChannel(0))
+	AssertNoError(t, pq.RepartitionChannel(0, 4))
+	stats, err := pq.Stats()
+	AssertNoError(t, err)
+	for partition, ready := range expected {
+		AssertEqual(t, stats[0].Partitions[partition], ready)
+	}
 }